@@ -30,13 +30,163 @@
 package graveldb
 
 import (
+	"context"
+	"time"
+
 	"github.com/MikhailWahib/graveldb/internal/config"
 	"github.com/MikhailWahib/graveldb/internal/engine"
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/memtable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
 )
 
 // Config is an alias for config.Config, re-exported for user convenience.
 type Config = config.Config
 
+// Memtable is an alias for memtable.Memtable, the in-memory table that
+// Config.MemtableFactory returns in place of the default skiplist.
+type Memtable = memtable.Memtable
+
+// MemtableIterator is an alias for memtable.Iterator, an ordered iterator
+// over the entries of a Memtable.
+type MemtableIterator = memtable.Iterator
+
+// Entry is an alias for storage.Entry, a write applied to a Memtable.
+type Entry = storage.Entry
+
+// EntryType is an alias for storage.EntryType, the kind of write an Entry
+// records.
+type EntryType = storage.EntryType
+
+// Entry types a Memtable is given.
+const (
+	PutEntry         = storage.PutEntry
+	DeleteEntry      = storage.DeleteEntry
+	RangeDeleteEntry = storage.RangeDeleteEntry
+	MergeEntry       = storage.MergeEntry
+)
+
+// KV is an alias for engine.KV, a key-value pair written by PutMany.
+type KV = engine.KV
+
+// Batch is an alias for engine.Batch, a group of puts and deletes applied
+// atomically by Write.
+type Batch = engine.Batch
+
+// WriteOptions is an alias for engine.WriteOptions, the per-write settings
+// taken by PutWithOptions.
+type WriteOptions = engine.WriteOptions
+
+// VersionedValue is an alias for engine.VersionedValue, one version of a
+// key returned by GetVersions.
+type VersionedValue = engine.VersionedValue
+
+// Iterator is an alias for engine.Iterator, an ordered iterator over a key range.
+type Iterator = engine.Iterator
+
+// KeyValueIterator is an alias for engine.KeyValueIterator, the stream of
+// sorted pairs read by IngestSorted. An Iterator satisfies it.
+type KeyValueIterator = engine.KeyValueIterator
+
+// Compression is an alias for config.Compression, the codec applied to
+// SSTable data blocks.
+type Compression = config.Compression
+
+// Codecs accepted by Config.Compression.
+const (
+	NoCompression     = config.NoCompression
+	SnappyCompression = config.SnappyCompression
+)
+
+// CompactionStrategy is an alias for config.CompactionStrategy, the way
+// SSTables are merged into deeper tiers.
+type CompactionStrategy = config.CompactionStrategy
+
+// Strategies accepted by Config.CompactionStrategy.
+const (
+	TieredCompaction  = config.TieredCompaction
+	LeveledCompaction = config.LeveledCompaction
+)
+
+// WALSyncMode is an alias for config.WALSyncMode, the policy for syncing
+// the WAL to disk.
+type WALSyncMode = config.WALSyncMode
+
+// Modes accepted by Config.WALSyncMode.
+const (
+	WALSyncAlways   = config.WALSyncAlways
+	WALSyncInterval = config.WALSyncInterval
+	WALSyncNever    = config.WALSyncNever
+)
+
+// EventListener is an alias for config.EventListener, notified by
+// Config.EventListener of flushes and compactions.
+type EventListener = config.EventListener
+
+// FlushInfo is an alias for config.FlushInfo, the description of a flush
+// passed to EventListener.OnFlush.
+type FlushInfo = config.FlushInfo
+
+// CompactionInfo is an alias for config.CompactionInfo, the description of
+// a compaction passed to EventListener.OnCompaction.
+type CompactionInfo = config.CompactionInfo
+
+// CompactionPicker is an alias for config.CompactionPicker, set in
+// Config.CompactionPicker to choose which waiting compaction runs first.
+type CompactionPicker = config.CompactionPicker
+
+// CompactionCandidate is an alias for config.CompactionCandidate, the
+// description of a waiting compaction passed to CompactionPicker.Pick.
+type CompactionCandidate = config.CompactionCandidate
+
+// OverlapPicker is an alias for engine.OverlapPicker, the default
+// CompactionPicker.
+type OverlapPicker = engine.OverlapPicker
+
+// Stats is an alias for engine.Stats, a snapshot of the database's state
+// and operation counts returned by DB.Stats.
+type Stats = engine.Stats
+
+// MetricsCollector is an alias for engine.MetricsCollector, the receiver
+// of the samples reported by DB.CollectMetrics.
+type MetricsCollector = engine.MetricsCollector
+
+// TableInfo is an alias for engine.TableInfo, the description of one
+// SSTable returned by DB.SSTableInfo.
+type TableInfo = engine.TableInfo
+
+// RepairReport is an alias for engine.RepairReport, the outcome of Repair.
+type RepairReport = engine.RepairReport
+
+// RepairOptions is an alias for engine.RepairOptions, the settings taken by
+// RepairWithOptions.
+type RepairOptions = engine.RepairOptions
+
+// ErrChecksumMismatch matches errors caused by stored data failing its
+// checksum. Use errors.Is to test for it.
+var ErrChecksumMismatch = gerrors.ErrChecksumMismatch
+
+// ErrEntryTooLarge matches errors from writes whose key or value exceeds
+// Config.MaxKeySize or Config.MaxValueSize. Use errors.Is to test for it.
+var ErrEntryTooLarge = gerrors.ErrEntryTooLarge
+
+// ErrEmptyKey matches errors from writes with an empty key, which the
+// database does not store. Use errors.Is to test for it.
+var ErrEmptyKey = gerrors.ErrEmptyKey
+
+// ErrInvalidArgument matches errors from calls given an argument they do
+// not accept, such as a CompactTier tier the database does not have. Use
+// errors.Is to test for it.
+var ErrInvalidArgument = gerrors.ErrInvalidArgument
+
+// ErrUnsupportedVersion matches errors from opening an SSTable written in a
+// format this release does not read. Use errors.Is to test for it.
+var ErrUnsupportedVersion = gerrors.ErrUnsupportedVersion
+
+// ErrClosed matches errors from operations on a database after Close. Use
+// errors.Is to test for it.
+var ErrClosed = gerrors.ErrClosed
+
 // DefaultConfig returns a Config struct populated with default values. Re-exported for user convenience.
 var DefaultConfig = config.DefaultConfig
 
@@ -64,30 +214,321 @@ func Open(path string, cfg *config.Config) (*DB, error) {
 	return &DB{engine: e}, nil
 }
 
+// OpenInMemory opens a database that keeps all of its files in memory, as
+// with Config.InMemory: nothing is written to disk and the data is lost when
+// the database is closed. cfg is not modified; nil means DefaultConfig.
+func OpenInMemory(cfg *config.Config) (*DB, error) {
+	inMemory := *config.DefaultConfig()
+	if cfg != nil {
+		inMemory = *cfg
+	}
+	inMemory.InMemory = true
+	return Open("graveldb", &inMemory)
+}
+
+// Repair checks every SSTable in the database at path, moves tables that are
+// damaged into its quarantine directory and rebuilds the manifest from the
+// tables that remain, so the database can be opened again after partial
+// disk corruption. Data in quarantined tables is lost unless a newer copy
+// survives elsewhere.
+//
+// Repair must not be run on a database that is open. cfg should be the
+// configuration the database is opened with, since a table sorted by a
+// custom Comparator would look damaged when checked with the default one;
+// nil means DefaultConfig.
+func Repair(path string, cfg *config.Config) (RepairReport, error) {
+	return engine.Repair(path, cfg)
+}
+
+// RepairWithOptions is like Repair, with settings such as a dry run that
+// only reports the damaged tables without changing anything.
+func RepairWithOptions(path string, cfg *config.Config, opts RepairOptions) (RepairReport, error) {
+	return engine.RepairWithOptions(path, cfg, opts)
+}
+
 // Put writes a key-value pair to the database.
 // Overwrites the value if the key already exists.
 //
-// Both key and value must be non-nil. Returns an error if the operation fails.
+// Both key and value must be non-nil. Put does not retain key or value, so the
+// caller may modify or reuse them once Put returns.
+// Returns an error if the operation fails.
 func (db *DB) Put(key, value []byte) error {
 	return db.engine.Put(key, value)
 }
 
+// PutWithOptions is like Put, with per-write settings. With opts.Sync the
+// write is on stable storage when PutWithOptions returns, even if
+// WALSyncMode would not sync it, so critical writes can be made durable
+// while bulk writes keep the cheaper global mode.
+func (db *DB) PutWithOptions(key, value []byte, opts WriteOptions) error {
+	return db.engine.PutWithOptions(key, value, opts)
+}
+
+// SetWithTTL writes a key-value pair that expires ttl from now. Once it
+// expires the key reads as missing, as if it had been deleted, and its value
+// is dropped from disk by a later compaction. Like Put, it does not retain
+// key or value.
+func (db *DB) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.engine.SetWithTTL(key, value, ttl)
+}
+
+// PutMany writes several key-value pairs, sharing one lock acquisition and
+// one WAL sync between them. It is meant for bulk loads: the writes are not
+// atomic, and a crash mid-call may persist only some of them.
+func (db *DB) PutMany(pairs []KV) error {
+	return db.engine.PutMany(pairs)
+}
+
+// Write applies every Put and Delete in batch atomically, in the order they
+// were added. After a crash either the whole batch is recovered or none of
+// it is.
+//
+//	var b graveldb.Batch
+//	b.Put([]byte("a"), []byte("1"))
+//	b.Delete([]byte("b"))
+//	if err := db.Write(&b); err != nil {
+//		return err
+//	}
+func (db *DB) Write(batch *Batch) error {
+	return db.engine.Write(batch)
+}
+
+// PutCtx is like Put but returns ctx.Err() if ctx is done before the write
+// lock is acquired.
+//
+// A PutCtx that times out after the entry was appended to the WAL still has
+// its write applied, so a context error does not guarantee the key is
+// unchanged.
+func (db *DB) PutCtx(ctx context.Context, key, value []byte) error {
+	return db.engine.PutCtx(ctx, key, value)
+}
+
 // Get retrieves the value for a given key.
 // Returns the value and true if found, or nil and false if the key doesn't exist.
+// A failed read is also reported as a missing key; use GetE to tell them apart.
+// The returned slice may be shared with the database and must not be modified.
 func (db *DB) Get(key []byte) ([]byte, bool) {
 	return db.engine.Get(key)
 }
 
+// GetE is like Get but returns an error when the key could not be read, for
+// example because of a disk error or a checksum mismatch, instead of
+// reporting it as missing. A key that does not exist gives nil, false and
+// a nil error. It is GetCtx for callers that have no context to pass, and
+// the error-returning counterpart of Get as GetManyE is of GetMany.
+func (db *DB) GetE(key []byte) ([]byte, bool, error) {
+	return db.engine.GetCtx(context.Background(), key)
+}
+
+// GetMany retrieves the values of several keys at once, taking the database
+// read lock once and reading each SSTable block at most once. values[i] and
+// found[i] hold the result for keys[i]; like Get, a missing key has a nil
+// value and false. A failed read reports every key as missing; use GetManyE
+// to tell them apart. The returned slices may be shared with the database
+// and must not be modified.
+func (db *DB) GetMany(keys [][]byte) ([][]byte, []bool) {
+	values, found, err := db.GetManyE(keys)
+	if err != nil {
+		return make([][]byte, len(keys)), make([]bool, len(keys))
+	}
+	return values, found
+}
+
+// GetManyE is like GetMany but returns an error when any of the keys could
+// not be read, instead of reporting all of them as missing.
+func (db *DB) GetManyE(keys [][]byte) ([][]byte, []bool, error) {
+	return db.engine.GetMany(keys)
+}
+
+// GetVersions returns up to n versions of key, newest first, or every
+// version still held if n <= 0. Config.MaxVersionsPerKey sets how many
+// versions flushes and compactions keep; tombstones and expired versions
+// count as versions and are returned with Deleted set. A failed read gives
+// no versions. The returned values may be shared with the database and must
+// not be modified.
+func (db *DB) GetVersions(key []byte, n int) []VersionedValue {
+	versions, err := db.engine.GetVersions(key, n)
+	if err != nil {
+		return nil
+	}
+	return versions
+}
+
+// Has reports whether the key exists, without returning its value or
+// fetching it from a blob file, so it is cheaper than Get for keys with
+// large values. A deleted or expired key does not exist.
+func (db *DB) Has(key []byte) bool {
+	return db.engine.Has(key)
+}
+
+// GetCtx is like Get but returns ctx.Err() if ctx is done while waiting for
+// the read lock or between SSTable reads. Unexpected read errors are also
+// returned rather than reported as a missing key.
+func (db *DB) GetCtx(ctx context.Context, key []byte) ([]byte, bool, error) {
+	return db.engine.GetCtx(ctx, key)
+}
+
 // Delete removes the key and its value from the database.
 // Returns an error only if the deletion fails.
 func (db *DB) Delete(key []byte) error {
 	return db.engine.Delete(key)
 }
 
+// DeleteRange removes every key with start <= key < end by writing a single
+// range tombstone, however many keys the range holds. Keys written after
+// the call are not affected. An empty range deletes nothing.
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.engine.DeleteRange(start, end)
+}
+
+// DropPrefix removes every key starting with prefix by writing a single
+// range tombstone, however many keys share it. Keys written under prefix
+// after the call are not affected, and Compact reclaims the dropped keys'
+// space. A prefix of only 0xFF bytes drops every key from it up. The
+// prefix must be non-empty, and DropPrefix relies on byte order, so it
+// fails with ErrInvalidArgument if config.Comparator is set.
+func (db *DB) DropPrefix(prefix []byte) error {
+	return db.engine.DropPrefix(prefix)
+}
+
+// Merge records operand as a change to the value of key without reading it.
+// Reads see config.MergeFunc applied to the older value and every operand
+// merged since, oldest first. It fails if no MergeFunc is configured.
+func (db *DB) Merge(key, operand []byte) error {
+	return db.engine.Merge(key, operand)
+}
+
+// IngestSorted bulk-loads the pairs of iter, whose keys must be strictly
+// increasing, by writing them straight into new SSTables instead of through
+// the WAL and memtable. Writes wait until it is done. Unsorted input fails
+// the call with ErrInvalidArgument without adding anything.
+func (db *DB) IngestSorted(iter KeyValueIterator) error {
+	return db.engine.IngestSorted(iter)
+}
+
+// ScanPrefix calls fn for every key starting with prefix, in key order, until
+// fn returns false. fn must not write to the database.
+//
+// When Config.PrefixExtractor is set, SSTables that cannot contain the prefix
+// are skipped without being read. It fails with ErrInvalidArgument if
+// Config.Comparator is set, since keys sharing a prefix only sort together in
+// byte order.
+func (db *DB) ScanPrefix(prefix []byte, fn func(key, value []byte) bool) error {
+	return db.engine.ScanPrefix(prefix, fn)
+}
+
+// PrefixScan returns an iterator over the live keys starting with prefix,
+// in lexicographic order. An empty prefix iterates over every key. Like
+// NewIterator, it reads a snapshot and must be closed. Like ScanPrefix, it
+// fails with ErrInvalidArgument if Config.Comparator is set.
+func (db *DB) PrefixScan(prefix []byte) (*Iterator, error) {
+	return db.engine.PrefixScan(prefix)
+}
+
+// NewIterator returns an iterator over the live keys with start <= key < end,
+// in lexicographic order. A nil start means from the first key and a nil end
+// means to the last key. The iterator sees the database as of the call; use
+// RefreshSnapshot to pick up later writes.
+//
+//	it, err := db.NewIterator(nil, nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Printf("%s=%s\n", it.Key(), it.Value())
+//	}
+//	if err := it.Error(); err != nil {
+//		return err
+//	}
+//
+// The iterator must be closed to release the SSTables it holds open.
+func (db *DB) NewIterator(start, end []byte) (*Iterator, error) {
+	return db.engine.NewIterator(start, end)
+}
+
+// Flush writes the data currently in memory to a new SSTable and returns
+// once it is synced to disk, e.g. before taking a backup of the database
+// directory. Writes made while Flush runs are not guaranteed to be included.
+// Flush does nothing if there is nothing to write.
+func (db *DB) Flush() error {
+	return db.engine.Flush()
+}
+
+// Compact merges all SSTables into one, tier by tier, regardless of the
+// compaction thresholds. It blocks until the merge is done and the replaced
+// SSTables are deleted. Use it to reclaim space after bulk overwrites or to
+// minimize the number of files before taking a snapshot.
+func (db *DB) Compact() error {
+	return db.engine.CompactAll()
+}
+
+// CompactTier merges tier, 0 for T0, into the next tier regardless of the
+// compaction thresholds, e.g. to clear out a tier that has piled up
+// overlapping tables. It waits for any background compaction of the same
+// tables to finish first and blocks until the merge is done. A tier the
+// database does not have fails with an error matching ErrInvalidArgument.
+func (db *DB) CompactTier(tier int) error {
+	return db.engine.CompactTier(tier)
+}
+
+// Stats returns the number of SSTables in each tier and their size, the
+// database's size on disk, the memtable size, the number of memtables
+// waiting to be flushed, the number of puts, deletes and gets since Open,
+// block cache hits and misses, and the bytes written by flushes and
+// compactions. Stats can be encoded with encoding/json, e.g. to serve it
+// from a metrics endpoint.
+func (db *DB) Stats() Stats {
+	return db.engine.Stats()
+}
+
+// CollectMetrics reports the values of Stats to c as counters and gauges
+// named graveldb_*, with the tier sizes labelled by tier, so that any
+// metrics backend can export them. Call it on every scrape, e.g. from the
+// Collect method of a prometheus.Collector.
+func (db *DB) CollectMetrics(c MetricsCollector) {
+	db.engine.CollectMetrics(c)
+}
+
+// SSTableInfo lists the database's SSTables, T0 first and oldest first
+// within each tier, with each table's path, file size, key range and entry
+// count. It is cheap: the details come from the table footers and metadata
+// already loaded when the tables were opened.
+func (db *DB) SSTableInfo() []TableInfo {
+	return db.engine.SSTableInfo()
+}
+
+// ApproximateSize estimates how many keys and bytes fall in
+// start <= key < end, from the SSTable indexes and the memtables, without
+// scanning the data. Keys overwritten or deleted but not yet compacted are
+// counted more than once. A nil start or end leaves that side unbounded.
+func (db *DB) ApproximateSize(start, end []byte) (keys uint64, bytes uint64) {
+	return db.engine.ApproximateSize(start, end)
+}
+
+// RangeHash returns a digest of all key-value pairs with start <= key < end.
+// A nil end means no upper bound.
+//
+// Two databases holding the same data in a range return the same hash, which
+// lets replicas find diverging ranges before syncing them.
+func (db *DB) RangeHash(start, end []byte) ([]byte, error) {
+	return db.engine.RangeHash(start, end)
+}
+
+// Checkpoint writes a consistent copy of the database to destDir, which
+// must not exist or be empty, for use as a backup. The memtable is flushed
+// first, and the copy holds everything written before that; it can be
+// opened directly with Open. SSTables are hard-linked when destDir is on
+// the same filesystem, so a checkpoint is cheap to take. A non-empty
+// destDir fails with ErrInvalidArgument.
+func (db *DB) Checkpoint(destDir string) error {
+	return db.engine.Checkpoint(destDir)
+}
+
 // Close gracefully shuts down the database, ensuring all data is persisted.
 // This method flushes any remaining memtable data to disk and closes all
-// open files. After calling Close, the database should not be used for
-// any operations.
+// open files. Operations after Close fail with an error matching ErrClosed,
+// or report keys as missing where they return no error.
 //
 // It's recommended to call Close when you're done with the database,
 // typically using defer:
@@ -0,0 +1,327 @@
+package graveldb_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MikhailWahib/graveldb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publicAPI lists the methods of DB that callers depend on, so a renamed or
+// re-typed method fails to compile here rather than in user code.
+type publicAPI interface {
+	Put(key, value []byte) error
+	SetWithTTL(key, value []byte, ttl time.Duration) error
+	PutWithOptions(key, value []byte, opts graveldb.WriteOptions) error
+	PutMany(pairs []graveldb.KV) error
+	Write(batch *graveldb.Batch) error
+	PutCtx(ctx context.Context, key, value []byte) error
+	Get(key []byte) ([]byte, bool)
+	GetE(key []byte) ([]byte, bool, error)
+	GetMany(keys [][]byte) ([][]byte, []bool)
+	GetManyE(keys [][]byte) ([][]byte, []bool, error)
+	GetVersions(key []byte, n int) []graveldb.VersionedValue
+	Has(key []byte) bool
+	GetCtx(ctx context.Context, key []byte) ([]byte, bool, error)
+	Delete(key []byte) error
+	DeleteRange(start, end []byte) error
+	DropPrefix(prefix []byte) error
+	Merge(key, operand []byte) error
+	IngestSorted(iter graveldb.KeyValueIterator) error
+	ScanPrefix(prefix []byte, fn func(key, value []byte) bool) error
+	PrefixScan(prefix []byte) (*graveldb.Iterator, error)
+	NewIterator(start, end []byte) (*graveldb.Iterator, error)
+	Flush() error
+	Compact() error
+	CompactTier(tier int) error
+	Checkpoint(destDir string) error
+	Stats() graveldb.Stats
+	CollectMetrics(c graveldb.MetricsCollector)
+	SSTableInfo() []graveldb.TableInfo
+	RangeHash(start, end []byte) ([]byte, error)
+	ApproximateSize(start, end []byte) (keys uint64, bytes uint64)
+	Close() error
+}
+
+var _ publicAPI = (*graveldb.DB)(nil)
+
+func TestDB_PublicAPI(t *testing.T) {
+	cfg := graveldb.DefaultConfig()
+	cfg.Compression = graveldb.SnappyCompression
+	cfg.CompactionStrategy = graveldb.TieredCompaction
+
+	dir := t.TempDir()
+	db, err := graveldb.Open(dir, cfg)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.PutCtx(ctx, []byte("b"), []byte("2")))
+	require.NoError(t, db.PutMany([]graveldb.KV{{Key: []byte("c"), Value: []byte("3")}, {Key: []byte("d"), Value: []byte("4")}}))
+	require.NoError(t, db.SetWithTTL([]byte("e"), []byte("5"), time.Hour))
+
+	var batch graveldb.Batch
+	batch.Put([]byte("f"), []byte("6"))
+	batch.Delete([]byte("d"))
+	require.NoError(t, db.Write(&batch))
+	require.NoError(t, db.Delete([]byte("c")))
+
+	value, found := db.Get([]byte("a"))
+	assert.True(t, found)
+	assert.Equal(t, "1", string(value))
+	value, found, err = db.GetCtx(ctx, []byte("b"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "2", string(value))
+	values, founds := db.GetMany([][]byte{[]byte("c"), []byte("e"), []byte("f")})
+	assert.Equal(t, []bool{false, true, true}, founds)
+	assert.Equal(t, "5", string(values[1]))
+	values, founds, err = db.GetManyE([][]byte{[]byte("a"), []byte("d")})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false}, founds)
+	assert.Equal(t, "1", string(values[0]))
+	assert.True(t, db.Has([]byte("f")))
+	assert.False(t, db.Has([]byte("d")))
+
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.Compact())
+
+	var scanned []string
+	require.NoError(t, db.ScanPrefix(nil, func(key, _ []byte) bool {
+		scanned = append(scanned, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"a", "b", "e", "f"}, scanned)
+
+	it, err := db.PrefixScan([]byte("f"))
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	assert.Equal(t, "f", string(it.Key()))
+	assert.False(t, it.Next())
+	require.NoError(t, it.Error())
+	require.NoError(t, it.Close())
+
+	hash, err := db.RangeHash(nil, nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, hash)
+	assert.Equal(t, uint64(6), db.Stats().Puts)
+	require.NoError(t, db.Close())
+
+	// Everything is still there after reopening
+	db, err = graveldb.Open(dir, nil)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	it, err = db.NewIterator(nil, nil)
+	require.NoError(t, err)
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	require.NoError(t, it.Error())
+	require.NoError(t, it.Close())
+	assert.Equal(t, scanned, keys)
+	again, err := db.RangeHash(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, hash, again)
+}
+
+func TestDB_OpenInMemory(t *testing.T) {
+	cfg := graveldb.DefaultConfig()
+	cfg.MaxMemtableSize = 256
+	db, err := graveldb.OpenInMemory(cfg)
+	require.NoError(t, err)
+	assert.False(t, cfg.InMemory)
+
+	for i := range 50 {
+		require.NoError(t, db.Put([]byte{'k', byte(i)}, []byte("value")))
+	}
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.Compact())
+	value, found := db.Get([]byte{'k', 7})
+	assert.True(t, found)
+	assert.Equal(t, "value", string(value))
+	require.NoError(t, db.Close())
+
+	// Nothing outlives the database
+	db, err = graveldb.OpenInMemory(cfg)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	assert.False(t, db.Has([]byte{'k', 7}))
+}
+
+func TestDB_GetVersions(t *testing.T) {
+	cfg := graveldb.DefaultConfig()
+	cfg.MaxVersionsPerKey = 2
+	db, err := graveldb.OpenInMemory(cfg)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	for _, value := range []string{"1", "2", "3"} {
+		require.NoError(t, db.Put([]byte("k"), []byte(value)))
+		require.NoError(t, db.Flush())
+	}
+	require.NoError(t, db.Compact())
+
+	versions := db.GetVersions([]byte("k"), 0)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "3", string(versions[0].Value))
+	assert.Equal(t, "2", string(versions[1].Value))
+	assert.Greater(t, versions[0].Seq, versions[1].Seq)
+	assert.Len(t, db.GetVersions([]byte("k"), 1), 1)
+	assert.Empty(t, db.GetVersions([]byte("missing"), 0))
+}
+
+// sortedMemtable is a Memtable built only from the graveldb package, as a
+// caller outside the module would write one: the newest entry of each key
+// in a map, sorted into a snapshot whenever an iterator is created.
+type sortedMemtable struct {
+	entries   map[string]graveldb.Entry
+	rangeDels []graveldb.Entry
+	size      int
+}
+
+func newSortedMemtable() *sortedMemtable {
+	return &sortedMemtable{entries: make(map[string]graveldb.Entry)}
+}
+
+func (m *sortedMemtable) NewIterator() graveldb.MemtableIterator {
+	return m.NewRangeIterator(nil, nil)
+}
+
+func (m *sortedMemtable) NewRangeIterator(start, end []byte) graveldb.MemtableIterator {
+	var entries []graveldb.Entry
+	for _, entry := range m.entries {
+		if (start == nil || bytes.Compare(entry.Key, start) >= 0) && (end == nil || bytes.Compare(entry.Key, end) < 0) {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b graveldb.Entry) int { return bytes.Compare(a.Key, b.Key) })
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+func (m *sortedMemtable) NewVersionsIterator() graveldb.MemtableIterator {
+	return m.NewIterator()
+}
+
+func (m *sortedMemtable) Put(key, value []byte) error {
+	return m.Apply(graveldb.Entry{Type: graveldb.PutEntry, Key: key, Value: value})
+}
+
+func (m *sortedMemtable) Apply(entry graveldb.Entry) error {
+	entry.Key, entry.Value = bytes.Clone(entry.Key), bytes.Clone(entry.Value)
+	m.size += len(entry.Key) + len(entry.Value)
+	if entry.Type == graveldb.RangeDeleteEntry {
+		m.rangeDels = append(m.rangeDels, entry)
+		return nil
+	}
+	m.entries[string(entry.Key)] = entry
+	return nil
+}
+
+func (m *sortedMemtable) Get(key []byte) (graveldb.Entry, bool) {
+	entry, found := m.entries[string(key)]
+	return entry, found
+}
+
+func (m *sortedMemtable) Versions(key []byte) []graveldb.Entry {
+	if entry, found := m.entries[string(key)]; found {
+		return []graveldb.Entry{entry}
+	}
+	return nil
+}
+
+func (m *sortedMemtable) Delete(key []byte) error {
+	return m.Apply(graveldb.Entry{Type: graveldb.DeleteEntry, Key: key})
+}
+
+func (m *sortedMemtable) RangeTombstones() []graveldb.Entry { return m.rangeDels }
+func (m *sortedMemtable) Size() int                         { return m.size }
+func (m *sortedMemtable) Len() int                          { return len(m.entries) + len(m.rangeDels) }
+
+func (m *sortedMemtable) Clear() {
+	m.entries = make(map[string]graveldb.Entry)
+	m.rangeDels = nil
+	m.size = 0
+}
+
+// sliceIterator iterates over a sorted snapshot of entries.
+type sliceIterator struct {
+	entries []graveldb.Entry
+	pos     int
+}
+
+func (it *sliceIterator) Seek(key []byte) bool {
+	it.pos = sort.Search(len(it.entries), func(i int) bool { return bytes.Compare(it.entries[i].Key, key) >= 0 })
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) Key() []byte              { return it.entries[it.pos].Key }
+func (it *sliceIterator) Value() []byte            { return it.entries[it.pos].Value }
+func (it *sliceIterator) Type() graveldb.EntryType { return it.entries[it.pos].Type }
+func (it *sliceIterator) IsDeleted() bool          { return it.Type() == graveldb.DeleteEntry }
+func (it *sliceIterator) ExpiresAt() int64         { return it.entries[it.pos].ExpiresAt }
+func (it *sliceIterator) Seq() uint64              { return it.entries[it.pos].Seq }
+
+func TestDB_CustomMemtable(t *testing.T) {
+	var created atomic.Int64
+	cfg := graveldb.DefaultConfig()
+	cfg.MemtableFactory = func() graveldb.Memtable {
+		created.Add(1)
+		return newSortedMemtable()
+	}
+
+	dir := t.TempDir()
+	db, err := graveldb.Open(dir, cfg)
+	require.NoError(t, err)
+	for i := range 20 {
+		require.NoError(t, db.Put(fmt.Appendf(nil, "key-%02d", i), fmt.Appendf(nil, "value-%02d", i)))
+	}
+	require.NoError(t, db.Delete([]byte("key-03")))
+	require.NoError(t, db.DeleteRange([]byte("key-10"), []byte("key-15")))
+	require.NoError(t, db.Put([]byte("key-12"), []byte("again")))
+
+	check := func(stage string) {
+		t.Helper()
+		value, found := db.Get([]byte("key-12"))
+		assert.True(t, found, stage)
+		assert.Equal(t, "again", string(value), stage)
+		assert.False(t, db.Has([]byte("key-03")), stage)
+		assert.False(t, db.Has([]byte("key-11")), stage)
+		it, err := db.NewIterator([]byte("key-08"), []byte("key-17"))
+		require.NoError(t, err, stage)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		require.NoError(t, it.Error(), stage)
+		require.NoError(t, it.Close())
+		assert.Equal(t, []string{"key-08", "key-09", "key-12", "key-15", "key-16"}, keys, stage)
+	}
+	check("in memtable")
+	assert.Positive(t, created.Load())
+
+	// Close flushes the custom memtable, and the tables hold what it held
+	require.NoError(t, db.Close())
+	db, err = graveldb.Open(dir, cfg)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check("reopened")
+	require.NoError(t, db.Put([]byte("key-13"), []byte("later")))
+	require.NoError(t, db.Flush())
+	value, found := db.Get([]byte("key-13"))
+	assert.True(t, found)
+	assert.Equal(t, "later", string(value))
+}
@@ -2,8 +2,11 @@ package graveldb_test
 
 import (
 	"fmt"
+	"io/fs"
 	"math/rand"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -77,9 +80,14 @@ func makeRandomDataset(count int) ([][]byte, [][]byte) {
 
 func preloadReadDB(b *testing.B) (*graveldb.DB, [][]byte) {
 	b.Helper()
+	return preloadDB(b, readBenchConfig())
+}
+
+func preloadDB(b *testing.B, cfg *graveldb.Config) (*graveldb.DB, [][]byte) {
+	b.Helper()
 
 	dir := b.TempDir()
-	seedDB := openBenchDB(b, dir, readBenchConfig())
+	seedDB := openBenchDB(b, dir, cfg)
 	keys, values := makeDataset(benchNumKeys, 0)
 
 	for i := 0; i < benchNumKeys; i++ {
@@ -92,7 +100,7 @@ func preloadReadDB(b *testing.B) (*graveldb.DB, [][]byte) {
 		b.Fatal(err)
 	}
 
-	db := openBenchDB(b, dir, readBenchConfig())
+	db := openBenchDB(b, dir, cfg)
 	return db, keys
 }
 
@@ -174,6 +182,202 @@ func BenchmarkWrites(b *testing.B) {
 	})
 }
 
+func BenchmarkBulkInsert(b *testing.B) {
+	const batchSize = 100
+
+	// Sync the WAL on every write so the cost of each sync shows up
+	cfg := writeBenchConfig()
+	cfg.WALFlushThreshold = 1
+
+	b.Run("IndividualPuts", func(b *testing.B) {
+		dir := b.TempDir()
+		db := openBenchDB(b, dir, cfg)
+		keys, values := makeDataset(b.N, 0)
+
+		b.ResetTimer()
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if err := db.Put(keys[i], values[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		reportThroughput(b)
+	})
+
+	b.Run("PutMany", func(b *testing.B) {
+		dir := b.TempDir()
+		db := openBenchDB(b, dir, cfg)
+		keys, values := makeDataset(b.N, 0)
+		pairs := make([]graveldb.KV, b.N)
+		for i := range pairs {
+			pairs[i] = graveldb.KV{Key: keys[i], Value: values[i]}
+		}
+
+		b.ResetTimer()
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i += batchSize {
+			end := min(i+batchSize, b.N)
+			if err := db.PutMany(pairs[i:end]); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		reportThroughput(b)
+	})
+}
+
+// BenchmarkConcurrentWrites measures put throughput as writers are added,
+// with the WAL buffered as usual and with it written and synced on every
+// commit, where concurrent writers share a sync.
+func BenchmarkConcurrentWrites(b *testing.B) {
+	modes := []struct {
+		name      string
+		threshold int
+	}{
+		{"Buffered", 0},
+		{"Synced", 1},
+	}
+
+	for _, m := range modes {
+		for _, workers := range []int{1, 8, 16} {
+			b.Run(fmt.Sprintf("%s/workers_%d", m.name, workers), func(b *testing.B) {
+				cfg := writeBenchConfig()
+				if m.threshold > 0 {
+					cfg.WALFlushThreshold = m.threshold
+				}
+				dir := b.TempDir()
+				db := openBenchDB(b, dir, cfg)
+				keys, values := makeDataset(b.N, 0)
+
+				b.ResetTimer()
+				b.ReportAllocs()
+
+				var next atomic.Int64
+				var wg sync.WaitGroup
+				for worker := 0; worker < workers; worker++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for {
+							i := int(next.Add(1)) - 1
+							if i >= b.N {
+								return
+							}
+							if err := db.Put(keys[i], values[i]); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}()
+				}
+
+				wg.Wait()
+				reportThroughput(b)
+			})
+		}
+	}
+}
+
+func BenchmarkWALSyncMode(b *testing.B) {
+	modes := []struct {
+		name string
+		mode graveldb.WALSyncMode
+	}{
+		{"Always", graveldb.WALSyncAlways},
+		{"Interval", graveldb.WALSyncInterval},
+		{"Never", graveldb.WALSyncNever},
+	}
+
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			// Write on every put so the modes differ only in when they sync
+			cfg := writeBenchConfig()
+			cfg.WALFlushThreshold = 1
+			cfg.WALSyncMode = m.mode
+
+			dir := b.TempDir()
+			db := openBenchDB(b, dir, cfg)
+			keys, values := makeDataset(b.N, 0)
+
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if err := db.Put(keys[i], values[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportThroughput(b)
+		})
+	}
+}
+
+func BenchmarkWALPreallocate(b *testing.B) {
+	for _, size := range []int{0, 16 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("Preallocate=%d", size), func(b *testing.B) {
+			cfg := writeBenchConfig()
+			cfg.WALFlushThreshold = 1
+			cfg.WALSyncMode = graveldb.WALSyncAlways
+			cfg.WALPreallocateSize = size
+
+			dir := b.TempDir()
+			db := openBenchDB(b, dir, cfg)
+			keys, values := makeDataset(b.N, 0)
+
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if err := db.Put(keys[i], values[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportThroughput(b)
+		})
+	}
+}
+
+func BenchmarkBlockCache(b *testing.B) {
+	const hotKeys = 100
+
+	cases := []struct {
+		name string
+		size int
+	}{
+		{"Disabled", -1},
+		{"Enabled", 8 * 1024 * 1024},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			cfg := readBenchConfig()
+			cfg.BlockCacheSize = c.size
+			db, keys := preloadDB(b, cfg)
+			hot := keys[:hotKeys]
+			indices := make([]int, b.N)
+			for i := range indices {
+				indices[i] = rand.Intn(len(hot))
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, found := db.Get(hot[indices[i]]); !found {
+					b.Fatalf("key not found: %s", hot[indices[i]])
+				}
+			}
+
+			reportThroughput(b)
+		})
+	}
+}
+
 func BenchmarkReads(b *testing.B) {
 	b.Run("Sequential", func(b *testing.B) {
 		db, keys := preloadReadDB(b)
@@ -248,6 +452,105 @@ func BenchmarkReads(b *testing.B) {
 	})
 }
 
+func BenchmarkMissingKeys(b *testing.B) {
+	for _, bench := range []struct {
+		name            string
+		bloomBitsPerKey int
+	}{
+		{"BloomFilter", 10},
+		{"NoFilter", -1},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			cfg := readBenchConfig()
+			cfg.BloomBitsPerKey = bench.bloomBitsPerKey
+			db, keys := preloadDB(b, cfg)
+
+			// Absent keys that sort between stored ones, so no table can
+			// be ruled out by its key range
+			missing := make([][]byte, len(keys))
+			for i, key := range keys {
+				missing[i] = append(append([]byte(nil), key...), '~')
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, found := db.Get(missing[i%len(missing)]); found {
+					b.Fatalf("unexpected key: %s", missing[i%len(missing)])
+				}
+			}
+
+			reportThroughput(b)
+		})
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	for _, bench := range []struct {
+		name        string
+		compression graveldb.Compression
+	}{
+		{"Snappy", graveldb.SnappyCompression},
+		{"None", graveldb.NoCompression},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			cfg := readBenchConfig()
+			cfg.Compression = bench.compression
+
+			// makeDataset values are mostly zero padding, so they compress well
+			dir := b.TempDir()
+			seedDB := openBenchDB(b, dir, cfg)
+			keys, values := makeDataset(benchNumKeys, 0)
+			for i := range keys {
+				if err := seedDB.Put(keys[i], values[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := seedDB.Close(); err != nil {
+				b.Fatal(err)
+			}
+			sstBytes := dirSize(b, filepath.Join(dir, "sstables"))
+
+			db := openBenchDB(b, dir, cfg)
+
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, found := db.Get(keys[i%len(keys)]); !found {
+					b.Fatalf("missing key: %s", keys[i%len(keys)])
+				}
+			}
+
+			reportThroughput(b)
+			b.ReportMetric(float64(sstBytes), "sst-bytes")
+		})
+	}
+}
+
+// dirSize returns the total size of the files under dir.
+func dirSize(b *testing.B, dir string) int64 {
+	b.Helper()
+
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return size
+}
+
 func BenchmarkMixedWorkload(b *testing.B) {
 	db, keys := preloadReadDB(b)
 	writes, values := makeDataset(b.N/2+1, benchNumKeys)
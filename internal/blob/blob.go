@@ -0,0 +1,251 @@
+// Package blob stores large values outside SSTables, in append-only blob
+// files, so that compaction rewrites small pointers to the values instead
+// of the values themselves.
+package blob
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+const (
+	// PointerSize is the size in bytes of an encoded pointer: the blob file
+	// number, the offset of the record in the file and the value length.
+	PointerSize = 8 + 8 + 4
+
+	// checksumSize is the size of the CRC32 that precedes each value.
+	checksumSize = 4
+
+	// fileSuffix ends the name of every blob file.
+	fileSuffix = ".blob"
+
+	// maxFileSize is the size past which values go to a new blob file.
+	maxFileSize = 64 * 1024 * 1024
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Store appends values to numbered blob files in one directory
+// (000001.blob, 000002.blob, ...) and reads them back by pointer. Each
+// record is the value preceded by its checksum. Files are only ever
+// appended to: every Store starts a new file the first time it appends, so
+// a record torn by a crash is never followed by live data.
+//
+// A Store is safe for concurrent use. Nothing is created on disk until the
+// first Append.
+type Store struct {
+	fs  storage.FS
+	dir string
+
+	// closeMu is held for reading by every Get, so that Close does not
+	// close a file while it is being read
+	closeMu sync.RWMutex
+	mu      sync.Mutex
+	files   map[uint64]storage.FSFile // opened for reading, by number
+	active  storage.FSFile
+	num     uint64 // number of the active file, or the newest on disk
+	size    int64  // bytes written to the active file
+	created bool   // the active file was created since the last Sync
+	dirty   bool   // data was written since the last Sync
+	closed  bool
+}
+
+// Open returns a store for the blob files in dir, which need not exist.
+func Open(dir string) (*Store, error) {
+	return OpenFS(storage.OSFS{}, dir)
+}
+
+// OpenFS is like Open for a directory of fs.
+func OpenFS(fs storage.FS, dir string) (*Store, error) {
+	s := &Store{fs: fs, dir: dir, files: make(map[uint64]storage.FSFile)}
+	entries, err := fs.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, gerrors.IO("failed to read blob directory", err)
+	}
+	for _, entry := range entries {
+		if num, ok := fileNumber(entry.Name()); ok {
+			s.num = max(s.num, num)
+		}
+	}
+	return s, nil
+}
+
+// Dir returns the directory holding the blob files.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// FilePath returns the path of blob file num in dir.
+func FilePath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, fileSuffix))
+}
+
+// fileNumber parses the number of a blob file from its name.
+func fileNumber(name string) (uint64, bool) {
+	base, ok := strings.CutSuffix(name, fileSuffix)
+	if !ok {
+		return 0, false
+	}
+	num, err := strconv.ParseUint(base, 10, 64)
+	return num, err == nil
+}
+
+// Append writes value to the active blob file and returns the pointer to
+// it. The value is not durable until Sync.
+func (s *Store) Append(value []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, gerrors.Closed("blob store is closed", nil)
+	}
+
+	if s.active == nil || s.size >= maxFileSize {
+		if err := s.rotateLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	record := make([]byte, checksumSize+len(value))
+	binary.BigEndian.PutUint32(record, crc32.Checksum(value, castagnoli))
+	copy(record[checksumSize:], value)
+	if _, err := s.active.WriteAt(record, s.size); err != nil {
+		return nil, gerrors.IO("failed to write blob", err)
+	}
+
+	ptr := make([]byte, PointerSize)
+	binary.BigEndian.PutUint64(ptr[0:8], s.num)
+	binary.BigEndian.PutUint64(ptr[8:16], uint64(s.size))
+	binary.BigEndian.PutUint32(ptr[16:20], uint32(len(value)))
+	s.size += int64(len(record))
+	s.dirty = true
+	return ptr, nil
+}
+
+// rotateLocked syncs the active file, if any, and starts the next one.
+// Must be called with s.mu held.
+func (s *Store) rotateLocked() error {
+	if s.active != nil {
+		if err := s.syncLocked(); err != nil {
+			return err
+		}
+	}
+	if err := s.fs.MkdirAll(s.dir, 0755); err != nil {
+		return gerrors.IO("failed to create blob directory", err)
+	}
+	num := s.num + 1
+	f, err := s.fs.OpenFile(FilePath(s.dir, num), os.O_CREATE|os.O_RDWR|os.O_EXCL, 0644)
+	if err != nil {
+		return gerrors.IO("failed to create blob file", err)
+	}
+	// The previous file stays open for reading in files
+	s.active, s.num, s.size, s.created = f, num, 0, true
+	s.files[num] = f
+	return nil
+}
+
+// Sync makes every value appended so far durable.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncLocked()
+}
+
+// syncLocked syncs the active file and, if it is new, the directory. Must
+// be called with s.mu held.
+func (s *Store) syncLocked() error {
+	if s.dirty {
+		if err := s.active.Sync(); err != nil {
+			return gerrors.IO("failed to sync blob file", err)
+		}
+		s.dirty = false
+	}
+	if s.created {
+		if err := s.fs.SyncDir(s.dir); err != nil {
+			return gerrors.IO("failed to sync blob directory", err)
+		}
+		s.created = false
+	}
+	return nil
+}
+
+// Get returns the value ptr points to, checking it against its checksum.
+func (s *Store) Get(ptr []byte) ([]byte, error) {
+	if len(ptr) != PointerSize {
+		return nil, gerrors.Corruption(fmt.Sprintf("blob pointer is %d bytes, want %d", len(ptr), PointerSize), nil)
+	}
+	num := binary.BigEndian.Uint64(ptr[0:8])
+	offset := int64(binary.BigEndian.Uint64(ptr[8:16]))
+	length := binary.BigEndian.Uint32(ptr[16:20])
+
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	f, release, err := s.file(num)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	record := make([]byte, checksumSize+int(length))
+	if _, err := f.ReadAt(record, offset); err != nil {
+		return nil, gerrors.Corruption(fmt.Sprintf("failed to read blob at offset %d of %s", offset, f.Name()), err)
+	}
+	value := record[checksumSize:]
+	if crc32.Checksum(value, castagnoli) != binary.BigEndian.Uint32(record) {
+		return nil, gerrors.Corruption(fmt.Sprintf("checksum mismatch for blob at offset %d of %s", offset, f.Name()), gerrors.ErrChecksumMismatch)
+	}
+	return value, nil
+}
+
+// file returns blob file num opened for reading and the function to call
+// once done with it. Once the store is closed, each call opens the file
+// afresh, so that iterators outliving the store can still read it.
+func (s *Store) file(num uint64) (storage.FSFile, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[num]; ok && !s.closed {
+		return f, func() {}, nil
+	}
+
+	f, err := storage.Open(s.fs, FilePath(s.dir, num))
+	if err != nil {
+		return nil, nil, gerrors.IO("failed to open blob file", err)
+	}
+	if s.closed {
+		return f, func() { _ = f.Close() }, nil
+	}
+	s.files[num] = f
+	return f, func() {}, nil
+}
+
+// Close syncs the active file and closes every open blob file.
+func (s *Store) Close() error {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	if s.active != nil {
+		err = s.syncLocked()
+	}
+	for _, f := range s.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = gerrors.IO("failed to close blob file", cerr)
+		}
+	}
+	s.files, s.active = nil, nil
+	return err
+}
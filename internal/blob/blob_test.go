@@ -0,0 +1,83 @@
+package blob_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MikhailWahib/graveldb/internal/blob"
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_AppendAndGet(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blobs")
+	s, err := blob.Open(dir)
+	require.NoError(t, err)
+
+	// Nothing is created until the first append
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	values := [][]byte{bytes.Repeat([]byte("a"), 1000), []byte("b"), {}}
+	var ptrs [][]byte
+	for _, value := range values {
+		ptr, err := s.Append(value)
+		require.NoError(t, err)
+		assert.Len(t, ptr, blob.PointerSize)
+		ptrs = append(ptrs, ptr)
+	}
+	require.NoError(t, s.Sync())
+	for i, ptr := range ptrs {
+		got, err := s.Get(ptr)
+		require.NoError(t, err)
+		assert.Equal(t, values[i], got)
+	}
+	require.NoError(t, s.Close())
+
+	// A reopened store reads the old file and appends to a new one
+	s, err = blob.Open(dir)
+	require.NoError(t, err)
+	got, err := s.Get(ptrs[0])
+	require.NoError(t, err)
+	assert.Equal(t, values[0], got)
+	_, err = s.Append([]byte("c"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	_, err = os.Stat(blob.FilePath(dir, 2))
+	assert.NoError(t, err)
+
+	// Files stay readable after Close
+	got, err = s.Get(ptrs[1])
+	require.NoError(t, err)
+	assert.Equal(t, values[1], got)
+	_, err = s.Append([]byte("d"))
+	assert.ErrorIs(t, err, gerrors.ErrClosed)
+}
+
+func TestStore_GetDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	s, err := blob.Open(dir)
+	require.NoError(t, err)
+	ptr, err := s.Append([]byte("value"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	path := blob.FilePath(dir, 1)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	s, err = blob.Open(dir)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	_, err = s.Get(ptr)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+
+	_, err = s.Get(ptr[:4])
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+}
@@ -0,0 +1,110 @@
+// Package bloom implements Bloom filters for probabilistic set membership
+// tests with no false negatives.
+package bloom
+
+import (
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+)
+
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+	minBits   = 64
+	maxProbes = 30
+)
+
+// Builder accumulates keys and builds a filter sized for them.
+type Builder struct {
+	hashes []uint64
+}
+
+// NewBuilder creates an empty Builder.
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Add records key in the filter being built.
+func (b *Builder) Add(key []byte) {
+	b.hashes = append(b.hashes, hash(key))
+}
+
+// Len returns the number of keys added so far.
+func (b *Builder) Len() int {
+	return len(b.hashes)
+}
+
+// Build encodes a filter using roughly bitsPerKey bits for every key added.
+// The encoding is the bit array followed by one byte holding the probe count.
+func (b *Builder) Build(bitsPerKey int) []byte {
+	nbits := max(len(b.hashes)*bitsPerKey, minBits)
+	nbytes := (nbits + 7) / 8
+	nbits = nbytes * 8
+
+	// k = bitsPerKey * ln(2) minimizes the false positive rate
+	k := min(max(bitsPerKey*69/100, 1), maxProbes)
+
+	data := make([]byte, nbytes+1)
+	for _, h := range b.hashes {
+		forEachProbe(h, k, nbits, func(bit int) {
+			data[bit/8] |= 1 << (bit % 8)
+		})
+	}
+	data[nbytes] = byte(k)
+	return data
+}
+
+// Filter is a decoded, read-only Bloom filter.
+type Filter struct {
+	bits []byte
+	k    int
+}
+
+// Decode parses a filter produced by Builder.Build.
+func Decode(data []byte) (*Filter, error) {
+	if len(data) < 2 {
+		return nil, gerrors.Corruption("bloom filter too short", nil)
+	}
+	k := int(data[len(data)-1])
+	if k < 1 || k > maxProbes {
+		return nil, gerrors.Corruption("invalid bloom filter probe count", nil)
+	}
+	return &Filter{bits: data[:len(data)-1], k: k}, nil
+}
+
+// MayContain reports whether key may have been added to the filter.
+// A false result means the key was definitely not added.
+func (f *Filter) MayContain(key []byte) bool {
+	nbits := len(f.bits) * 8
+	found := true
+	forEachProbe(hash(key), f.k, nbits, func(bit int) {
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// forEachProbe calls fn with the k bit positions for hash h, derived by
+// double hashing from the two halves of h.
+func forEachProbe(h uint64, k, nbits int, fn func(bit int)) {
+	h1 := uint32(h)
+	h2 := uint32(h >> 32)
+	for i := range k {
+		fn(int((h1 + uint32(i)*h2) % uint32(nbits)))
+	}
+}
+
+// hash is FNV-1a followed by a 64-bit finalizer to spread the high bits.
+func hash(key []byte) uint64 {
+	h := uint64(fnvOffset)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= fnvPrime
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
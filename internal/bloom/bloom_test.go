@@ -0,0 +1,58 @@
+package bloom_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/MikhailWahib/graveldb/internal/bloom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloom_NoFalseNegatives(t *testing.T) {
+	b := bloom.NewBuilder()
+	for i := range 1000 {
+		b.Add(fmt.Appendf(nil, "key-%d", i))
+	}
+
+	f, err := bloom.Decode(b.Build(10))
+	require.NoError(t, err)
+
+	for i := range 1000 {
+		assert.True(t, f.MayContain(fmt.Appendf(nil, "key-%d", i)))
+	}
+}
+
+func TestBloom_FalsePositiveRate(t *testing.T) {
+	b := bloom.NewBuilder()
+	for i := range 10000 {
+		b.Add(fmt.Appendf(nil, "key-%d", i))
+	}
+
+	f, err := bloom.Decode(b.Build(10))
+	require.NoError(t, err)
+
+	falsePositives := 0
+	for i := range 10000 {
+		if f.MayContain(fmt.Appendf(nil, "missing-%d", i)) {
+			falsePositives++
+		}
+	}
+
+	// 10 bits per key gives roughly a 1% false positive rate
+	assert.Less(t, falsePositives, 300)
+}
+
+func TestBloom_EmptyFilter(t *testing.T) {
+	f, err := bloom.Decode(bloom.NewBuilder().Build(10))
+	require.NoError(t, err)
+	assert.False(t, f.MayContain([]byte("anything")))
+}
+
+func TestBloom_DecodeInvalid(t *testing.T) {
+	_, err := bloom.Decode(nil)
+	assert.Error(t, err)
+
+	_, err = bloom.Decode([]byte{0xff, 0})
+	assert.Error(t, err)
+}
@@ -3,23 +3,394 @@ package config
 
 import (
 	"time"
+
+	"github.com/MikhailWahib/graveldb/internal/memtable"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
 )
 
 const (
 	defaultMaxMemtableSize   = 32 * 1024 * 1024
 	defaultMaxTablesPerTier  = 4
 	defaultIndexInterval     = 16
+	defaultBlockSize         = 4 * 1024
 	defaultWALFlushThreshold = 64 * 1024
 	defaultWALFlushInterval  = 10 * time.Millisecond
+	defaultWALSegmentSize    = 16 * 1024 * 1024
+	defaultWALMaxRecordSize  = 64 * 1024 * 1024
+	defaultIORetryAttempts   = 3
+	defaultIORetryBackoff    = 10 * time.Millisecond
+	defaultBloomBitsPerKey   = 10
+	defaultMaxCompactions    = 1
+	defaultBlockCacheSize    = 8 * 1024 * 1024
+	defaultMaxKeySize        = 64 * 1024
+	defaultMaxValueSize      = 64 * 1024 * 1024
+	defaultSkipListMaxLevel  = 16
+	defaultSkipListProb      = 0.5
 )
 
+// IORetry controls how transient disk errors are retried.
+type IORetry = storage.RetryPolicy
+
+// Compression selects the codec used for SSTable data blocks.
+type Compression = sstable.Compression
+
+// Codecs accepted by Config.Compression.
+const (
+	NoCompression     = sstable.NoCompression
+	SnappyCompression = sstable.SnappyCompression
+)
+
+// CompactionStrategy selects how SSTables are merged into deeper tiers.
+type CompactionStrategy uint8
+
+const (
+	// TieredCompaction merges every table of a full tier into one table in
+	// the next tier.
+	TieredCompaction CompactionStrategy = iota
+	// LeveledCompaction keeps the tables of every tier but T0 on disjoint
+	// key ranges and pushes tables down one at a time, rewriting only the
+	// tables of the next tier they overlap.
+	LeveledCompaction
+)
+
+// WALSyncMode selects when the WAL is synced to disk.
+type WALSyncMode uint8
+
+const (
+	// WALSyncAlways syncs the WAL every time buffered entries are written
+	// to it, so nothing written to the file is lost on a machine crash.
+	WALSyncAlways WALSyncMode = iota
+	// WALSyncInterval writes buffered entries as usual but syncs only once
+	// every WALFlushInterval, when the WAL is rotated and on Close. A
+	// machine crash can lose up to one interval of writes.
+	WALSyncInterval
+	// WALSyncNever never syncs the WAL and leaves it to the operating
+	// system. Writes survive a process crash but an unbounded amount can
+	// be lost on a machine crash.
+	WALSyncNever
+)
+
+// EventListener is notified of flushes and compactions as they start and
+// finish. Its methods are called on the goroutine doing the work, without
+// the engine lock held, so they may read and write the database, but the
+// work waits until they return. They must not call Flush, Compact,
+// CompactTier or Close, which may wait for the very work being reported.
+type EventListener interface {
+	OnFlush(info FlushInfo)
+	OnCompaction(info CompactionInfo)
+}
+
+// FlushInfo describes a flush of sealed memtables to a T0 SSTable.
+type FlushInfo struct {
+	// Done is false when the flush starts and true once it has finished
+	Done bool
+	// Path is the SSTable the flush writes
+	Path string
+	// Memtables is the number of memtables flushed together
+	Memtables int
+	// Entries and Bytes are the entry count and file size of the table
+	// written, set once the flush is done
+	Entries uint64
+	Bytes   int64
+	// Duration is how long the flush took, set once it is done
+	Duration time.Duration
+	// Err is the error that ended the flush, if any
+	Err error
+}
+
+// CompactionInfo describes a compaction of tables from one tier into the
+// next.
+type CompactionInfo struct {
+	// Done is false when the compaction starts and true once it has
+	// finished
+	Done bool
+	// Tier is the tier compacted; the output goes to Tier+1
+	Tier int
+	// InputFiles and InputBytes are the tables merged and their total size.
+	// Under leveled compaction they include the tables of Tier+1 that were
+	// merged in.
+	InputFiles []string
+	InputBytes int64
+	// OutputFiles and OutputBytes are the tables written and their total
+	// size, set once the compaction is done
+	OutputFiles []string
+	OutputBytes int64
+	// Duration is how long the compaction took, set once it is done
+	Duration time.Duration
+	// Err is the error that ended the compaction, if any
+	Err error
+}
+
+// CompactionCandidate describes a tier waiting to be compacted.
+type CompactionCandidate struct {
+	// Tier is the tier whose tables would be compacted into Tier+1
+	Tier int
+	// Tables and Bytes are the number and total size of its SSTables
+	Tables int
+	Bytes  int64
+	// Overlap is the most tables of the tier whose key ranges share a key,
+	// i.e. the most tables of the tier a point lookup may have to read
+	Overlap int
+}
+
+// CompactionPicker chooses which waiting compaction runs next when more
+// than one could. Pick returns the index of the chosen candidate; the
+// candidates are in the order their compactions were requested. It is
+// called without the engine lock held.
+type CompactionPicker interface {
+	Pick(candidates []CompactionCandidate) int
+}
+
 // Config holds all tunable parameters for GravelDB's performance and durability.
 type Config struct {
-	MaxMemtableSize   int
-	MaxTablesPerTier  int
-	IndexInterval     int
+	MaxMemtableSize int
+	// MaxMemtableEntries also seals the memtable for flushing once it holds
+	// more entries than this, whatever its size, so that workloads with tiny
+	// values do not build huge memtables that are slow to flush. Each key
+	// counts once, tombstones included, as does each range tombstone. Zero
+	// or negative means only MaxMemtableSize applies.
+	MaxMemtableEntries int
+	// MaxImmutableMemtables is the number of sealed memtables that may wait
+	// to be flushed. Once more are waiting, writes block until a flush
+	// finishes, so that memory stays bounded when flushing cannot keep up.
+	// Zero or negative means no limit.
+	MaxImmutableMemtables int
+	MaxTablesPerTier      int
+	// IndexInterval is the most entries per SSTable data block, each of
+	// which gets one index entry. Large values shrink the index but make
+	// every point lookup read and scan a bigger block. Negative values are
+	// treated as 1.
+	IndexInterval int
+	// BlockSize is the size in bytes before compression past which an
+	// SSTable data block ends, even if it holds fewer than IndexInterval
+	// entries. Negative values cut blocks by IndexInterval alone.
+	BlockSize         int
 	WALFlushThreshold int
 	WALFlushInterval  time.Duration
+	IORetry           IORetry
+
+	// WALSyncMode selects when the WAL is synced to disk, trading write
+	// throughput for how much a machine crash can lose. Defaults to
+	// WALSyncAlways.
+	WALSyncMode WALSyncMode
+
+	// WALSegmentSize is the size in bytes past which the WAL moves on to a
+	// new segment file. Segments are deleted once all of their data is in
+	// SSTables.
+	WALSegmentSize int
+
+	// WALPreallocateSize is the size in bytes each new WAL segment is
+	// extended to before it is written, so synced appends fill reserved
+	// space instead of growing the file. Segments keep the space until
+	// they are removed, and up to two removed segments are reused for new
+	// ones; the active segment is truncated to its data on Close. Failing
+	// to reserve the space, e.g. on a full disk, fails the write that
+	// needed a new segment. 0 disables preallocation.
+	WALPreallocateSize int
+
+	// WALMaxRecordSize bounds the combined key and value size of a WAL
+	// record, batches included. Larger writes are rejected, and a record
+	// claiming a larger size during replay is treated as corruption that
+	// ends the log. A negative value removes the bound.
+	WALMaxRecordSize int
+
+	// MaxKeySize and MaxValueSize are the longest key and value a write
+	// may hold, in bytes. Longer ones are rejected with
+	// errors.ErrEntryTooLarge before anything is logged. A negative value
+	// removes the limit, though reads still reject entries over 1GB as
+	// corrupt.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// CompactAtMaxTables compacts a tier as soon as it holds MaxTablesPerTier
+	// tables. By default a tier is compacted only once a new table pushes it
+	// past MaxTablesPerTier, i.e. at MaxTablesPerTier+1 tables.
+	CompactAtMaxTables bool
+
+	// MaxTierBytes also compacts a tier holding at least two tables once
+	// their combined size exceeds it, whatever their number. Under
+	// LeveledCompaction it grows tenfold per level like MaxTablesPerTier.
+	// Zero or negative means only MaxTablesPerTier applies.
+	MaxTierBytes int64
+
+	// CompactionStrategy selects tiered or leveled compaction. Under
+	// LeveledCompaction, T0 holds up to MaxTablesPerTier tables like a tier
+	// and each deeper level n holds up to MaxTablesPerTier*10^n tables of
+	// about MaxMemtableSize bytes each. Defaults to TieredCompaction.
+	CompactionStrategy CompactionStrategy
+
+	// MaxConcurrentCompactions is the number of background compactions
+	// that may run at once. A compaction of tier n also writes to tier
+	// n+1, so only compactions two or more tiers apart run together.
+	// Defaults to 1.
+	MaxConcurrentCompactions int
+
+	// CompactionPicker chooses which tier to compact first when several are
+	// waiting. Defaults to engine.OverlapPicker, which prefers the tier
+	// with the most overlapping tables.
+	CompactionPicker CompactionPicker
+
+	// TierPaths places tiers on other directories, e.g. other disks:
+	// TierPaths[n], if set, is the directory under which new tables of
+	// tier n are written, in an sstables/Tn subdirectory as in the data
+	// directory. Tiers past the end of the list and empty entries use the
+	// data directory. The manifest records where each table was written,
+	// so tables written under an earlier setting are still found, and they
+	// move to the new location as they are compacted. A directory must not
+	// be shared with another database, since tables it holds that the
+	// manifest does not reference are deleted at open.
+	TierPaths []string
+
+	// CompactionRateLimit caps the bytes per second written by all
+	// compactions together, leaving disk bandwidth to foreground writes.
+	// It applies to Compact as well. 0 means no limit.
+	CompactionRateLimit int
+
+	// CompactionFilter, if set, is called for every live entry rewritten by
+	// compaction. Returning false drops the value and leaves a tombstone.
+	CompactionFilter func(key, value []byte) bool
+
+	// MergeFunc, if set, enables Merge. It returns the value that results
+	// from applying operand to existing, the key's older value, which is nil
+	// if the key had none. Operands are applied oldest first, and may be
+	// combined with each other before the older value is known, so the
+	// function must be associative: MergeFunc(MergeFunc(v, a), b) must equal
+	// MergeFunc(v, MergeFunc(a, b)). It must not modify its arguments. Merge
+	// operands stay unresolved on disk until compaction reaches the key's
+	// value, so the function must not change for an existing database.
+	MergeFunc func(existing, operand []byte) []byte
+
+	// MaxVersionsPerKey is how many versions of each key, newest first by
+	// sequence number, flushes and compaction keep instead of only the
+	// newest, for reading back with GetVersions. Tombstones count as
+	// versions; a key whose newest version is a tombstone is still dropped
+	// whole once compaction reaches the bottom tier. A merge entry resolved
+	// against older versions replaces them. 0 and 1 keep only the newest
+	// version.
+	MaxVersionsPerKey int
+
+	// PrefixExtractor, if set, maps a key to the prefix recorded in each
+	// SSTable's prefix filter, letting prefix scans skip tables that cannot
+	// match. It may return nil for keys without a prefix. For any scan prefix
+	// p where PrefixExtractor(p) is non-nil, every key starting with p must
+	// extract to the same value, e.g. a fixed-length extractor. Tables keep
+	// the filter they were written with, so the function must not change
+	// for an existing database.
+	PrefixExtractor func(key []byte) []byte
+
+	// Comparator, if set, orders keys instead of bytes.Compare: it returns
+	// a negative number, zero or a positive number as a sorts before, equal
+	// to or after b, and must only report identical keys as equal. It is used
+	// by the memtable, SSTables, merges and iterator bounds alike, and
+	// SSTables do not record it, so it must stay the same for the life of
+	// the database; changing it on existing data is unsupported and makes
+	// lookups miss keys. Keys sharing a prefix only sort together in byte
+	// order, so ScanPrefix, PrefixScan and DropPrefix reject a custom
+	// Comparator.
+	Comparator func(a, b []byte) int
+
+	// SkipListMaxLevel is the most levels a memtable skiplist node may
+	// have, up to 64. Lookups stay logarithmic up to about
+	// (1/SkipListProbability)^SkipListMaxLevel entries, 65536 with the
+	// defaults, so raise it for memtables holding millions of keys.
+	// Defaults to 16.
+	SkipListMaxLevel int
+
+	// SkipListProbability is the chance that a skiplist node reaching one
+	// level also reaches the next, in (0, 1). Lower values use less memory
+	// per node but make searches longer. Defaults to 0.5.
+	SkipListProbability float64
+
+	// MemtableFactory, if set, returns the empty memtables the engine
+	// writes to instead of the default skiplist, e.g. to try another data
+	// structure. Each memtable must order keys as Comparator does, or by
+	// bytes.Compare if it is nil. The skiplist settings do not apply to
+	// it, and it decides itself how many versions of a key to keep. Code
+	// outside this module implements it through the graveldb.Memtable,
+	// graveldb.MemtableIterator and graveldb.Entry aliases.
+	//
+	// Writes to a memtable are serialized under the engine's exclusive
+	// lock, but its read methods are called from many goroutines at once
+	// under a shared lock, so they must be safe to run concurrently with
+	// each other. A full memtable is sealed and never written again, and
+	// its iterators, used by scans and the background flush, outlive the
+	// lock. Keys, values and the RangeTombstones slice it returns may be
+	// kept after the lock is released, so it must not modify them later.
+	MemtableFactory func() memtable.Memtable
+
+	// StrictInvariants enables cheap runtime checks of internal invariants:
+	// SSTable keys are written in order, index offsets are monotonic, tiers
+	// stay ordered oldest to newest and the memtable size never goes
+	// negative. A violation fails the operation that caused it with an
+	// errors.ErrInvariant error. Meant for tests; off by default.
+	StrictInvariants bool
+
+	// ParanoidChecks verifies every SSTable in full when the database is
+	// opened: each entry's checksum, the index and the footer, as Verify
+	// does. Damage fails the open instead of surfacing on the first read
+	// of the damaged entry. Tables written by flushes and compactions
+	// while the database is open are not verified again. It makes opening
+	// a large database slow, as every table is read in full. By default
+	// checksums are only checked on the entries actually read.
+	ParanoidChecks bool
+
+	// IgnoreMissingTables lets the database open when SSTables recorded in
+	// its manifest no longer exist, e.g. because they were deleted by hand.
+	// The missing tables are dropped from the manifest and the data they
+	// held is lost, which is logged. By default opening fails with an
+	// errors.ErrCorrupt error naming the first missing file. Tables that
+	// exist but cannot be opened fail the open either way; Repair rebuilds
+	// a database without them.
+	IgnoreMissingTables bool
+
+	// MergeFlushOnClose makes Close write every memtable still waiting to
+	// be flushed into one T0 SSTable instead of one table per memtable.
+	MergeFlushOnClose bool
+
+	// NegativeCacheSize is the number of recently missed keys remembered so
+	// repeated lookups of absent keys skip the SSTables. Entries are dropped
+	// when their key is written and the whole cache is cleared whenever a
+	// flush or compaction installs a table. 0 disables the cache.
+	NegativeCacheSize int
+
+	// BloomBitsPerKey sizes the Bloom filter of keys stored in every new
+	// SSTable, which lets lookups skip tables that do not hold a key. 10
+	// bits per key gives about a 1% false positive rate. A negative value
+	// disables the filter.
+	BloomBitsPerKey int
+
+	// BlockCacheSize is the capacity in bytes of the cache of SSTable data
+	// blocks shared by all tables, which lets repeated lookups of hot keys
+	// skip the disk. A negative value disables the cache.
+	BlockCacheSize int
+
+	// Compression is the codec applied to the data blocks of new SSTables.
+	// Each table records its codec, so changing it only affects tables
+	// written afterwards. Defaults to NoCompression.
+	Compression Compression
+
+	// ValueThreshold, if positive, is the longest value stored inside
+	// SSTables. Longer values are written once to append-only blob files
+	// under the blobs directory and the SSTables hold pointers to them, so
+	// compaction copies the pointers rather than the values. Space held by
+	// values that were overwritten or deleted is not reclaimed. Defaults to
+	// 0, which keeps every value in the SSTables.
+	ValueThreshold int
+
+	// EventListener, if set, is notified when flushes and compactions start
+	// and finish, e.g. for metrics or logging.
+	EventListener EventListener
+
+	// InMemory keeps every file of the database in memory instead of under
+	// the data directory, which is never created: the database works as
+	// usual but is lost when closed. Meant for tests and caches. Checkpoint
+	// still writes to disk.
+	InMemory bool
+
+	// Clock, if set, returns the current time used to expire keys written
+	// with a TTL. Defaults to time.Now; meant for tests.
+	Clock func() time.Time
 }
 
 // DefaultConfig returns a Config struct populated with default values.
@@ -28,8 +399,22 @@ func DefaultConfig() *Config {
 		MaxMemtableSize:   defaultMaxMemtableSize,
 		MaxTablesPerTier:  defaultMaxTablesPerTier,
 		IndexInterval:     defaultIndexInterval,
+		BlockSize:         defaultBlockSize,
 		WALFlushThreshold: defaultWALFlushThreshold,
 		WALFlushInterval:  defaultWALFlushInterval,
+		WALSegmentSize:    defaultWALSegmentSize,
+		WALMaxRecordSize:  defaultWALMaxRecordSize,
+		MaxKeySize:        defaultMaxKeySize,
+		MaxValueSize:      defaultMaxValueSize,
+		IORetry: IORetry{
+			MaxAttempts: defaultIORetryAttempts,
+			Backoff:     defaultIORetryBackoff,
+		},
+		BloomBitsPerKey:          defaultBloomBitsPerKey,
+		MaxConcurrentCompactions: defaultMaxCompactions,
+		BlockCacheSize:           defaultBlockCacheSize,
+		SkipListMaxLevel:         defaultSkipListMaxLevel,
+		SkipListProbability:      defaultSkipListProb,
 	}
 }
 
@@ -44,6 +429,12 @@ func (c *Config) FillDefaults() {
 	}
 	if c.IndexInterval == 0 {
 		c.IndexInterval = def.IndexInterval
+	} else if c.IndexInterval < 0 {
+		// Every block needs at least one entry
+		c.IndexInterval = 1
+	}
+	if c.BlockSize == 0 {
+		c.BlockSize = def.BlockSize
 	}
 	if c.WALFlushThreshold == 0 {
 		c.WALFlushThreshold = def.WALFlushThreshold
@@ -51,4 +442,37 @@ func (c *Config) FillDefaults() {
 	if c.WALFlushInterval == 0 {
 		c.WALFlushInterval = def.WALFlushInterval
 	}
+	if c.WALSegmentSize == 0 {
+		c.WALSegmentSize = def.WALSegmentSize
+	}
+	if c.WALMaxRecordSize == 0 {
+		c.WALMaxRecordSize = def.WALMaxRecordSize
+	}
+	if c.MaxKeySize == 0 {
+		c.MaxKeySize = def.MaxKeySize
+	}
+	if c.MaxValueSize == 0 {
+		c.MaxValueSize = def.MaxValueSize
+	}
+	if c.IORetry.MaxAttempts == 0 {
+		c.IORetry.MaxAttempts = def.IORetry.MaxAttempts
+	}
+	if c.IORetry.Backoff == 0 {
+		c.IORetry.Backoff = def.IORetry.Backoff
+	}
+	if c.MaxConcurrentCompactions == 0 {
+		c.MaxConcurrentCompactions = def.MaxConcurrentCompactions
+	}
+	if c.BlockCacheSize == 0 {
+		c.BlockCacheSize = def.BlockCacheSize
+	}
+	if c.BloomBitsPerKey == 0 {
+		c.BloomBitsPerKey = def.BloomBitsPerKey
+	}
+	if c.SkipListMaxLevel == 0 {
+		c.SkipListMaxLevel = def.SkipListMaxLevel
+	}
+	if c.SkipListProbability == 0 {
+		c.SkipListProbability = def.SkipListProbability
+	}
 }
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"slices"
+
+	"github.com/MikhailWahib/graveldb/internal/storage"
+	"github.com/MikhailWahib/graveldb/internal/wal"
+)
+
+// Batch collects puts and deletes to be applied atomically by Write.
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	entries []storage.Entry
+}
+
+// Put records a put of key to value. The key and value are copied.
+func (b *Batch) Put(key, value []byte) {
+	b.entries = append(b.entries, storage.Entry{Type: storage.PutEntry, Key: bytes.Clone(key), Value: bytes.Clone(value)})
+}
+
+// Delete records a delete of key. The key is copied.
+func (b *Batch) Delete(key []byte) {
+	b.entries = append(b.entries, storage.Entry{Type: storage.DeleteEntry, Key: bytes.Clone(key)})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// Write applies every operation in b atomically, in the order they were
+// added. The batch is logged to the WAL as one record, so after a crash
+// either all of its operations are recovered or none are. Readers never see
+// part of a batch, and the memtable is rotated at most once, after the whole
+// batch is applied.
+func (e *Engine) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	// Commit a copy so the batch can be reused
+	write := wal.Write{Entries: slices.Clone(b.entries), Atomic: true, Flush: true}
+	return e.commitWrite(context.Background(), write, true)
+}
+
+// applyLocked applies logged entries to the active memtable. Must be called
+// with the engine mutex held.
+func (e *Engine) applyLocked(entries []storage.Entry) error {
+	for _, entry := range entries {
+		if entry.Type == storage.MergeEntry {
+			entry = e.memtableMergeLocked(entry)
+		}
+		if err := e.memtable.Apply(entry); err != nil {
+			return err
+		}
+		if entry.Type == storage.DeleteEntry || entry.Type == storage.RangeDeleteEntry {
+			e.counters.deletes.Add(1)
+		} else {
+			e.counters.puts.Add(1)
+		}
+		e.negCache.remove(entry.Key)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// checkpointMarker is the file Checkpoint writes last in the checkpoint
+// directory. A directory without it is an incomplete checkpoint.
+const checkpointMarker = "CHECKPOINT"
+
+// Checkpoint writes a consistent copy of the database to destDir, which
+// must not exist or be empty, that can be opened like any data directory.
+// A non-empty destDir fails with ErrInvalidArgument.
+// It flushes the memtable first and then captures the live SSTables with a
+// manifest listing them; writes made after the flush are not included.
+//
+// SSTables are immutable, so they are hard-linked into destDir and cost no
+// space until the original database compacts them away. When linking is
+// not possible, e.g. across filesystems, they are copied instead. Blob
+// files are linked or copied the same way. The checkpoint is complete once
+// the CHECKPOINT marker file is written.
+//
+// destDir is always on disk: checkpointing an InMemory database copies it
+// there, which saves it to be opened later.
+func (e *Engine) Checkpoint(destDir string) error {
+	entries, err := os.ReadDir(destDir)
+	if err != nil && !os.IsNotExist(err) {
+		return gerrors.IO("failed to read checkpoint directory", err)
+	}
+	if len(entries) > 0 {
+		return gerrors.InvalidArgument(fmt.Sprintf("checkpoint directory %s is not empty", destDir), nil)
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return gerrors.IO("failed to create checkpoint directory", err)
+	}
+	if err := e.Flush(); err != nil {
+		return err
+	}
+
+	tiers, copies, err := e.linkTables(destDir)
+	for _, c := range copies {
+		if err == nil {
+			err = copyFile(c.src, c.dest)
+		}
+		_ = c.src.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// Blob files are only appended to, so every value the linked tables
+	// point to is already in them
+	if err := e.linkBlobs(filepath.Join(destDir, blobDir)); err != nil {
+		return err
+	}
+
+	dirs := []string{filepath.Join(destDir, "sstables"), filepath.Join(destDir, blobDir)}
+	for tier := range tiers {
+		dirs = append(dirs, filepath.Dir(tablePathIn(destDir, tableRef{tier: tier})))
+	}
+	for _, dir := range dirs {
+		if err := syncDirIfExists(dir); err != nil {
+			return gerrors.IO("failed to sync checkpoint directory", err)
+		}
+	}
+	m, err := createManifest(storage.OSFS{}, destDir, tiers, nil, e.sstCounter.Load())
+	if err != nil {
+		return err
+	}
+	if err := m.close(); err != nil {
+		return gerrors.IO("failed to close checkpoint manifest", err)
+	}
+
+	var tables int
+	for _, nums := range tiers {
+		tables += len(nums)
+	}
+	marker := fmt.Sprintf("created %s\ntables %d\n", time.Now().UTC().Format(time.RFC3339), tables)
+	if err := writeSynced(filepath.Join(destDir, checkpointMarker), []byte(marker)); err != nil {
+		return gerrors.IO("failed to write checkpoint marker", err)
+	}
+	return storage.SyncDir(destDir)
+}
+
+// linkBlobs hard-links every blob file into destDir, copying the files that
+// cannot be linked.
+func (e *Engine) linkBlobs(destDir string) error {
+	srcDir := e.blobs.Dir()
+	entries, err := e.fs.ReadDir(srcDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return gerrors.IO("failed to read blob directory", err)
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return gerrors.IO("failed to create checkpoint blob directory", err)
+	}
+	for _, entry := range entries {
+		src, dest := filepath.Join(srcDir, entry.Name()), filepath.Join(destDir, entry.Name())
+		if e.onDisk() && os.Link(src, dest) == nil {
+			continue
+		}
+		f, err := storage.Open(e.fs, src)
+		if err != nil {
+			return gerrors.IO("failed to open blob file for checkpoint", err)
+		}
+		err = copyFile(f, dest)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableCopy is a live SSTable that could not be linked into a checkpoint.
+// src stays open so the data survives a compaction removing the file.
+type tableCopy struct {
+	src  storage.FSFile
+	dest string
+}
+
+// linkTables hard-links every live SSTable into the same place under
+// destDir and returns the table numbers of each tier, oldest first. Tables
+// that cannot be linked are opened and returned to be copied once the read
+// lock is released, so a slow copy does not hold up writes.
+func (e *Engine) linkTables(destDir string) ([][]uint64, []tableCopy, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closing {
+		return nil, nil, gerrors.Closed("engine is closed", nil)
+	}
+
+	tiers := make([][]uint64, len(e.tiers))
+	var copies []tableCopy
+	for tier, readers := range e.tiers {
+		for _, reader := range readers {
+			num, _ := sstNumber(reader.Path())
+			dest := tablePathIn(destDir, tableRef{tier: tier, num: num})
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return nil, copies, gerrors.IO("failed to create checkpoint tier directory", err)
+			}
+			tiers[tier] = append(tiers[tier], num)
+
+			if e.onDisk() && os.Link(reader.Path(), dest) == nil {
+				continue
+			}
+			src, err := storage.Open(e.fs, reader.Path())
+			if err != nil {
+				return nil, copies, gerrors.IO("failed to open SSTable for checkpoint", err)
+			}
+			copies = append(copies, tableCopy{src: src, dest: dest})
+		}
+	}
+	return tiers, copies, nil
+}
+
+// onDisk reports whether the database's files are on disk, where they can
+// be linked into a checkpoint.
+func (e *Engine) onDisk() bool {
+	_, ok := e.fs.(storage.OSFS)
+	return ok
+}
+
+// copyFile copies src to a new file at dest on disk and syncs it.
+func copyFile(src storage.FSFile, dest string) error {
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return gerrors.IO("failed to create checkpoint file", err)
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		_ = out.Close()
+		return gerrors.IO(fmt.Sprintf("failed to copy %s", src.Name()), err)
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return gerrors.IO("failed to sync checkpoint file", err)
+	}
+	return out.Close()
+}
+
+// writeSynced writes data to a new file at path and syncs it.
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDirIfExists syncs dir, doing nothing if it does not exist.
+func syncDirIfExists(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return storage.SyncDir(dir)
+}
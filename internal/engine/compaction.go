@@ -4,23 +4,41 @@ package engine
 import (
 	"fmt"
 	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
-	"os"
+	"slices"
 	"sync"
 
+	"github.com/MikhailWahib/graveldb/internal/config"
 	"github.com/MikhailWahib/graveldb/internal/sstable"
 )
 
+// levelSizeMultiplier is how many times more tables each level below T0 may
+// hold than the one above it under leveled compaction.
+const levelSizeMultiplier = 10
+
 // CompactionManager manages the compaction process for SSTable tiers.
+// Background compactions run on the scheduler's workers and hold mu for
+// reading; compactAll holds it for writing so it runs alone.
 type CompactionManager struct {
-	mu     sync.Mutex
-	engine *Engine
+	mu      sync.RWMutex
+	engine  *Engine
+	sched   compactionScheduler
+	limiter *rateLimiter
+	picker  config.CompactionPicker
 }
 
 // NewCompactionManager creates a new CompactionManager for the given data directory and tiers.
 func NewCompactionManager(e *Engine) *CompactionManager {
-	return &CompactionManager{
-		engine: e,
+	cm := &CompactionManager{
+		engine:  e,
+		limiter: newRateLimiter(e.config.CompactionRateLimit),
+		picker:  e.config.CompactionPicker,
+	}
+	if cm.picker == nil {
+		cm.picker = OverlapPicker{}
 	}
+	cm.sched.cond = sync.NewCond(&cm.sched.mu)
+	cm.sched.busy = make(map[int]bool)
+	return cm
 }
 
 // shouldCompactTier checks if a tier should be compacted.
@@ -29,51 +47,158 @@ func (cm *CompactionManager) shouldCompactTier(tier int) bool {
 	if tier >= len(cm.engine.tiers) {
 		return false
 	}
-	return len(cm.engine.tiers[tier]) > cm.engine.maxTablesPerTier
+	count := len(cm.engine.tiers[tier])
+	limit := cm.engine.maxTablesPerTier
+	maxBytes := cm.engine.config.MaxTierBytes
+	if cm.leveled() {
+		for range tier {
+			limit *= levelSizeMultiplier
+			maxBytes *= levelSizeMultiplier
+		}
+	}
+	// A lone table is never compacted for its size, as merging it would
+	// only move it down a tier
+	if maxBytes > 0 && count > 1 {
+		var size int64
+		for _, reader := range cm.engine.tiers[tier] {
+			size += reader.Size()
+		}
+		if size > maxBytes {
+			return true
+		}
+	}
+	if cm.engine.config.CompactAtMaxTables {
+		return count >= limit
+	}
+	return count > limit
+}
+
+// leveled reports whether the engine uses leveled compaction.
+func (cm *CompactionManager) leveled() bool {
+	return cm.engine.config.CompactionStrategy == config.LeveledCompaction
 }
 
 // generateOutputPath generates a unique output path for compacted SSTable.
 func (cm *CompactionManager) generateOutputPath(tier int) string {
-	outputDir := fmt.Sprintf("%s/sstables/T%d", cm.engine.dataDir, tier)
-	err := os.MkdirAll(outputDir, 0755)
+	outputDir := cm.engine.tierDir(tier)
+	err := cm.engine.fs.MkdirAll(outputDir, 0755)
 	if err != nil {
 		return ""
 	}
 	// Atomically increment counter to avoid filename conflicts
-	return fmt.Sprintf("%s/%06d.sst", outputDir, cm.engine.sstCounter.Add(1))
+	return cm.engine.tablePath(tableRef{tier: tier, num: cm.engine.sstCounter.Add(1)})
+}
+
+// compactTier compacts tier if it holds more tables than its limit. Under
+// leveled compaction the level gives up one table at a time until it is
+// back in bounds. Must be called with cm.mu held.
+func (cm *CompactionManager) compactTier(tier int) error {
+	cm.engine.mu.RLock()
+	shouldCompact := cm.shouldCompactTier(tier)
+	cm.engine.mu.RUnlock()
+
+	if !shouldCompact {
+		return nil
+	}
+	if !cm.leveled() {
+		return cm.compact(tier)
+	}
+
+	for shouldCompact {
+		if err := cm.compactLevel(tier); err != nil {
+			return err
+		}
+		cm.engine.mu.RLock()
+		shouldCompact = cm.shouldCompactTier(tier)
+		cm.engine.mu.RUnlock()
+	}
+	return nil
 }
 
-// compactTiers compacts tiers starting from the given tier.
-func (cm *CompactionManager) compactTiers(start int) error {
+// compactAll merges every tier down into the next one, T0 first, regardless
+// of how many tables each holds, until all data sits in a single table in
+// the deepest tier.
+func (cm *CompactionManager) compactAll() error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	for tier := start; tier < len(cm.engine.tiers); tier++ {
-		// Check if compaction is needed
-		shouldCompact := cm.shouldCompactTier(tier)
+	for tier := 0; ; tier++ {
+		cm.engine.mu.RLock()
+		deepest := -1
+		for i, tables := range cm.engine.tiers {
+			if len(tables) > 0 {
+				deepest = i
+			}
+		}
+		count := 0
+		if tier < len(cm.engine.tiers) {
+			count = len(cm.engine.tiers[tier])
+		}
+		cm.engine.mu.RUnlock()
 
-		if !shouldCompact {
+		// A lone table in the deepest tier is already fully compacted
+		if tier > deepest || (tier == deepest && count <= 1) {
 			return nil
 		}
+		if count == 0 {
+			continue
+		}
+		if err := cm.compact(tier); err != nil {
+			return err
+		}
+	}
+}
+
+// compactTierNow merges tier into the next one regardless of its size. It
+// claims both tiers from the scheduler first, as a worker running a job for
+// tier would, then queues the tiers it may have left over their limits.
+func (cm *CompactionManager) compactTierNow(tier int) error {
+	cm.sched.claim(tier)
+	defer cm.sched.release(tier)
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
 
+	if !cm.leveled() {
 		if err := cm.compact(tier); err != nil {
 			return err
 		}
+	} else {
+		// Push down only the tables present now, so tables flushed
+		// meanwhile cannot keep the loop going
+		for n := cm.engine.tableCount(tier); n > 0 && cm.engine.tableCount(tier) > 0; n-- {
+			if err := cm.compactLevel(tier); err != nil {
+				return err
+			}
+		}
+	}
+
+	cm.engine.mu.RLock()
+	defer cm.engine.mu.RUnlock()
+	for _, t := range []int{tier, tier + 1} {
+		if cm.shouldCompactTier(t) {
+			cm.enqueue(t)
+		}
 	}
 	return nil
 }
 
 // compact compacts a single tier by merging all SSTables in it.
-func (cm *CompactionManager) compact(tier int) error {
+func (cm *CompactionManager) compact(tier int) (err error) {
 	merger := sstable.NewMerger()
 
 	cm.engine.mu.RLock()
 	inputs := append([]*sstable.Reader(nil), cm.engine.tiers[tier]...)
+	// The output only lands below all other data if the next tier and
+	// those under it are empty
+	bottom := cm.engine.emptyFromLocked(tier + 1)
 	cm.engine.mu.RUnlock()
 
 	if len(inputs) == 0 {
 		return nil
 	}
+	var written []*sstable.Reader
+	done := cm.engine.compactionEvent(tier, inputs)
+	defer func() { done(written, err) }()
 
 	// Generate output path (counter is atomically incremented)
 	outputFile := cm.generateOutputPath(tier + 1)
@@ -95,48 +220,320 @@ func (cm *CompactionManager) compact(tier int) error {
 		}
 	}
 
-	output, err := sstable.NewWriter(outputFile, cm.engine.config.IndexInterval)
+	// The inputs stay live in their tier until the swap below, so no
+	// error path may close them
+	output, err := sstable.NewWriterWithOptions(outputFile, cm.engine.sstOptions())
 	if err != nil {
-		for _, sst := range inputs {
-			_ = sst.Close()
-		}
 		return gerrors.IO("failed to open output SST for writing", err)
 	}
 
 	merger.SetOutput(output)
+	merger.SetThrottle(cm.limiter.wait)
+	merger.SetDropTombstones(bottom)
+	merger.SetFilter(cm.engine.config.CompactionFilter)
+	merger.SetMerge(cm.engine.config.MergeFunc)
+	merger.SetMaxVersions(cm.engine.config.MaxVersionsPerKey)
+	merger.SetNow(cm.engine.now())
 	if err := merger.Merge(); err != nil {
-		_ = output.Close()
-		for _, sst := range inputs {
-			_ = sst.Close()
-		}
+		_ = output.Abort()
 		return gerrors.Internal("failed to merge SSTables", err)
 	}
 
 	if err := output.Close(); err != nil {
-		for _, sst := range inputs {
-			_ = sst.Close()
-		}
 		return gerrors.IO("failed to close output SST", err)
 	}
 
-	outputReader, err := sstable.NewReader(outputFile)
+	outputReader, err := sstable.NewReaderWithOptions(outputFile, cm.engine.sstOptions())
 	if err != nil {
+		_ = cm.engine.fs.Remove(outputFile)
 		return gerrors.IO("failed to open compacted SST for reading", err)
 	}
 
 	// Update tiers structure
+	// Every entry may have been a dropped tombstone
+	if outputReader.Empty() {
+		_ = outputReader.Close()
+		_ = cm.engine.fs.Remove(outputFile)
+		outputReader = nil
+	}
+
 	cm.engine.mu.Lock()
 	defer cm.engine.mu.Unlock()
 
-	cm.engine.tiers[tier] = []*sstable.Reader{}
-	cm.engine.tiers[tier+1] = append(cm.engine.tiers[tier+1], outputReader)
+	var edit manifestEdit
+	if outputReader != nil {
+		if err := cm.engine.checkAppendLocked(tier+1, outputReader); err != nil {
+			_ = outputReader.Close()
+			_ = cm.engine.fs.Remove(outputFile)
+			return err
+		}
+		outputNum, _ := sstNumber(outputFile)
+		edit.added = []tableRef{{tier: tier + 1, num: outputNum}}
+	}
+
+	// Record the swap before making it; until then a crash leaves the
+	// inputs live and the output unreferenced
+	for _, sst := range inputs {
+		num, _ := sstNumber(sst.Path())
+		edit.removed = append(edit.removed, tableRef{tier: tier, num: num})
+	}
+	if err := cm.engine.logEdit(edit); err != nil {
+		if outputReader != nil {
+			_ = outputReader.Close()
+			_ = cm.engine.fs.Remove(outputFile)
+		}
+		return err
+	}
+
+	// Tables flushed while the merge ran were appended after the inputs
+	// and are kept for the next compaction
+	cm.engine.tiers[tier] = append([]*sstable.Reader(nil), cm.engine.tiers[tier][len(inputs):]...)
+	if outputReader != nil {
+		cm.engine.tiers[tier+1] = append(cm.engine.tiers[tier+1], outputReader)
+	}
+	cm.engine.negCache.clear()
 
 	// Cleanup inputs
 	for _, sst := range inputs {
-		path := sst.Path()
+		// Iterators may still be reading the inputs; the last one to
+		// release an input deletes it
+		sst.RemoveOnClose()
+		_ = sst.Close()
+	}
+	if outputReader != nil {
+		written = []*sstable.Reader{outputReader}
+		cm.engine.counters.bytesCompacted.Add(uint64(outputReader.Size()))
+	}
+
+	return nil
+}
+
+// compactLevel pushes tables from level into the next level under leveled
+// compaction. T0 tables may overlap, so all of them are pushed together;
+// from deeper levels only the oldest table is. They are merged with the
+// tables of the next level whose key ranges they overlap, and the result is
+// split into tables of about MaxMemtableSize bytes, keeping the next level's
+// key ranges disjoint.
+func (cm *CompactionManager) compactLevel(level int) (err error) {
+	e := cm.engine
+
+	e.mu.Lock()
+	for len(e.tiers) <= level+1 {
+		e.tiers = append(e.tiers, nil)
+	}
+	var upper []*sstable.Reader
+	if level == 0 {
+		upper = slices.Clone(e.tiers[0])
+	} else if len(e.tiers[level]) > 0 {
+		upper = []*sstable.Reader{oldestTable(e.tiers[level])}
+	}
+	var lower []*sstable.Reader
+	for _, reader := range e.tiers[level+1] {
+		if overlapsAny(e.compare, reader, upper) {
+			lower = append(lower, reader)
+		}
+	}
+	// The tables of the next level left out of the merge cannot hold the
+	// merged keys, so only deeper levels could hold data a tombstone hides
+	bottom := e.emptyFromLocked(level + 2)
+	e.mu.Unlock()
+
+	if len(upper) == 0 {
+		return nil
+	}
+
+	// The next level holds older data, so its tables go first
+	inputs := append(slices.Clone(lower), upper...)
+	var written []*sstable.Reader
+	done := e.compactionEvent(level, inputs)
+	defer func() { done(written, err) }()
+
+	newOutput := func() (*sstable.Writer, error) {
+		path := cm.generateOutputPath(level + 1)
+		if path == "" {
+			return nil, gerrors.IO("failed to generate output path for compaction", nil)
+		}
+		writer, err := sstable.NewWriterWithOptions(path, e.sstOptions())
+		if err != nil {
+			return nil, gerrors.IO("failed to open output SST for writing", err)
+		}
+		return writer, nil
+	}
+	first, err := newOutput()
+	if err != nil {
+		return err
+	}
+
+	merger := sstable.NewMerger()
+	for _, sst := range inputs {
+		if err := merger.AddSource(sst); err != nil {
+			_ = first.Abort()
+			return gerrors.Internal("failed to add source to merger", err)
+		}
+	}
+	merger.SetOutput(first)
+	merger.SetSplit(int64(e.maxMemtableSize), newOutput)
+	merger.SetThrottle(cm.limiter.wait)
+	merger.SetDropTombstones(bottom)
+	merger.SetFilter(e.config.CompactionFilter)
+	merger.SetMerge(e.config.MergeFunc)
+	merger.SetMaxVersions(e.config.MaxVersionsPerKey)
+	merger.SetNow(e.now())
+
+	if err := merger.Merge(); err != nil {
+		for _, w := range merger.Outputs() {
+			_ = w.Abort()
+		}
+		return gerrors.Internal("failed to merge SSTables", err)
+	}
+	writers := merger.Outputs()
+
+	var outputs []*sstable.Reader
+	discard := func() {
+		for _, reader := range outputs {
+			path := reader.Path()
+			_ = reader.Close()
+			_ = cm.engine.fs.Remove(path)
+		}
+	}
+	for i, w := range writers {
+		if err := w.Close(); err != nil {
+			for _, rest := range writers[i:] {
+				_ = rest.Delete()
+			}
+			discard()
+			return gerrors.IO("failed to close output SST", err)
+		}
+		reader, err := sstable.NewReaderWithOptions(w.Path(), e.sstOptions())
+		if err != nil {
+			_ = cm.engine.fs.Remove(w.Path())
+			for _, rest := range writers[i+1:] {
+				_ = rest.Abort()
+			}
+			discard()
+			return gerrors.IO("failed to open compacted SST for reading", err)
+		}
+		if reader.Empty() {
+			// Every entry was a dropped tombstone
+			_ = reader.Close()
+			_ = cm.engine.fs.Remove(w.Path())
+			continue
+		}
+		outputs = append(outputs, reader)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	next := withoutTables(e.tiers[level+1], lower)
+	for _, reader := range outputs {
+		if e.config.StrictInvariants && overlapsAny(e.compare, reader, next) {
+			discard()
+			return gerrors.Invariant(fmt.Sprintf("SSTable %s overlaps another table in T%d", reader.Path(), level+1), nil)
+		}
+		next = append(next, reader)
+	}
+
+	// Record the swap before making it; until then a crash leaves the
+	// inputs live and the outputs unreferenced
+	var edit manifestEdit
+	for _, reader := range outputs {
+		num, _ := sstNumber(reader.Path())
+		edit.added = append(edit.added, tableRef{tier: level + 1, num: num})
+	}
+	for _, sst := range upper {
+		num, _ := sstNumber(sst.Path())
+		edit.removed = append(edit.removed, tableRef{tier: level, num: num})
+	}
+	for _, sst := range lower {
+		num, _ := sstNumber(sst.Path())
+		edit.removed = append(edit.removed, tableRef{tier: level + 1, num: num})
+	}
+	if err := e.logEdit(edit); err != nil {
+		discard()
+		return err
+	}
+
+	// Tables flushed to T0 while the merge ran are kept for the next compaction
+	e.tiers[level] = withoutTables(e.tiers[level], upper)
+	e.tiers[level+1] = next
+	e.negCache.clear()
+
+	for _, sst := range inputs {
+		// Iterators may still be reading the inputs; the last one to
+		// release an input deletes it
+		sst.RemoveOnClose()
 		_ = sst.Close()
-		_ = os.Remove(path)
+	}
+	written = outputs
+	for _, reader := range outputs {
+		e.counters.bytesCompacted.Add(uint64(reader.Size()))
 	}
 
 	return nil
 }
+
+// emptyFromLocked reports whether tier and every tier below it hold no
+// tables. Must be called with the engine mutex held.
+func (e *Engine) emptyFromLocked(tier int) bool {
+	for t := tier; t < len(e.tiers); t++ {
+		if len(e.tiers[t]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tableCount returns the number of tables in tier.
+func (e *Engine) tableCount(tier int) int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if tier >= len(e.tiers) {
+		return 0
+	}
+	return len(e.tiers[tier])
+}
+
+// oldestTable returns the table with the lowest SSTable number.
+func oldestTable(tables []*sstable.Reader) *sstable.Reader {
+	oldest := tables[0]
+	oldestNum, _ := sstNumber(oldest.Path())
+	for _, reader := range tables[1:] {
+		if num, _ := sstNumber(reader.Path()); num < oldestNum {
+			oldest, oldestNum = reader, num
+		}
+	}
+	return oldest
+}
+
+// overlapsAny reports whether the key range of reader, including the ranges
+// its range tombstones delete, overlaps that of any of tables, with keys
+// ordered by cmp. Empty tables overlap nothing, and a nil upper bound from
+// tableBounds is unbounded.
+func overlapsAny(cmp func(a, b []byte) int, reader *sstable.Reader, tables []*sstable.Reader) bool {
+	lo, hi := tableBounds(cmp, reader)
+	if lo == nil {
+		return false
+	}
+	for _, other := range tables {
+		otherLo, otherHi := tableBounds(cmp, other)
+		if otherLo == nil {
+			continue
+		}
+		if (otherHi == nil || cmp(lo, otherHi) <= 0) && (hi == nil || cmp(otherLo, hi) <= 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutTables returns a copy of tables without the ones in removed.
+func withoutTables(tables, removed []*sstable.Reader) []*sstable.Reader {
+	kept := make([]*sstable.Reader, 0, len(tables))
+	for _, reader := range tables {
+		if !slices.Contains(removed, reader) {
+			kept = append(kept, reader)
+		}
+	}
+	return kept
+}
@@ -1,17 +1,22 @@
 package engine
 
 import (
-	"errors"
+	"bytes"
+	"cmp"
+	"context"
 	"fmt"
 	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/MikhailWahib/graveldb/internal/blob"
 	"github.com/MikhailWahib/graveldb/internal/config"
 	"github.com/MikhailWahib/graveldb/internal/memtable"
 	"github.com/MikhailWahib/graveldb/internal/sstable"
@@ -19,12 +24,25 @@ import (
 	"github.com/MikhailWahib/graveldb/internal/wal"
 )
 
+// blobDir is the directory under the data directory holding the blob files
+// of values longer than config.ValueThreshold.
+const blobDir = "blobs"
+
 // Engine is the main database engine, managing memtable, WAL, SSTables, and compaction.
 type Engine struct {
 	mu   sync.RWMutex
 	once sync.Once
 	wg   sync.WaitGroup
 
+	// writeMu guards writers, the queue of writes waiting to be committed.
+	// The first write in the queue is the leader committing it.
+	writeMu sync.Mutex
+	writers []*pendingWrite
+	// group and groupWrites are the committing leader's scratch space,
+	// guarded by mu
+	group       []*pendingWrite
+	groupWrites []wal.Write
+
 	dataDir            string
 	memtable           memtable.Memtable
 	immutableMemtables []immutableMemtable
@@ -32,15 +50,43 @@ type Engine struct {
 	tiers              [][]*sstable.Reader
 	compactionMgr      *CompactionManager
 	sstCounter         *atomic.Uint64
-	walCounter         *atomic.Uint64
 	maxMemtableSize    int
 	maxTablesPerTier   int
 	config             *config.Config
+	closing            bool
+	// closed is set once Close starts, and checked without the engine
+	// lock by every operation
+	closed     atomic.Bool
+	negCache   *negativeCache
+	blockCache *sstable.BlockCache
+	blobs      *blob.Store
+	manifest   *manifest
+	counters   opCounters
+	lastSeq    uint64 // last sequence number assigned, guarded by mu
+	// compare orders keys: the configured comparator or bytes.Compare
+	compare func(a, b []byte) int
+	// fs holds the database's files: the disk, or memory under InMemory
+	fs storage.FS
+	// walSegment is the first WAL segment holding data of the active
+	// memtable, guarded by mu
+	walSegment uint64
+	// tierRoots holds the absolute TierPaths entry of each tier, "" for
+	// tiers kept in the data directory
+	tierRoots []string
+	// beforeFlush, if set, is called by each flush goroutine before it
+	// writes its memtable, letting tests slow flushes down
+	beforeFlush func()
 }
 
+// immutableMemtable is a sealed memtable waiting to be flushed. Its SSTable
+// number is assigned when it is sealed, so T0 tables are numbered in the
+// order their data was written.
 type immutableMemtable struct {
-	mt      memtable.Memtable
-	walPath string
+	mt         memtable.Memtable
+	walSegment uint64 // first WAL segment holding the memtable's data
+	sstNum     uint64
+	done       chan struct{} // closed once the flush goroutine has finished
+	err        *error        // the flush goroutine's error, set before done is closed
 }
 
 // NewEngine creates a new Engine instance for the given data directory.
@@ -50,115 +96,448 @@ func NewEngine(cfg *config.Config) *Engine {
 	} else {
 		cfg.FillDefaults()
 	}
+	compare := cfg.Comparator
+	if compare == nil {
+		compare = bytes.Compare
+	}
+	var fs storage.FS = storage.OSFS{}
+	if cfg.InMemory {
+		fs = storage.NewMemFS()
+	}
 	return &Engine{
-		memtable:         memtable.NewMemtable(),
+		memtable:         newMemtable(cfg, compare),
 		tiers:            make([][]*sstable.Reader, 0),
 		sstCounter:       new(atomic.Uint64),
-		walCounter:       new(atomic.Uint64),
 		maxMemtableSize:  cfg.MaxMemtableSize,
 		maxTablesPerTier: cfg.MaxTablesPerTier,
 		config:           cfg,
+		negCache:         newNegativeCache(cfg.NegativeCacheSize),
+		blockCache:       sstable.NewBlockCache(int64(cfg.BlockCacheSize)),
+		compare:          compare,
+		fs:               fs,
 	}
 }
 
+// newMemtable returns an empty memtable from cfg.MemtableFactory, or else a
+// skiplist ordered by compare and shaped by the skiplist settings in cfg.
+func newMemtable(cfg *config.Config, compare func(a, b []byte) int) memtable.Memtable {
+	if cfg.MemtableFactory != nil {
+		return cfg.MemtableFactory()
+	}
+	return memtable.NewMemtableWithOptions(memtable.Options{
+		Comparator:  compare,
+		MaxLevel:    cfg.SkipListMaxLevel,
+		Probability: cfg.SkipListProbability,
+		MaxVersions: cfg.MaxVersionsPerKey,
+	})
+}
+
 // OpenDB initializes the compaction manager and parses existing SSTables.
 func (e *Engine) OpenDB(dataDir string) error {
-	err := os.MkdirAll(dataDir, 0755)
+	err := e.fs.MkdirAll(dataDir, 0755)
 	if err != nil {
 		return err
 	}
-	e.dataDir = dataDir
+	if err := e.setDataDir(dataDir); err != nil {
+		return err
+	}
 
-	walFile, err := wal.NewWAL(dataDir+"/wal.log", e.config.WALFlushThreshold, e.config.WALFlushInterval)
+	walFile, err := wal.Open(dataDir, wal.Options{
+		FlushThreshold: e.config.WALFlushThreshold,
+		FlushInterval:  e.config.WALFlushInterval,
+		SyncMode:       e.config.WALSyncMode,
+		SegmentSize:    int64(e.config.WALSegmentSize),
+		Preallocate:    int64(max(e.config.WALPreallocateSize, 0)),
+		MaxRecordSize:  max(e.config.WALMaxRecordSize, 0),
+		MaxKeySize:     max(e.config.MaxKeySize, 0),
+		MaxValueSize:   max(e.config.MaxValueSize, 0),
+		IORetry:        e.config.IORetry,
+		FS:             e.fs,
+	})
 	if err != nil {
 		return err
 	}
 
-	entries, err := wal.ReplayDir(dataDir)
+	// Every existing segment is replayed into the active memtable, so its
+	// data starts at the first segment
+	entries, truncated, err := walFile.Replay()
 	if err != nil {
+		_ = walFile.Close()
 		return err
 	}
+	if truncated {
+		log.Printf("WAL ended with a torn or corrupt record; recovered %d entries before it", len(entries))
+	}
 
+	now := e.now()
 	for _, entry := range entries {
 		switch entry.Type {
-		case storage.PutEntry:
-			if err := e.memtable.Put(entry.Key, entry.Value); err != nil {
-				return err
-			}
-		case storage.DeleteEntry:
-			if err := e.memtable.Delete(entry.Key); err != nil {
-				return err
-			}
+		case storage.PutEntry, storage.DeleteEntry, storage.RangeDeleteEntry, storage.MergeEntry:
+		default:
+			continue
+		}
+		e.lastSeq = max(e.lastSeq, entry.Seq)
+		// An expired put still shadows older values, like a delete
+		if entry.Type == storage.PutEntry && entry.Expired(now) {
+			entry = storage.Entry{Type: storage.DeleteEntry, Key: entry.Key, Seq: entry.Seq}
+		}
+		if entry.Type == storage.MergeEntry {
+			entry = e.memtableMergeLocked(entry)
+		}
+		if err := e.memtable.Apply(entry); err != nil {
+			return err
 		}
 	}
 	e.wal = walFile
 
+	// Tables may point to values in blob files even if ValueThreshold no
+	// longer separates new ones
+	if e.blobs, err = blob.OpenFS(e.fs, filepath.Join(dataDir, blobDir)); err != nil {
+		return err
+	}
+
 	compactionMgr := NewCompactionManager(e)
 	e.compactionMgr = compactionMgr
 
-	return e.parseTiers()
+	if err := e.parseTiers(); err != nil {
+		return err
+	}
+	for _, tier := range e.tiers {
+		for _, reader := range tier {
+			e.lastSeq = max(e.lastSeq, reader.MaxSeq())
+		}
+	}
+	compactionMgr.startWorkers(e.config.MaxConcurrentCompactions)
+	return nil
 }
 
-// parseTiers scans the SSTable directory and populates the engine's tier structure.
+// setDataDir sets the data directory and resolves config.TierPaths against
+// it.
+func (e *Engine) setDataDir(dataDir string) error {
+	e.dataDir = dataDir
+	absData, err := filepath.Abs(dataDir)
+	if err != nil {
+		return gerrors.IO("failed to resolve data directory", err)
+	}
+	e.tierRoots = make([]string, len(e.config.TierPaths))
+	for tier, path := range e.config.TierPaths {
+		if path == "" {
+			continue
+		}
+		root, err := filepath.Abs(path)
+		if err != nil {
+			return gerrors.IO(fmt.Sprintf("failed to resolve directory of T%d", tier), err)
+		}
+		if root != absData {
+			e.tierRoots[tier] = root
+		}
+	}
+	return nil
+}
+
+// externalRoot returns the TierPaths directory new tables of tier are
+// written under, or "" if they go in the data directory.
+func (e *Engine) externalRoot(tier int) string {
+	if tier < len(e.tierRoots) {
+		return e.tierRoots[tier]
+	}
+	return ""
+}
+
+// tierDir returns the directory new tables of tier are written to.
+func (e *Engine) tierDir(tier int) string {
+	return filepath.Dir(e.tablePath(tableRef{tier: tier}))
+}
+
+// parseTiers rebuilds the engine's tiers from the manifest and opens a fresh
+// manifest holding just the live tables. SSTable files the manifest does not
+// reference, such as the output of a compaction interrupted before it was
+// recorded, are removed, while a table the manifest references but the
+// directory lacks fails the open unless IgnoreMissingTables is set. A table
+// the manifest references that cannot be opened always fails it. A database
+// without a manifest, written before it was introduced, is rebuilt from the
+// SSTable directories instead: tables in the unversioned format from
+// before format versions are converted to the current one, and a file that
+// still does not open as a table fails the open with ErrCorrupt, leaving it
+// for Repair.
 func (e *Engine) parseTiers() error {
-	sstableDir := filepath.Join(e.dataDir, "sstables")
-	subdirs, err := os.ReadDir(sstableDir)
-	if err != nil && !os.IsNotExist(err) {
+	tierNums, roots, maxNum, found, err := openManifest(e.fs, e.dataDir)
+	if err != nil {
 		return err
 	}
 
+	onDisk, maxOnDisk, err := e.scanSSTables(roots)
+	if err != nil {
+		return err
+	}
+	if found {
+		live := make(map[tableRef]bool)
+		for tier, nums := range tierNums {
+			for _, num := range nums {
+				live[tableRef{tier: tier, num: num}] = true
+			}
+		}
+		for _, table := range onDisk {
+			if live[table.ref] {
+				continue
+			}
+			path := table.path
+			if err := e.fs.Remove(path); err != nil {
+				log.Printf("failed to remove unreferenced SSTable %s: %v", path, err)
+			}
+		}
+	} else {
+		for _, table := range onDisk {
+			for len(tierNums) <= table.ref.tier {
+				tierNums = append(tierNums, nil)
+			}
+			tierNums[table.ref.tier] = append(tierNums[table.ref.tier], table.ref.num)
+		}
+	}
+
+	paths := make(map[tableRef]string, len(onDisk))
+	for _, table := range onDisk {
+		paths[table.ref] = table.path
+	}
+
+	liveNums := make([][]uint64, len(tierNums))
+	liveRoots := make(map[uint64]string)
+	e.tiers = make([][]*sstable.Reader, len(tierNums))
+	closeTiers := func() {
+		for _, readers := range e.tiers {
+			for _, reader := range readers {
+				_ = reader.Close()
+			}
+		}
+		e.tiers = nil
+	}
+	// ParanoidChecks looks for damage done while the database was closed,
+	// so only these tables are verified in full, not every flush or
+	// compaction output reopened later
+	opts := e.sstOptions()
+	opts.VerifyOnOpen = e.config.ParanoidChecks
+	for tier, nums := range tierNums {
+		for _, num := range nums {
+			ref := tableRef{tier: tier, num: num}
+			path, ok := paths[ref]
+			if !ok {
+				path = tablePathIn(cmp.Or(roots[num], e.dataDir), ref)
+				if _, err := e.fs.Stat(path); os.IsNotExist(err) {
+					if !e.config.IgnoreMissingTables {
+						closeTiers()
+						return gerrors.Corruption(fmt.Sprintf("SSTable %s recorded in the manifest is missing", path), err)
+					}
+					log.Printf("SSTable %s recorded in the manifest is missing; dropping it, the data it held is lost", path)
+					continue
+				}
+			}
+			if !found {
+				if err := e.convertLegacyTable(path); err != nil {
+					closeTiers()
+					return err
+				}
+			}
+			reader, err := sstable.NewReaderWithOptions(path, opts)
+			if err != nil && found {
+				// Refuse to open with part of the data missing. Dropping
+				// the table would also delete it as unreferenced on the
+				// next open, so it is left for Repair to deal with
+				closeTiers()
+				return gerrors.IO(fmt.Sprintf("failed to open SSTable %s", path), err)
+			}
+			if err != nil {
+				// Without a manifest the file may still hold data, and
+				// leaving it out of the new manifest would lose it for
+				// good; only Repair sets tables aside
+				closeTiers()
+				return gerrors.Corruption(fmt.Sprintf("SSTable %s cannot be opened; run Repair to quarantine it", path), err)
+			}
+			e.tiers[tier] = append(e.tiers[tier], reader)
+			liveNums[tier] = append(liveNums[tier], num)
+			if root := tableRoot(path); root != filepath.Clean(e.dataDir) {
+				liveRoots[num] = root
+			}
+		}
+	}
+
+	// Numbers recorded in the manifest stay used even once their tables
+	// are gone; the directory scan covers databases without a manifest
+	e.sstCounter.Store(max(maxNum, maxOnDisk))
+	e.manifest, err = createManifest(e.fs, e.dataDir, liveNums, liveRoots, e.sstCounter.Load())
+	return err
+}
+
+// convertLegacyTable rewrites the table at path in the current format if it
+// is in the unversioned format from before format versions, which a
+// database from before the manifest may hold.
+func (e *Engine) convertLegacyTable(path string) error {
+	legacy, err := sstable.IsLegacy(e.fs, path)
+	if err != nil || !legacy {
+		return err
+	}
+	if err := sstable.ConvertLegacy(path, e.sstOptions()); err != nil {
+		return err
+	}
+	log.Printf("converted SSTable %s from the unversioned format to version %d", path, sstable.Version)
+	return nil
+}
+
+// diskTable is an SSTable file found in a tier directory.
+type diskTable struct {
+	ref  tableRef
+	path string
+}
+
+// scanSSTables lists the SSTables in the tier directories of the data
+// directory, the TierPaths directories and the directories in roots, oldest
+// first within each tier, and returns the highest table number among them.
+// Partially written tables are removed.
+func (e *Engine) scanSSTables(roots map[uint64]string) ([]diskTable, uint64, error) {
+	dirs := []string{filepath.Clean(e.dataDir)}
+	for _, root := range e.tierRoots {
+		dirs = append(dirs, root)
+	}
+	for _, root := range roots {
+		dirs = append(dirs, root)
+	}
+
+	var tables []diskTable
+	var maxSSTNumber uint64
+	scanned := make(map[string]bool)
+	seen := make(map[tableRef]bool)
+	for _, dir := range dirs {
+		if dir == "" || scanned[dir] {
+			continue
+		}
+		scanned[dir] = true
+		found, maxNum, err := scanSSTableDir(e.fs, filepath.Join(dir, "sstables"))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, table := range found {
+			if !seen[table.ref] {
+				seen[table.ref] = true
+				tables = append(tables, table)
+			}
+		}
+		maxSSTNumber = max(maxSSTNumber, maxNum)
+	}
+	return tables, maxSSTNumber, nil
+}
+
+// scanSSTableDir lists the SSTables in the tier directories of sstableDir,
+// oldest first within each tier, and returns the highest table number among
+// them. Partially written tables are removed.
+func scanSSTableDir(fs storage.FS, sstableDir string) ([]diskTable, uint64, error) {
+	subdirs, err := fs.ReadDir(sstableDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+
+	var tables []diskTable
 	var maxSSTNumber uint64
 
 	for _, dir := range subdirs {
-		if !dir.IsDir() || !strings.HasPrefix(dir.Name(), "T") {
+		if !dir.IsDir() {
 			continue
 		}
 
-		tierStr := strings.TrimPrefix(dir.Name(), "T")
-		tier, err := strconv.Atoi(tierStr)
+		tier, ok, err := parseTierDirName(dir.Name())
 		if err != nil {
-			return gerrors.Internal("invalid tier dir name", err)
+			return nil, 0, err
 		}
-
-		// Ensure tiers slice is long enough
-		for len(e.tiers) <= tier {
-			e.tiers = append(e.tiers, nil)
+		if !ok {
+			continue
 		}
 
-		sstDir := filepath.Join(sstableDir, fmt.Sprintf("T%d", tier))
-		files, err := os.ReadDir(sstDir)
+		sstDir := filepath.Join(sstableDir, dir.Name())
+		files, err := fs.ReadDir(sstDir)
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
 
+		var found []diskTable
 		for _, file := range files {
 			if file.IsDir() {
 				continue
 			}
 
-			filename := file.Name()
-			if strings.HasSuffix(filename, ".sst") {
-				numberStr := strings.TrimSuffix(filename, ".sst")
-				if sstNum, err := strconv.ParseUint(numberStr, 10, 64); err == nil {
-					if sstNum > maxSSTNumber {
-						maxSSTNumber = sstNum
-					}
+			if isPartialSSTable(file.Name()) {
+				// Left behind by a write that never reached its rename
+				path := filepath.Join(sstDir, file.Name())
+				if err := fs.Remove(path); err != nil {
+					log.Printf("failed to remove partial SSTable %s: %v", path, err)
 				}
-			}
-
-			path := filepath.Join(sstDir, file.Name())
-			reader, err := sstable.NewReader(path)
-			if err != nil {
-				log.Printf("failed to open SSTable for read: %v", err)
 				continue
 			}
 
-			e.tiers[tier] = append(e.tiers[tier], reader)
+			if sstNum, ok := sstNumber(file.Name()); ok {
+				found = append(found, diskTable{
+					ref:  tableRef{tier: tier, num: sstNum},
+					path: filepath.Join(sstDir, file.Name()),
+				})
+				maxSSTNumber = max(maxSSTNumber, sstNum)
+			}
 		}
+
+		// Order tables oldest first; names stop sorting numerically once
+		// numbers outgrow the zero padding.
+		slices.SortFunc(found, func(a, b diskTable) int {
+			return cmp.Compare(a.ref.num, b.ref.num)
+		})
+		tables = append(tables, found...)
 	}
 
-	e.sstCounter.Store(maxSSTNumber)
-	return nil
+	return tables, maxSSTNumber, nil
+}
+
+// tablePath returns the path a new SSTable identified by ref is written to.
+func (e *Engine) tablePath(ref tableRef) string {
+	return tablePathIn(cmp.Or(e.externalRoot(ref.tier), e.dataDir), ref)
+}
+
+// tablePathIn returns the path of the SSTable ref under dir, a data
+// directory or a TierPaths directory.
+func tablePathIn(dir string, ref tableRef) string {
+	return filepath.Join(dir, "sstables", fmt.Sprintf("T%d", ref.tier), fmt.Sprintf("%06d.sst", ref.num))
+}
+
+// tableRoot returns the directory under which the SSTable at path was
+// written, the reverse of tablePathIn.
+func tableRoot(path string) string {
+	return filepath.Dir(filepath.Dir(filepath.Dir(path)))
+}
+
+// sstNumber returns the number in an SSTable file name such as "000042.sst".
+func sstNumber(name string) (uint64, bool) {
+	numberStr, ok := strings.CutSuffix(filepath.Base(name), ".sst")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(numberStr, 10, 64)
+	return n, err == nil
+}
+
+// isPartialSSTable reports whether name is an SSTable that was still being
+// written, which is never complete enough to open.
+func isPartialSSTable(name string) bool {
+	return strings.HasSuffix(name, sstable.TempSuffix) || strings.HasSuffix(name, ".partial")
+}
+
+// parseTierDirName parses a tier directory name of the form T<number>.
+// Names that do not start with "T" followed by a digit (e.g. "Tmp", ".tmp")
+// are not tier directories and are reported with ok set to false. Names that
+// do, but are not entirely numeric after the "T" (e.g. "T01x"), are an error.
+func parseTierDirName(name string) (tier int, ok bool, err error) {
+	if len(name) < 2 || name[0] != 'T' || name[1] < '0' || name[1] > '9' {
+		return 0, false, nil
+	}
+
+	tier, err = strconv.Atoi(name[1:])
+	if err != nil {
+		return 0, false, gerrors.Corruption(fmt.Sprintf("invalid tier dir name %q", name), err)
+	}
+	return tier, true, nil
 }
 
 // Tiers returns the current SSTable tiers managed by the engine.
@@ -170,120 +549,644 @@ func (e *Engine) Tiers() [][]*sstable.Reader {
 
 // Put inserts or updates a key-value pair in the database.
 func (e *Engine) Put(key, value []byte) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	return e.PutCtx(context.Background(), key, value)
+}
 
-	if err := e.wal.AppendPut(key, value); err != nil {
-		return err
+// PutCtx is like Put but gives up once ctx is done. The context is checked
+// while the write waits to be committed and, if this writer commits it,
+// again after the entry has been appended to the WAL and memtable, before
+// any memtable rotation I/O. A context error returned at that point means
+// the write was applied anyway.
+func (e *Engine) PutCtx(ctx context.Context, key, value []byte) error {
+	entry := storage.Entry{Type: storage.PutEntry, Key: key, Value: value}
+	return e.commitEntry(ctx, entry, true)
+}
+
+// WriteOptions control how a single write is committed.
+type WriteOptions struct {
+	// Sync writes the entry to the WAL file and syncs it before the write
+	// returns, whatever the configured WALSyncMode, along with any writes
+	// buffered before it.
+	Sync bool
+}
+
+// PutWithOptions is like Put, committing the write as opts asks.
+func (e *Engine) PutWithOptions(key, value []byte, opts WriteOptions) error {
+	w := pendingWrites.Get().(*pendingWrite)
+	defer w.recycle()
+	w.one[0] = storage.Entry{Type: storage.PutEntry, Key: key, Value: value}
+	w.write = wal.Write{Entries: w.one[:], ForceSync: opts.Sync}
+	w.rotate = true
+	return e.commit(context.Background(), w)
+}
+
+// SetWithTTL inserts or updates a key-value pair that expires ttl from now.
+// Once expired the key reads as missing, and compaction later purges its
+// value. A ttl <= 0 writes a key that is already expired.
+func (e *Engine) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	expiresAt := e.now() + int64(ttl)
+	if ttl <= 0 {
+		// Keep the expiry non-zero so the key does not become permanent
+		expiresAt = e.now()
 	}
 
-	if err := e.memtable.Put(key, value); err != nil {
+	entry := storage.Entry{
+		Type:      storage.PutEntry,
+		Key:       key,
+		Value:     value,
+		ExpiresAt: expiresAt,
+	}
+	return e.commitEntry(context.Background(), entry, true)
+}
+
+// now returns the current time in Unix nanoseconds according to the
+// configured clock.
+func (e *Engine) now() int64 {
+	if e.config.Clock != nil {
+		return e.config.Clock().UnixNano()
+	}
+	return time.Now().UnixNano()
+}
+
+// nextSeqLocked returns the sequence number for a new write. Must be called
+// with the engine mutex held.
+func (e *Engine) nextSeqLocked() uint64 {
+	e.lastSeq++
+	return e.lastSeq
+}
+
+// KV is a key-value pair written by PutMany.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// PutMany inserts or updates several key-value pairs under a single lock
+// acquisition and a single WAL sync. Unlike a batch, the writes are not
+// atomic: a crash during the WAL write may persist only some of them.
+func (e *Engine) PutMany(pairs []KV) error {
+	entries := make([]storage.Entry, len(pairs))
+	for i, kv := range pairs {
+		entries[i] = storage.Entry{Type: storage.PutEntry, Key: kv.Key, Value: kv.Value}
+	}
+
+	return e.commitWrite(context.Background(), wal.Write{Entries: entries, Flush: true}, true)
+}
+
+// maybeRotateLocked seals the active memtable and schedules its flush once it
+// exceeds the configured size or entry count. Must be called with the engine mutex held.
+func (e *Engine) maybeRotateLocked() error {
+	if e.memtable.Size() <= e.maxMemtableSize && (e.config.MaxMemtableEntries <= 0 || e.memtable.Len() <= e.config.MaxMemtableEntries) {
+		return nil
+	}
+	return e.sealMemtableLocked()
+}
+
+// waitForFlushes blocks while more than MaxImmutableMemtables sealed
+// memtables are still being flushed, until one of them is done or ctx is.
+// Memtables whose flush failed are not counted, so a broken flush does not
+// stall writes for good.
+func (e *Engine) waitForFlushes(ctx context.Context) error {
+	limit := e.config.MaxImmutableMemtables
+	if limit <= 0 {
+		return nil
+	}
+	for {
+		e.mu.RLock()
+		var pending []chan struct{}
+		for _, immutable := range e.immutableMemtables {
+			if immutable.done == nil {
+				continue
+			}
+			select {
+			case <-immutable.done:
+			default:
+				pending = append(pending, immutable.done)
+			}
+		}
+		closing := e.closing
+		e.mu.RUnlock()
+		if closing || len(pending) <= limit {
+			return nil
+		}
+
+		select {
+		case <-pending[0]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sealMemtableLocked seals the active memtable and its WAL segment and
+// schedules the memtable's flush. Flushes run one after another in the order
+// the memtables were sealed, so T0 stays ordered oldest to newest. Must be
+// called with the engine mutex held.
+func (e *Engine) sealMemtableLocked() error {
+	segment, err := e.wal.Rotate()
+	if err != nil {
 		return err
 	}
 
-	if e.memtable.Size() > e.maxMemtableSize {
-		walPath := e.nextWalPath()
-		sealedPath, err := e.wal.Seal(walPath)
-		if err != nil {
-			return err
+	var prev chan struct{}
+	if n := len(e.immutableMemtables); n > 0 {
+		prev = e.immutableMemtables[n-1].done
+	}
+
+	immutable := immutableMemtable{
+		mt:         e.memtable,
+		walSegment: e.walSegment,
+		sstNum:     e.sstCounter.Add(1),
+		done:       make(chan struct{}),
+		err:        new(error),
+	}
+	e.immutableMemtables = append(e.immutableMemtables, immutable)
+	e.memtable = newMemtable(e.config, e.compare)
+	e.walSegment = segment
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer close(immutable.done)
+		if prev != nil {
+			<-prev
+		}
+		if e.deferFlushToClose() {
+			return
+		}
+		if e.beforeFlush != nil {
+			e.beforeFlush()
+		}
+		if err := e.flushMemtable(immutable); err != nil {
+			*immutable.err = err
+			log.Printf("flushMemtable error: %v", err)
 		}
+	}()
+
+	return nil
+}
 
-		immutable := immutableMemtable{
-			mt:      e.memtable,
-			walPath: sealedPath,
+// Flush seals the active memtable, if it holds anything, and waits until it
+// and every memtable sealed before it have been flushed to synced T0
+// SSTables. Writes may continue while it waits; they go to the new active
+// memtable and are not covered by the call. The first flush error is
+// returned.
+func (e *Engine) Flush() error {
+	e.mu.Lock()
+	if e.closing {
+		e.mu.Unlock()
+		return gerrors.Closed("engine is closed", nil)
+	}
+	if e.memtable.Size() > 0 {
+		if err := e.sealMemtableLocked(); err != nil {
+			e.mu.Unlock()
+			return err
 		}
-		e.immutableMemtables = append(e.immutableMemtables, immutable)
-		e.memtable = memtable.NewMemtable()
-		immutableToFlush := e.immutableMemtables[len(e.immutableMemtables)-1]
-		e.wg.Add(1)
-		go func() {
-			defer e.wg.Done()
-			if err := e.flushMemtable(immutableToFlush.mt, immutableToFlush.walPath); err != nil {
-				log.Printf("flushMemtable error: %v", err)
-			}
-		}()
 	}
+	pending := append([]immutableMemtable(nil), e.immutableMemtables...)
+	e.mu.Unlock()
 
+	for _, immutable := range pending {
+		if immutable.done == nil {
+			continue
+		}
+		<-immutable.done
+		if err := *immutable.err; err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// CompactAll compacts every tier into the next, starting from T0 and
+// ignoring MaxTablesPerTier, until the data is held in a single SSTable. It
+// blocks until the merges are done and the replaced SSTables are removed.
+func (e *Engine) CompactAll() error {
+	e.mu.Lock()
+	if e.closing {
+		e.mu.Unlock()
+		return gerrors.Closed("engine is closed", nil)
+	}
+	// Keep Close from closing the tables while they are merged
+	e.wg.Add(1)
+	e.mu.Unlock()
+	defer e.wg.Done()
+
+	return e.compactionMgr.compactAll()
+}
+
+// CompactTier merges tier into the next one, ignoring MaxTablesPerTier, and
+// blocks until the replaced SSTables are removed. Under leveled compaction
+// the level's tables are pushed down until it is empty, keeping the next
+// level's key ranges disjoint. It waits for a background compaction using
+// tier or the next one to finish first, so the same tables are never merged
+// twice at once.
+func (e *Engine) CompactTier(tier int) error {
+	e.mu.Lock()
+	if e.closing {
+		e.mu.Unlock()
+		return gerrors.Closed("engine is closed", nil)
+	}
+	if tier < 0 || tier >= len(e.tiers) {
+		n := len(e.tiers)
+		e.mu.Unlock()
+		return gerrors.InvalidArgument(fmt.Sprintf("tier %d out of range, the database has %d tiers", tier, n), nil)
+	}
+	// Keep Close from closing the tables while they are merged
+	e.wg.Add(1)
+	e.mu.Unlock()
+	defer e.wg.Done()
+
+	return e.compactionMgr.compactTierNow(tier)
+}
+
 // Get retrieves the value for a given key, searching memtable and all SSTable tiers.
+// A read error is reported as a missing key; use GetCtx to tell them apart.
 func (e *Engine) Get(key []byte) ([]byte, bool) {
-	e.mu.RLock()
+	value, found, _ := e.GetCtx(context.Background(), key)
+	return value, found
+}
+
+// GetCtx is like Get but gives up once ctx is done. The context is checked
+// while waiting for the read lock and before each SSTable read. Unlike Get,
+// unexpected read errors are returned instead of being reported as missing.
+func (e *Engine) GetCtx(ctx context.Context, key []byte) ([]byte, bool, error) {
+	if err := lockCtx(ctx, e.mu.RLock, e.mu.RUnlock, e.mu.TryRLock); err != nil {
+		return nil, false, err
+	}
 	defer e.mu.RUnlock()
+	if e.closed.Load() {
+		return nil, false, gerrors.Closed("engine is closed", nil)
+	}
 
-	// First check memtable
-	entry, found := e.memtable.Get(key)
-	if found {
-		if entry.Type == storage.DeleteEntry {
-			return nil, false
-		}
-		return entry.Value, true
+	e.counters.gets.Add(1)
+	if e.negCache.contains(key) {
+		return nil, false, nil
+	}
+
+	entry, found, err := e.lookupLocked(ctx, key)
+	if err != nil {
+		return nil, false, err
 	}
+	if !found || entry.Type == storage.DeleteEntry || entry.Expired(e.now()) {
+		e.negCache.add(key)
+		return nil, false, nil
+	}
+	return entry.Value, true, nil
+}
 
-	// Check immutable memtables, newest to oldest so newer writes win.
+// lookupLocked returns the newest entry for key, which may be a tombstone.
+// Sources are searched newest to oldest: the active memtable, immutable
+// memtables from last sealed to first, then T0, T1 and so on, newest table
+// first within each tier. Compaction only moves data to a higher tier, so a
+// lower tier always holds newer data than a higher one. The search stops at
+// the first source that holds the key at all, so a tombstone shadows every
+// older value. An entry deleted by a newer range tombstone is returned as a
+// tombstone, and a merge entry as the put it resolves to. Must be called
+// with the engine mutex held.
+func (e *Engine) lookupLocked(ctx context.Context, key []byte) (storage.Entry, bool, error) {
+	entry, found, err := e.newestLocked(ctx, key)
+	if err != nil || !found {
+		return entry, found, err
+	}
+	if e.rangeDeletedLocked(key, entry.Seq) {
+		return storage.Entry{Type: storage.DeleteEntry, Key: key, Seq: entry.Seq}, true, nil
+	}
+	if entry.Type == storage.MergeEntry && e.config.MergeFunc != nil {
+		entry, err = e.resolveMergeLocked(ctx, entry)
+	}
+	return entry, true, err
+}
+
+// newestLocked returns the newest entry for key, ignoring range tombstones.
+// Must be called with the engine mutex held.
+func (e *Engine) newestLocked(ctx context.Context, key []byte) (storage.Entry, bool, error) {
+	var newest storage.Entry
+	var found bool
+	err := e.versionsLocked(ctx, key, func(entry storage.Entry) bool {
+		newest, found = entry, true
+		return false
+	})
+	if err != nil {
+		return storage.Entry{}, false, err
+	}
+	return newest, found, nil
+}
+
+// versionsLocked calls visit with each version of key, newest first, until
+// it returns false: the one in the active memtable, those in the immutable
+// memtables from last sealed to first, then those in T0, T1 and so on,
+// newest table first within each tier. Range tombstones are ignored. When
+// MaxVersionsPerKey keeps more than one version, every version a source
+// holds is visited; otherwise only its newest. Must be called with the
+// engine mutex held.
+func (e *Engine) versionsLocked(ctx context.Context, key []byte, visit func(entry storage.Entry) bool) error {
+	if e.config.MaxVersionsPerKey > 1 {
+		return e.allVersionsLocked(ctx, key, visit)
+	}
+	if entry, found := e.memtable.Get(key); found && !visit(entry) {
+		return nil
+	}
 	for i := len(e.immutableMemtables) - 1; i >= 0; i-- {
-		mt := e.immutableMemtables[i].mt
-		entry, found := mt.Get(key)
-		if found {
-			if entry.Type == storage.DeleteEntry {
-				return nil, false
+		if entry, found := e.immutableMemtables[i].mt.Get(key); found && !visit(entry) {
+			return nil
+		}
+	}
+
+	keys := [][]byte{key}
+	for _, tier := range e.tiers {
+		for i := len(tier) - 1; i >= 0; i-- {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			entries, found, err := tier[i].GetMultiE(keys)
+			if err != nil {
+				return err
+			}
+			if found[0] && !visit(entries[0]) {
+				return nil
 			}
-			return entry.Value, true
 		}
 	}
+	return nil
+}
 
-	// Not found in memtable, search in disk
-	// Search all tiers, newest to oldest
+// allVersionsLocked is versionsLocked for sources that may hold several
+// versions of key. Must be called with the engine mutex held.
+func (e *Engine) allVersionsLocked(ctx context.Context, key []byte, visit func(entry storage.Entry) bool) error {
+	visitAll := func(entries []storage.Entry) bool {
+		for _, entry := range entries {
+			if !visit(entry) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !visitAll(e.memtable.Versions(key)) {
+		return nil
+	}
+	for i := len(e.immutableMemtables) - 1; i >= 0; i-- {
+		if !visitAll(e.immutableMemtables[i].mt.Versions(key)) {
+			return nil
+		}
+	}
 	for _, tier := range e.tiers {
 		for i := len(tier) - 1; i >= 0; i-- {
-			reader := tier[i]
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			entries, err := tier[i].GetVersions(key)
+			if err != nil {
+				return err
+			}
+			if !visitAll(entries) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// memtableLookupLocked returns the newest entry for key held in memory,
+// searching the active memtable and then the immutable memtables from last
+// sealed to first. Must be called with the engine mutex held.
+func (e *Engine) memtableLookupLocked(key []byte) (storage.Entry, bool) {
+	if entry, found := e.memtable.Get(key); found {
+		return entry, true
+	}
+	for i := len(e.immutableMemtables) - 1; i >= 0; i-- {
+		if entry, found := e.immutableMemtables[i].mt.Get(key); found {
+			return entry, true
+		}
+	}
+	return storage.Entry{}, false
+}
+
+// GetMany looks up several keys under a single read lock. values[i] and
+// found[i] hold the result for keys[i]. Keys not found in memory are looked
+// up in each SSTable together, newest table first, so that every data block
+// is read at most once per table.
+func (e *Engine) GetMany(keys [][]byte) ([][]byte, []bool, error) {
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed.Load() {
+		return nil, nil, gerrors.Closed("engine is closed", nil)
+	}
+
+	e.counters.gets.Add(uint64(len(keys)))
+	now := e.now()
+	resolve := func(i int, entry storage.Entry) error {
+		if entry.Type == storage.DeleteEntry || entry.Expired(now) || e.rangeDeletedLocked(keys[i], entry.Seq) {
+			e.negCache.add(keys[i])
+			return nil
+		}
+		if entry.Type == storage.MergeEntry && e.config.MergeFunc != nil {
+			var err error
+			if entry, err = e.resolveMergeLocked(context.Background(), entry); err != nil {
+				return err
+			}
+		}
+		values[i], found[i] = entry.Value, true
+		return nil
+	}
+
+	var pending []int
+	for i, key := range keys {
+		if e.negCache.contains(key) {
+			continue
+		}
+		if entry, ok := e.memtableLookupLocked(key); ok {
+			if err := resolve(i, entry); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	lookup := make([][]byte, 0, len(pending))
+	for _, tier := range e.tiers {
+		for t := len(tier) - 1; t >= 0 && len(pending) > 0; t-- {
+			lookup = lookup[:0]
+			for _, i := range pending {
+				lookup = append(lookup, keys[i])
+			}
+			entries, hits, err := tier[t].GetMultiE(lookup)
+			if err != nil {
+				return nil, nil, err
+			}
 
-			entry, err := reader.Get(key)
-			if err == nil {
-				if entry.Type == storage.DeleteEntry {
-					return nil, false
+			// Keys the table holds, even as tombstones, are settled
+			rest := pending[:0]
+			for j, i := range pending {
+				if !hits[j] {
+					rest = append(rest, i)
+				} else if err := resolve(i, entries[j]); err != nil {
+					return nil, nil, err
 				}
-				return entry.Value, true
 			}
-			if !errors.Is(err, gerrors.ErrNotFound) {
-				return nil, false // unexpected error
+			pending = rest
+		}
+	}
+	for _, i := range pending {
+		e.negCache.add(keys[i])
+	}
+
+	return values, found, nil
+}
+
+// Has reports whether key holds a live value, like Get without returning
+// the value. It reads and checksums the same SSTable blocks as Get, but
+// skips fetching values kept in blob files, so checking a key whose value
+// was large enough to be stored there is much cheaper than Get. Read errors
+// are reported as missing, as with Get.
+func (e *Engine) Has(key []byte) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed.Load() || e.negCache.contains(key) {
+		return false
+	}
+
+	entry, found := e.memtableLookupLocked(key)
+	for _, tier := range e.tiers {
+		for i := len(tier) - 1; i >= 0 && !found; i-- {
+			var err error
+			entry, found, err = tier[i].Probe(key)
+			if err != nil {
+				return false
 			}
 		}
 	}
 
-	return nil, false
+	if !found || entry.Type == storage.DeleteEntry || entry.Expired(e.now()) || e.rangeDeletedLocked(key, entry.Seq) {
+		e.negCache.add(key)
+		return false
+	}
+	return true
+}
+
+// lockCtx acquires a lock, giving up once ctx is done. A contended lock is
+// taken by a goroutine that hands it over, or releases it again if the
+// caller has given up by the time it is acquired. Contexts that can never
+// be done take the blocking lock directly.
+func lockCtx(ctx context.Context, lock, unlock func(), tryLock func() bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	if tryLock() {
+		return nil
+	}
+
+	handoff := make(chan struct{})
+	go func() {
+		lock()
+		select {
+		case handoff <- struct{}{}:
+		case <-ctx.Done():
+			unlock()
+		}
+	}()
+	select {
+	case <-handoff:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Delete removes a key from the database.
 func (e *Engine) Delete(key []byte) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	entry := storage.Entry{Type: storage.DeleteEntry, Key: key}
+	return e.commitEntry(context.Background(), entry, false)
+}
 
-	if err := e.wal.AppendDelete(key); err != nil {
-		return err
+// deferFlushToClose reports whether a scheduled flush should be left for
+// Close to merge with the other pending memtables.
+func (e *Engine) deferFlushToClose() bool {
+	if !e.config.MergeFlushOnClose {
+		return false
 	}
-	return e.memtable.Delete(key)
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.closing
 }
 
-// flushMemtable writes the contents of a memtable to a new SSTable on disk.
-func (e *Engine) flushMemtable(mt memtable.Memtable, walPath string) error {
-	iter := mt.NewIterator()
+// flushMemtable writes the contents of an immutable memtable to a new SSTable on disk.
+func (e *Engine) flushMemtable(immutable immutableMemtable) error {
+	return e.flushMerged([]immutableMemtable{immutable}, immutable.sstNum)
+}
+
+// flushMerged writes the immutable memtables, given oldest first, to a
+// single T0 SSTable numbered sstNum, keeping the newest version of every
+// key, or up to MaxVersionsPerKey versions. It then drops the memtables and
+// the WAL segments no longer needed.
+func (e *Engine) flushMerged(immutables []immutableMemtable, sstNum uint64) (err error) {
+	var flushed *sstable.Reader
+	done := e.flushEvent(e.tablePath(tableRef{tier: 0, num: sstNum}), len(immutables))
+	defer func() { done(flushed, err) }()
+
+	// Several versions of a key are kept only if MaxVersionsPerKey asks
+	maxVersions := max(e.config.MaxVersionsPerKey, 1)
+	sources := make([]sstable.Source, len(immutables))
+	for i, immutable := range immutables {
+		if maxVersions > 1 {
+			sources[i] = immutable.mt.NewVersionsIterator()
+		} else {
+			sources[i] = immutable.mt.NewIterator()
+		}
+	}
+	iter := sstable.NewMergingIteratorWithComparator(sources, e.compare)
+	iter.SetAllVersions(maxVersions > 1)
+	var rangeDels []storage.Entry
+	for _, immutable := range immutables {
+		rangeDels = append(rangeDels, immutable.mt.RangeTombstones()...)
+	}
+	// Older versions of merged keys may be in SSTables
+	merge := e.mergeOptions(rangeDels, e.now())
+	merge.Complete = false
+	iter.SetMerge(merge)
 
-	filename, writer, err := e.newFlushWriter()
+	filename, writer, err := e.newFlushWriter(sstNum)
 	if err != nil {
 		return err
 	}
 
+	var lastKey []byte
+	kept := 0
 	for iter.Next() {
-		if iter.Type() == storage.DeleteEntry {
-			if err := writer.DeleteEntry(iter.Key()); err != nil {
-				return err
+		if lastKey != nil && e.compare(iter.Key(), lastKey) == 0 {
+			if kept++; kept >= maxVersions {
+				continue
 			}
 		} else {
-			if err := writer.PutEntry(iter.Key(), iter.Value()); err != nil {
-				return err
-			}
+			lastKey, kept = append(lastKey[:0], iter.Key()...), 0
+		}
+		entry := storage.Entry{
+			Type:      iter.Type(),
+			Key:       iter.Key(),
+			Value:     iter.Value(),
+			ExpiresAt: iter.ExpiresAt(),
+			Seq:       iter.Seq(),
+		}
+		if err := writer.Add(entry); err != nil {
+			_ = writer.Abort()
+			return err
+		}
+	}
+	for _, rangeDel := range rangeDels {
+		if err := writer.AddRangeTombstone(rangeDel); err != nil {
+			_ = writer.Abort()
+			return err
 		}
 	}
 
@@ -291,27 +1194,34 @@ func (e *Engine) flushMemtable(mt memtable.Memtable, walPath string) error {
 		return gerrors.IO("failed to finish SSTable", err)
 	}
 
-	reader, err := sstable.NewReader(filename)
+	reader, err := sstable.NewReaderWithOptions(filename, e.sstOptions())
 	if err != nil {
 		return gerrors.IO("failed to open SSTable for reading", err)
 	}
 
-	shouldCompact := e.registerFlushedMemtable(mt, reader)
+	shouldCompact, err := e.registerFlushed(reader, immutables)
+	if err != nil {
+		_ = reader.Close()
+		_ = e.fs.Remove(filename)
+		return err
+	}
+	flushed = reader
+	e.counters.bytesFlushed.Add(uint64(reader.Size()))
 	e.maybeCompactT0(shouldCompact)
-	e.removeWalSegment(walPath)
+	e.removeFlushedWal()
 
 	return nil
 }
 
-func (e *Engine) newFlushWriter() (string, *sstable.Writer, error) {
-	l0Dir := filepath.Join(e.dataDir, "sstables", "T0")
-	if err := os.MkdirAll(l0Dir, 0755); err != nil {
+func (e *Engine) newFlushWriter(sstNum uint64) (string, *sstable.Writer, error) {
+	l0Dir := e.tierDir(0)
+	if err := e.fs.MkdirAll(l0Dir, 0755); err != nil {
 		return "", nil, gerrors.IO("failed to create T0 directory", err)
 	}
 
-	filename := filepath.Join(l0Dir, fmt.Sprintf("%06d.sst", e.sstCounter.Add(1)))
+	filename := filepath.Join(l0Dir, fmt.Sprintf("%06d.sst", sstNum))
 
-	writer, err := sstable.NewWriter(filename, e.config.IndexInterval)
+	writer, err := sstable.NewWriterWithOptions(filename, e.sstOptions())
 	if err != nil {
 		return "", nil, err
 	}
@@ -319,7 +1229,28 @@ func (e *Engine) newFlushWriter() (string, *sstable.Writer, error) {
 	return filename, writer, nil
 }
 
-func (e *Engine) registerFlushedMemtable(mt memtable.Memtable, reader *sstable.Reader) bool {
+// sstOptions returns the options used for every SSTable the engine opens.
+// Key and value sizes are not among them: they are checked when writes are
+// logged, so that tables written under higher limits can still be
+// compacted.
+func (e *Engine) sstOptions() sstable.Options {
+	return sstable.Options{
+		IndexInterval:    e.config.IndexInterval,
+		BlockSize:        max(e.config.BlockSize, 0),
+		IORetry:          e.config.IORetry,
+		PrefixExtractor:  e.config.PrefixExtractor,
+		StrictInvariants: e.config.StrictInvariants,
+		BloomBitsPerKey:  max(e.config.BloomBitsPerKey, 0),
+		Compression:      e.config.Compression,
+		BlockCache:       e.blockCache,
+		Comparator:       e.compare,
+		Blobs:            e.blobs,
+		ValueThreshold:   max(e.config.ValueThreshold, 0),
+		FS:               e.fs,
+	}
+}
+
+func (e *Engine) registerFlushed(reader *sstable.Reader, immutables []immutableMemtable) (bool, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -327,13 +1258,23 @@ func (e *Engine) registerFlushedMemtable(mt memtable.Memtable, reader *sstable.R
 		e.tiers = append(e.tiers, []*sstable.Reader{})
 	}
 
+	if err := e.checkAppendLocked(0, reader); err != nil {
+		return false, err
+	}
+	num, _ := sstNumber(reader.Path())
+	if err := e.logEdit(manifestEdit{added: []tableRef{{tier: 0, num: num}}}); err != nil {
+		return false, err
+	}
 	e.tiers[0] = append(e.tiers[0], reader)
-	e.removeImmutableMemtableLocked(mt)
+	for _, immutable := range immutables {
+		e.removeImmutableMemtableLocked(immutable.mt)
+	}
+	e.negCache.clear()
 
 	if e.compactionMgr == nil {
-		return false
+		return false, nil
 	}
-	return e.compactionMgr.shouldCompactTier(0)
+	return e.compactionMgr.shouldCompactTier(0), nil
 }
 
 func (e *Engine) removeImmutableMemtableLocked(mt memtable.Memtable) {
@@ -345,92 +1286,139 @@ func (e *Engine) removeImmutableMemtableLocked(mt memtable.Memtable) {
 	}
 }
 
+// maybeCompactT0 queues a compaction of T0 if a flush left it over its
+// limit.
 func (e *Engine) maybeCompactT0(shouldCompact bool) {
-	if !shouldCompact {
-		return
+	if shouldCompact {
+		e.compactionMgr.enqueue(0)
 	}
-
-	e.wg.Add(1)
-	go func() {
-		defer e.wg.Done()
-		if err := e.compactionMgr.compactTiers(0); err != nil {
-			log.Printf("compaction error: %v", err)
-		}
-	}()
 }
 
-func (e *Engine) removeWalSegment(walPath string) {
-	if walPath == "" {
-		return
+// removeFlushedWal deletes the WAL segments older than the first segment
+// of any memtable not yet flushed, i.e. those whose data is all in
+// SSTables. A memtable whose flush failed keeps its segments until it is
+// flushed.
+func (e *Engine) removeFlushedWal() {
+	e.mu.RLock()
+	cutoff := e.walSegment
+	if len(e.immutableMemtables) > 0 {
+		cutoff = e.immutableMemtables[0].walSegment
 	}
+	e.mu.RUnlock()
 
-	if err := os.Remove(walPath); err != nil && !os.IsNotExist(err) {
-		log.Printf("failed to remove WAL file %s: %v", walPath, err)
+	if err := e.wal.RemoveBefore(cutoff); err != nil {
+		log.Printf("failed to remove WAL segments: %v", err)
 	}
 }
 
 // Close gracefully shuts down the engine, ensuring all data is persisted.
 // This method:
-//   - Flushes any remaining memtable data to disk
+//   - Flushes any remaining memtable data to disk, as a single SSTable when
+//     MergeFlushOnClose is set
 //   - Closes the WAL file
 //   - Waits for any ongoing compaction operations to complete
 //
-// After calling Close, the engine should not be used for any operations.
+// Operations started after Close fail with an error matching
+// errors.ErrClosed, or report keys as missing where they return no error.
+// Iterators created before Close keep reading their snapshot until closed.
 // Returns an error if any cleanup operation fails.
 func (e *Engine) Close() error {
 	var finalErr error
 
 	e.once.Do(func() {
-		// Flush any remaining memtable data
-		if e.memtable != nil && e.memtable.Size() > 0 {
-			old := e.memtable
-			walPath := ""
-			if e.wal != nil {
-				path := e.nextWalPath()
-				segment, err := e.wal.Seal(path)
-				if err != nil {
-					finalErr = gerrors.IO("failed to seal WAL before final flush", err)
-				} else {
-					walPath = segment
-				}
-			}
-			e.memtable = memtable.NewMemtable()
-			if err := e.flushMemtable(old, walPath); err != nil {
-				finalErr = gerrors.IO("failed to flush final memtable", err)
+		e.closed.Store(true)
+
+		// Seal any remaining memtable data behind the pending flushes
+		e.mu.Lock()
+		e.closing = true
+		if e.wal != nil && e.memtable.Size() > 0 {
+			if err := e.sealMemtableLocked(); err != nil {
+				finalErr = gerrors.IO("failed to seal WAL before final flush", err)
 			}
 		}
+		e.mu.Unlock()
+		e.wg.Wait()
 
+		// Flush what is still pending: memtables deferred to a merged
+		// flush, or whose background flush failed
+		e.mu.RLock()
 		pending := append([]immutableMemtable(nil), e.immutableMemtables...)
-		for _, immutable := range pending {
-			if err := e.flushMemtable(immutable.mt, immutable.walPath); err != nil {
-				finalErr = gerrors.IO("failed to flush immutable memtable", err)
+		e.mu.RUnlock()
+		if e.config.MergeFlushOnClose && len(pending) > 0 {
+			if err := e.flushMerged(pending, e.sstCounter.Add(1)); err != nil {
+				finalErr = gerrors.IO("failed to flush merged memtables", err)
 			}
+		} else {
+			for _, immutable := range pending {
+				if err := e.flushMemtable(immutable); err != nil {
+					finalErr = gerrors.IO("failed to flush immutable memtable", err)
+				}
+			}
+		}
+
+		// Wait for all background flush/compaction operations to finish
+		// before closing the readers they may still be using
+		e.wg.Wait()
+		if e.compactionMgr != nil {
+			e.compactionMgr.stopWorkers()
 		}
 
+		// Readers that got the lock before closed was set finish first
+		e.mu.Lock()
 		for _, tier := range e.tiers {
 			for _, reader := range tier {
 				_ = reader.Close()
 			}
 		}
+		e.mu.Unlock()
 
 		if e.wal != nil {
 			if err := e.wal.Close(); err != nil {
 				finalErr = gerrors.IO("failed to close WAL", err)
 			}
 		}
-
-		// Wait for all background flush/compaction operations to finish
-		e.wg.Wait()
+		if err := e.manifest.close(); err != nil {
+			finalErr = gerrors.IO("failed to close manifest", err)
+		}
+		if e.blobs != nil {
+			if err := e.blobs.Close(); err != nil {
+				finalErr = err
+			}
+		}
 	})
 
 	return finalErr
 }
 
+// checkMemtableLocked reports a negative memtable size in strict mode.
+// Must be called with the engine mutex held.
+func (e *Engine) checkMemtableLocked() error {
+	if !e.config.StrictInvariants {
+		return nil
+	}
+	if size := e.memtable.Size(); size < 0 {
+		return gerrors.Invariant(fmt.Sprintf("memtable size is negative (%d)", size), nil)
+	}
+	return nil
+}
+
+// checkAppendLocked reports, in strict mode, if appending reader to tier
+// would break the tier's oldest-to-newest order. Must be called with the
+// engine mutex held.
+func (e *Engine) checkAppendLocked(tier int, reader *sstable.Reader) error {
+	if !e.config.StrictInvariants || len(e.tiers[tier]) == 0 {
+		return nil
+	}
+	last := e.tiers[tier][len(e.tiers[tier])-1]
+	lastNum, ok1 := sstNumber(last.Path())
+	num, ok2 := sstNumber(reader.Path())
+	if ok1 && ok2 && num <= lastNum {
+		return gerrors.Invariant(fmt.Sprintf("SSTable %s is not newer than %s in T%d", reader.Path(), last.Path(), tier), nil)
+	}
+	return nil
+}
+
 // WaitForFlush waits for all flushed to be done (for tests)
 func (e *Engine) WaitForFlush() {
 	e.wg.Wait()
 }
-
-func (e *Engine) nextWalPath() string {
-	return filepath.Join(e.dataDir, fmt.Sprintf("wal-%06d.log", e.walCounter.Add(1)))
-}
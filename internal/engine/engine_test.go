@@ -2,14 +2,27 @@ package engine_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/MikhailWahib/graveldb/internal/config"
 	"github.com/MikhailWahib/graveldb/internal/engine"
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/memtable"
 	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -89,10 +102,11 @@ func TestEngine_OpenDB_ParseLevels(t *testing.T) {
 	err := os.MkdirAll(levelDir, 0755)
 	require.NoError(t, err)
 
-	// Create dummy SST file
-	fakeSST := filepath.Join(levelDir, "00000001.sst")
-	err = os.WriteFile(fakeSST, []byte("placeholder"), 0644)
+	// Create an SST file
+	w, err := sstable.NewWriter(filepath.Join(levelDir, "00000001.sst"), 16)
 	require.NoError(t, err)
+	require.NoError(t, w.PutEntry([]byte("k"), []byte("v")))
+	require.NoError(t, w.Close())
 
 	e := engine.NewEngine(nil)
 	err = e.OpenDB(tmpDir)
@@ -103,6 +117,35 @@ func TestEngine_OpenDB_ParseLevels(t *testing.T) {
 	require.True(t, len(e.Tiers()[0]) == 1)
 }
 
+func TestEngine_OpenDB_RejectsUnreadableTableWithoutManifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTierSST(t, tmpDir, 0, 1, map[string]string{"k": "v"})
+	placeholder := filepath.Join(tmpDir, "sstables", "T0", "000002.sst")
+	require.NoError(t, os.WriteFile(placeholder, []byte("placeholder"), 0644))
+
+	// Without a manifest there is no telling what the file held, so the
+	// open fails and leaves it, and no manifest is written without it
+	e := engine.NewEngine(nil)
+	assert.ErrorIs(t, e.OpenDB(tmpDir), gerrors.ErrCorrupt)
+	assert.FileExists(t, placeholder)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "MANIFEST"))
+
+	// Repair sets it aside, and the valid table opens
+	report, err := engine.Repair(tmpDir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.TablesQuarantined)
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	require.Len(t, e.Tiers()[0], 1)
+	value, found := e.Get([]byte("k"))
+	assert.True(t, found)
+	assert.Equal(t, "v", string(value))
+	data, err := os.ReadFile(filepath.Join(tmpDir, "quarantine", "T0-000002.sst"))
+	require.NoError(t, err)
+	assert.Equal(t, "placeholder", string(data))
+}
+
 func TestMemtableFlush(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -130,6 +173,87 @@ func TestMemtableFlush(t *testing.T) {
 	require.True(t, bytes.Equal([]byte("value1"), entry.Value))
 }
 
+func TestMemtableFlushByEntryCount(t *testing.T) {
+	for _, maxEntries := range []int{0, 100} {
+		t.Run(strconv.Itoa(maxEntries), func(t *testing.T) {
+			cfg := &config.Config{MaxMemtableSize: 1 << 20, MaxMemtableEntries: maxEntries, MaxTablesPerTier: 100}
+			e := engine.NewEngine(cfg)
+			require.NoError(t, e.OpenDB(t.TempDir()))
+			defer func() { require.NoError(t, e.Close()) }()
+
+			// A thousand tiny keys stay far below the byte threshold
+			for i := range 1000 {
+				require.NoError(t, e.Put(fmt.Appendf(nil, "k%03d", i), []byte("v")))
+			}
+			e.WaitForFlush()
+			assert.Less(t, e.MemtableSize(), cfg.MaxMemtableSize)
+
+			infos := e.SSTableInfo()
+			if maxEntries == 0 {
+				assert.Empty(t, infos)
+				return
+			}
+			// Each memtable is sealed as soon as it holds one entry too many
+			require.Len(t, infos, 1000/(maxEntries+1))
+			for _, info := range infos {
+				assert.Equal(t, uint64(maxEntries+1), info.Entries)
+			}
+			got, found := e.Get([]byte("k000"))
+			assert.True(t, found)
+			assert.Equal(t, "v", string(got))
+		})
+	}
+}
+
+func TestEngine_MaxImmutableMemtablesBlocksWrites(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxMemtableSize: 1, MaxImmutableMemtables: 2, MaxTablesPerTier: 100})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Flushes wait until released, so every sealed memtable stays queued
+	release := make(chan struct{})
+	e.SetBeforeFlush(func() { <-release })
+	released := false
+	defer func() {
+		if !released {
+			close(release)
+		}
+	}()
+
+	// Every put fills the memtable, so each one seals another
+	for i := range 3 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%d", i), []byte("v")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, e.PutCtx(ctx, []byte("key-x"), []byte("v")), context.DeadlineExceeded)
+
+	done := make(chan error, 1)
+	go func() { done <- e.Put([]byte("key-3"), []byte("v")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Put returned %v with three memtables waiting to be flushed", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Draining the queue lets the blocked write through
+	close(release)
+	released = true
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put still blocked after the flushes were released")
+	}
+	for i := range 4 {
+		_, found := e.Get(fmt.Appendf(nil, "key-%d", i))
+		assert.True(t, found, i)
+	}
+	_, found := e.Get([]byte("key-x"))
+	assert.False(t, found)
+}
+
 func TestEngine_GetFromSSTable(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -184,20 +308,15 @@ func TestEngine_GetDeletedFromSSTable(t *testing.T) {
 func TestEngine_SSTCounterRestoration(t *testing.T) {
 	tmpDir := t.TempDir()
 
-	// Create existing SSTable files
+	// Create existing SSTables with different numbers
 	t0Dir := filepath.Join(tmpDir, "sstables", "T0")
-	err := os.MkdirAll(t0Dir, 0755)
-	require.NoError(t, err)
-
-	// Create files with different numbers
-	for _, num := range []string{"000003.sst", "000001.sst", "000005.sst"} {
-		err := os.WriteFile(filepath.Join(t0Dir, num), []byte("test"), 0644)
-		require.NoError(t, err)
+	for _, num := range []int{3, 1, 5} {
+		writeTierSST(t, tmpDir, 0, num, map[string]string{"k": "v"})
 	}
 
 	// Force flush to see next counter value
 	e := engine.NewEngine(&config.Config{MaxMemtableSize: 1})
-	err = e.OpenDB(tmpDir)
+	err := e.OpenDB(tmpDir)
 	require.NoError(t, err)
 
 	err = e.Put([]byte("test_key"), []byte("test_value"))
@@ -212,6 +331,69 @@ func TestEngine_SSTCounterRestoration(t *testing.T) {
 	require.NoError(t, err, "Expected new SSTable to have counter 000006")
 }
 
+func TestEngine_SSTCounterPersistedInManifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{MaxTablesPerTier: 10, IgnoreMissingTables: true}
+
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for i := range 3 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%d", i), []byte("v")))
+		require.NoError(t, e.Flush())
+	}
+	infos := e.SSTableInfo()
+	require.Len(t, infos, 3)
+	highest := infos[2].Path
+	require.NoError(t, e.Close())
+
+	// Lose the highest-numbered table and open twice, so the manifest is
+	// rewritten without it before the next flush
+	require.NoError(t, os.Remove(highest))
+	for range 2 {
+		e = engine.NewEngine(cfg)
+		require.NoError(t, e.OpenDB(tmpDir))
+		require.NoError(t, e.Close())
+	}
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	require.NoError(t, e.Put([]byte("new"), []byte("v")))
+	require.NoError(t, e.Flush())
+
+	infos = e.SSTableInfo()
+	require.Len(t, infos, 3)
+	assert.NotEqual(t, highest, infos[2].Path)
+	assert.Greater(t, filepath.Base(infos[2].Path), filepath.Base(highest))
+}
+
+func TestEngine_SeqRestoredOnOpen(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	require.NoError(t, e.Put([]byte("k"), []byte("v1")))
+	require.NoError(t, e.Put([]byte("k"), []byte("v2")))
+	require.NoError(t, e.Close())
+
+	// The only record of the last sequence number is the flushed table
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	require.NoError(t, e.Put([]byte("k"), []byte("v3")))
+	require.NoError(t, e.Flush())
+
+	tables := e.Tiers()[0]
+	require.Len(t, tables, 2)
+	assert.Equal(t, uint64(2), tables[0].MaxSeq())
+	assert.Equal(t, uint64(3), tables[1].MaxSeq())
+
+	require.NoError(t, e.CompactAll())
+	value, found := e.Get([]byte("k"))
+	assert.True(t, found)
+	assert.Equal(t, "v3", string(value))
+}
+
 func TestEngine_NonExistentKey(t *testing.T) {
 	tmpDir := t.TempDir()
 	e := engine.NewEngine(nil)
@@ -263,6 +445,29 @@ func Test_ReadLatestFromMultipleSSTsInOneTier(t *testing.T) {
 	require.Equal(t, "new", string(val))
 }
 
+func TestEngine_FlushesInSealOrder(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxMemtableSize: 1, MaxTablesPerTier: 100})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Every put seals the memtable, so the flushes are all in flight at once
+	for i := range 10 {
+		require.NoError(t, e.Put([]byte("k"), fmt.Appendf(nil, "v%d", i)))
+	}
+	e.WaitForFlush()
+
+	tables := e.Tiers()[0]
+	require.Len(t, tables, 10)
+	for i, reader := range tables {
+		entry, err := reader.Get([]byte("k"))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("v%d", i), string(entry.Value))
+	}
+	val, found := e.Get([]byte("k"))
+	require.True(t, found)
+	assert.Equal(t, "v9", string(val))
+}
+
 func TestCompaction_TriggersWhenThresholdExceeded(t *testing.T) {
 	tmpDir := t.TempDir()
 	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 2, MaxMemtableSize: 1})
@@ -428,6 +633,95 @@ func TestCompaction_PromotesToHigherTiers(t *testing.T) {
 	}
 }
 
+func TestCompaction_KeepsTablesFlushedDuringMerge(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 1000})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Each round merges T0 while another table is flushed into it; the
+	// flushed table must survive whether it lands before or during the merge
+	for i := range 20 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "a%02d", i), []byte("v")))
+		e.SealMemtable()
+		require.NoError(t, e.FlushSealed())
+
+		require.NoError(t, e.Put(fmt.Appendf(nil, "b%02d", i), []byte("v")))
+		e.SealMemtable()
+		done := make(chan error)
+		go func() { done <- e.CompactTierSync(0) }()
+		require.NoError(t, e.FlushSealed())
+		require.NoError(t, <-done)
+	}
+
+	for i := range 20 {
+		for _, prefix := range []string{"a", "b"} {
+			_, found := e.Get(fmt.Appendf(nil, "%s%02d", prefix, i))
+			assert.True(t, found, "%s%02d", prefix, i)
+		}
+	}
+}
+
+func TestCompaction_RespectsMaxConcurrentCompactions(t *testing.T) {
+	for _, limit := range []int{1, 2} {
+		tmpDir := t.TempDir()
+		e := engine.NewEngine(&config.Config{
+			MaxMemtableSize:          256,
+			MaxTablesPerTier:         1,
+			MaxConcurrentCompactions: limit,
+			// Slow compactions down so that they pile up behind the writes
+			CompactionRateLimit: 1 << 20,
+		})
+		require.NoError(t, e.OpenDB(tmpDir))
+
+		var wg sync.WaitGroup
+		for w := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 100 {
+					assert.NoError(t, e.Put(fmt.Appendf(nil, "w%d-%03d", w, i), bytes.Repeat([]byte("v"), 48)))
+				}
+			}()
+		}
+		wg.Wait()
+		e.WaitForFlush()
+
+		peak := e.CompactionPeak()
+		assert.GreaterOrEqual(t, peak, 1, "limit %d", limit)
+		assert.LessOrEqual(t, peak, limit, "limit %d", limit)
+		for w := range 4 {
+			for i := range 100 {
+				_, found := e.Get(fmt.Appendf(nil, "w%d-%03d", w, i))
+				require.True(t, found, "w%d-%03d", w, i)
+			}
+		}
+		require.NoError(t, e.Close())
+	}
+}
+
+func TestCompaction_RateLimit(t *testing.T) {
+	tmpDir := t.TempDir()
+	value := bytes.Repeat([]byte("v"), 1000)
+	for num := range 2 {
+		kvs := make(map[string]string)
+		for i := range 10 {
+			kvs[fmt.Sprintf("t%d-%02d", num, i)] = string(value)
+		}
+		writeTierSST(t, tmpDir, 0, num+1, kvs)
+	}
+
+	// About 20KB to rewrite at 40KB/s
+	e := engine.NewEngine(&config.Config{CompactionRateLimit: 40 << 10})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	start := time.Now()
+	require.NoError(t, e.CompactAll())
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	_, found := e.Get([]byte("t1-09"))
+	assert.True(t, found)
+}
+
 func TestEngine_WALReplay_MixedTombstones(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -512,3 +806,3610 @@ func TestEngine_Close_FlushesMemtableEvenIfBelowThreshold(t *testing.T) {
 	assert.True(t, found, "Should find key after Close and reopen, even if memtable was not full")
 	assert.True(t, bytes.Equal(val, got), "Value should match after Close and reopen")
 }
+
+func TestEngine_Close_FlushesPendingMemtablesOnce(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(&config.Config{MaxMemtableSize: 64, MaxTablesPerTier: 1000})
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	// Close while flushes of sealed memtables are still running
+	for i := range 100 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key%03d", i), fmt.Appendf(nil, "val%d", i)))
+	}
+	require.NoError(t, e.Close())
+
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	for i := range 100 {
+		val, found := e.Get(fmt.Appendf(nil, "key%03d", i))
+		require.True(t, found, "key%03d", i)
+		assert.Equal(t, fmt.Sprintf("val%d", i), string(val))
+	}
+}
+
+func TestEngine_GetPutCtx(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, e.PutCtx(ctx, []byte("k"), []byte("v")))
+	val, found, err := e.GetCtx(ctx, []byte("k"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("v"), val)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err = e.GetCtx(canceled, []byte("k"))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	err = e.PutCtx(canceled, []byte("k"), []byte("v2"))
+	assert.ErrorIs(t, err, context.Canceled)
+	val, _ = e.Get([]byte("k"))
+	assert.Equal(t, []byte("v"), val)
+}
+
+func TestEngine_CtxGivesUpWaitingForLock(t *testing.T) {
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+	require.NoError(t, e.Put([]byte("k"), []byte("v")))
+
+	unlock := e.LockForTest()
+	for range 10 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		_, _, err := e.GetCtx(ctx, []byte("k"))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorIs(t, e.PutCtx(ctx, []byte("k"), []byte("v2")), context.DeadlineExceeded)
+		cancel()
+	}
+	unlock()
+
+	// Waiters that gave up release the lock once they get it
+	done := make(chan error, 1)
+	go func() { done <- e.Put([]byte("k"), []byte("v3")) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not released by the waiters that gave up")
+	}
+	val, found := e.Get([]byte("k"))
+	assert.True(t, found)
+	assert.Equal(t, []byte("v3"), val)
+}
+
+func TestEngine_GetCtxDeadlineOnDiskRead(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(&config.Config{MaxMemtableSize: 1, MaxTablesPerTier: 100})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	require.NoError(t, e.Put([]byte("k"), []byte("v")))
+	e.WaitForFlush()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, _, err := e.GetCtx(ctx, []byte("k"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestEngine_GetCtxCanceledBetweenTables(t *testing.T) {
+	// The comparator stands in for a slow table read: once armed, the first
+	// comparison cancels the lookup's context
+	var armed atomic.Bool
+	var calls atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	compare := func(a, b []byte) int {
+		if armed.Load() {
+			calls.Add(1)
+			cancel()
+		}
+		return bytes.Compare(a, b)
+	}
+
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 100, Comparator: compare})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// k is only in the oldest table, under two newer tables whose key
+	// ranges cover it
+	for _, keys := range [][]string{{"k"}, {"a", "z"}, {"b", "y"}} {
+		for _, key := range keys {
+			require.NoError(t, e.Put([]byte(key), []byte("v")))
+		}
+		require.NoError(t, e.Flush())
+	}
+	_, found, err := e.GetCtx(ctx, []byte("k"))
+	require.NoError(t, err)
+	require.True(t, found)
+
+	armed.Store(true)
+	_, found, err = e.GetCtx(ctx, []byte("k"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, found)
+	assert.Positive(t, calls.Load())
+}
+
+func TestEngine_GetCtxReturnsReadErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 100, BlockCacheSize: -1})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	require.NoError(t, e.Put([]byte("a"), []byte("1")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.Put([]byte("b"), []byte("2")))
+	require.NoError(t, e.Flush())
+
+	// Lose the data of the table holding a while it is open, so reading
+	// its block fails
+	require.NoError(t, os.Truncate(e.Tiers()[0][0].Path(), 0))
+
+	val, found, err := e.GetCtx(context.Background(), []byte("a"))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, gerrors.ErrNotFound)
+	assert.False(t, found)
+	assert.Nil(t, val)
+
+	// Get still reports the key as missing
+	_, found = e.Get([]byte("a"))
+	assert.False(t, found)
+
+	// Reads that never touch the failing table are unaffected
+	val, found, err = e.GetCtx(context.Background(), []byte("b"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "2", string(val))
+	val, found, err = e.GetCtx(context.Background(), []byte("missing"))
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Nil(t, val)
+}
+
+func TestEngine_RejectsOversizedEntries(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(&config.Config{MaxKeySize: 8, MaxValueSize: 16})
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	assert.ErrorIs(t, e.Put([]byte("long-key-1"), []byte("v")), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, e.Put([]byte("k"), make([]byte, 17)), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, e.Delete([]byte("long-key-1")), gerrors.ErrEntryTooLarge)
+	b := new(engine.Batch)
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), make([]byte, 17))
+	assert.ErrorIs(t, e.Write(b), gerrors.ErrEntryTooLarge)
+
+	// Nothing rejected was applied
+	require.NoError(t, e.Put([]byte("k"), make([]byte, 16)))
+	_, found := e.Get([]byte("a"))
+	assert.False(t, found)
+	require.NoError(t, e.Close())
+
+	// Raising the limits later keeps existing data readable
+	e = engine.NewEngine(&config.Config{MaxKeySize: -1, MaxValueSize: -1})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	val, found := e.Get([]byte("k"))
+	require.True(t, found)
+	assert.Len(t, val, 16)
+	require.NoError(t, e.Put([]byte("long-key-1"), make([]byte, 100)))
+}
+
+func TestEngine_RejectsEmptyKeys(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MergeFunc: addMerge})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, key := range [][]byte{nil, {}} {
+		assert.ErrorIs(t, e.Put(key, []byte("v")), gerrors.ErrEmptyKey)
+		assert.ErrorIs(t, e.SetWithTTL(key, []byte("v"), time.Hour), gerrors.ErrEmptyKey)
+		assert.ErrorIs(t, e.Delete(key), gerrors.ErrEmptyKey)
+		assert.ErrorIs(t, e.Merge(key, []byte("1")), gerrors.ErrEmptyKey)
+	}
+	// Writes of several entries are rejected as a whole
+	assert.ErrorIs(t, e.PutMany([]engine.KV{{Key: []byte("a"), Value: []byte("1")}, {Value: []byte("2")}}), gerrors.ErrEmptyKey)
+	b := new(engine.Batch)
+	b.Put([]byte("b"), []byte("1"))
+	b.Delete(nil)
+	assert.ErrorIs(t, e.Write(b), gerrors.ErrEmptyKey)
+
+	// An empty key reads as missing from the memtable and SSTables alike,
+	// and an empty range start deletes from the first key
+	require.NoError(t, e.Put([]byte("c"), []byte("1")))
+	check := func(stage string) {
+		t.Helper()
+		for _, key := range []string{"", "a", "b"} {
+			_, found, err := e.GetCtx(context.Background(), []byte(key))
+			require.NoError(t, err, stage)
+			assert.False(t, found, "%s: %q", stage, key)
+		}
+		got, found := e.Get([]byte("c"))
+		assert.True(t, found, stage)
+		assert.Equal(t, "1", string(got), stage)
+	}
+	check("memtable")
+	require.NoError(t, e.Flush())
+	check("flushed")
+
+	require.NoError(t, e.DeleteRange([]byte{}, []byte("d")))
+	_, found := e.Get([]byte("c"))
+	assert.False(t, found)
+}
+
+func TestEngine_RangeHash(t *testing.T) {
+	// a flushes every write, b keeps everything in memory
+	a := engine.NewEngine(&config.Config{MaxMemtableSize: 1, MaxTablesPerTier: 2})
+	require.NoError(t, a.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, a.Close()) }()
+
+	b := engine.NewEngine(nil)
+	require.NoError(t, b.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, b.Close()) }()
+
+	for _, e := range []*engine.Engine{a, b} {
+		for i := range 10 {
+			require.NoError(t, e.Put(fmt.Appendf(nil, "k%d", i), fmt.Appendf(nil, "v%d", i)))
+			e.WaitForFlush()
+		}
+		require.NoError(t, e.Put([]byte("k3"), []byte("updated")))
+		e.WaitForFlush()
+		require.NoError(t, e.Delete([]byte("k5")))
+	}
+
+	hashA, err := a.RangeHash([]byte("k2"), []byte("k8"))
+	require.NoError(t, err)
+	hashB, err := b.RangeHash([]byte("k2"), []byte("k8"))
+	require.NoError(t, err)
+	assert.Equal(t, hashA, hashB, "identical data should hash identically")
+
+	// A change outside the range does not affect it
+	require.NoError(t, b.Put([]byte("k9"), []byte("other")))
+	require.NoError(t, b.Put([]byte("k1"), []byte("other")))
+	hashB, err = b.RangeHash([]byte("k2"), []byte("k8"))
+	require.NoError(t, err)
+	assert.Equal(t, hashA, hashB)
+
+	// A nil start hashes from the first key
+	hashA, err = a.RangeHash(nil, []byte("k8"))
+	require.NoError(t, err)
+	fromFirst, err := a.RangeHash([]byte("k0"), []byte("k8"))
+	require.NoError(t, err)
+	assert.Equal(t, fromFirst, hashA)
+	hashA, err = a.RangeHash([]byte("k2"), []byte("k8"))
+	require.NoError(t, err)
+
+	// A single changed value inside the range does
+	require.NoError(t, b.Put([]byte("k4"), []byte("changed")))
+	hashB, err = b.RangeHash([]byte("k2"), []byte("k8"))
+	require.NoError(t, err)
+	assert.NotEqual(t, hashA, hashB)
+}
+
+func TestEngine_PutDoesNotAliasCallerBuffer(t *testing.T) {
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	buf := []byte("original")
+	require.NoError(t, e.Put([]byte("k"), buf))
+	copy(buf, "mutated!")
+
+	val, found := e.Get([]byte("k"))
+	require.True(t, found)
+	assert.Equal(t, []byte("original"), val)
+}
+
+func TestCompaction_FilterDropsMatchingKeys(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(&config.Config{
+		MaxTablesPerTier: 1,
+		MaxMemtableSize:  1,
+		CompactionFilter: func(key, _ []byte) bool {
+			return !bytes.HasPrefix(key, []byte("tmp/"))
+		},
+	})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, key := range []string{"keep/a", "tmp/a", "keep/b", "tmp/b"} {
+		require.NoError(t, e.Put([]byte(key), []byte("value")))
+		e.WaitForFlush()
+	}
+
+	tiers := e.Tiers()
+	require.GreaterOrEqual(t, len(tiers), 2, "expected compaction to have run")
+
+	for _, key := range []string{"tmp/a", "tmp/b"} {
+		_, found := e.Get([]byte(key))
+		assert.False(t, found, "filtered key %s should be gone", key)
+	}
+	for _, key := range []string{"keep/a", "keep/b"} {
+		val, found := e.Get([]byte(key))
+		assert.True(t, found)
+		assert.Equal(t, []byte("value"), val)
+	}
+}
+
+func TestEngine_GetTombstoneShadowsOlderSources(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 100})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Key lives in an SSTable
+	require.NoError(t, e.Put([]byte("k"), []byte("v")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+
+	// A newer immutable memtable holds a tombstone for it
+	require.NoError(t, e.Delete([]byte("k")))
+	e.SealMemtable()
+
+	_, found := e.Get([]byte("k"))
+	assert.False(t, found, "tombstone in immutable memtable must shadow SSTable value")
+
+	// Once the tombstone is flushed, the newer SSTable must shadow the older one
+	require.NoError(t, e.FlushSealed())
+	require.Len(t, e.Tiers()[0], 2)
+	_, found = e.Get([]byte("k"))
+	assert.False(t, found, "tombstone in newer SSTable must shadow older SSTable value")
+}
+
+func TestEngine_PutMany(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	var pairs []engine.KV
+	for i := range 100 {
+		pairs = append(pairs, engine.KV{Key: fmt.Appendf(nil, "key%03d", i), Value: fmt.Appendf(nil, "val%03d", i)})
+	}
+	require.NoError(t, e.PutMany(pairs))
+
+	for _, kv := range pairs {
+		val, found := e.Get(kv.Key)
+		require.True(t, found)
+		assert.Equal(t, kv.Value, val)
+	}
+	require.NoError(t, e.Close())
+
+	// All pairs survive a restart
+	e2 := engine.NewEngine(nil)
+	require.NoError(t, e2.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e2.Close()) }()
+	for _, kv := range pairs {
+		val, found := e2.Get(kv.Key)
+		require.True(t, found)
+		assert.Equal(t, kv.Value, val)
+	}
+}
+
+func TestEngine_OpenDB_TierDirNames(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		wantErr bool
+	}{
+		{"Tmp", false},
+		{".tmp", false},
+		{".T0", false},
+		{"T", false},
+		{"T01x", true},
+		{"T-1", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "sstables", tc.name), 0755))
+
+			e := engine.NewEngine(nil)
+			err := e.OpenDB(tmpDir)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+				return
+			}
+			require.NoError(t, err)
+			assert.Empty(t, e.Tiers())
+			require.NoError(t, e.Close())
+		})
+	}
+}
+
+func TestCompaction_TriggerCount(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		compactAtMax  bool
+		lastSafeCount int
+	}{
+		{"ExceedsMax", false, 3},
+		{"ReachesMax", true, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := engine.NewEngine(&config.Config{
+				MaxTablesPerTier:   3,
+				MaxMemtableSize:    1,
+				CompactAtMaxTables: tc.compactAtMax,
+			})
+			require.NoError(t, e.OpenDB(t.TempDir()))
+			defer func() { require.NoError(t, e.Close()) }()
+
+			for i := range tc.lastSafeCount {
+				require.NoError(t, e.Put(fmt.Appendf(nil, "k%d", i), []byte("v")))
+				e.WaitForFlush()
+			}
+			require.Len(t, e.Tiers(), 1, "no compaction expected yet")
+			require.Len(t, e.Tiers()[0], tc.lastSafeCount)
+
+			// One more table triggers compaction
+			require.NoError(t, e.Put([]byte("last"), []byte("v")))
+			e.WaitForFlush()
+			tiers := e.Tiers()
+			require.Len(t, tiers, 2)
+			assert.Empty(t, tiers[0])
+			assert.Len(t, tiers[1], 1)
+		})
+	}
+}
+
+func TestCompaction_TriggerBytes(t *testing.T) {
+	big := bytes.Repeat([]byte("v"), 4096)
+	for _, tc := range []struct {
+		name      string
+		maxTables int
+		maxBytes  int64
+		// values are flushed to T0 one table each; the last one triggers
+		// compaction
+		values [][]byte
+	}{
+		// A lone large table stays put, but a second table of any size
+		// takes the tier over its byte limit
+		{"BytesBeforeCount", 10, 2048, [][]byte{big, []byte("v")}},
+		// Tiny tables stay far below the byte limit
+		{"CountBeforeBytes", 2, 1 << 20, [][]byte{[]byte("v"), []byte("v"), []byte("v")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := engine.NewEngine(&config.Config{
+				MaxTablesPerTier: tc.maxTables,
+				MaxTierBytes:     tc.maxBytes,
+			})
+			require.NoError(t, e.OpenDB(t.TempDir()))
+			defer func() { require.NoError(t, e.Close()) }()
+
+			last := len(tc.values) - 1
+			for i, value := range tc.values[:last] {
+				require.NoError(t, e.Put(fmt.Appendf(nil, "k%d", i), value))
+				require.NoError(t, e.Flush())
+				e.WaitForFlush()
+			}
+			require.Len(t, e.Tiers(), 1, "no compaction expected yet")
+			require.Len(t, e.Tiers()[0], last)
+
+			require.NoError(t, e.Put([]byte("last"), tc.values[last]))
+			require.NoError(t, e.Flush())
+			e.WaitForFlush()
+			tiers := e.Tiers()
+			require.Len(t, tiers, 2)
+			assert.Empty(t, tiers[0])
+			assert.Len(t, tiers[1], 1)
+		})
+	}
+}
+
+func TestEngine_ScanPrefixSkipsFilteredTables(t *testing.T) {
+	e := engine.NewEngine(&config.Config{
+		MaxTablesPerTier: 100,
+		PrefixExtractor: func(key []byte) []byte {
+			if len(key) < 5 {
+				return nil
+			}
+			return key[:5]
+		},
+	})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// One SSTable per prefix
+	for _, prefix := range []string{"user:", "item:", "cart:"} {
+		for i := range 3 {
+			require.NoError(t, e.Put(fmt.Appendf(nil, "%s%d", prefix, i), []byte(prefix)))
+		}
+		e.SealMemtable()
+		require.NoError(t, e.FlushSealed())
+	}
+	require.Len(t, e.Tiers()[0], 3)
+
+	tables := e.PrefixTables([]byte("user:"))
+	require.Len(t, tables, 1)
+	assert.Equal(t, e.Tiers()[0][0].Path(), tables[0])
+
+	var keys []string
+	require.NoError(t, e.ScanPrefix([]byte("user:"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		assert.Equal(t, []byte("user:"), value)
+		return true
+	}))
+	assert.Equal(t, []string{"user:0", "user:1", "user:2"}, keys)
+
+	// Prefixes shorter than the extractor cannot use the filter
+	assert.Len(t, e.PrefixTables([]byte("u")), 3)
+	keys = nil
+	require.NoError(t, e.ScanPrefix([]byte("u"), func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"user:0", "user:1", "user:2"}, keys)
+
+	var n int
+	require.NoError(t, e.ScanPrefix(nil, func(_, _ []byte) bool {
+		n++
+		return true
+	}))
+	assert.Equal(t, 9, n)
+}
+
+func collectKeys(t *testing.T, it *engine.Iterator, n int) []string {
+	t.Helper()
+	var keys []string
+	for len(keys) < n && it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	require.NoError(t, it.Error())
+	return keys
+}
+
+func TestIterator_RefreshSnapshot(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 100})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, k := range []string{"a", "c", "e"} {
+		require.NoError(t, e.Put([]byte(k), []byte(k)))
+	}
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+
+	it, err := e.NewIterator(nil, nil)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, it.Close()) }()
+	assert.Equal(t, []string{"a"}, collectKeys(t, it, 1))
+
+	// Writes after creation are invisible until refresh
+	require.NoError(t, e.Put([]byte("b"), []byte("b")))
+	require.NoError(t, e.Put([]byte("d"), []byte("d")))
+	assert.Equal(t, []string{"c"}, collectKeys(t, it, 1))
+
+	require.NoError(t, it.RefreshSnapshot())
+	assert.Equal(t, []string{"d", "e"}, collectKeys(t, it, 10))
+
+	// Refreshing an exhausted iterator only picks up keys after the last one
+	require.NoError(t, e.Put([]byte("0"), []byte("0")))
+	require.NoError(t, e.Put([]byte("f"), []byte("f")))
+	require.NoError(t, it.RefreshSnapshot())
+	assert.Equal(t, []string{"f"}, collectKeys(t, it, 10))
+}
+
+func TestIterator_RefreshAfterCurrentKeyCompactedAway(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 1})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, e.Put([]byte(k), []byte(k)))
+	}
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+
+	it, err := e.NewIterator([]byte("a"), []byte("z"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, it.Close()) }()
+	assert.Equal(t, []string{"a", "b"}, collectKeys(t, it, 2))
+
+	stale, err := e.NewIterator(nil, nil)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, stale.Close()) }()
+
+	// Delete the current key and compact, removing the pinned table
+	require.NoError(t, e.Delete([]byte("b")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+	e.WaitForFlush()
+	require.Greater(t, len(e.Tiers()), 1, "expected compaction")
+
+	// A snapshot taken before compaction is still readable
+	assert.Equal(t, []string{"a", "b", "c"}, collectKeys(t, stale, 10))
+
+	require.NoError(t, e.Put([]byte("d"), []byte("d")))
+	require.NoError(t, it.RefreshSnapshot())
+	assert.Equal(t, []string{"c", "d"}, collectKeys(t, it, 10))
+}
+
+func TestIterator_PinsTablesAcrossCompaction(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 100})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Spread the keys over several tables
+	for table := range 4 {
+		for i := range 50 {
+			key := fmt.Sprintf("key-%03d", table*50+i)
+			require.NoError(t, e.Put([]byte(key), []byte("old")))
+		}
+		require.NoError(t, e.Flush())
+	}
+	pinned, err := filepath.Glob(filepath.Join(tmpDir, "sstables", "T*", "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, pinned, 4)
+
+	it, err := e.NewIterator(nil, nil)
+	require.NoError(t, err)
+
+	// Rewrite every key and compact the tables away while the iterator
+	// walks them slowly
+	for i := range 200 {
+		require.NoError(t, e.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("new")))
+	}
+	done := make(chan error, 1)
+	go func() { done <- e.CompactAll() }()
+	var keys []string
+	for it.Next() {
+		assert.Equal(t, "old", string(it.Value()), string(it.Key()))
+		keys = append(keys, string(it.Key()))
+		if len(keys)%50 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	require.NoError(t, <-done)
+	require.NoError(t, it.Error())
+	assert.Len(t, keys, 200)
+
+	// The replaced tables are only deleted once the iterator lets go
+	for _, path := range pinned {
+		_, err := os.Stat(path)
+		require.NoError(t, err, path)
+	}
+	require.NoError(t, it.Close())
+	for _, path := range pinned {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	value, found := e.Get([]byte("key-123"))
+	assert.True(t, found)
+	assert.Equal(t, "new", string(value))
+}
+
+func TestEngine_StrictInvariants_MemtableSize(t *testing.T) {
+	e := engine.NewEngine(&config.Config{StrictInvariants: true})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { _ = e.Close() }()
+
+	// Overwrites and deletes keep the memtable size exact, so the size
+	// check never fires
+	require.NoError(t, e.Put([]byte("k"), nil))
+	require.NoError(t, e.Put([]byte("k"), []byte("longer value")))
+	require.NoError(t, e.Delete([]byte("k")))
+	assert.Equal(t, len("k"), e.MemtableSize())
+}
+
+func TestEngine_StrictInvariants_TierOrder(t *testing.T) {
+	e := engine.NewEngine(&config.Config{StrictInvariants: true, MaxTablesPerTier: 10})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { _ = e.Close() }()
+
+	require.NoError(t, e.Put([]byte("k"), []byte("old")))
+	e.SealMemtable()
+	require.NoError(t, e.Put([]byte("k"), []byte("new")))
+	e.SealMemtable()
+
+	// Flushing the newer memtable first leaves the older one unable to
+	// join T0 without breaking its age order
+	require.NoError(t, e.FlushSealedAt(1))
+	assert.ErrorIs(t, e.FlushSealedAt(0), gerrors.ErrInvariant)
+}
+
+func TestEngine_OpenDB_IgnoresPartialSSTables(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	require.NoError(t, e.Put([]byte("k"), []byte("v")))
+	require.NoError(t, e.Close())
+
+	// Simulate crashes mid-flush: a half-written table, and a complete one
+	// whose rename never happened
+	t0Dir := filepath.Join(tmpDir, "sstables", "T0")
+	halfWritten := filepath.Join(t0Dir, "000007.sst"+sstable.TempSuffix)
+	require.NoError(t, os.WriteFile(halfWritten, []byte("partial data"), 0644))
+
+	unrenamed := filepath.Join(t0Dir, "000008.sst")
+	w, err := sstable.NewWriter(unrenamed, 16)
+	require.NoError(t, err)
+	require.NoError(t, w.PutEntry([]byte("k"), []byte("stale")))
+	require.NoError(t, w.Finish())
+
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	defer func() { _ = w.Delete() }()
+
+	require.Len(t, e.Tiers(), 1)
+	assert.Len(t, e.Tiers()[0], 1)
+	val, found := e.Get([]byte("k"))
+	require.True(t, found)
+	assert.Equal(t, []byte("v"), val)
+
+	assert.NoFileExists(t, halfWritten)
+	assert.NoFileExists(t, unrenamed+sstable.TempSuffix)
+}
+
+func TestEngine_MergeFlushOnClose(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{MergeFlushOnClose: true}
+
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	require.NoError(t, e.Put([]byte("a"), []byte("1")))
+	require.NoError(t, e.Put([]byte("b"), []byte("1")))
+	e.SealMemtable()
+	require.NoError(t, e.Put([]byte("b"), []byte("2")))
+	require.NoError(t, e.Put([]byte("c"), []byte("2")))
+	e.SealMemtable()
+	require.NoError(t, e.Delete([]byte("a")))
+	e.SealMemtable()
+	require.NoError(t, e.Put([]byte("d"), []byte("3")))
+
+	require.NoError(t, e.Close())
+
+	files, err := filepath.Glob(filepath.Join(tmpDir, "sstables", "T0", "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	reader, err := sstable.NewReader(files[0])
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	got := map[string]string{}
+	it := reader.NewIterator()
+	for it.Next() {
+		if !it.IsDeleted() {
+			got[string(it.Key())] = string(it.Value())
+		}
+	}
+	assert.Equal(t, map[string]string{"b": "2", "c": "2", "d": "3"}, got)
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	_, found := e.Get([]byte("a"))
+	assert.False(t, found)
+	val, found := e.Get([]byte("b"))
+	require.True(t, found)
+	assert.Equal(t, []byte("2"), val)
+}
+
+func TestEngine_NegativeCache(t *testing.T) {
+	e := engine.NewEngine(&config.Config{NegativeCacheSize: 2})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	key := []byte("absent")
+	_, found := e.Get(key)
+	require.False(t, found)
+	assert.Equal(t, 1, e.NegativeCacheLen())
+
+	// Writing a cached key invalidates it
+	require.NoError(t, e.Put(key, []byte("v1")))
+	val, found := e.Get(key)
+	require.True(t, found)
+	assert.Equal(t, []byte("v1"), val)
+
+	require.NoError(t, e.Delete(key))
+	_, found = e.Get(key)
+	require.False(t, found)
+
+	require.NoError(t, e.PutMany([]engine.KV{{Key: key, Value: []byte("v2")}}))
+	val, found = e.Get(key)
+	require.True(t, found)
+	assert.Equal(t, []byte("v2"), val)
+
+	// Least recently used misses are evicted
+	for _, k := range []string{"x", "y", "z"} {
+		_, found = e.Get([]byte(k))
+		require.False(t, found)
+	}
+	assert.Equal(t, 2, e.NegativeCacheLen())
+
+	// Installing a new table clears the cache
+	require.NoError(t, e.Put([]byte("other"), []byte("v")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+	assert.Equal(t, 0, e.NegativeCacheLen())
+}
+
+func TestIterator_IncludeDeleted(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 100})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Puts and deletes interleaved across a table and the memtable
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		require.NoError(t, e.Put([]byte(k), []byte(k)))
+	}
+	require.NoError(t, e.Delete([]byte("b")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.Delete([]byte("d")))
+	require.NoError(t, e.Put([]byte("b"), []byte("b2")))
+	require.NoError(t, e.DeleteRange([]byte("e"), []byte("f")))
+	require.NoError(t, e.Delete([]byte("g")))
+
+	collect := func(include bool) []string {
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, it.Close()) }()
+		it.SetIncludeDeleted(include)
+		var got []string
+		for it.Next() {
+			if it.Deleted() {
+				assert.Nil(t, it.Value())
+				got = append(got, string(it.Key())+"=-")
+			} else {
+				got = append(got, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+			}
+		}
+		require.NoError(t, it.Error())
+		return got
+	}
+	assert.Equal(t, []string{"a=a", "b=b2", "c=c", "f=f"}, collect(false))
+	assert.Equal(t, []string{"a=a", "b=b2", "c=c", "d=-", "e=-", "f=f", "g=-"}, collect(true))
+}
+
+func TestIterator_MergesAllSources(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 1})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+
+	// Oldest data ends up in T1, then T0, an immutable memtable and the
+	// active memtable
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, e.Put([]byte(k), []byte("t1")))
+	}
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+	require.NoError(t, e.Put([]byte("x"), []byte("t1")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+	e.WaitForFlush()
+	require.Len(t, e.Tiers(), 2)
+	require.Len(t, e.Tiers()[1], 1)
+
+	require.NoError(t, e.Put([]byte("b"), []byte("t0")))
+	require.NoError(t, e.Delete([]byte("c")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+
+	require.NoError(t, e.Put([]byte("d"), []byte("imm")))
+	require.NoError(t, e.Delete([]byte("x")))
+	e.SealMemtable()
+
+	require.NoError(t, e.Put([]byte("e"), []byte("active")))
+	require.NoError(t, e.Put([]byte("0"), []byte("active")))
+
+	it, err := e.NewIterator(nil, nil)
+	require.NoError(t, err)
+	var got []string
+	for it.Next() {
+		got = append(got, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	require.NoError(t, it.Error())
+	require.NoError(t, it.Close())
+	assert.Equal(t, []string{"0=active", "a=t1", "b=t0", "d=imm", "e=active"}, got)
+
+	it, err = e.NewIterator([]byte("b"), []byte("e"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "d"}, collectKeys(t, it, 10))
+	require.NoError(t, it.Close())
+
+	require.NoError(t, e.Close())
+	_, err = e.NewIterator(nil, nil)
+	assert.ErrorIs(t, err, &gerrors.Error{Code: gerrors.ErrCodeClosed})
+}
+
+// writeTierSST writes an SSTable numbered num into tier under dataDir.
+// A value of "-" writes a tombstone.
+func writeTierSST(t *testing.T, dataDir string, tier int, num int, kvs map[string]string) {
+	t.Helper()
+	dir := filepath.Join(dataDir, "sstables", fmt.Sprintf("T%d", tier))
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w, err := sstable.NewWriter(filepath.Join(dir, fmt.Sprintf("%06d.sst", num)), 16)
+	require.NoError(t, err)
+	for _, k := range keys {
+		if kvs[k] == "-" {
+			require.NoError(t, w.DeleteEntry([]byte(k)))
+		} else {
+			require.NoError(t, w.PutEntry([]byte(k), []byte(kvs[k])))
+		}
+	}
+	require.NoError(t, w.Close())
+}
+
+func TestEngine_GetNewestTierWins(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Older data sits in higher tiers and has lower table numbers
+	writeTierSST(t, tmpDir, 2, 1, map[string]string{"all": "t2", "t1t2": "t2", "t0t2": "t2", "only2": "t2", "dead": "t2"})
+	writeTierSST(t, tmpDir, 2, 2, map[string]string{"all": "t2-newer", "only2": "t2-newer"})
+	writeTierSST(t, tmpDir, 1, 3, map[string]string{"all": "t1", "t1t2": "t1", "dead": "-"})
+	writeTierSST(t, tmpDir, 0, 4, map[string]string{"all": "t0-older", "t0t2": "t0-older", "mem": "t0"})
+	writeTierSST(t, tmpDir, 0, 5, map[string]string{"all": "t0", "t0t2": "t0"})
+
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 10})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	require.Len(t, e.Tiers(), 3)
+
+	require.NoError(t, e.Put([]byte("mem"), []byte("immutable")))
+	e.SealMemtable()
+
+	want := map[string]string{
+		"all":   "t0",
+		"t0t2":  "t0",
+		"t1t2":  "t1",
+		"only2": "t2-newer",
+		"mem":   "immutable",
+	}
+	for key, value := range want {
+		got, found := e.Get([]byte(key))
+		require.True(t, found, key)
+		assert.Equal(t, value, string(got), key)
+	}
+
+	// A tombstone in T1 shadows the value in T2
+	_, found := e.Get([]byte("dead"))
+	assert.False(t, found)
+
+	// The active memtable beats everything
+	require.NoError(t, e.Put([]byte("all"), []byte("active")))
+	got, found := e.Get([]byte("all"))
+	require.True(t, found)
+	assert.Equal(t, "active", string(got))
+}
+
+func TestEngine_WriteBatch(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	require.NoError(t, e.Put([]byte("old"), []byte("v")))
+
+	var b engine.Batch
+	key := []byte("a")
+	b.Put(key, []byte("1"))
+	key[0] = 'b' // the batch keeps its own copy
+	b.Put(key, []byte("2"))
+	b.Delete([]byte("old"))
+	b.Put([]byte("c"), []byte("3"))
+	b.Delete([]byte("c"))
+	require.Equal(t, 5, b.Len())
+	require.NoError(t, e.Write(&b))
+
+	check := func(e *engine.Engine) {
+		for k, want := range map[string]string{"a": "1", "b": "2"} {
+			val, found := e.Get([]byte(k))
+			require.True(t, found, k)
+			assert.Equal(t, want, string(val), k)
+		}
+		for _, k := range []string{"old", "c"} {
+			_, found := e.Get([]byte(k))
+			assert.False(t, found, k)
+		}
+	}
+	check(e)
+	require.NoError(t, e.Close())
+
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	check(e)
+}
+
+func TestEngine_WriteBatchRecoveredAfterCrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	var b engine.Batch
+	for i := range 10 {
+		b.Put(fmt.Appendf(nil, "key-%d", i), []byte("v"))
+	}
+	b.Delete([]byte("key-3"))
+
+	// Crash after the batch reached the WAL but before the memtable
+	require.NoError(t, e.LogBatch(&b))
+	_, found := e.Get([]byte("key-0"))
+	require.False(t, found)
+	e.Crash()
+
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for i := range 10 {
+		_, found := e.Get(fmt.Appendf(nil, "key-%d", i))
+		assert.Equal(t, i != 3, found, "key-%d", i)
+	}
+}
+
+func TestEngine_FlushedDataNotReplayedAfterCrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{MaxMemtableSize: 100}
+
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for i := range 3 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%d", i), []byte("v")))
+	}
+	// Push the memtable over its limit so it is sealed and flushed
+	require.NoError(t, e.Put([]byte("big"), bytes.Repeat([]byte("x"), 100)))
+	e.WaitForFlush()
+	require.NoError(t, e.Delete([]byte("key-0")))
+	e.Crash()
+
+	// Only the WAL segment written after the flush is left
+	segments, err := filepath.Glob(filepath.Join(tmpDir, "wal-*.log"))
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// The replayed memtable holds just the tombstone, not the flushed puts
+	assert.Equal(t, len("key-0"), e.MemtableSize())
+	_, found := e.Get([]byte("key-0"))
+	assert.False(t, found)
+	val, found := e.Get([]byte("key-1"))
+	require.True(t, found)
+	assert.Equal(t, []byte("v"), val)
+}
+
+func TestEngine_WALSegmentsReplayedAfterCrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{WALFlushThreshold: 1, WALSegmentSize: 64}
+
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for i := range 20 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%02d", i), []byte("v1")))
+	}
+	require.NoError(t, e.Delete([]byte("key-03")))
+	require.NoError(t, e.Put([]byte("key-05"), []byte("v2")))
+	e.Crash()
+
+	segments, err := filepath.Glob(filepath.Join(tmpDir, "wal-*.log"))
+	require.NoError(t, err)
+	assert.Greater(t, len(segments), 5)
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for i := range 20 {
+		val, found := e.Get(fmt.Appendf(nil, "key-%02d", i))
+		if i == 3 {
+			assert.False(t, found)
+			continue
+		}
+		require.True(t, found, "key-%02d", i)
+		if i == 5 {
+			assert.Equal(t, "v2", string(val))
+		}
+	}
+
+	// Once the replayed data is flushed, only the active segment is left
+	require.NoError(t, e.Flush())
+	segments, err = filepath.Glob(filepath.Join(tmpDir, "wal-*.log"))
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+	require.NoError(t, e.Close())
+}
+
+func TestEngine_OpenDB_RecoversFromTornWALRecord(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{WALFlushThreshold: 1}
+
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	require.NoError(t, e.Put([]byte("a"), []byte("1")))
+	require.NoError(t, e.Put([]byte("b"), []byte("2")))
+	e.Crash()
+
+	// The crash hit partway through writing a third record
+	segments, err := filepath.Glob(filepath.Join(tmpDir, "wal-*.log"))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	record := storage.SerializeEntry(storage.Entry{Type: storage.PutEntry, Key: []byte("c"), Value: []byte("3")})
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(record[:len(record)-2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	val, found := e.Get([]byte("b"))
+	require.True(t, found)
+	assert.Equal(t, "2", string(val))
+	_, found = e.Get([]byte("c"))
+	assert.False(t, found)
+
+	// Writes after recovery survive another crash before any flush
+	require.NoError(t, e.Put([]byte("d"), []byte("4")))
+	e.Crash()
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	_, found = e.Get([]byte("b"))
+	assert.True(t, found)
+	_, found = e.Get([]byte("d"))
+	assert.True(t, found)
+}
+
+func TestEngine_OpenDB_RecoversLegacyWAL(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Unflushed writes in the WAL format used before segments were numbered
+	legacy := legacyRecord(storage.PutEntry, "a", "1")
+	legacy = append(legacy, legacyRecord(storage.PutEntry, "b", "2")...)
+	legacy = append(legacy, legacyRecord(storage.DeleteEntry, "a", "")...)
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "wal.log"), legacy, 0644))
+
+	for _, stage := range []string{"converted", "reopened"} {
+		e := engine.NewEngine(nil)
+		require.NoError(t, e.OpenDB(tmpDir), stage)
+		value, found := e.Get([]byte("b"))
+		assert.True(t, found, stage)
+		assert.Equal(t, "2", string(value), stage)
+		_, found = e.Get([]byte("a"))
+		assert.False(t, found, stage)
+		require.NoError(t, e.Close())
+	}
+}
+
+// legacyRecord encodes an entry as the WAL and SSTables did before
+// checksums and format versions: [type][key length][value length][key]
+// [value].
+func legacyRecord(entryType storage.EntryType, key, value string) []byte {
+	buf := []byte{byte(entryType)}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(append(buf, key...), value...)
+}
+
+// writeLegacySST writes an SSTable in the unversioned format to tier of
+// dataDir: the entries of kvs in key order, "-" marking a tombstone, a
+// sparse index of the first entry and a footer holding the index offset
+// and size.
+func writeLegacySST(t *testing.T, dataDir string, tier int, num int, kvs map[string]string) {
+	t.Helper()
+	dir := filepath.Join(dataDir, "sstables", fmt.Sprintf("T%d", tier))
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	keys := slices.Sorted(maps.Keys(kvs))
+	var data []byte
+	for _, k := range keys {
+		if kvs[k] == "-" {
+			data = append(data, legacyRecord(storage.DeleteEntry, k, "")...)
+		} else {
+			data = append(data, legacyRecord(storage.PutEntry, k, kvs[k])...)
+		}
+	}
+	indexOffset := len(data)
+	data = append(data, legacyRecord(storage.IndexEntry, keys[0], "")...)
+	data = binary.BigEndian.AppendUint64(data, 0)
+	data = binary.BigEndian.AppendUint64(data, uint64(indexOffset))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(data)-indexOffset-8))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%06d.sst", num)), data, 0644))
+}
+
+func TestEngine_OpenDB_ConvertsLegacyTables(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeLegacySST(t, tmpDir, 0, 1, map[string]string{"a": "old", "b": "1"})
+	writeLegacySST(t, tmpDir, 0, 2, map[string]string{"a": "new", "b": "-"})
+	writeLegacySST(t, tmpDir, 1, 3, map[string]string{"c": "3"})
+
+	for _, stage := range []string{"converted", "reopened"} {
+		e := engine.NewEngine(nil)
+		require.NoError(t, e.OpenDB(tmpDir), stage)
+		value, found := e.Get([]byte("a"))
+		assert.True(t, found, stage)
+		assert.Equal(t, "new", string(value), stage)
+		_, found = e.Get([]byte("b"))
+		assert.False(t, found, stage)
+		value, found = e.Get([]byte("c"))
+		assert.True(t, found, stage)
+		assert.Equal(t, "3", string(value), stage)
+		require.NoError(t, e.Close())
+	}
+	_, err := os.Stat(filepath.Join(tmpDir, "quarantine"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Once a manifest references it, a table left in the old format is not
+	// converted behind its back
+	writeLegacySST(t, tmpDir, 0, 2, map[string]string{"a": "new", "b": "-"})
+	e := engine.NewEngine(nil)
+	assert.ErrorIs(t, e.OpenDB(tmpDir), gerrors.ErrUnsupportedVersion)
+}
+
+func TestEngine_Stats(t *testing.T) {
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	require.NoError(t, e.Put([]byte("a"), []byte("1")))
+	require.NoError(t, e.Put([]byte("b"), []byte("2")))
+	require.NoError(t, e.PutMany([]engine.KV{{Key: []byte("c"), Value: []byte("3")}, {Key: []byte("d"), Value: []byte("4")}}))
+	require.NoError(t, e.Delete([]byte("a")))
+
+	var b engine.Batch
+	b.Put([]byte("e"), []byte("5"))
+	b.Delete([]byte("b"))
+	require.NoError(t, e.Write(&b))
+
+	e.Get([]byte("c"))
+	e.Get([]byte("missing"))
+	_, _, err := e.GetCtx(context.Background(), []byte("e"))
+	require.NoError(t, err)
+
+	stats := e.Stats()
+	assert.Equal(t, uint64(5), stats.Puts)
+	assert.Equal(t, uint64(2), stats.Deletes)
+	assert.Equal(t, uint64(3), stats.Gets)
+	assert.Equal(t, e.MemtableSize(), stats.MemtableBytes)
+	assert.Positive(t, stats.MemtableBytes)
+	assert.Zero(t, stats.ImmutableMemtables)
+	assert.Empty(t, stats.TablesPerTier)
+
+	e.SealMemtable()
+	assert.Equal(t, 1, e.Stats().ImmutableMemtables)
+
+	require.NoError(t, e.FlushSealed())
+	stats = e.Stats()
+	assert.Zero(t, stats.ImmutableMemtables)
+	assert.Zero(t, stats.MemtableBytes)
+	require.Len(t, stats.TablesPerTier, 1)
+	assert.Equal(t, 1, stats.TablesPerTier[0])
+	assert.Greater(t, stats.DiskBytes, int64(0))
+
+	data, err := json.Marshal(stats)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"tables_per_tier":[1]`)
+	assert.Contains(t, string(data), `"puts":5`)
+}
+
+func TestEngine_ManifestIgnoresOrphanedCompactionOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	require.NoError(t, e.Put([]byte("a"), []byte("1")))
+	e.SealMemtable()
+	require.NoError(t, e.Put([]byte("a"), []byte("2")))
+	require.NoError(t, e.Put([]byte("b"), []byte("2")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+
+	// A compaction that wrote its output but crashed before recording it
+	// in the manifest
+	e.Crash()
+	writeTierSST(t, tmpDir, 1, 100, map[string]string{"a": "stale", "b": "-"})
+	orphan := filepath.Join(tmpDir, "sstables", "T1", "000100.sst")
+
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	assert.NoFileExists(t, orphan)
+	tiers := e.Tiers()
+	require.NotEmpty(t, tiers)
+	assert.Len(t, tiers[0], 2)
+	for _, tier := range tiers[1:] {
+		assert.Empty(t, tier)
+	}
+
+	val, found := e.Get([]byte("a"))
+	require.True(t, found)
+	assert.Equal(t, "2", string(val))
+	val, found = e.Get([]byte("b"))
+	require.True(t, found)
+	assert.Equal(t, "2", string(val))
+
+	// New tables are numbered past the orphan, so nothing reuses its name
+	require.NoError(t, e.Put([]byte("c"), []byte("3")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+	assert.FileExists(t, filepath.Join(tmpDir, "sstables", "T0", "000101.sst"))
+}
+
+func TestEngine_ManifestCorruptionBeforeNewerRecordsFailsOpen(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for _, k := range []string{"a", "b"} {
+		require.NoError(t, e.Put([]byte(k), []byte("1")))
+		e.SealMemtable()
+		require.NoError(t, e.FlushSealed())
+	}
+	e.Crash()
+
+	path := filepath.Join(tmpDir, "MANIFEST")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	_, n, err := storage.DecodeEntry(data)
+	require.NoError(t, err)
+	require.Less(t, n, len(data))
+
+	// A torn last record, cut short or with a bad checksum, was never
+	// applied and is dropped
+	last := data[n:]
+	for _, torn := range [][]byte{last[:len(last)/2], append(bytes.Clone(last[:len(last)-1]), last[len(last)-1]^0xff)} {
+		require.NoError(t, os.WriteFile(path, append(bytes.Clone(data), torn...), 0644))
+		e = engine.NewEngine(nil)
+		require.NoError(t, e.OpenDB(tmpDir))
+		value, found := e.Get([]byte("b"))
+		assert.True(t, found)
+		assert.Equal(t, "1", string(value))
+		e.Crash()
+	}
+
+	// Damage before newer records fails the open and deletes nothing
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	require.NoError(t, e.Put([]byte("c"), []byte("1")))
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+	e.Crash()
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	tables, err := filepath.Glob(filepath.Join(tmpDir, "sstables", "T0", "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, tables, 3)
+	_, n, err = storage.DecodeEntry(data)
+	require.NoError(t, err)
+	require.Less(t, n, len(data))
+	corrupt := bytes.Clone(data)
+	corrupt[n-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, corrupt, 0644))
+	e = engine.NewEngine(nil)
+	assert.ErrorIs(t, e.OpenDB(tmpDir), gerrors.ErrCorrupt)
+	for _, table := range tables {
+		assert.FileExists(t, table)
+	}
+}
+
+func TestEngine_Flush(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	// Nothing to flush yet
+	require.NoError(t, e.Flush())
+	assert.Empty(t, e.Stats().TablesPerTier)
+
+	for i := range 10 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%02d", i), fmt.Appendf(nil, "val-%02d", i)))
+	}
+	require.NoError(t, e.Delete([]byte("key-03")))
+	require.NoError(t, e.Flush())
+
+	stats := e.Stats()
+	assert.Equal(t, []int{1}, stats.TablesPerTier)
+	assert.Zero(t, stats.MemtableBytes)
+	assert.Zero(t, stats.ImmutableMemtables)
+
+	// A second flush with an empty memtable writes nothing
+	require.NoError(t, e.Flush())
+	assert.Equal(t, []int{1}, e.Stats().TablesPerTier)
+
+	// Flushing while other goroutines write is safe
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				assert.NoError(t, e.Put(fmt.Appendf(nil, "w%d-%02d", w, i), []byte("v")))
+			}
+		}()
+	}
+	for range 5 {
+		require.NoError(t, e.Flush())
+	}
+	wg.Wait()
+	require.NoError(t, e.Close())
+
+	// The first table holds exactly what was written before the flush
+	reader, err := sstable.NewReader(filepath.Join(tmpDir, "sstables", "T0", "000001.sst"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+	for i := range 10 {
+		entry, err := reader.Get(fmt.Appendf(nil, "key-%02d", i))
+		if i == 3 {
+			assert.ErrorIs(t, err, gerrors.ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("val-%02d", i), string(entry.Value))
+	}
+
+	// Flush reports an error once the engine is closed
+	assert.Error(t, e.Flush())
+}
+
+func TestEngine_CompactAll(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Overlapping keys spread over three tiers, newest in T0
+	writeTierSST(t, tmpDir, 2, 1, map[string]string{"a": "t2", "b": "t2", "c": "t2", "d": "t2"})
+	writeTierSST(t, tmpDir, 1, 2, map[string]string{"b": "t1", "c": "-"})
+	writeTierSST(t, tmpDir, 0, 3, map[string]string{"a": "t0-old", "e": "t0-old"})
+	writeTierSST(t, tmpDir, 0, 4, map[string]string{"a": "t0", "d": "-"})
+
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	require.NoError(t, e.Put([]byte("f"), []byte("mem")))
+
+	require.NoError(t, e.CompactAll())
+
+	// Everything on disk ends up in one table below the deepest tier
+	assert.Equal(t, []int{0, 0, 0, 1}, e.Stats().TablesPerTier)
+	files, err := filepath.Glob(filepath.Join(tmpDir, "sstables", "T*", "*.sst"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	want := map[string]string{"a": "t0", "b": "t1", "c": "", "d": "", "e": "t0-old", "f": "mem"}
+	for key, value := range want {
+		got, found := e.Get([]byte(key))
+		assert.Equal(t, value != "", found, key)
+		assert.Equal(t, value, string(got), key)
+	}
+
+	// A single fully compacted table is left alone
+	require.NoError(t, e.CompactAll())
+	assert.Equal(t, []int{0, 0, 0, 1}, e.Stats().TablesPerTier)
+}
+
+func TestEngine_MaxVersionsPerKey(t *testing.T) {
+	for _, limit := range []int{0, 1, 3, 10} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			e := engine.NewEngine(&config.Config{MaxVersionsPerKey: limit, StrictInvariants: true})
+			require.NoError(t, e.OpenDB(t.TempDir()))
+			defer func() { require.NoError(t, e.Close()) }()
+
+			// Six versions of k, some in the same memtable, the newest a
+			// tombstone, and one version of other keys around it
+			require.NoError(t, e.Put([]byte("a"), []byte("a")))
+			require.NoError(t, e.Put([]byte("z"), []byte("z")))
+			for i := 1; i <= 5; i++ {
+				require.NoError(t, e.Put([]byte("k"), []byte(fmt.Sprint(i))))
+				if i%2 == 0 {
+					require.NoError(t, e.Flush())
+				}
+			}
+			require.NoError(t, e.Delete([]byte("k")))
+			require.NoError(t, e.Flush())
+			require.NoError(t, e.CompactAll())
+
+			render := func(versions []engine.VersionedValue) []string {
+				var got []string
+				for _, v := range versions {
+					if v.Deleted {
+						got = append(got, "-")
+					} else {
+						got = append(got, string(v.Value))
+					}
+				}
+				return got
+			}
+			// A bottom compaction drops a key whose newest version is a
+			// tombstone, along with every version beneath it
+			versions, err := e.GetVersions([]byte("k"), 0)
+			require.NoError(t, err)
+			assert.Empty(t, versions)
+
+			require.NoError(t, e.Put([]byte("k"), []byte("6")))
+			require.NoError(t, e.Flush())
+			for i := 7; i <= 9; i++ {
+				require.NoError(t, e.Delete([]byte("k")))
+				require.NoError(t, e.Put([]byte("k"), []byte(fmt.Sprint(i))))
+				require.NoError(t, e.Flush())
+			}
+			all := []string{"9", "-", "8", "-", "7", "-", "6"}
+			require.NoError(t, e.CompactAll())
+
+			want := all[:min(max(limit, 1), len(all))]
+			versions, err = e.GetVersions([]byte("k"), 0)
+			require.NoError(t, err)
+			assert.Equal(t, want, render(versions))
+			for i, v := range versions[1:] {
+				assert.Greater(t, versions[i].Seq, v.Seq)
+			}
+			versions, err = e.GetVersions([]byte("k"), 2)
+			require.NoError(t, err)
+			assert.Equal(t, want[:min(2, len(want))], render(versions))
+
+			// Reads still see the newest version only
+			value, found := e.Get([]byte("k"))
+			assert.True(t, found)
+			assert.Equal(t, "9", string(value))
+			for _, key := range []string{"a", "z"} {
+				versions, err = e.GetVersions([]byte(key), 0)
+				require.NoError(t, err)
+				assert.Equal(t, []string{key}, render(versions))
+			}
+		})
+	}
+}
+
+func TestCompaction_DropsTombstonesAtBottomTier(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTierSST(t, tmpDir, 2, 1, map[string]string{"a": "old", "b": "old"})
+	writeTierSST(t, tmpDir, 0, 2, map[string]string{"a": "-"})
+	writeTierSST(t, tmpDir, 0, 3, map[string]string{"c": "new"})
+
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 2})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// T0 goes over its limit and is merged into T1. T2 still holds an old
+	// value for a, so the tombstone must be kept.
+	require.NoError(t, e.Put([]byte("d"), []byte("new")))
+	require.NoError(t, e.Flush())
+	e.WaitForFlush()
+	tiers := e.Tiers()
+	require.Len(t, tiers[1], 1)
+	assert.Equal(t, []string{"a=-", "c=new", "d=new"}, tableEntries(t, tiers[1][0]))
+	_, found := e.Get([]byte("a"))
+	assert.False(t, found)
+
+	// Merging everything into the bottom tier drops the tombstone along
+	// with the value it hid
+	require.NoError(t, e.CompactAll())
+	tiers = e.Tiers()
+	bottom := tiers[len(tiers)-1]
+	require.Len(t, bottom, 1)
+	assert.Equal(t, []string{"b=old", "c=new", "d=new"}, tableEntries(t, bottom[0]))
+	_, found = e.Get([]byte("a"))
+	assert.False(t, found)
+
+	// A bottom-tier merge of nothing but tombstones leaves no table behind
+	require.NoError(t, e.Delete([]byte("b")))
+	require.NoError(t, e.Delete([]byte("c")))
+	require.NoError(t, e.Delete([]byte("d")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.CompactAll())
+	files, err := filepath.Glob(filepath.Join(tmpDir, "sstables", "T*", "*.sst"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestEngine_DeleteRange(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	// Covered keys both on disk and in the memtable
+	for _, k := range []string{"a", "b1", "b2"} {
+		require.NoError(t, e.Put([]byte(k), []byte("old")))
+	}
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.Put([]byte("b3"), []byte("old")))
+	require.NoError(t, e.Put([]byte("c"), []byte("old")))
+
+	require.NoError(t, e.DeleteRange([]byte("b"), []byte("c")))
+	// Written after the range delete, so it survives it
+	require.NoError(t, e.Put([]byte("b2"), []byte("new")))
+
+	check := func(stage string) {
+		t.Helper()
+		want := map[string]string{"a": "old", "b1": "", "b2": "new", "b3": "", "c": "old"}
+		for key, value := range want {
+			got, found := e.Get([]byte(key))
+			assert.Equal(t, value != "", found, "%s: %s", stage, key)
+			assert.Equal(t, value, string(got), "%s: %s", stage, key)
+			assert.Equal(t, value != "", e.Has([]byte(key)), "%s: %s", stage, key)
+		}
+
+		values, found, err := e.GetMany([][]byte{[]byte("b1"), []byte("b2")})
+		require.NoError(t, err)
+		assert.Equal(t, []bool{false, true}, found, stage)
+		assert.Equal(t, "new", string(values[1]), stage)
+
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		require.NoError(t, it.Error())
+		require.NoError(t, it.Close())
+		assert.Equal(t, []string{"a=old", "b2=new", "c=old"}, keys, stage)
+	}
+
+	check("memtable")
+	require.NoError(t, e.Flush())
+	check("flushed")
+
+	// The range tombstone survives a restart once its WAL segment is gone
+	require.NoError(t, e.Close())
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	check("reopened")
+
+	// Compaction removes the covered keys from disk
+	require.NoError(t, e.CompactAll())
+	tiers := e.Tiers()
+	bottom := tiers[len(tiers)-1]
+	require.Len(t, bottom, 1)
+	assert.Equal(t, []string{"a=old", "b2=new", "c=old"}, tableEntries(t, bottom[0]))
+	check("compacted")
+}
+
+func TestEngine_DropPrefix(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, k := range []string{"tenant1/a", "tenant1/b", "tenant2/a"} {
+		require.NoError(t, e.Put([]byte(k), []byte("old")))
+	}
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.Put([]byte("tenant1/c"), []byte("old")))
+	// Sorts right after the prefix, so it must survive the drop
+	require.NoError(t, e.Put([]byte("tenant10"), []byte("old")))
+
+	require.NoError(t, e.DropPrefix([]byte("tenant1/")))
+	require.NoError(t, e.Put([]byte("tenant1/b"), []byte("new")))
+
+	check := func(stage string) {
+		t.Helper()
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		require.NoError(t, it.Error())
+		require.NoError(t, it.Close())
+		assert.Equal(t, []string{"tenant1/b=new", "tenant10=old", "tenant2/a=old"}, keys, stage)
+		_, found := e.Get([]byte("tenant1/a"))
+		assert.False(t, found, stage)
+	}
+	check("dropped")
+
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.CompactAll())
+	tiers := e.Tiers()
+	bottom := tiers[len(tiers)-1]
+	require.Len(t, bottom, 1)
+	assert.Equal(t, []string{"tenant1/b=new", "tenant10=old", "tenant2/a=old"}, tableEntries(t, bottom[0]))
+	check("compacted")
+
+	assert.ErrorIs(t, e.DropPrefix(nil), gerrors.ErrEmptyKey)
+}
+
+func TestEngine_DropPrefixAllOnes(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, k := range []string{"\xfe\xff", "\xff", "\xff\xff", "\xff\xff\x00", "\xff\xff\xff\xff"} {
+		require.NoError(t, e.Put([]byte(k), []byte("old")))
+	}
+	require.NoError(t, e.Flush())
+
+	// No key sorts past every key starting with 0xFF 0xFF, so the tombstone
+	// is open-ended
+	require.NoError(t, e.DropPrefix([]byte{0xff, 0xff}))
+	require.NoError(t, e.Put([]byte("\xff\xff\x01"), []byte("new")))
+
+	check := func(stage string) {
+		t.Helper()
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		require.NoError(t, it.Error())
+		require.NoError(t, it.Close())
+		assert.Equal(t, []string{"\xfe\xff=old", "\xff=old", "\xff\xff\x01=new"}, keys, stage)
+		_, found := e.Get([]byte("\xff\xff\xff\xff"))
+		assert.False(t, found, stage)
+	}
+	check("dropped")
+
+	require.NoError(t, e.Flush())
+	check("flushed")
+	require.NoError(t, e.CompactAll())
+	check("compacted")
+}
+
+func TestEngine_PrefixOperationsRequireByteOrder(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Comparator = func(a, b []byte) int { return bytes.Compare(b, a) }
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	assert.ErrorIs(t, e.DropPrefix([]byte("tenant1/")), gerrors.ErrInvalidArgument)
+	assert.ErrorIs(t, e.ScanPrefix([]byte("tenant1/"), func(_, _ []byte) bool { return true }), gerrors.ErrInvalidArgument)
+	_, err := e.PrefixScan([]byte("tenant1/"))
+	assert.ErrorIs(t, err, gerrors.ErrInvalidArgument)
+}
+
+func TestEngine_DeleteRangeReplayedFromWAL(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	require.NoError(t, e.Put([]byte("k1"), []byte("v")))
+	require.NoError(t, e.Put([]byte("k2"), []byte("v")))
+	require.NoError(t, e.DeleteRange([]byte("k1"), []byte("k2")))
+	e.Crash()
+
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	_, found := e.Get([]byte("k1"))
+	assert.False(t, found)
+	_, found = e.Get([]byte("k2"))
+	assert.True(t, found)
+
+	// Sequence numbers continue after the range tombstone's, so new writes
+	// are not hidden by it
+	require.NoError(t, e.Put([]byte("k1"), []byte("again")))
+	got, found := e.Get([]byte("k1"))
+	assert.True(t, found)
+	assert.Equal(t, "again", string(got))
+}
+
+func TestEngine_Comparator(t *testing.T) {
+	// Orders keys by length and then bytes, so that "k2" sorts before "k10"
+	lengthFirst := func(a, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	}
+
+	scan := func(e *engine.Engine, start, end string) []string {
+		t.Helper()
+		var startKey, endKey []byte
+		if start != "" {
+			startKey = []byte(start)
+		}
+		if end != "" {
+			endKey = []byte(end)
+		}
+		it, err := e.NewIterator(startKey, endKey)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, it.Close()) }()
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		require.NoError(t, it.Error())
+		return keys
+	}
+	write := func(e *engine.Engine) {
+		t.Helper()
+		// Spread the keys over several SSTables and the memtable
+		for i, n := range []int{10, 2, 33, 1, 20, 3, 100, 11} {
+			require.NoError(t, e.Put([]byte(fmt.Sprintf("k%d", n)), []byte("v")))
+			if i%3 == 2 {
+				require.NoError(t, e.Flush())
+			}
+		}
+	}
+
+	def := engine.NewEngine(nil)
+	require.NoError(t, def.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, def.Close()) }()
+	write(def)
+	assert.Equal(t, []string{"k1", "k10", "k100", "k11", "k2", "k20", "k3", "k33"}, scan(def, "", ""))
+
+	custom := engine.NewEngine(&config.Config{
+		Comparator:         lengthFirst,
+		MaxTablesPerTier:   2,
+		CompactionStrategy: config.LeveledCompaction,
+		StrictInvariants:   true,
+	})
+	require.NoError(t, custom.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, custom.Close()) }()
+	write(custom)
+
+	want := []string{"k1", "k2", "k3", "k10", "k11", "k20", "k33", "k100"}
+	check := func(stage string) {
+		t.Helper()
+		assert.Equal(t, want, scan(custom, "", ""), stage)
+		assert.Equal(t, []string{"k3", "k10", "k11", "k20"}, scan(custom, "k3", "k33"), stage)
+		for _, key := range want {
+			_, found := custom.Get([]byte(key))
+			assert.True(t, found, "%s: %s", stage, key)
+		}
+	}
+	check("written")
+
+	require.NoError(t, custom.DeleteRange([]byte("k3"), []byte("k20")))
+	want = []string{"k1", "k2", "k20", "k33", "k100"}
+	assert.Equal(t, want, scan(custom, "", ""))
+	require.NoError(t, custom.Flush())
+	require.NoError(t, custom.CompactAll())
+	assert.Equal(t, want, scan(custom, "", ""))
+}
+
+func TestEngine_ApproximateSize(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 4})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// 10000 evenly spread keys over several SSTables, the last ones still in
+	// the memtable
+	value := make([]byte, 100)
+	for i := range 10000 {
+		require.NoError(t, e.Put([]byte(fmt.Sprintf("key%05d", i)), value))
+		if i%2500 == 2499 && i < 9000 {
+			require.NoError(t, e.Flush())
+		}
+	}
+	e.WaitForFlush()
+
+	totalKeys, totalBytes := e.ApproximateSize(nil, nil)
+	assert.InEpsilon(t, 10000, totalKeys, 0.02)
+
+	for _, r := range []struct{ start, end int }{{0, 10000}, {2000, 5000}, {4321, 4821}, {9500, 10000}} {
+		keys, size := e.ApproximateSize([]byte(fmt.Sprintf("key%05d", r.start)), []byte(fmt.Sprintf("key%05d", r.end)))
+		want := float64(r.end - r.start)
+		assert.InEpsilon(t, want, float64(keys), 0.1, "[%d, %d)", r.start, r.end)
+		assert.InEpsilon(t, want/10000*float64(totalBytes), float64(size), 0.1, "[%d, %d)", r.start, r.end)
+	}
+
+	keys, size := e.ApproximateSize([]byte("zzz"), nil)
+	assert.Zero(t, keys)
+	assert.Zero(t, size)
+}
+
+// tableEntries returns every entry of reader as key=value, with "-" for
+// tombstones.
+func tableEntries(t *testing.T, reader *sstable.Reader) []string {
+	t.Helper()
+	var got []string
+	it := reader.NewIterator()
+	for it.Next() {
+		if it.IsDeleted() {
+			got = append(got, string(it.Key())+"=-")
+		} else {
+			got = append(got, string(it.Key())+"="+string(it.Value()))
+		}
+	}
+	require.NoError(t, it.Error())
+	return got
+}
+
+func TestRepair_QuarantinesCorruptTable(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := range 10 {
+			require.NoError(t, e.Put(fmt.Appendf(nil, "%s-%02d", prefix, i), fmt.Appendf(nil, "val-%s-%02d", prefix, i)))
+		}
+		require.NoError(t, e.Flush())
+	}
+	require.NoError(t, e.Close())
+
+	// Damage a value in the table holding the b keys
+	bad := filepath.Join(tmpDir, "sstables", "T0", "000002.sst")
+	data, err := os.ReadFile(bad)
+	require.NoError(t, err)
+	pos := bytes.Index(data, []byte("val-b-05"))
+	require.Positive(t, pos)
+	data[pos] ^= 0xff
+	require.NoError(t, os.WriteFile(bad, data, 0644))
+	manifest, err := os.ReadFile(filepath.Join(tmpDir, "MANIFEST"))
+	require.NoError(t, err)
+
+	// A dry run reports the damage without changing anything
+	report, err := engine.RepairWithOptions(tmpDir, nil, engine.RepairOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, engine.RepairReport{TablesScanned: 3, Damaged: []string{bad}, RecoverableKeys: 20}, report)
+	assert.FileExists(t, bad)
+	after, err := os.ReadFile(filepath.Join(tmpDir, "MANIFEST"))
+	require.NoError(t, err)
+	assert.Equal(t, manifest, after)
+
+	report, err = engine.Repair(tmpDir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.TablesScanned)
+	assert.Equal(t, 1, report.TablesQuarantined)
+	assert.Equal(t, []string{bad}, report.Damaged)
+	assert.Equal(t, uint64(20), report.RecoverableKeys)
+	assert.Equal(t, []string{filepath.Join(tmpDir, "quarantine", "T0-000002.sst")}, report.Quarantined)
+	assert.NoFileExists(t, bad)
+	assert.FileExists(t, report.Quarantined[0])
+
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	assert.Equal(t, []int{2}, e.Stats().TablesPerTier)
+	for _, prefix := range []string{"a", "b", "c"} {
+		val, found := e.Get(fmt.Appendf(nil, "%s-05", prefix))
+		if prefix == "b" {
+			assert.False(t, found)
+			continue
+		}
+		require.True(t, found, prefix)
+		assert.Equal(t, "val-"+prefix+"-05", string(val))
+	}
+
+	// A second repair finds nothing left to quarantine
+	require.NoError(t, e.Close())
+	report, err = engine.Repair(tmpDir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, engine.RepairReport{TablesScanned: 2, RecoverableKeys: 20}, report)
+}
+
+func TestEngine_Checkpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 2})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for round := range 3 {
+		for i := range 20 {
+			require.NoError(t, e.Put(fmt.Appendf(nil, "key-%02d", i), fmt.Appendf(nil, "v%d", round)))
+		}
+		require.NoError(t, e.Flush())
+	}
+	require.NoError(t, e.Delete([]byte("key-00")))
+	require.NoError(t, e.DeleteRange([]byte("key-10"), []byte("key-12")))
+
+	// The memtable is flushed into the checkpoint
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	require.NoError(t, e.Checkpoint(checkpoint))
+	assert.FileExists(t, filepath.Join(checkpoint, "CHECKPOINT"))
+	assert.ErrorIs(t, e.Checkpoint(checkpoint), gerrors.ErrInvalidArgument)
+	// A destDir that cannot be read is reported as it is, not as empty
+	assert.ErrorContains(t, e.Checkpoint(filepath.Join(checkpoint, "CHECKPOINT")), "failed to read checkpoint directory")
+
+	// Later writes and compactions of the original do not reach it
+	for i := range 20 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%02d", i), []byte("after")))
+	}
+	require.NoError(t, e.Put([]byte("new"), []byte("after")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.CompactAll())
+
+	c := engine.NewEngine(nil)
+	require.NoError(t, c.OpenDB(checkpoint))
+	defer func() { require.NoError(t, c.Close()) }()
+	for i := range 20 {
+		val, found := c.Get(fmt.Appendf(nil, "key-%02d", i))
+		if i == 0 || i == 10 || i == 11 {
+			assert.False(t, found, i)
+			continue
+		}
+		require.True(t, found, i)
+		assert.Equal(t, "v2", string(val), i)
+	}
+	_, found := c.Get([]byte("new"))
+	assert.False(t, found)
+
+	val, found := e.Get([]byte("key-00"))
+	require.True(t, found)
+	assert.Equal(t, "after", string(val))
+}
+
+func TestEngine_PrefixScan(t *testing.T) {
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, k := range []string{"user:2", "item:1", "user:1", "user;", "use", "\xff\xff", "\xff\xffz", "user:3"} {
+		require.NoError(t, e.Put([]byte(k), []byte("v")))
+	}
+	// Part of the data on disk, part deleted
+	e.SealMemtable()
+	require.NoError(t, e.FlushSealed())
+	require.NoError(t, e.Delete([]byte("user:3")))
+
+	scan := func(prefix string) []string {
+		it, err := e.PrefixScan([]byte(prefix))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, it.Close()) }()
+		return collectKeys(t, it, 100)
+	}
+
+	assert.Equal(t, []string{"user:1", "user:2"}, scan("user:"))
+	assert.Equal(t, []string{"item:1"}, scan("item"))
+	assert.Empty(t, scan("nope"))
+	// An all-0xFF prefix has no upper bound and scans to the end
+	assert.Equal(t, []string{"\xff\xff", "\xff\xffz"}, scan("\xff\xff"))
+	assert.Equal(t, []string{"item:1", "use", "user:1", "user:2", "user;", "\xff\xff", "\xff\xffz"}, scan(""))
+}
+
+// fakeClock is a settable clock for Config.Clock.
+type fakeClock struct {
+	now atomic.Int64
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{}
+	c.now.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	return c
+}
+
+func (c *fakeClock) Now() time.Time          { return time.Unix(0, c.now.Load()) }
+func (c *fakeClock) Advance(d time.Duration) { c.now.Add(int64(d)) }
+
+func TestEngine_SetWithTTL(t *testing.T) {
+	tmpDir := t.TempDir()
+	clock := newFakeClock()
+
+	e := engine.NewEngine(&config.Config{Clock: clock.Now})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// An older permanent value on disk must stay shadowed once "a" expires
+	require.NoError(t, e.Put([]byte("a"), []byte("old")))
+	require.NoError(t, e.Flush())
+
+	require.NoError(t, e.SetWithTTL([]byte("a"), []byte("short"), time.Minute))
+	require.NoError(t, e.SetWithTTL([]byte("b"), []byte("long"), time.Hour))
+	require.NoError(t, e.Put([]byte("c"), []byte("forever")))
+
+	value, found := e.Get([]byte("a"))
+	assert.True(t, found)
+	assert.Equal(t, "short", string(value))
+
+	live := func() []string {
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, it.Close()) }()
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		require.NoError(t, it.Error())
+		return keys
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, live())
+
+	clock.Advance(2 * time.Minute)
+	_, found = e.Get([]byte("a"))
+	assert.False(t, found)
+	assert.Equal(t, []string{"b", "c"}, live())
+
+	// Expiry survives the flush to an SSTable
+	require.NoError(t, e.Flush())
+	_, found = e.Get([]byte("a"))
+	assert.False(t, found)
+	value, found = e.Get([]byte("b"))
+	assert.True(t, found)
+	assert.Equal(t, "long", string(value))
+
+	// Compaction into the bottom tier, with nothing older beneath, drops
+	// the expired entry and every version under it, but keeps the
+	// unexpired expiry
+	require.NoError(t, e.CompactAll())
+	tiers := e.Tiers()
+	out := tiers[len(tiers)-1][0]
+	_, found, err := out.GetEntry([]byte("a"))
+	require.NoError(t, err)
+	assert.False(t, found, "expired entry left in the bottom tier")
+	entry, err := out.Get([]byte("b"))
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now().Add(58*time.Minute).UnixNano(), entry.ExpiresAt)
+
+	clock.Advance(time.Hour)
+	_, found = e.Get([]byte("b"))
+	assert.False(t, found)
+	assert.Equal(t, []string{"c"}, live())
+}
+
+func TestEngine_SetWithTTL_WALReplay(t *testing.T) {
+	tmpDir := t.TempDir()
+	clock := newFakeClock()
+	writeTierSST(t, tmpDir, 0, 1, map[string]string{"a": "old", "b": "old"})
+
+	e := engine.NewEngine(&config.Config{Clock: clock.Now})
+	require.NoError(t, e.OpenDB(tmpDir))
+	require.NoError(t, e.SetWithTTL([]byte("a"), []byte("new"), time.Minute))
+	require.NoError(t, e.SetWithTTL([]byte("b"), []byte("new"), time.Hour))
+	e.Crash()
+
+	clock.Advance(2 * time.Minute)
+	e = engine.NewEngine(&config.Config{Clock: clock.Now})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// The replayed expired put hides the older value instead of reviving it
+	_, found := e.Get([]byte("a"))
+	assert.False(t, found)
+	value, found := e.Get([]byte("b"))
+	assert.True(t, found)
+	assert.Equal(t, "new", string(value))
+
+	clock.Advance(time.Hour)
+	_, found = e.Get([]byte("b"))
+	assert.False(t, found)
+}
+
+// assertDisjointLevels checks that the tables of every tier below T0 cover
+// non-overlapping key ranges.
+func assertDisjointLevels(t *testing.T, tiers [][]*sstable.Reader) {
+	t.Helper()
+	for level := 1; level < len(tiers); level++ {
+		tables := slices.Clone(tiers[level])
+		slices.SortFunc(tables, func(a, b *sstable.Reader) int { return bytes.Compare(a.MinKey(), b.MinKey()) })
+		for i := 1; i < len(tables); i++ {
+			assert.Negative(t, bytes.Compare(tables[i-1].MaxKey(), tables[i].MinKey()),
+				"T%d tables %s and %s overlap", level, tables[i-1].Path(), tables[i].Path())
+		}
+	}
+}
+
+func TestEngine_LeveledCompaction_DisjointLevels(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		CompactionStrategy: config.LeveledCompaction,
+		MaxTablesPerTier:   1,
+		MaxMemtableSize:    512,
+		StrictInvariants:   true,
+	}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	// Overwrite keys spread over the whole key space in every round
+	want := make(map[string]string)
+	for round := range 10 {
+		for i := range 60 {
+			key := fmt.Sprintf("key-%03d", (i*37+round*11)%200)
+			value := fmt.Sprintf("value-%d-%d", round, i)
+			require.NoError(t, e.Put([]byte(key), []byte(value)))
+			want[key] = value
+		}
+		require.NoError(t, e.Flush())
+		e.WaitForFlush()
+		assertDisjointLevels(t, e.Tiers())
+	}
+
+	// L1 overflowed its 10 tables into L2
+	tiers := e.Tiers()
+	require.Greater(t, len(tiers), 2)
+	assert.NotEmpty(t, tiers[2])
+	for key, value := range want {
+		got, found := e.Get([]byte(key))
+		assert.True(t, found, key)
+		assert.Equal(t, value, string(got), key)
+	}
+
+	// The levels are rebuilt from the manifest on reopen
+	require.NoError(t, e.Close())
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	assertDisjointLevels(t, e.Tiers())
+	for key, value := range want {
+		got, found := e.Get([]byte(key))
+		assert.True(t, found, key)
+		assert.Equal(t, value, string(got), key)
+	}
+}
+
+func TestEngine_LeveledCompaction_RewritesOnlyOverlappingTables(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(&config.Config{
+		CompactionStrategy: config.LeveledCompaction,
+		MaxTablesPerTier:   1,
+		MaxMemtableSize:    1024,
+	})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Two flushes push a full key range into L1, split into several tables
+	for i := range 100 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%03d", i), []byte("v1")))
+	}
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.Put([]byte("key-000"), []byte("v2")))
+	require.NoError(t, e.Flush())
+	e.WaitForFlush()
+
+	before := e.Tiers()[1]
+	require.Greater(t, len(before), 2)
+	paths := func(tables []*sstable.Reader) []string {
+		var out []string
+		for _, reader := range tables {
+			out = append(out, reader.Path())
+		}
+		return out
+	}
+	untouched := paths(before)
+
+	// Pushing a single key down only rewrites the L1 table that holds it
+	require.NoError(t, e.Put([]byte("key-099"), []byte("v2")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.Put([]byte("key-099"), []byte("v3")))
+	require.NoError(t, e.Flush())
+	e.WaitForFlush()
+
+	after := paths(e.Tiers()[1])
+	var kept int
+	for _, path := range untouched {
+		if slices.Contains(after, path) {
+			kept++
+		}
+	}
+	assert.Equal(t, len(untouched)-1, kept, "only the table holding key-099 should be rewritten")
+	assertDisjointLevels(t, e.Tiers())
+
+	value, found := e.Get([]byte("key-099"))
+	assert.True(t, found)
+	assert.Equal(t, "v3", string(value))
+	value, found = e.Get([]byte("key-000"))
+	assert.True(t, found)
+	assert.Equal(t, "v2", string(value))
+}
+
+func TestEngine_Has(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTierSST(t, tmpDir, 1, 1, map[string]string{"deep": "t1", "gone": "t1"})
+	writeTierSST(t, tmpDir, 0, 2, map[string]string{"disk": "t0", "gone": "-"})
+
+	clock := newFakeClock()
+	e := engine.NewEngine(&config.Config{NegativeCacheSize: 16, Clock: clock.Now})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	require.NoError(t, e.Put([]byte("sealed"), []byte("immutable")))
+	e.SealMemtable()
+	require.NoError(t, e.Put([]byte("mem"), []byte("active")))
+	require.NoError(t, e.Delete([]byte("disk")))
+	require.NoError(t, e.SetWithTTL([]byte("ttl"), []byte("v"), time.Minute))
+
+	for key, want := range map[string]bool{
+		"deep":    true,
+		"gone":    false, // tombstone in a newer table
+		"disk":    false, // deleted in the memtable
+		"sealed":  true,
+		"mem":     true,
+		"ttl":     true,
+		"missing": false,
+	} {
+		assert.Equal(t, want, e.Has([]byte(key)), key)
+		_, found := e.Get([]byte(key))
+		assert.Equal(t, found, e.Has([]byte(key)), key)
+	}
+
+	clock.Advance(time.Minute)
+	assert.False(t, e.Has([]byte("ttl")))
+
+	// A key written after a cached miss is found
+	require.NoError(t, e.Put([]byte("missing"), []byte("now")))
+	assert.True(t, e.Has([]byte("missing")))
+}
+
+func TestEngine_GetMany(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTierSST(t, tmpDir, 1, 1, map[string]string{"deep": "t1", "shadowed": "t1", "gone": "t1"})
+	writeTierSST(t, tmpDir, 0, 2, map[string]string{"disk": "t0", "shadowed": "t0", "gone": "-"})
+
+	e := engine.NewEngine(&config.Config{NegativeCacheSize: 16})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	require.NoError(t, e.Put([]byte("sealed"), []byte("immutable")))
+	require.NoError(t, e.Put([]byte("deep"), []byte("immutable")))
+	e.SealMemtable()
+	require.NoError(t, e.Put([]byte("mem"), []byte("active")))
+	require.NoError(t, e.Delete([]byte("disk-deleted")))
+
+	keys := []string{"missing", "deep", "mem", "gone", "disk", "sealed", "shadowed", "disk-deleted", "mem", "zzz"}
+	input := make([][]byte, len(keys))
+	for i, key := range keys {
+		input[i] = []byte(key)
+	}
+
+	values, found, err := e.GetMany(input)
+	require.NoError(t, err)
+	want := []string{"", "immutable", "active", "", "t0", "immutable", "t0", "", "active", ""}
+	for i, key := range keys {
+		assert.Equal(t, want[i] != "", found[i], key)
+		assert.Equal(t, want[i], string(values[i]), key)
+
+		// Every result matches a single Get
+		value, ok := e.Get([]byte(key))
+		assert.Equal(t, ok, found[i], key)
+		assert.Equal(t, string(value), string(values[i]), key)
+	}
+
+	// Misses are cached like those of Get
+	assert.Positive(t, e.NegativeCacheLen())
+	values, found, err = e.GetMany(input)
+	require.NoError(t, err)
+	assert.False(t, found[0])
+	assert.Equal(t, "t0", string(values[4]))
+
+	values, found, err = e.GetMany(nil)
+	require.NoError(t, err)
+	assert.Empty(t, values)
+	assert.Empty(t, found)
+}
+
+func TestEngine_ConcurrentWriters(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		MaxMemtableSize:   4096,
+		MaxTablesPerTier:  4,
+		WALFlushThreshold: 1,
+		MaxValueSize:      64,
+	}
+	const (
+		writers = 16
+		rounds  = 50
+	)
+
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				key := fmt.Appendf(nil, "w%02d-%03d", w, i)
+				switch i % 4 {
+				case 0:
+					assert.NoError(t, e.Put(key, key))
+				case 1:
+					assert.NoError(t, e.PutMany([]engine.KV{{Key: key, Value: key}}))
+				case 2:
+					var b engine.Batch
+					b.Put(key, key)
+					b.Put(append(key, "-deleted"...), key)
+					b.Delete(append(key, "-deleted"...))
+					assert.NoError(t, e.Write(&b))
+				case 3:
+					// A rejected write must not fail the writes committed with it
+					err := e.Put(key, bytes.Repeat([]byte("v"), 65))
+					assert.ErrorIs(t, err, gerrors.ErrEntryTooLarge)
+					assert.NoError(t, e.Put(key, key))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(e *engine.Engine) {
+		for w := range writers {
+			for i := range rounds {
+				key := fmt.Appendf(nil, "w%02d-%03d", w, i)
+				val, found := e.Get(key)
+				require.True(t, found, "%s", key)
+				assert.Equal(t, key, val)
+				_, found = e.Get(append(key, "-deleted"...))
+				assert.False(t, found, "%s-deleted", key)
+			}
+		}
+	}
+	check(e)
+	require.NoError(t, e.Close())
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	check(e)
+}
+
+func TestEngine_BatchWritesJoinGroups(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Hold the engine lock so a batch and a PutMany queue up behind a
+	// leader and are committed in its group
+	unlock := e.LockForTest()
+	leaderDone := make(chan error, 1)
+	go func() { leaderDone <- e.Put([]byte("leader"), []byte("v")) }()
+	require.Eventually(t, func() bool { return e.QueuedWrites() == 1 }, time.Second, time.Millisecond)
+
+	batchDone := make(chan error, 1)
+	go func() {
+		var b engine.Batch
+		b.Put([]byte("batch"), []byte("v"))
+		batchDone <- e.Write(&b)
+	}()
+	require.Eventually(t, func() bool { return e.QueuedWrites() == 2 }, time.Second, time.Millisecond)
+	manyDone := make(chan error, 1)
+	go func() { manyDone <- e.PutMany([]engine.KV{{Key: []byte("many"), Value: []byte("v")}}) }()
+	require.Eventually(t, func() bool { return e.QueuedWrites() == 3 }, time.Second, time.Millisecond)
+
+	unlock()
+	require.NoError(t, <-leaderDone)
+	require.NoError(t, <-batchDone)
+	require.NoError(t, <-manyDone)
+	for _, key := range []string{"leader", "batch", "many"} {
+		_, found := e.Get([]byte(key))
+		assert.True(t, found, key)
+	}
+}
+
+func TestEngine_PutCtxCanceledWhileQueued(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Hold the engine lock so the writes below queue up behind a leader
+	unlock := e.LockForTest()
+	leaderDone := make(chan error, 1)
+	go func() { leaderDone <- e.Put([]byte("leader"), []byte("v")) }()
+	require.Eventually(t, func() bool { return e.QueuedWrites() == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queuedDone := make(chan error, 1)
+	go func() { queuedDone <- e.PutCtx(ctx, []byte("queued"), []byte("v")) }()
+	require.Eventually(t, func() bool { return e.QueuedWrites() == 2 }, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-queuedDone, context.Canceled)
+	assert.Equal(t, 1, e.QueuedWrites())
+
+	unlock()
+	require.NoError(t, <-leaderDone)
+	_, found := e.Get([]byte("leader"))
+	assert.True(t, found)
+	_, found = e.Get([]byte("queued"))
+	assert.False(t, found)
+	assert.Zero(t, e.QueuedWrites())
+}
+
+func TestEngine_SSTableInfo(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 10})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	assert.Empty(t, e.SSTableInfo())
+
+	flushes := [][]string{{"b", "c", "d"}, {"a", "b"}, {"x"}}
+	for _, keys := range flushes {
+		for _, key := range keys {
+			require.NoError(t, e.Put([]byte(key), []byte("v")))
+		}
+		require.NoError(t, e.Flush())
+	}
+	require.NoError(t, e.Delete([]byte("c")))
+	require.NoError(t, e.Flush())
+
+	infos := e.SSTableInfo()
+	require.Len(t, infos, 4)
+	want := []struct {
+		minKey, maxKey string
+		entries        uint64
+	}{{"b", "d", 3}, {"a", "b", 2}, {"x", "x", 1}, {"c", "c", 1}}
+	for i, info := range infos {
+		assert.Equal(t, 0, info.Tier, i)
+		assert.Equal(t, want[i].minKey, string(info.MinKey), i)
+		assert.Equal(t, want[i].maxKey, string(info.MaxKey), i)
+		assert.Equal(t, want[i].entries, info.Entries, i)
+		stat, err := os.Stat(info.Path)
+		require.NoError(t, err)
+		assert.Equal(t, stat.Size(), info.Size, i)
+	}
+
+	// Compaction replaces the tables with one deeper table holding the
+	// newest version of each key
+	require.NoError(t, e.CompactAll())
+	infos = e.SSTableInfo()
+	require.Len(t, infos, 1)
+	assert.Equal(t, 1, infos[0].Tier)
+	assert.Equal(t, "a", string(infos[0].MinKey))
+	assert.Equal(t, "x", string(infos[0].MaxKey))
+	assert.Equal(t, uint64(4), infos[0].Entries)
+	assert.Equal(t, tmpDir, filepath.Dir(filepath.Dir(filepath.Dir(infos[0].Path))))
+}
+
+func TestEngine_FailedCompactionKeepsInputsReadable(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 10})
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for _, k := range []string{"a", "b"} {
+		require.NoError(t, e.Put([]byte(k), []byte("1")))
+		e.SealMemtable()
+		require.NoError(t, e.FlushSealed())
+	}
+
+	// A directory in place of the output's temporary file makes creating
+	// the compaction's writer fail
+	blocked := filepath.Join(tmpDir, "sstables", "T1", "000003.sst"+sstable.TempSuffix)
+	require.NoError(t, os.MkdirAll(blocked, 0755))
+	require.Error(t, e.CompactTierSync(0))
+
+	check := func(stage string) {
+		t.Helper()
+		for _, k := range []string{"a", "b"} {
+			value, found, err := e.GetCtx(context.Background(), []byte(k))
+			require.NoError(t, err, stage)
+			assert.True(t, found, stage)
+			assert.Equal(t, "1", string(value), stage)
+		}
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err, stage)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		require.NoError(t, it.Error(), stage)
+		require.NoError(t, it.Close())
+		assert.Equal(t, []string{"a", "b"}, keys, stage)
+	}
+	// The inputs are still live in T0 and must still be open
+	require.Len(t, e.Tiers()[0], 2)
+	check("failed")
+
+	require.NoError(t, os.Remove(blocked))
+	require.NoError(t, e.CompactTierSync(0))
+	assert.Empty(t, e.Tiers()[0])
+	check("compacted")
+}
+
+func TestEngine_CompactTier(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTierSST(t, tmpDir, 2, 1, map[string]string{"a": "t2", "z": "t2"})
+	writeTierSST(t, tmpDir, 0, 2, map[string]string{"a": "t0-old", "b": "t0-old"})
+	writeTierSST(t, tmpDir, 0, 3, map[string]string{"b": "t0", "c": "-"})
+
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	t2 := e.SSTableInfo()[2]
+	require.Equal(t, 2, t2.Tier)
+
+	require.NoError(t, e.CompactTier(0))
+
+	// T0 lands in a single T1 table, tombstone included since T2 still
+	// holds data below it, and T2 is untouched
+	assert.Equal(t, []int{0, 1, 1}, e.Stats().TablesPerTier)
+	infos := e.SSTableInfo()
+	assert.Equal(t, "a", string(infos[0].MinKey))
+	assert.Equal(t, "c", string(infos[0].MaxKey))
+	assert.Equal(t, uint64(3), infos[0].Entries)
+	assert.Equal(t, t2, infos[1])
+
+	want := map[string]string{"a": "t0-old", "b": "t0", "c": "", "z": "t2"}
+	for key, value := range want {
+		got, found := e.Get([]byte(key))
+		assert.Equal(t, value != "", found, key)
+		assert.Equal(t, value, string(got), key)
+	}
+
+	assert.ErrorIs(t, e.CompactTier(-1), gerrors.ErrInvalidArgument)
+	assert.ErrorContains(t, e.CompactTier(3), "out of range")
+}
+
+func TestEngine_PutWithOptionsSync(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		WALSyncMode:       config.WALSyncNever,
+		WALFlushThreshold: 1 << 20,
+		WALFlushInterval:  time.Hour,
+	}
+
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	require.NoError(t, e.Put([]byte("bulk"), []byte("v")))
+	require.NoError(t, e.PutWithOptions([]byte("critical"), []byte("v"), engine.WriteOptions{Sync: true}))
+	require.NoError(t, e.Put([]byte("after"), []byte("v")))
+
+	// Copy the files as they are now, as if the process died without
+	// closing anything
+	crashDir := filepath.Join(t.TempDir(), "crash")
+	require.NoError(t, os.CopyFS(crashDir, os.DirFS(tmpDir)))
+
+	recovered := engine.NewEngine(cfg)
+	require.NoError(t, recovered.OpenDB(crashDir))
+	defer func() { require.NoError(t, recovered.Close()) }()
+
+	for key, want := range map[string]bool{"bulk": true, "critical": true, "after": false} {
+		_, found := recovered.Get([]byte(key))
+		assert.Equal(t, want, found, key)
+	}
+}
+
+// addMerge is an integer-add merge function over decimal values.
+func addMerge(existing, operand []byte) []byte {
+	sum, _ := strconv.Atoi(string(existing))
+	n, _ := strconv.Atoi(string(operand))
+	return strconv.AppendInt(nil, int64(sum+n), 10)
+}
+
+func TestEngine_Merge(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{MaxTablesPerTier: 2, MergeFunc: addMerge}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	require.NoError(t, e.Put([]byte("counter"), []byte("100")))
+	require.NoError(t, e.Flush())
+
+	const writers, merges = 8, 50
+	want := 100
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range merges {
+				operand := strconv.AppendInt(nil, int64(w*merges+i), 10)
+				assert.NoError(t, e.Merge([]byte("counter"), operand))
+				assert.NoError(t, e.Merge([]byte("fresh"), []byte("1")))
+				// Spread the operands over SSTables while background
+				// compactions combine them
+				if i%10 == 9 {
+					assert.NoError(t, e.Flush())
+				}
+			}
+		}()
+		for i := range merges {
+			want += w*merges + i
+		}
+	}
+	wg.Wait()
+
+	// Operands written after a delete apply to no value
+	require.NoError(t, e.Put([]byte("reset"), []byte("7")))
+	require.NoError(t, e.Merge([]byte("reset"), []byte("1")))
+	require.NoError(t, e.DeleteRange([]byte("reset"), []byte("reset\x00")))
+	require.NoError(t, e.Merge([]byte("reset"), []byte("5")))
+
+	wantValues := map[string]string{"counter": strconv.Itoa(want), "fresh": strconv.Itoa(writers * merges), "reset": "5"}
+	check := func(stage string) {
+		t.Helper()
+		for key, value := range wantValues {
+			got, found := e.Get([]byte(key))
+			assert.True(t, found, "%s: %s", stage, key)
+			assert.Equal(t, value, string(got), "%s: %s", stage, key)
+			assert.True(t, e.Has([]byte(key)), "%s: %s", stage, key)
+		}
+
+		values, _, err := e.GetMany([][]byte{[]byte("counter"), []byte("fresh")})
+		require.NoError(t, err)
+		assert.Equal(t, wantValues["counter"], string(values[0]), stage)
+		assert.Equal(t, wantValues["fresh"], string(values[1]), stage)
+
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		got := map[string]string{}
+		for it.Next() {
+			got[string(it.Key())] = string(it.Value())
+		}
+		require.NoError(t, it.Error())
+		require.NoError(t, it.Close())
+		assert.Equal(t, wantValues, got, stage)
+	}
+	check("merged")
+
+	// Operands still in the memtable are replayed from the WAL
+	require.NoError(t, e.Merge([]byte("fresh"), []byte("10")))
+	wantValues["fresh"] = strconv.Itoa(writers*merges + 10)
+	e.Crash()
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	check("replayed")
+
+	// Compaction folds every operand into a plain value
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.CompactAll())
+	tiers := e.Tiers()
+	bottom := tiers[len(tiers)-1]
+	require.Len(t, bottom, 1)
+	assert.Equal(t, []string{"counter=" + wantValues["counter"], "fresh=" + wantValues["fresh"], "reset=5"}, tableEntries(t, bottom[0]))
+	check("compacted")
+
+	assert.Error(t, engine.NewEngine(nil).Merge([]byte("k"), []byte("1")))
+}
+
+func TestEngine_OperationsAfterClose(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MergeFunc: addMerge})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	require.NoError(t, e.Put([]byte("k"), []byte("v")))
+	it, err := e.NewIterator(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, e.Close())
+
+	var batch engine.Batch
+	batch.Put([]byte("k"), []byte("v"))
+	ops := map[string]func() error{
+		"Put":            func() error { return e.Put([]byte("k"), []byte("v")) },
+		"SetWithTTL":     func() error { return e.SetWithTTL([]byte("k"), []byte("v"), time.Hour) },
+		"PutWithOptions": func() error { return e.PutWithOptions([]byte("k"), []byte("v"), engine.WriteOptions{Sync: true}) },
+		"PutMany":        func() error { return e.PutMany([]engine.KV{{Key: []byte("k"), Value: []byte("v")}}) },
+		"Write":          func() error { return e.Write(&batch) },
+		"Delete":         func() error { return e.Delete([]byte("k")) },
+		"DeleteRange":    func() error { return e.DeleteRange([]byte("a"), []byte("z")) },
+		"Merge":          func() error { return e.Merge([]byte("k"), []byte("1")) },
+		"Flush":          e.Flush,
+		"CompactAll":     e.CompactAll,
+		"GetCtx": func() error {
+			_, _, err := e.GetCtx(context.Background(), []byte("k"))
+			return err
+		},
+		"GetMany": func() error {
+			_, _, err := e.GetMany([][]byte{[]byte("k")})
+			return err
+		},
+		"NewIterator": func() error {
+			_, err := e.NewIterator(nil, nil)
+			return err
+		},
+		"ScanPrefix": func() error {
+			return e.ScanPrefix(nil, func(key, value []byte) bool { return true })
+		},
+		"RangeHash": func() error {
+			_, err := e.RangeHash(nil, nil)
+			return err
+		},
+	}
+	for name, op := range ops {
+		assert.ErrorIs(t, op(), gerrors.ErrClosed, name)
+	}
+
+	_, found := e.Get([]byte("k"))
+	assert.False(t, found)
+	assert.False(t, e.Has([]byte("k")))
+	require.NoError(t, e.Close())
+
+	// An iterator created before Close still reads its snapshot
+	require.True(t, it.Next())
+	assert.Equal(t, "v", string(it.Value()))
+	require.NoError(t, it.Close())
+}
+
+func TestEngine_ParanoidChecks(t *testing.T) {
+	tmpDir := t.TempDir()
+	e := engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for i := range 20 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%02d", i), fmt.Appendf(nil, "value-%02d", i)))
+	}
+	require.NoError(t, e.Close())
+
+	files, err := filepath.Glob(filepath.Join(tmpDir, "sstables", "T*", "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	pos := bytes.Index(data, []byte("value-15"))
+	require.Positive(t, pos)
+	data[pos+len("value-")] ^= 0xff
+	require.NoError(t, os.WriteFile(files[0], data, 0644))
+
+	// Without paranoid checks only a read of the damaged entry fails
+	e = engine.NewEngine(nil)
+	require.NoError(t, e.OpenDB(tmpDir))
+	got, found, err := e.GetCtx(context.Background(), []byte("key-03"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "value-03", string(got))
+	_, _, err = e.GetCtx(context.Background(), []byte("key-15"))
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+	require.NoError(t, e.Close())
+
+	e = engine.NewEngine(&config.Config{ParanoidChecks: true})
+	assert.ErrorIs(t, e.OpenDB(tmpDir), gerrors.ErrChecksumMismatch)
+}
+
+func TestEngine_MissingTables(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{MaxTablesPerTier: 10}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, e.Put([]byte(key), []byte(key)))
+		require.NoError(t, e.Flush())
+	}
+	infos := e.SSTableInfo()
+	require.Len(t, infos, 3)
+	require.NoError(t, e.Close())
+	require.NoError(t, os.Remove(infos[1].Path))
+
+	// By default the open fails and names the missing table
+	e = engine.NewEngine(cfg)
+	err := e.OpenDB(tmpDir)
+	require.ErrorIs(t, err, gerrors.ErrCorrupt)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Contains(t, err.Error(), infos[1].Path)
+
+	// With IgnoreMissingTables the table's data is gone and the rest stays
+	lenient := *cfg
+	lenient.IgnoreMissingTables = true
+	e = engine.NewEngine(&lenient)
+	require.NoError(t, e.OpenDB(tmpDir))
+	check := func() {
+		t.Helper()
+		for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+			_, found := e.Get([]byte(key))
+			assert.Equal(t, want, found, key)
+		}
+		assert.Len(t, e.SSTableInfo(), 2)
+	}
+	check()
+	require.NoError(t, e.Close())
+
+	// The table was dropped from the manifest, so the default open works
+	// again
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	check()
+}
+
+func TestEngine_UnreadableTableFailsOpen(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{MaxTablesPerTier: 10}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	for _, key := range []string{"a", "b"} {
+		require.NoError(t, e.Put([]byte(key), []byte(key)))
+		require.NoError(t, e.Flush())
+	}
+	infos := e.SSTableInfo()
+	require.Len(t, infos, 2)
+	require.NoError(t, e.Close())
+
+	// A table in a format version this release no longer reads
+	data, err := os.ReadFile(infos[0].Path)
+	require.NoError(t, err)
+	data[len(data)-sstable.MagicSize-1] = 1
+	require.NoError(t, os.WriteFile(infos[0].Path, data, 0644))
+
+	// Even with IgnoreMissingTables the open fails, every time, and the
+	// table stays on disk
+	lenient := *cfg
+	lenient.IgnoreMissingTables = true
+	for range 2 {
+		e = engine.NewEngine(&lenient)
+		err = e.OpenDB(tmpDir)
+		require.ErrorIs(t, err, gerrors.ErrUnsupportedVersion)
+		assert.Contains(t, err.Error(), infos[0].Path)
+		_, statErr := os.Stat(infos[0].Path)
+		require.NoError(t, statErr)
+	}
+
+	// Repair sets the table aside so the rest of the data opens
+	report, err := engine.Repair(tmpDir, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.TablesQuarantined)
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	_, found := e.Get([]byte("b"))
+	assert.True(t, found)
+}
+
+func TestEngine_TierPaths(t *testing.T) {
+	dataDir, fast, slow := t.TempDir(), t.TempDir(), t.TempDir()
+	cfg := &config.Config{MaxTablesPerTier: 10, TierPaths: []string{fast, slow}}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(dataDir))
+
+	for i := range 3 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%d", i), []byte("old")))
+		require.NoError(t, e.Flush())
+	}
+	require.NoError(t, e.CompactTier(0))
+	require.NoError(t, e.Put([]byte("key-0"), []byte("new")))
+	require.NoError(t, e.Flush())
+
+	// Each tier's tables are written under its own directory
+	check := func(stage string, roots map[int]string) {
+		t.Helper()
+		infos := e.SSTableInfo()
+		require.Len(t, infos, 2, stage)
+		for _, info := range infos {
+			want := filepath.Join(roots[info.Tier], "sstables", fmt.Sprintf("T%d", info.Tier))
+			assert.Equal(t, want, filepath.Dir(info.Path), stage)
+		}
+		for i, want := range []string{"new", "old", "old"} {
+			got, found := e.Get(fmt.Appendf(nil, "key-%d", i))
+			assert.True(t, found, "%s: %d", stage, i)
+			assert.Equal(t, want, string(got), "%s: %d", stage, i)
+		}
+	}
+	check("written", map[int]string{0: fast, 1: slow})
+	files, err := filepath.Glob(filepath.Join(dataDir, "sstables", "*", "*.sst"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	require.NoError(t, e.Close())
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(dataDir))
+	check("reopened", map[int]string{0: fast, 1: slow})
+	require.NoError(t, e.Close())
+
+	// The manifest records where the tables are, so they are found without
+	// TierPaths, and new tables go to the data directory
+	e = engine.NewEngine(&config.Config{MaxTablesPerTier: 10})
+	require.NoError(t, e.OpenDB(dataDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	check("without TierPaths", map[int]string{0: fast, 1: slow})
+	require.NoError(t, e.Put([]byte("key-3"), []byte("v")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.CompactAll())
+	infos := e.SSTableInfo()
+	require.Len(t, infos, 1)
+	assert.Equal(t, filepath.Join(dataDir, "sstables", fmt.Sprintf("T%d", infos[0].Tier)), filepath.Dir(infos[0].Path))
+	files, err = filepath.Glob(filepath.Join(slow, "sstables", "*", "*.sst"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+// sliceIterator is an engine.KeyValueIterator over a slice of pairs.
+type sliceIterator struct {
+	pairs []engine.KV
+	pos   int
+}
+
+func (it *sliceIterator) Next() bool {
+	it.pos++
+	return it.pos <= len(it.pairs)
+}
+
+func (it *sliceIterator) Key() []byte   { return it.pairs[it.pos-1].Key }
+func (it *sliceIterator) Value() []byte { return it.pairs[it.pos-1].Value }
+func (it *sliceIterator) Error() error  { return nil }
+
+func TestEngine_IngestSorted(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{MaxMemtableSize: 64 << 10, MaxTablesPerTier: 10}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+
+	require.NoError(t, e.Put([]byte("key00005"), []byte("old")))
+	require.NoError(t, e.Put([]byte("zzz"), []byte("kept")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.Put([]byte("key00010"), []byte("old")))
+
+	const n = 10000
+	pairs := make([]engine.KV, n)
+	for i := range pairs {
+		pairs[i] = engine.KV{Key: fmt.Appendf(nil, "key%05d", i), Value: fmt.Appendf(nil, "value%05d", i)}
+	}
+	require.NoError(t, e.IngestSorted(&sliceIterator{pairs: pairs}))
+
+	// The input overlaps existing keys, so it lands in T0 as several tables
+	// that replace the older values
+	infos := e.SSTableInfo()
+	assert.Greater(t, len(infos), 3)
+	for _, info := range infos {
+		assert.Equal(t, 0, info.Tier)
+	}
+	check := func(stage string) {
+		t.Helper()
+		for _, pair := range pairs {
+			got, found := e.Get(pair.Key)
+			require.True(t, found, "%s: %s", stage, pair.Key)
+			require.Equal(t, string(pair.Value), string(got), stage)
+		}
+		got, found := e.Get([]byte("zzz"))
+		assert.True(t, found, stage)
+		assert.Equal(t, "kept", string(got), stage)
+
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		count := 0
+		for it.Next() {
+			count++
+		}
+		require.NoError(t, it.Error())
+		require.NoError(t, it.Close())
+		assert.Equal(t, n+1, count, stage)
+	}
+	check("ingested")
+
+	// Unsorted input and empty keys add nothing
+	tables := len(e.SSTableInfo())
+	unsorted := []engine.KV{{Key: []byte("x2"), Value: []byte("v")}, {Key: []byte("x1"), Value: []byte("v")}}
+	assert.ErrorIs(t, e.IngestSorted(&sliceIterator{pairs: unsorted}), gerrors.ErrInvalidArgument)
+	duplicate := []engine.KV{{Key: []byte("x1"), Value: []byte("v")}, {Key: []byte("x1"), Value: []byte("v")}}
+	assert.ErrorIs(t, e.IngestSorted(&sliceIterator{pairs: duplicate}), gerrors.ErrInvalidArgument)
+	empty := []engine.KV{{Key: []byte("x1"), Value: []byte("v")}, {Value: []byte("v")}}
+	assert.ErrorIs(t, e.IngestSorted(&sliceIterator{pairs: empty}), gerrors.ErrEmptyKey)
+	assert.Len(t, e.SSTableInfo(), tables)
+	_, found := e.Get([]byte("x1"))
+	assert.False(t, found)
+	files, err := filepath.Glob(filepath.Join(tmpDir, "sstables", "T0", "*"))
+	require.NoError(t, err)
+	assert.Len(t, files, tables)
+
+	// Later writes still win over the ingested values, and everything
+	// survives a restart
+	require.NoError(t, e.Put([]byte("key00000"), []byte("new")))
+	pairs[0].Value = []byte("new")
+	check("written")
+	require.NoError(t, e.Close())
+
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+	check("reopened")
+}
+
+func TestEngine_IngestSortedIntoEmptyRange(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 2})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Into an empty database the tables go to T0
+	require.NoError(t, e.IngestSorted(&sliceIterator{pairs: []engine.KV{{Key: []byte("a"), Value: []byte("1")}}}))
+	require.NoError(t, e.Put([]byte("b"), []byte("2")))
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.CompactAll())
+	require.Len(t, e.SSTableInfo(), 1)
+	require.Equal(t, 1, e.SSTableInfo()[0].Tier)
+
+	// Keys beyond every table go straight to the deepest tier, and an
+	// Iterator over another database works as the input
+	src := engine.NewEngine(&config.Config{})
+	require.NoError(t, src.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, src.Close()) }()
+	for _, key := range []string{"m", "n", "o"} {
+		require.NoError(t, src.Put([]byte(key), []byte(key)))
+	}
+	it, err := src.NewIterator(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, e.IngestSorted(it))
+	require.NoError(t, it.Close())
+
+	infos := e.SSTableInfo()
+	require.Len(t, infos, 2)
+	assert.Equal(t, 1, infos[1].Tier)
+	assert.Equal(t, "m", string(infos[1].MinKey))
+	assert.Equal(t, "o", string(infos[1].MaxKey))
+	for _, key := range []string{"a", "b", "m", "n", "o"} {
+		_, found := e.Get([]byte(key))
+		assert.True(t, found, key)
+	}
+
+	// Nothing to ingest adds nothing
+	require.NoError(t, e.IngestSorted(&sliceIterator{}))
+	assert.Len(t, e.SSTableInfo(), 2)
+}
+
+type recordingListener struct {
+	mu          sync.Mutex
+	engine      *engine.Engine
+	flushes     []config.FlushInfo
+	compactions []config.CompactionInfo
+}
+
+func (l *recordingListener) OnFlush(info config.FlushInfo) {
+	// The engine lock is not held, so the database can be read
+	l.engine.Get([]byte("key-0"))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushes = append(l.flushes, info)
+}
+
+func (l *recordingListener) OnCompaction(info config.CompactionInfo) {
+	l.engine.Get([]byte("key-0"))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compactions = append(l.compactions, info)
+}
+
+func TestEngine_EventListener(t *testing.T) {
+	listener := &recordingListener{}
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 10, EventListener: listener})
+	listener.engine = e
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for i := range 2 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%d", i), []byte("value")))
+		require.NoError(t, e.Flush())
+	}
+
+	listener.mu.Lock()
+	flushes := slices.Clone(listener.flushes)
+	listener.mu.Unlock()
+	require.Len(t, flushes, 4)
+	tables := e.SSTableInfo()
+	require.Len(t, tables, 2)
+	for i, table := range tables {
+		start, done := flushes[2*i], flushes[2*i+1]
+		assert.False(t, start.Done)
+		assert.Equal(t, table.Path, start.Path)
+		assert.Equal(t, 1, start.Memtables)
+		assert.True(t, done.Done)
+		assert.Equal(t, table.Path, done.Path)
+		assert.Equal(t, uint64(1), done.Entries)
+		assert.Equal(t, table.Size, done.Bytes)
+		assert.NoError(t, done.Err)
+	}
+
+	require.NoError(t, e.CompactTier(0))
+
+	listener.mu.Lock()
+	compactions := slices.Clone(listener.compactions)
+	listener.mu.Unlock()
+	require.Len(t, compactions, 2)
+	start, done := compactions[0], compactions[1]
+	assert.False(t, start.Done)
+	assert.Equal(t, 0, start.Tier)
+	assert.Equal(t, []string{tables[0].Path, tables[1].Path}, start.InputFiles)
+	assert.Equal(t, tables[0].Size+tables[1].Size, start.InputBytes)
+	assert.Empty(t, start.OutputFiles)
+
+	assert.True(t, done.Done)
+	assert.Equal(t, start.InputFiles, done.InputFiles)
+	outputs := e.SSTableInfo()
+	require.Len(t, outputs, 1)
+	assert.Equal(t, []string{outputs[0].Path}, done.OutputFiles)
+	assert.Equal(t, outputs[0].Size, done.OutputBytes)
+	assert.NoError(t, done.Err)
+}
+
+func TestEngine_ValueSeparation(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &config.Config{MaxTablesPerTier: 10, ValueThreshold: 100}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(dataDir))
+
+	value := func(i, version int) []byte {
+		if i%2 == 0 {
+			return fmt.Appendf(nil, "small-%d-%d", i, version)
+		}
+		return bytes.Repeat(fmt.Appendf(nil, "%d-%d,", i, version), 1000)
+	}
+	// The second version overwrites half of the keys
+	for version := range 2 {
+		for i := version * 10; i < 20; i++ {
+			require.NoError(t, e.Put(fmt.Appendf(nil, "key-%02d", i), value(i, version)))
+		}
+		require.NoError(t, e.Flush())
+	}
+	check := func(stage string) {
+		t.Helper()
+		for i := range 20 {
+			want := value(i, 0)
+			if i >= 10 {
+				want = value(i, 1)
+			}
+			got, found := e.Get(fmt.Appendf(nil, "key-%02d", i))
+			assert.True(t, found, "%s: %d", stage, i)
+			assert.Equal(t, want, got, "%s: %d", stage, i)
+		}
+		it, err := e.NewIterator(nil, nil)
+		require.NoError(t, err)
+		var n int
+		for it.Next() {
+			n++
+		}
+		require.NoError(t, it.Error())
+		require.NoError(t, it.Close())
+		assert.Equal(t, 20, n, stage)
+	}
+	blobBytes := func() int64 {
+		t.Helper()
+		files, err := filepath.Glob(filepath.Join(dataDir, "blobs", "*.blob"))
+		require.NoError(t, err)
+		var size int64
+		for _, file := range files {
+			info, err := os.Stat(file)
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+	check("flushed")
+
+	// The tables hold pointers, not the values
+	before := blobBytes()
+	assert.Greater(t, before, int64(15*4000))
+	for _, info := range e.SSTableInfo() {
+		assert.Less(t, info.Size, int64(2000), info.Path)
+	}
+
+	// Compaction merges the pointers and leaves the blob files alone
+	require.NoError(t, e.CompactTier(0))
+	infos := e.SSTableInfo()
+	require.Len(t, infos, 1)
+	assert.Equal(t, 1, infos[0].Tier)
+	assert.Less(t, infos[0].Size, int64(2000))
+	assert.Equal(t, before, blobBytes())
+	check("compacted")
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	require.NoError(t, e.Checkpoint(checkpoint))
+	require.NoError(t, e.Close())
+
+	for _, dir := range []string{dataDir, checkpoint} {
+		e = engine.NewEngine(cfg)
+		require.NoError(t, e.OpenDB(dir))
+		check(dir)
+		require.NoError(t, e.Close())
+	}
+}
+
+// fakeCollector records the samples it receives, keyed by metric name and
+// labels.
+type fakeCollector struct {
+	counters map[string]float64
+	gauges   map[string]float64
+}
+
+func newFakeCollector() *fakeCollector {
+	return &fakeCollector{counters: map[string]float64{}, gauges: map[string]float64{}}
+}
+
+func seriesName(name string, labels []string) string {
+	for i := 0; i+1 < len(labels); i += 2 {
+		name += fmt.Sprintf(",%s=%s", labels[i], labels[i+1])
+	}
+	return name
+}
+
+func (c *fakeCollector) Counter(name, help string, value float64, labels ...string) {
+	c.counters[seriesName(name, labels)] = value
+}
+
+func (c *fakeCollector) Gauge(name, help string, value float64, labels ...string) {
+	c.gauges[seriesName(name, labels)] = value
+}
+
+func TestEngine_CollectMetrics(t *testing.T) {
+	e := engine.NewEngine(&config.Config{MaxTablesPerTier: 10})
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	for i := range 2 {
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%d", i), []byte("value")))
+		require.NoError(t, e.Flush())
+	}
+	require.NoError(t, e.Delete([]byte("key-1")))
+	require.NoError(t, e.CompactTier(0))
+	// The first read of the table's block misses the cache, the second
+	// hits it
+	for range 2 {
+		_, found := e.Get([]byte("key-0"))
+		require.True(t, found)
+	}
+
+	c := newFakeCollector()
+	e.CollectMetrics(c)
+	stats := e.Stats()
+
+	assert.Equal(t, 2.0, c.counters["graveldb_puts_total"])
+	assert.Equal(t, 1.0, c.counters["graveldb_deletes_total"])
+	assert.Equal(t, 2.0, c.counters["graveldb_gets_total"])
+	assert.Equal(t, 1.0, c.counters["graveldb_block_cache_hits_total"])
+	assert.Equal(t, 1.0, c.counters["graveldb_block_cache_misses_total"])
+	assert.Positive(t, c.counters["graveldb_flushed_bytes_total"])
+	assert.Equal(t, float64(stats.BytesPerTier[1]), c.counters["graveldb_compacted_bytes_total"])
+
+	require.Equal(t, []int{0, 1}, stats.TablesPerTier)
+	assert.Equal(t, 0.0, c.gauges["graveldb_tier_tables,tier=0"])
+	assert.Equal(t, 1.0, c.gauges["graveldb_tier_tables,tier=1"])
+	assert.Equal(t, 0.0, c.gauges["graveldb_tier_bytes,tier=0"])
+	assert.Positive(t, c.gauges["graveldb_tier_bytes,tier=1"])
+	assert.Equal(t, float64(stats.DiskBytes), c.gauges["graveldb_disk_bytes"])
+	assert.Contains(t, c.gauges, "graveldb_memtable_bytes")
+	assert.Contains(t, c.gauges, "graveldb_immutable_memtables")
+}
+
+type recordingPicker struct {
+	mu         sync.Mutex
+	candidates [][]config.CompactionCandidate
+}
+
+func (p *recordingPicker) Pick(candidates []config.CompactionCandidate) int {
+	p.mu.Lock()
+	p.candidates = append(p.candidates, slices.Clone(candidates))
+	p.mu.Unlock()
+	return engine.OverlapPicker{}.Pick(candidates)
+}
+
+func TestCompaction_PicksMostOverlappingTier(t *testing.T) {
+	tmpDir := t.TempDir()
+	// T0 tables hold disjoint keys, T1 tables all span a-z
+	for n := range 3 {
+		writeTierSST(t, tmpDir, 0, n+1, map[string]string{
+			fmt.Sprintf("t0-%d-a", n): "v", fmt.Sprintf("t0-%d-b", n): "v",
+		})
+		writeTierSST(t, tmpDir, 1, n+4, map[string]string{
+			fmt.Sprintf("a-%d", n): "v", fmt.Sprintf("z-%d", n): "v",
+		})
+	}
+
+	picker := &recordingPicker{}
+	listener := &recordingListener{}
+	e := engine.NewEngine(&config.Config{
+		MaxTablesPerTier: 2,
+		CompactionPicker: picker,
+		EventListener:    listener,
+	})
+	listener.engine = e
+	require.NoError(t, e.OpenDB(tmpDir))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	// Tier 0 is requested first, but tier 1 overlaps more
+	e.EnqueueCompactions(0, 1)
+	e.WaitForFlush()
+
+	picker.mu.Lock()
+	require.NotEmpty(t, picker.candidates)
+	first := picker.candidates[0]
+	picker.mu.Unlock()
+	require.Len(t, first, 2)
+	assert.Equal(t, 0, first[0].Tier)
+	assert.Equal(t, 3, first[0].Tables)
+	assert.Equal(t, 1, first[0].Overlap)
+	assert.Equal(t, 1, first[1].Tier)
+	assert.Equal(t, 3, first[1].Overlap)
+	assert.Positive(t, first[1].Bytes)
+
+	listener.mu.Lock()
+	compactions := slices.Clone(listener.compactions)
+	listener.mu.Unlock()
+	require.NotEmpty(t, compactions)
+	assert.Equal(t, 1, compactions[0].Tier)
+
+	for n := range 3 {
+		for _, key := range []string{fmt.Sprintf("t0-%d-a", n), fmt.Sprintf("z-%d", n)} {
+			_, found := e.Get([]byte(key))
+			assert.True(t, found, key)
+		}
+	}
+}
+
+func TestOverlapPicker(t *testing.T) {
+	var p engine.OverlapPicker
+	assert.Equal(t, 1, p.Pick([]config.CompactionCandidate{
+		{Tier: 0, Overlap: 2, Bytes: 100},
+		{Tier: 2, Overlap: 3, Bytes: 10},
+	}))
+	// Ties go to the larger tier, then to the earlier request
+	assert.Equal(t, 1, p.Pick([]config.CompactionCandidate{
+		{Tier: 0, Overlap: 2, Bytes: 10},
+		{Tier: 2, Overlap: 2, Bytes: 100},
+	}))
+	assert.Equal(t, 0, p.Pick([]config.CompactionCandidate{
+		{Tier: 3, Overlap: 2, Bytes: 10},
+		{Tier: 0, Overlap: 2, Bytes: 10},
+	}))
+}
+
+func TestEngine_InMemory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	cfg := &config.Config{
+		InMemory:         true,
+		MaxMemtableSize:  512,
+		MaxTablesPerTier: 2,
+		ValueThreshold:   64,
+	}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(dir))
+
+	long := bytes.Repeat([]byte("v"), 100)
+	for i := range 200 {
+		value := []byte("short")
+		if i%10 == 0 {
+			value = long
+		}
+		require.NoError(t, e.Put(fmt.Appendf(nil, "key-%03d", i), value))
+	}
+	for i := range 200 {
+		if i%3 == 0 {
+			require.NoError(t, e.Delete(fmt.Appendf(nil, "key-%03d", i)))
+		}
+	}
+	require.NoError(t, e.Flush())
+	require.NoError(t, e.CompactAll())
+	assert.NotEmpty(t, e.SSTableInfo())
+
+	check := func(e *engine.Engine) {
+		t.Helper()
+		for i := range 200 {
+			value, found := e.Get(fmt.Appendf(nil, "key-%03d", i))
+			if i%3 == 0 {
+				assert.False(t, found, i)
+				continue
+			}
+			require.True(t, found, i)
+			if i%10 == 0 {
+				assert.Equal(t, long, value)
+			} else {
+				assert.Equal(t, "short", string(value))
+			}
+		}
+	}
+	check(e)
+
+	// Nothing was written under the data directory
+	_, err := os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// A checkpoint saves the database to disk
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	require.NoError(t, e.Checkpoint(checkpoint))
+	require.NoError(t, e.Close())
+
+	onDisk := engine.NewEngine(nil)
+	require.NoError(t, onDisk.OpenDB(checkpoint))
+	check(onDisk)
+	require.NoError(t, onDisk.Close())
+
+	// The data is gone once closed
+	e = engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(dir))
+	defer func() { require.NoError(t, e.Close()) }()
+	_, found := e.Get([]byte("key-001"))
+	assert.False(t, found)
+	assert.Empty(t, e.SSTableInfo())
+}
+
+// mapMemtable is a memtable backed by a map, keeping only the newest
+// version of each key. Its iterators walk a sorted copy of the entries.
+type mapMemtable struct {
+	entries   map[string]storage.Entry
+	rangeDels []storage.Entry
+	size      int
+}
+
+func newMapMemtable() memtable.Memtable {
+	return &mapMemtable{entries: make(map[string]storage.Entry)}
+}
+
+func (m *mapMemtable) NewIterator() memtable.Iterator {
+	return m.NewRangeIterator(nil, nil)
+}
+
+func (m *mapMemtable) NewRangeIterator(start, end []byte) memtable.Iterator {
+	var entries []storage.Entry
+	for _, entry := range m.entries {
+		if (start == nil || bytes.Compare(entry.Key, start) >= 0) && (end == nil || bytes.Compare(entry.Key, end) < 0) {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b storage.Entry) int { return bytes.Compare(a.Key, b.Key) })
+	return &mapIterator{entries: entries, pos: -1}
+}
+
+func (m *mapMemtable) NewVersionsIterator() memtable.Iterator {
+	return m.NewIterator()
+}
+
+func (m *mapMemtable) Put(key, value []byte) error {
+	return m.Apply(storage.Entry{Type: storage.PutEntry, Key: key, Value: value})
+}
+
+func (m *mapMemtable) Apply(entry storage.Entry) error {
+	entry.Key, entry.Value = bytes.Clone(entry.Key), bytes.Clone(entry.Value)
+	m.size += len(entry.Key) + len(entry.Value)
+	if entry.Type == storage.RangeDeleteEntry {
+		m.rangeDels = append(m.rangeDels, entry)
+		return nil
+	}
+	m.entries[string(entry.Key)] = entry
+	return nil
+}
+
+func (m *mapMemtable) Get(key []byte) (storage.Entry, bool) {
+	entry, ok := m.entries[string(key)]
+	return entry, ok
+}
+
+func (m *mapMemtable) Versions(key []byte) []storage.Entry {
+	if entry, ok := m.entries[string(key)]; ok {
+		return []storage.Entry{entry}
+	}
+	return nil
+}
+
+func (m *mapMemtable) Delete(key []byte) error {
+	return m.Apply(storage.Entry{Type: storage.DeleteEntry, Key: key})
+}
+
+func (m *mapMemtable) RangeTombstones() []storage.Entry { return m.rangeDels }
+func (m *mapMemtable) Size() int                        { return m.size }
+func (m *mapMemtable) Len() int                         { return len(m.entries) + len(m.rangeDels) }
+
+func (m *mapMemtable) Clear() {
+	m.entries = make(map[string]storage.Entry)
+	m.rangeDels = nil
+	m.size = 0
+}
+
+type mapIterator struct {
+	entries []storage.Entry
+	pos     int
+}
+
+func (it *mapIterator) Seek(key []byte) bool {
+	it.pos = sort.Search(len(it.entries), func(i int) bool { return bytes.Compare(it.entries[i].Key, key) >= 0 })
+	return it.pos < len(it.entries)
+}
+
+func (it *mapIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.entries)
+}
+
+func (it *mapIterator) Key() []byte             { return it.entries[it.pos].Key }
+func (it *mapIterator) Value() []byte           { return it.entries[it.pos].Value }
+func (it *mapIterator) Type() storage.EntryType { return it.entries[it.pos].Type }
+func (it *mapIterator) IsDeleted() bool         { return it.Type() == storage.DeleteEntry }
+func (it *mapIterator) ExpiresAt() int64        { return it.entries[it.pos].ExpiresAt }
+func (it *mapIterator) Seq() uint64             { return it.entries[it.pos].Seq }
+
+func TestEngine_MemtableFactory(t *testing.T) {
+	var created atomic.Int32
+	cfg := config.DefaultConfig()
+	cfg.MemtableFactory = func() memtable.Memtable {
+		created.Add(1)
+		return newMapMemtable()
+	}
+	e := engine.NewEngine(cfg)
+	require.NoError(t, e.OpenDB(t.TempDir()))
+	defer func() { require.NoError(t, e.Close()) }()
+
+	require.NoError(t, e.Put([]byte("a"), []byte("1")))
+	require.NoError(t, e.Put([]byte("b"), []byte("2")))
+	require.NoError(t, e.Put([]byte("a"), []byte("3")))
+	require.NoError(t, e.Delete([]byte("b")))
+
+	check := func(stage string) {
+		t.Helper()
+		value, found := e.Get([]byte("a"))
+		assert.True(t, found, stage)
+		assert.Equal(t, "3", string(value), stage)
+		_, found = e.Get([]byte("b"))
+		assert.False(t, found, stage)
+	}
+	check("memtable")
+
+	// Sealing the memtable for the flush takes a fresh one from the factory
+	require.NoError(t, e.Flush())
+	assert.GreaterOrEqual(t, created.Load(), int32(2))
+	check("flushed")
+}
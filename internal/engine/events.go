@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/MikhailWahib/graveldb/internal/config"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+)
+
+// flushEvent reports a flush of memtables memtables to the table at path
+// to the configured event listener, if any: it reports the start straight
+// away and returns the function that reports the end, given the table
+// written and the flush's error. Both must be called without the engine
+// mutex held.
+func (e *Engine) flushEvent(path string, memtables int) func(table *sstable.Reader, err error) {
+	listener := e.config.EventListener
+	if listener == nil {
+		return func(*sstable.Reader, error) {}
+	}
+
+	info := config.FlushInfo{Path: path, Memtables: memtables}
+	listener.OnFlush(info)
+	start := time.Now()
+	return func(table *sstable.Reader, err error) {
+		info.Done = true
+		if table != nil {
+			info.Entries, info.Bytes = table.Count(), table.Size()
+		}
+		info.Duration = time.Since(start)
+		info.Err = err
+		listener.OnFlush(info)
+	}
+}
+
+// compactionEvent reports a compaction of inputs from tier to the
+// configured event listener, if any: it reports the start straight away and
+// returns the function that reports the end, given the tables written and
+// the compaction's error. Both must be called without the engine mutex held.
+func (e *Engine) compactionEvent(tier int, inputs []*sstable.Reader) func(outputs []*sstable.Reader, err error) {
+	listener := e.config.EventListener
+	if listener == nil {
+		return func([]*sstable.Reader, error) {}
+	}
+
+	info := config.CompactionInfo{Tier: tier}
+	info.InputFiles, info.InputBytes = tableFiles(inputs)
+	listener.OnCompaction(info)
+	start := time.Now()
+	return func(outputs []*sstable.Reader, err error) {
+		info.Done = true
+		info.OutputFiles, info.OutputBytes = tableFiles(outputs)
+		info.Duration = time.Since(start)
+		info.Err = err
+		listener.OnCompaction(info)
+	}
+}
+
+// tableFiles returns the paths and total size of readers.
+func tableFiles(readers []*sstable.Reader) ([]string, int64) {
+	var paths []string
+	var size int64
+	for _, reader := range readers {
+		paths = append(paths, reader.Path())
+		size += reader.Size()
+	}
+	return paths, size
+}
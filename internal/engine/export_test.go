@@ -0,0 +1,125 @@
+package engine
+
+// SealMemtable moves the active memtable to the immutable list without
+// scheduling a flush, so tests can observe reads across pending memtables.
+func (e *Engine) SealMemtable() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.immutableMemtables = append(e.immutableMemtables, immutableMemtable{mt: e.memtable, walSegment: e.walSegment, sstNum: e.sstCounter.Add(1)})
+	e.memtable = newMemtable(e.config, e.compare)
+}
+
+// FlushSealed synchronously flushes every pending immutable memtable.
+func (e *Engine) FlushSealed() error {
+	e.mu.RLock()
+	pending := append([]immutableMemtable(nil), e.immutableMemtables...)
+	e.mu.RUnlock()
+
+	for _, immutable := range pending {
+		if err := e.flushMemtable(immutable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushSealedAt synchronously flushes the i-th pending immutable memtable,
+// oldest first, letting tests flush out of order.
+func (e *Engine) FlushSealedAt(i int) error {
+	e.mu.RLock()
+	immutable := e.immutableMemtables[i]
+	e.mu.RUnlock()
+
+	return e.flushMemtable(immutable)
+}
+
+// CompactTierSync merges tier into the next one on the calling goroutine.
+func (e *Engine) CompactTierSync(tier int) error {
+	return e.compactionMgr.compact(tier)
+}
+
+// PrefixTables returns the paths of the SSTables a prefix scan would read.
+func (e *Engine) PrefixTables(prefix []byte) []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var paths []string
+	for _, reader := range e.prefixTablesLocked(prefix) {
+		paths = append(paths, reader.Path())
+	}
+	return paths
+}
+
+// NegativeCacheLen returns the number of keys in the negative cache.
+func (e *Engine) NegativeCacheLen() int {
+	return e.negCache.len()
+}
+
+// LogBatch appends b to the WAL without applying it, as if the process died
+// between logging a batch and updating the memtable.
+func (e *Engine) LogBatch(b *Batch) error {
+	return e.wal.AppendAtomic(b.entries)
+}
+
+// Crash releases the engine's files without flushing memtables, leaving the
+// data directory as a crash would. Buffered WAL data is still written.
+func (e *Engine) Crash() {
+	e.wg.Wait()
+	e.compactionMgr.stopWorkers()
+	for _, tier := range e.tiers {
+		for _, reader := range tier {
+			_ = reader.Close()
+		}
+	}
+	_ = e.wal.Close()
+	_ = e.manifest.close()
+}
+
+// MemtableSize returns the size of the active memtable.
+func (e *Engine) MemtableSize() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.memtable.Size()
+}
+
+// CompactionPeak returns the most compactions that have run at once.
+func (e *Engine) CompactionPeak() int {
+	s := &e.compactionMgr.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// EnqueueCompactions queues compactions of tiers all at once, so that the
+// workers choose among them.
+func (e *Engine) EnqueueCompactions(tiers ...int) {
+	s := &e.compactionMgr.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tier := range tiers {
+		e.wg.Add(1)
+		s.queue = append(s.queue, tier)
+	}
+	s.cond.Broadcast()
+}
+
+// SetBeforeFlush makes every flush goroutine call fn before writing its
+// memtable.
+func (e *Engine) SetBeforeFlush(fn func()) {
+	e.beforeFlush = fn
+}
+
+// LockForTest takes the engine lock, holding up writes and reads, and
+// returns the function that releases it.
+func (e *Engine) LockForTest() func() {
+	e.mu.Lock()
+	return e.mu.Unlock
+}
+
+// QueuedWrites returns the number of writes in the commit queue, the
+// leader's included.
+func (e *Engine) QueuedWrites() int {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	return len(e.writers)
+}
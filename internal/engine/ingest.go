@@ -0,0 +1,221 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// KeyValueIterator is a stream of key-value pairs read by IngestSorted,
+// such as an Iterator. Next advances to the next pair and reports whether
+// there is one, and Error reports what stopped the stream early, if
+// anything.
+type KeyValueIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+}
+
+// IngestSorted writes the pairs of iter, whose keys must be strictly
+// increasing, straight into new SSTables, bypassing the WAL and memtable,
+// and adds the tables to the database with a single manifest edit. The pairs
+// replace older values of their keys as if written by Put when the call
+// started. Tables whose key range overlaps no existing data go to the
+// deepest tier, so loading into an empty range causes no compaction;
+// otherwise they become the newest tables in T0.
+//
+// The memtable is flushed first, and writes wait until the ingestion is
+// done, while reads continue. Keys out of order, failing with
+// ErrInvalidArgument, an empty key or an entry over the size limits fail
+// the call before anything is added.
+func (e *Engine) IngestSorted(iter KeyValueIterator) error {
+	if e.closed.Load() {
+		return gerrors.Closed("engine is closed", nil)
+	}
+
+	return e.exclusive(func() error {
+		// With writes held back, the memtables stay empty after the flush,
+		// so nothing in memory is older than the ingested pairs
+		if err := e.Flush(); err != nil {
+			return err
+		}
+		e.mu.Lock()
+		seq := e.nextSeqLocked()
+		e.mu.Unlock()
+
+		paths, first, last, err := e.writeIngested(iter, seq)
+		if err != nil || len(paths) == 0 {
+			return err
+		}
+		tier, err := e.installIngested(paths, first, last)
+		if err != nil {
+			for _, path := range paths {
+				_ = e.fs.Remove(path)
+			}
+			return err
+		}
+
+		e.mu.RLock()
+		shouldCompact := e.compactionMgr.shouldCompactTier(tier)
+		e.mu.RUnlock()
+		if shouldCompact {
+			e.compactionMgr.enqueue(tier)
+		}
+		return nil
+	})
+}
+
+// writeIngested writes the pairs of iter to T0 tables of about the
+// memtable size, all with sequence number seq, and returns their paths
+// along with the first and last keys. On error every table written is
+// deleted.
+func (e *Engine) writeIngested(iter KeyValueIterator, seq uint64) (paths []string, first, last []byte, err error) {
+	var writers []*sstable.Writer
+	defer func() {
+		if err != nil {
+			for _, w := range writers {
+				_ = w.Delete()
+			}
+		}
+	}()
+
+	var output *sstable.Writer
+	for iter.Next() {
+		entry := storage.Entry{Type: storage.PutEntry, Key: iter.Key(), Value: iter.Value(), Seq: seq}
+		if len(entry.Key) == 0 {
+			return nil, nil, nil, gerrors.EmptyKey("keys must not be empty", nil)
+		}
+		if err := storage.CheckEntrySize(entry, e.config.MaxKeySize, e.config.MaxValueSize); err != nil {
+			return nil, nil, nil, err
+		}
+		if last != nil && e.compare(entry.Key, last) <= 0 {
+			return nil, nil, nil, gerrors.InvalidArgument(fmt.Sprintf("ingested keys are not increasing: %q follows %q", entry.Key, last), nil)
+		}
+
+		if output == nil {
+			_, output, err = e.newFlushWriter(e.sstCounter.Add(1))
+			if err != nil {
+				return nil, nil, nil, gerrors.IO("failed to open ingested SST for writing", err)
+			}
+			writers = append(writers, output)
+		}
+		if err := output.Add(entry); err != nil {
+			return nil, nil, nil, err
+		}
+		if first == nil {
+			first = bytes.Clone(entry.Key)
+		}
+		last = bytes.Clone(entry.Key)
+
+		if output.Size() >= int64(e.maxMemtableSize) {
+			if err := output.Close(); err != nil {
+				return nil, nil, nil, gerrors.IO("failed to finish ingested SST", err)
+			}
+			output = nil
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, nil, nil, err
+	}
+	if output != nil {
+		if err := output.Close(); err != nil {
+			return nil, nil, nil, gerrors.IO("failed to finish ingested SST", err)
+		}
+	}
+	for _, w := range writers {
+		paths = append(paths, w.Path())
+	}
+	return paths, first, last, nil
+}
+
+// installIngested adds the tables at paths, which hold keys from first to
+// last, and returns the tier they joined. That is the deepest tier if no
+// table there or above overlaps the range and the tier is kept in the same
+// directory as T0, and T0 otherwise. Tables moved to another tier have
+// their entries in paths updated, so that the caller can remove them on
+// error.
+func (e *Engine) installIngested(paths []string, first, last []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closing {
+		return 0, gerrors.Closed("engine is closed", nil)
+	}
+
+	tier := 0
+	// Tables are moved by renaming them, which only works within one
+	// directory tree
+	if deepest := len(e.tiers) - 1; deepest > 0 && e.externalRoot(deepest) == e.externalRoot(0) &&
+		!e.overlapsTablesLocked(first, last) {
+		tier = deepest
+	}
+	if tier > 0 {
+		dir := e.tierDir(tier)
+		if err := e.fs.MkdirAll(dir, 0755); err != nil {
+			return 0, gerrors.IO("failed to create tier directory", err)
+		}
+		for i, path := range paths {
+			num, _ := sstNumber(path)
+			dest := e.tablePath(tableRef{tier: tier, num: num})
+			if err := e.fs.Rename(path, dest); err != nil {
+				return 0, gerrors.IO("failed to move ingested SST", err)
+			}
+			paths[i] = dest
+		}
+		for _, dir := range []string{dir, e.tierDir(0)} {
+			if err := e.fs.SyncDir(dir); err != nil {
+				return 0, gerrors.IO("failed to sync SSTable directory", err)
+			}
+		}
+	}
+
+	for len(e.tiers) <= tier {
+		e.tiers = append(e.tiers, nil)
+	}
+	var readers []*sstable.Reader
+	closeReaders := func() {
+		for _, reader := range readers {
+			_ = reader.Close()
+		}
+	}
+	var edit manifestEdit
+	for _, path := range paths {
+		reader, err := sstable.NewReaderWithOptions(path, e.sstOptions())
+		if err != nil {
+			closeReaders()
+			return 0, gerrors.IO("failed to open ingested SST for reading", err)
+		}
+		readers = append(readers, reader)
+		num, _ := sstNumber(path)
+		edit.added = append(edit.added, tableRef{tier: tier, num: num})
+	}
+	if err := e.checkAppendLocked(tier, readers[0]); err != nil {
+		closeReaders()
+		return 0, err
+	}
+	if err := e.logEdit(edit); err != nil {
+		closeReaders()
+		return 0, err
+	}
+
+	e.tiers[tier] = append(e.tiers[tier], readers...)
+	e.negCache.clear()
+	return tier, nil
+}
+
+// overlapsTablesLocked reports whether any table affects a key from first
+// to last. Must be called with the engine mutex held.
+func (e *Engine) overlapsTablesLocked(first, last []byte) bool {
+	for _, tier := range e.tiers {
+		for _, reader := range tier {
+			lo, hi := tableBounds(e.compare, reader)
+			if lo != nil && e.compare(lo, last) <= 0 && (hi == nil || e.compare(hi, first) >= 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"bytes"
+	"sort"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// tablesLocked returns every SSTable reader, oldest first.
+// Must be called with the engine mutex held.
+func (e *Engine) tablesLocked() []*sstable.Reader {
+	var tables []*sstable.Reader
+	for t := len(e.tiers) - 1; t >= 0; t-- {
+		tables = append(tables, e.tiers[t]...)
+	}
+	return tables
+}
+
+// sourcesLocked returns iterators over the given tables followed by every
+// memtable, oldest first. Must be called with the engine mutex held for as
+// long as the iterators are in use.
+func (e *Engine) sourcesLocked(tables []*sstable.Reader) []sstable.Source {
+	sources := make([]sstable.Source, 0, len(tables)+len(e.immutableMemtables)+1)
+	for _, reader := range tables {
+		sources = append(sources, reader.NewIterator())
+	}
+	for _, immutable := range e.immutableMemtables {
+		sources = append(sources, immutable.mt.NewIterator())
+	}
+	return append(sources, e.memtable.NewIterator())
+}
+
+// sliceIterator iterates over a sorted slice of entries.
+type sliceIterator struct {
+	entries []storage.Entry
+	pos     int
+	cmp     func(a, b []byte) int
+}
+
+func (s *sliceIterator) Seek(key []byte) bool {
+	s.pos = sort.Search(len(s.entries), func(i int) bool {
+		return s.cmp(s.entries[i].Key, key) >= 0
+	})
+	return s.Next()
+}
+
+func (s *sliceIterator) Next() bool {
+	if s.pos >= len(s.entries) {
+		return false
+	}
+	s.pos++
+	return true
+}
+
+func (s *sliceIterator) Key() []byte             { return s.entries[s.pos-1].Key }
+func (s *sliceIterator) Value() []byte           { return s.entries[s.pos-1].Value }
+func (s *sliceIterator) Type() storage.EntryType { return s.entries[s.pos-1].Type }
+func (s *sliceIterator) IsDeleted() bool         { return s.Type() == storage.DeleteEntry }
+func (s *sliceIterator) ExpiresAt() int64        { return s.entries[s.pos-1].ExpiresAt }
+func (s *sliceIterator) Seq() uint64             { return s.entries[s.pos-1].Seq }
+
+// expired reports whether the entry src is positioned on expired at or
+// before now.
+func expired(src sstable.Source, now int64) bool {
+	return src.ExpiresAt() != 0 && src.ExpiresAt() <= now
+}
+
+// Iterator iterates over the live keys in [start, end) as of the moment it
+// was created or last refreshed. Writes, flushes and compactions that happen
+// afterwards are not visible until RefreshSnapshot is called.
+//
+// An Iterator is not safe for concurrent use and must be closed to release
+// the SSTables it pins.
+type Iterator struct {
+	engine *Engine
+	start  []byte
+	end    []byte
+
+	tables []*sstable.Reader
+	iter   *sstable.MergingIterator
+	now    int64 // entries expired as of now are skipped
+	// rangeDels are the range tombstones of the snapshot
+	rangeDels []storage.Entry
+	pending   bool // iter is positioned on an entry Next has not consumed
+	valid     bool
+	last      []byte // last key returned, kept after exhaustion
+	key       []byte
+	value     []byte
+	err       error
+	closed    bool
+
+	// includeDeleted makes Next stop at deleted keys too; deleted reports
+	// whether the current key is one
+	includeDeleted bool
+	deleted        bool
+}
+
+// NewIterator returns an iterator over live keys with start <= key < end.
+// A nil start means from the first key and a nil end means to the last key.
+// It fails if the engine is closed.
+func (e *Engine) NewIterator(start, end []byte) (*Iterator, error) {
+	it := &Iterator{engine: e, start: start, end: end}
+	if err := it.pin(start); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// pin captures the current engine state for keys >= from.
+func (it *Iterator) pin(from []byte) error {
+	e := it.engine
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed.Load() {
+		return gerrors.Closed("engine is closed", nil)
+	}
+
+	it.tables = e.tablesLocked()
+	for _, reader := range it.tables {
+		reader.Ref()
+	}
+
+	sources := make([]sstable.Source, 0, len(it.tables)+len(e.immutableMemtables)+1)
+	for _, reader := range it.tables {
+		sources = append(sources, reader.NewIterator())
+	}
+	// Immutable memtables never change, but the active one does, so the
+	// part of it in range is copied.
+	for _, immutable := range e.immutableMemtables {
+		sources = append(sources, immutable.mt.NewIterator())
+	}
+	var active []storage.Entry
+	mtIter := e.memtable.NewRangeIterator(from, it.end)
+	for mtIter.Next() {
+		active = append(active, storage.Entry{
+			Type:      mtIter.Type(),
+			Key:       mtIter.Key(),
+			Value:     mtIter.Value(),
+			ExpiresAt: mtIter.ExpiresAt(),
+			Seq:       mtIter.Seq(),
+		})
+	}
+	sources = append(sources, &sliceIterator{entries: active, cmp: e.compare})
+
+	it.iter = sstable.NewMergingIteratorWithComparator(sources, e.compare)
+	it.now = e.now()
+	it.rangeDels = e.rangeTombstonesLocked()
+	it.iter.SetMerge(e.mergeOptions(it.rangeDels, it.now))
+	it.valid, it.deleted = false, false
+	it.key, it.value = nil, nil
+	// Seeking leaves the merged iterator on an entry Next has not consumed
+	it.pending = from != nil && it.iter.Seek(from)
+	return nil
+}
+
+// unpin releases the SSTables pinned by the current snapshot.
+func (it *Iterator) unpin() error {
+	var firstErr error
+	for _, reader := range it.tables {
+		if err := reader.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.tables = nil
+	return firstErr
+}
+
+// SetIncludeDeleted makes Next also stop at keys that are deleted, for
+// tooling that inspects tombstones: keys whose newest version is a
+// tombstone, has expired or is covered by a range tombstone. Deleted
+// reports whether the current key is one. Keys deleted by a range tombstone
+// are only seen while some version of them is still stored.
+func (it *Iterator) SetIncludeDeleted(include bool) {
+	it.includeDeleted = include
+}
+
+// Next advances to the next live key and reports whether there is one.
+// With SetIncludeDeleted, it advances to the next key, live or deleted.
+func (it *Iterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	for it.pending || it.iter.Next() {
+		it.pending = false
+		key := it.iter.Key()
+		if it.end != nil && it.engine.compare(key, it.end) >= 0 {
+			break
+		}
+		deleted := it.iter.Type() == storage.DeleteEntry || expired(it.iter, it.now) || it.engine.coveredBy(it.rangeDels, key, it.iter.Seq())
+		if deleted && !it.includeDeleted {
+			continue
+		}
+		it.key, it.deleted = key, deleted
+		it.value = nil
+		if !deleted {
+			it.value = it.iter.Value()
+		}
+		it.valid = true
+		it.last = key
+		return true
+	}
+
+	it.err = it.iter.Error()
+	it.valid, it.deleted = false, false
+	it.key, it.value = nil, nil
+	return false
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the current value, or nil for a deleted key.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Deleted reports whether the current key is deleted, which Next only
+// returns with SetIncludeDeleted.
+func (it *Iterator) Deleted() bool {
+	return it.deleted
+}
+
+// Error returns any error encountered during iteration.
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// RefreshSnapshot re-pins the iterator to the current engine state so that
+// later calls to Next see writes, flushes and compactions made since the
+// iterator was created. Iteration resumes after the last key returned, or
+// from the first key in range if Next has not returned one; if that key has
+// since been deleted or compacted away, iteration continues at the next key
+// that exists.
+//
+// Keys before the current position that changed are not revisited, so the
+// full sequence returned by the iterator may mix data from several snapshots.
+func (it *Iterator) RefreshSnapshot() error {
+	if it.closed {
+		return gerrors.Closed("iterator is closed", nil)
+	}
+
+	from := it.start
+	if it.last != nil {
+		// Resume strictly after the last key returned
+		from = append(bytes.Clone(it.last), 0)
+	}
+
+	if err := it.unpin(); err != nil {
+		return err
+	}
+	it.err = nil
+	if err := it.pin(from); err != nil {
+		it.err = err
+		return err
+	}
+	return nil
+}
+
+// Close releases the SSTables pinned by the iterator.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	return it.unpin()
+}
@@ -0,0 +1,269 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// manifestName is the file in the data directory that records which
+// SSTables are live, in order, for every tier.
+const manifestName = "MANIFEST"
+
+// Operations in a manifest edit
+const (
+	manifestAdd    byte = 1
+	manifestRemove byte = 2
+	// manifestLastNum records the highest table number handed out so far
+	manifestLastNum byte = 3
+	// manifestAddAt adds a table kept outside the data directory, followed
+	// by the length and absolute path of the directory holding its
+	// sstables subdirectory
+	manifestAddAt byte = 4
+)
+
+// manifestOpSize is the encoded size of one operation: op, tier and number.
+// manifestAddAt operations are followed by their directory.
+const manifestOpSize = 1 + 4 + 8
+
+// tableRef identifies an SSTable by its tier and number.
+type tableRef struct {
+	tier int
+	num  uint64
+}
+
+// manifestEdit is a change to the live SSTables that is applied as a whole:
+// a flush adds one table, a compaction adds its output and removes its
+// inputs.
+type manifestEdit struct {
+	added   []tableRef
+	removed []tableRef
+	// lastNum is the highest table number handed out when the edit was
+	// made, so numbers of tables that were since removed are not reused.
+	// 0 leaves it out of the record.
+	lastNum uint64
+	// roots holds, by number, the directory of every added table written
+	// under a TierPaths directory rather than the data directory
+	roots map[uint64]string
+}
+
+// encode serializes the edit as the value of a manifest record.
+func (edit manifestEdit) encode() []byte {
+	buf := make([]byte, 0, (len(edit.added)+len(edit.removed)+1)*manifestOpSize)
+	appendOp := func(op byte, ref tableRef) {
+		buf = append(buf, op)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(ref.tier))
+		buf = binary.BigEndian.AppendUint64(buf, ref.num)
+	}
+	for _, ref := range edit.removed {
+		appendOp(manifestRemove, ref)
+	}
+	for _, ref := range edit.added {
+		root, ok := edit.roots[ref.num]
+		if !ok {
+			appendOp(manifestAdd, ref)
+			continue
+		}
+		appendOp(manifestAddAt, ref)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(root)))
+		buf = append(buf, root...)
+	}
+	if edit.lastNum != 0 {
+		appendOp(manifestLastNum, tableRef{num: edit.lastNum})
+	}
+	return buf
+}
+
+// manifest is an append-only log of edits. Every flush and compaction
+// appends its edit and syncs it before installing its tables, so replaying
+// the log yields exactly the tables that were live at a crash, in order.
+type manifest struct {
+	file storage.FSFile
+	err  error
+}
+
+// openManifest replays the manifest in dataDir of fs. It returns:
+//   - tiers, the live table numbers of each tier, oldest first;
+//   - roots, the directory of each live table kept outside dataDir, by
+//     number;
+//   - maxNum, the highest table number ever recorded, whether added or only
+//     handed out;
+//   - found, false if there is no manifest yet.
+//
+// A record cut short by a crash while it was appended was never applied and
+// ends the replay. Only the last record can be torn that way, so one that
+// fails to decode before the end of the file fails with ErrCorrupt: the
+// edits after it were applied, and replaying without them would lose
+// tables.
+func openManifest(fs storage.FS, dataDir string) (tiers [][]uint64, roots map[uint64]string, maxNum uint64, found bool, err error) {
+	data, err := storage.ReadFile(fs, filepath.Join(dataDir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, nil, 0, false, gerrors.IO("failed to read manifest", err)
+	}
+
+	invalid := gerrors.Corruption("invalid manifest record", nil)
+	roots = make(map[uint64]string)
+	for len(data) > 0 {
+		record, n, err := storage.DecodeEntry(data)
+		if err != nil {
+			if tornTail(data) {
+				break
+			}
+			return nil, nil, 0, false, gerrors.Corruption("corrupt manifest record before newer records", err)
+		}
+		data = data[n:]
+		if record.Type != storage.EditEntry {
+			return nil, nil, 0, false, invalid
+		}
+
+		for ops := record.Value; len(ops) > 0; {
+			if len(ops) < manifestOpSize {
+				return nil, nil, 0, false, invalid
+			}
+			op := ops[0]
+			tier := int(binary.BigEndian.Uint32(ops[1:5]))
+			num := binary.BigEndian.Uint64(ops[5:13])
+			ops = ops[manifestOpSize:]
+			if op == manifestLastNum {
+				maxNum = max(maxNum, num)
+				continue
+			}
+			for len(tiers) <= tier {
+				tiers = append(tiers, nil)
+			}
+
+			switch op {
+			case manifestAdd, manifestAddAt:
+				if op == manifestAddAt {
+					if len(ops) < 4 {
+						return nil, nil, 0, false, invalid
+					}
+					size := 4 + int(binary.BigEndian.Uint32(ops))
+					if len(ops) < size {
+						return nil, nil, 0, false, invalid
+					}
+					roots[num] = string(ops[4:size])
+					ops = ops[size:]
+				}
+				tiers[tier] = append(tiers[tier], num)
+				maxNum = max(maxNum, num)
+			case manifestRemove:
+				for i, n := range tiers[tier] {
+					if n == num {
+						tiers[tier] = append(tiers[tier][:i], tiers[tier][i+1:]...)
+						break
+					}
+				}
+				delete(roots, num)
+			default:
+				return nil, nil, 0, false, gerrors.Corruption(fmt.Sprintf("unknown manifest operation %d", op), nil)
+			}
+		}
+	}
+
+	return tiers, roots, maxNum, true, nil
+}
+
+// tornTail reports whether the record at the start of data, which failed
+// to decode, reaches the end of data, as a record cut short or left
+// partly written by a crash would.
+func tornTail(data []byte) bool {
+	if len(data) < storage.PrefixSize {
+		return true
+	}
+	keyLen := uint64(binary.BigEndian.Uint32(data[storage.EntryTypeSize:]))
+	valLen := uint64(binary.BigEndian.Uint32(data[storage.EntryTypeSize+storage.LengthSize:]))
+	return storage.PrefixSize+keyLen+valLen+storage.ChecksumSize >= uint64(len(data))
+}
+
+// createManifest replaces the manifest in dataDir of fs with a single edit adding
+// every table in tiers, with the directories in roots for tables kept
+// outside the data directory, and recording lastNum as the highest table
+// number handed out, and opens it for appending. The new manifest is
+// written under a temporary name and renamed into place, so a crash leaves
+// either the old or the new one.
+func createManifest(fs storage.FS, dataDir string, tiers [][]uint64, roots map[uint64]string, lastNum uint64) (*manifest, error) {
+	snapshot := manifestEdit{lastNum: lastNum, roots: roots}
+	for tier, nums := range tiers {
+		for _, num := range nums {
+			snapshot.added = append(snapshot.added, tableRef{tier: tier, num: num})
+		}
+	}
+
+	path := filepath.Join(dataDir, manifestName)
+	tmpPath := path + ".tmp"
+	file, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, gerrors.IO("failed to create manifest", err)
+	}
+
+	m := &manifest{file: file}
+	if err := m.append(snapshot); err != nil {
+		_ = file.Close()
+		_ = fs.Remove(tmpPath)
+		return nil, err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		_ = file.Close()
+		_ = fs.Remove(tmpPath)
+		return nil, gerrors.IO("failed to rename manifest into place", err)
+	}
+	if err := fs.SyncDir(dataDir); err != nil {
+		_ = file.Close()
+		return nil, gerrors.IO("failed to sync data directory", err)
+	}
+	return m, nil
+}
+
+// append writes edit to the log and syncs it. Once it returns, the edit
+// survives a crash. After a failed append the log may end in a partial
+// record that would hide anything written after it, so every later append
+// fails too.
+func (m *manifest) append(edit manifestEdit) error {
+	if m.err != nil {
+		return gerrors.Closed("manifest is unusable after a failed write", m.err)
+	}
+
+	record := storage.SerializeEntry(storage.Entry{Type: storage.EditEntry, Value: edit.encode()})
+	if _, err := m.file.Write(record); err != nil {
+		m.err = err
+		return gerrors.IO("failed to write manifest", err)
+	}
+	if err := m.file.Sync(); err != nil {
+		m.err = err
+		return gerrors.IO("failed to sync manifest", err)
+	}
+	return nil
+}
+
+// logEdit appends edit to the manifest, recording the highest table number
+// handed out so far along with it. Added tables are recorded in the
+// directory new tables of their tier are written to.
+func (e *Engine) logEdit(edit manifestEdit) error {
+	edit.lastNum = e.sstCounter.Load()
+	for _, ref := range edit.added {
+		if root := e.externalRoot(ref.tier); root != "" {
+			if edit.roots == nil {
+				edit.roots = make(map[uint64]string)
+			}
+			edit.roots[ref.num] = root
+		}
+	}
+	return e.manifest.append(edit)
+}
+
+// close closes the manifest file.
+func (m *manifest) close() error {
+	if m == nil {
+		return nil
+	}
+	return m.file.Close()
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"context"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// Merge records operand as a change to the value of key without reading
+// it. Reads and compactions apply config.MergeFunc to the older value and
+// every operand written since, oldest first. It fails if no MergeFunc is
+// configured.
+func (e *Engine) Merge(key, operand []byte) error {
+	if e.config.MergeFunc == nil {
+		return gerrors.Internal("merge requires config.MergeFunc to be set", nil)
+	}
+	entry := storage.Entry{Type: storage.MergeEntry, Key: key, Value: operand}
+	return e.commitEntry(context.Background(), entry, true)
+}
+
+// memtableMergeLocked folds entry, a merge operand, into the version of its
+// key in the active memtable, so the memtable keeps a single entry per key.
+// The result is a put if that version settles the key's value, or a merge
+// entry combining both operands if it is itself a merge. Must be called
+// with the engine mutex held.
+func (e *Engine) memtableMergeLocked(entry storage.Entry) storage.Entry {
+	merge := e.config.MergeFunc
+	existing, found := e.memtable.Get(entry.Key)
+	if merge == nil || !found {
+		return entry
+	}
+
+	switch {
+	case existing.Type == storage.DeleteEntry || existing.Expired(e.now()) ||
+		e.coveredBy(e.memtable.RangeTombstones(), entry.Key, existing.Seq):
+		entry.Type, entry.Value = storage.PutEntry, merge(nil, entry.Value)
+	case existing.Type == storage.MergeEntry:
+		entry.Value = merge(existing.Value, entry.Value)
+	default:
+		entry.Type, entry.Value = storage.PutEntry, merge(existing.Value, entry.Value)
+		entry.ExpiresAt = existing.ExpiresAt
+	}
+	return entry
+}
+
+// resolveMergeLocked returns the put that newest, the newest version of its
+// key and a merge entry, resolves to: the operands down to the first
+// version that is not a merge, applied to that version's value, or to nil
+// if it is deleted or expired or there is none. Must be called with the
+// engine mutex held.
+func (e *Engine) resolveMergeLocked(ctx context.Context, newest storage.Entry) (storage.Entry, error) {
+	now := e.now()
+	var operands [][]byte
+	result := storage.Entry{Type: storage.PutEntry, Key: newest.Key, Seq: newest.Seq}
+	err := e.versionsLocked(ctx, newest.Key, func(entry storage.Entry) bool {
+		switch {
+		case entry.Type == storage.DeleteEntry || entry.Expired(now) || e.rangeDeletedLocked(entry.Key, entry.Seq):
+		case entry.Type == storage.MergeEntry:
+			operands = append(operands, entry.Value)
+			return true
+		default:
+			result.Value, result.ExpiresAt = entry.Value, entry.ExpiresAt
+		}
+		return false
+	})
+	if err != nil {
+		return storage.Entry{}, err
+	}
+
+	for i := len(operands) - 1; i >= 0; i-- {
+		result.Value = e.config.MergeFunc(result.Value, operands[i])
+	}
+	return result, nil
+}
+
+// mergeOptions returns how an iterator over every version of the data
+// resolves merge entries, given the range tombstones in effect and the time
+// entries expire as of.
+func (e *Engine) mergeOptions(rangeDels []storage.Entry, now int64) sstable.MergeOptions {
+	return sstable.MergeOptions{
+		Func:     e.config.MergeFunc,
+		Complete: true,
+		Deleted: func(key []byte, seq uint64) bool {
+			return e.coveredBy(rangeDels, key, seq)
+		},
+		Now: now,
+	}
+}
@@ -0,0 +1,39 @@
+package engine
+
+import "strconv"
+
+// MetricsCollector receives the metric samples reported by CollectMetrics.
+// Implementations adapt them to a metrics backend: for Prometheus, a
+// prometheus.Collector whose Collect calls CollectMetrics and turns each
+// sample into a const metric. Labels are given as alternating names and
+// values.
+type MetricsCollector interface {
+	// Counter reports the current value of a cumulative count
+	Counter(name, help string, value float64, labels ...string)
+	// Gauge reports a value that can go up and down
+	Gauge(name, help string, value float64, labels ...string)
+}
+
+// CollectMetrics reports a snapshot of the engine's statistics to c, with
+// Prometheus-style metric names prefixed with graveldb_. The snapshot is
+// taken as by Stats, and c is called without the engine lock held.
+func (e *Engine) CollectMetrics(c MetricsCollector) {
+	stats := e.Stats()
+
+	c.Counter("graveldb_puts_total", "Puts applied since the database was opened.", float64(stats.Puts))
+	c.Counter("graveldb_deletes_total", "Deletes applied since the database was opened.", float64(stats.Deletes))
+	c.Counter("graveldb_gets_total", "Keys looked up since the database was opened.", float64(stats.Gets))
+	c.Counter("graveldb_block_cache_hits_total", "Point lookups that found their SSTable block in the block cache.", float64(stats.BlockCacheHits))
+	c.Counter("graveldb_block_cache_misses_total", "Point lookups that read their SSTable block from disk.", float64(stats.BlockCacheMisses))
+	c.Counter("graveldb_flushed_bytes_total", "Bytes of SSTables written by flushes.", float64(stats.BytesFlushed))
+	c.Counter("graveldb_compacted_bytes_total", "Bytes of SSTables written by compactions.", float64(stats.BytesCompacted))
+
+	c.Gauge("graveldb_disk_bytes", "Size of the SSTables and WAL files.", float64(stats.DiskBytes))
+	c.Gauge("graveldb_memtable_bytes", "Size of the active memtable.", float64(stats.MemtableBytes))
+	c.Gauge("graveldb_immutable_memtables", "Sealed memtables waiting to be flushed.", float64(stats.ImmutableMemtables))
+	for tier, tables := range stats.TablesPerTier {
+		label := strconv.Itoa(tier)
+		c.Gauge("graveldb_tier_tables", "SSTables in the tier.", float64(tables), "tier", label)
+		c.Gauge("graveldb_tier_bytes", "Size of the SSTables in the tier.", float64(stats.BytesPerTier[tier]), "tier", label)
+	}
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"container/list"
+	"sync"
+)
+
+// negativeCache is a fixed-size LRU set of keys recently found to be absent.
+// Lookups run under the engine's read lock, so the cache has its own mutex.
+type negativeCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front is most recently used
+	items    map[string]*list.Element
+}
+
+// newNegativeCache returns a cache holding up to capacity keys, or nil if
+// capacity is not positive. All methods are no-ops on a nil cache.
+func newNegativeCache(capacity int) *negativeCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &negativeCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+// contains reports whether key is cached as absent.
+func (c *negativeCache) contains(key []byte) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[string(key)]
+	if ok {
+		c.order.MoveToFront(elem)
+	}
+	return ok
+}
+
+// add records key as absent, evicting the least recently used key if full.
+func (c *negativeCache) add(key []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[string(key)]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(string))
+	}
+	k := string(key)
+	c.items[k] = c.order.PushFront(k)
+}
+
+// remove forgets key.
+func (c *negativeCache) remove(key []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[string(key)]; ok {
+		c.order.Remove(elem)
+		delete(c.items, string(key))
+	}
+}
+
+// clear forgets every key.
+func (c *negativeCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.items)
+}
+
+// len returns the number of cached keys.
+func (c *negativeCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"slices"
+
+	"github.com/MikhailWahib/graveldb/internal/config"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+)
+
+// OverlapPicker is the default CompactionPicker. It prefers the tier with
+// the most overlapping tables, whose compaction saves point lookups the
+// most table reads, then the tier holding the most bytes, then the
+// compaction requested first.
+type OverlapPicker struct{}
+
+// Pick returns the index of the candidate with the highest overlap,
+// breaking ties by size and then by request order.
+func (OverlapPicker) Pick(candidates []config.CompactionCandidate) int {
+	best := 0
+	for i, c := range candidates {
+		b := candidates[best]
+		if c.Overlap > b.Overlap || (c.Overlap == b.Overlap && c.Bytes > b.Bytes) {
+			best = i
+		}
+	}
+	return best
+}
+
+// pick asks the picker which of the queued tiers to compact next. Must be
+// called without the engine lock held.
+func (cm *CompactionManager) pick(tiers []int) int {
+	cm.engine.mu.RLock()
+	candidates := make([]config.CompactionCandidate, len(tiers))
+	for i, tier := range tiers {
+		candidates[i] = cm.candidateLocked(tier)
+	}
+	cm.engine.mu.RUnlock()
+
+	i := cm.picker.Pick(candidates)
+	if i < 0 || i >= len(tiers) {
+		return tiers[0]
+	}
+	return tiers[i]
+}
+
+// candidateLocked describes the tables of tier for the picker. Must be
+// called with the engine lock held.
+func (cm *CompactionManager) candidateLocked(tier int) config.CompactionCandidate {
+	c := config.CompactionCandidate{Tier: tier}
+	if tier >= len(cm.engine.tiers) {
+		return c
+	}
+	readers := cm.engine.tiers[tier]
+	c.Tables = len(readers)
+	for _, reader := range readers {
+		c.Bytes += reader.Size()
+	}
+	c.Overlap = maxOverlap(readers, cm.engine.compare)
+	return c
+}
+
+// maxOverlap returns the most tables among readers whose key ranges all
+// contain one key. Tables without keys overlap nothing.
+func maxOverlap(readers []*sstable.Reader, compare func(a, b []byte) int) int {
+	type bound struct {
+		key   []byte
+		start bool
+	}
+	var bounds []bound
+	for _, reader := range readers {
+		if reader.MinKey() == nil {
+			continue
+		}
+		bounds = append(bounds, bound{reader.MinKey(), true}, bound{reader.MaxKey(), false})
+	}
+	// Ranges are inclusive, so at equal keys starts come before ends
+	slices.SortFunc(bounds, func(a, b bound) int {
+		if c := compare(a.key, b.key); c != 0 {
+			return c
+		}
+		if a.start == b.start {
+			return 0
+		}
+		if a.start {
+			return -1
+		}
+		return 1
+	})
+
+	open, most := 0, 0
+	for _, b := range bounds {
+		if b.start {
+			open++
+			most = max(most, open)
+		} else {
+			open--
+		}
+	}
+	return most
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"context"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// DeleteRange removes every key with start <= key < end. It is logged and
+// applied as a single range tombstone, however many keys it covers, which
+// hides the covered keys from reads until compaction removes them. Keys
+// written after the call are not affected. An empty range, including one
+// with a nil end, deletes nothing.
+func (e *Engine) DeleteRange(start, end []byte) error {
+	if e.compare(start, end) >= 0 {
+		return nil
+	}
+
+	entry := storage.Entry{Type: storage.RangeDeleteEntry, Key: start, Value: end}
+	return e.commitEntry(context.Background(), entry, false)
+}
+
+// DropPrefix removes every key starting with prefix with a single range
+// tombstone over [prefix, prefixUpperBound(prefix)), so the keys disappear
+// from reads at once and compaction reclaims their space. Keys written
+// under prefix after the call are not affected. A prefix of only 0xFF bytes
+// has no upper bound, so its tombstone covers every key from prefix up,
+// which in byte order are exactly the keys starting with it. The prefix
+// must be non-empty, and DropPrefix needs byte order: it fails with
+// ErrInvalidArgument if a custom Comparator is configured.
+func (e *Engine) DropPrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return gerrors.EmptyKey("prefix to drop cannot be empty", nil)
+	}
+	if e.config.Comparator != nil {
+		return gerrors.InvalidArgument("DropPrefix requires the default byte order, not a custom Comparator", nil)
+	}
+	end := prefixUpperBound(prefix)
+	if end == nil {
+		entry := storage.Entry{Type: storage.RangeDeleteEntry, Key: prefix}
+		return e.commitEntry(context.Background(), entry, false)
+	}
+	return e.DeleteRange(prefix, end)
+}
+
+// rangeTombstonesLocked returns the range tombstones of every memtable and
+// SSTable. Must be called with the engine mutex held.
+func (e *Engine) rangeTombstonesLocked() []storage.Entry {
+	var rangeDels []storage.Entry
+	for _, tier := range e.tiers {
+		for _, reader := range tier {
+			rangeDels = append(rangeDels, reader.RangeTombstones()...)
+		}
+	}
+	for _, immutable := range e.immutableMemtables {
+		rangeDels = append(rangeDels, immutable.mt.RangeTombstones()...)
+	}
+	return append(rangeDels, e.memtable.RangeTombstones()...)
+}
+
+// rangeDeletedLocked reports whether a range tombstone in any memtable or
+// SSTable deletes the version of key written with sequence number seq. Must
+// be called with the engine mutex held.
+func (e *Engine) rangeDeletedLocked(key []byte, seq uint64) bool {
+	if e.coveredBy(e.memtable.RangeTombstones(), key, seq) {
+		return true
+	}
+	for _, immutable := range e.immutableMemtables {
+		if e.coveredBy(immutable.mt.RangeTombstones(), key, seq) {
+			return true
+		}
+	}
+	for _, tier := range e.tiers {
+		for _, reader := range tier {
+			if e.coveredBy(reader.RangeTombstones(), key, seq) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// coveredBy reports whether any of rangeDels deletes the version of key
+// written with sequence number seq.
+func (e *Engine) coveredBy(rangeDels []storage.Entry, key []byte, seq uint64) bool {
+	for _, rangeDel := range rangeDels {
+		if rangeDel.Covers(e.compare, key, seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// tableBounds returns the smallest and largest keys reader affects: its own
+// keys, widened to the ranges its range tombstones delete, with keys ordered
+// by cmp. Both are nil if the table is empty; hi alone is nil if a range
+// tombstone has no end, as the table then affects every key from lo up.
+func tableBounds(cmp func(a, b []byte) int, reader *sstable.Reader) (lo, hi []byte) {
+	lo, hi = reader.MinKey(), reader.MaxKey()
+	unbounded := false
+	for _, rangeDel := range reader.RangeTombstones() {
+		if lo == nil || cmp(rangeDel.Key, lo) < 0 {
+			lo = rangeDel.Key
+		}
+		if len(rangeDel.Value) == 0 {
+			unbounded = true
+			continue
+		}
+		// The end is exclusive, so using it as the upper bound may make the
+		// table overlap one that starts there; that only costs extra work
+		if hi == nil || cmp(rangeDel.Value, hi) > 0 {
+			hi = rangeDel.Value
+		}
+	}
+	if unbounded {
+		hi = nil
+	}
+	return lo, hi
+}
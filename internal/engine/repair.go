@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/MikhailWahib/graveldb/internal/config"
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// quarantineDir is the directory in the data directory that Repair moves
+// damaged SSTables to.
+const quarantineDir = "quarantine"
+
+// RepairReport describes what Repair found and changed.
+type RepairReport struct {
+	// TablesScanned is the number of SSTable files checked
+	TablesScanned int
+	// TablesQuarantined is the number of SSTables that failed their check
+	// and were moved out of the database
+	TablesQuarantined int
+	// Damaged lists the paths of the SSTables that failed their check, as
+	// they were before being quarantined
+	Damaged []string
+	// Quarantined lists the paths the damaged tables were moved to
+	Quarantined []string
+	// RecoverableKeys is the number of entries, tombstones included, in the
+	// tables the rebuilt manifest references. Entries only in the WAL are
+	// not counted; they are replayed as usual when the database is opened.
+	RecoverableKeys uint64
+}
+
+// Repair checks every SSTable in the database at dataDir with
+// sstable.Reader.Verify, moves the ones that fail into a quarantine
+// directory and rewrites the manifest to reference only the tables that
+// survive. Tables keep the order the manifest gave them; without a readable
+// manifest every valid table on disk is used, as for a database written
+// before the manifest existed, and tables in the unversioned format from
+// before format versions are converted first. The WAL is left untouched.
+//
+// Repair must not run while the database is open. It takes cfg, which
+// should match the configuration the database is opened with, because
+// tables can only be checked against the Comparator that sorted them and
+// are found through TierPaths; nil means the defaults.
+func Repair(dataDir string, cfg *config.Config) (RepairReport, error) {
+	return RepairWithOptions(dataDir, cfg, RepairOptions{})
+}
+
+// RepairOptions control what Repair changes.
+type RepairOptions struct {
+	// DryRun checks every table and fills in the report, listing the
+	// damaged tables in Damaged, without quarantining them or rewriting
+	// the manifest
+	DryRun bool
+}
+
+// RepairWithOptions is like Repair, changing the database only as opts
+// allows.
+func RepairWithOptions(dataDir string, cfg *config.Config, opts RepairOptions) (RepairReport, error) {
+	var report RepairReport
+	e := NewEngine(cfg)
+	if _, err := e.fs.Stat(dataDir); err != nil {
+		return report, gerrors.IO("failed to open data directory", err)
+	}
+	if err := e.setDataDir(dataDir); err != nil {
+		return report, err
+	}
+	tierNums, roots, maxNum, found, err := openManifest(e.fs, dataDir)
+	if err != nil {
+		log.Printf("ignoring unreadable manifest: %v", err)
+		tierNums, roots, maxNum, found = nil, nil, 0, false
+	}
+
+	onDisk, maxOnDisk, err := e.scanSSTables(roots)
+	if err != nil {
+		return report, gerrors.IO("failed to list SSTables", err)
+	}
+	if !found {
+		for _, table := range onDisk {
+			for len(tierNums) <= table.ref.tier {
+				tierNums = append(tierNums, nil)
+			}
+			tierNums[table.ref.tier] = append(tierNums[table.ref.tier], table.ref.num)
+		}
+	}
+
+	// Check every table on disk, including ones the manifest no longer
+	// references, so the report covers the whole directory
+	valid := make(map[tableRef]uint64, len(onDisk))
+	liveRoots := make(map[uint64]string)
+	for _, table := range onDisk {
+		report.TablesScanned++
+		if !found {
+			// As when opening, tables from before format versions are
+			// converted rather than treated as damaged
+			if opts.DryRun {
+				if legacy, err := sstable.IsLegacy(e.fs, table.path); err == nil && legacy {
+					log.Printf("SSTable %s is in the unversioned format and would be converted", table.path)
+					continue
+				}
+			} else if err := e.convertLegacyTable(table.path); err != nil {
+				log.Printf("failed to convert SSTable %s: %v", table.path, err)
+			}
+		}
+		count, err := e.verifyTable(table.path)
+		if err == nil {
+			valid[table.ref] = count
+			if root := tableRoot(table.path); root != filepath.Clean(dataDir) {
+				liveRoots[table.ref.num] = root
+			}
+			continue
+		}
+
+		report.Damaged = append(report.Damaged, table.path)
+		if opts.DryRun {
+			log.Printf("SSTable %s is damaged: %v", table.path, err)
+			continue
+		}
+		log.Printf("quarantining SSTable %s: %v", table.path, err)
+		dest, err := quarantine(e.fs, table)
+		if err != nil {
+			return report, err
+		}
+		report.TablesQuarantined++
+		report.Quarantined = append(report.Quarantined, dest)
+	}
+
+	liveNums := make([][]uint64, len(tierNums))
+	for tier, nums := range tierNums {
+		for _, num := range nums {
+			count, ok := valid[tableRef{tier: tier, num: num}]
+			if !ok {
+				continue
+			}
+			liveNums[tier] = append(liveNums[tier], num)
+			report.RecoverableKeys += count
+		}
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+	m, err := createManifest(e.fs, dataDir, liveNums, liveRoots, max(maxNum, maxOnDisk))
+	if err != nil {
+		return report, err
+	}
+	if err := m.close(); err != nil {
+		return report, gerrors.IO("failed to close manifest", err)
+	}
+	return report, nil
+}
+
+// verifyTable opens and verifies the SSTable at path, returning its entry
+// count.
+func (e *Engine) verifyTable(path string) (uint64, error) {
+	opts := e.sstOptions()
+	opts.BlockCache = nil
+	reader, err := sstable.NewReaderWithOptions(path, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = reader.Close() }()
+
+	if err := reader.Verify(); err != nil {
+		return 0, err
+	}
+	return reader.Count(), nil
+}
+
+// quarantine moves table into the quarantine directory beside its sstables
+// directory, naming it after its tier and file name, and returns its new
+// path.
+func quarantine(fs storage.FS, table diskTable) (string, error) {
+	dir := filepath.Join(tableRoot(table.path), quarantineDir)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return "", gerrors.IO("failed to create quarantine directory", err)
+	}
+	dest := filepath.Join(dir, fmt.Sprintf("T%d-%s", table.ref.tier, filepath.Base(table.path)))
+	if err := fs.Rename(table.path, dest); err != nil {
+		return "", gerrors.IO("failed to quarantine SSTable", err)
+	}
+	return dest, nil
+}
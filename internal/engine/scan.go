@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"bytes"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// ScanPrefix calls fn for every live key starting with prefix, in key order,
+// until fn returns false. SSTables whose prefix filter rules out the prefix
+// are not read. The engine read lock is held during the scan, so fn must not
+// write to the engine. Keys sharing a prefix only sort together in byte
+// order, so it fails with ErrInvalidArgument if a custom Comparator is
+// configured.
+func (e *Engine) ScanPrefix(prefix []byte, fn func(key, value []byte) bool) error {
+	if e.config.Comparator != nil {
+		return gerrors.InvalidArgument("ScanPrefix requires the default byte order, not a custom Comparator", nil)
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed.Load() {
+		return gerrors.Closed("engine is closed", nil)
+	}
+
+	now := e.now()
+	// Tables the prefix filter rules out may still delete keys in range
+	rangeDels := e.rangeTombstonesLocked()
+	iter := sstable.NewMergingIteratorWithComparator(e.sourcesLocked(e.prefixTablesLocked(prefix)), e.compare)
+	iter.SetMerge(e.mergeOptions(rangeDels, now))
+	var ok bool
+	if len(prefix) > 0 {
+		ok = iter.Seek(prefix)
+	} else {
+		ok = iter.Next()
+	}
+	for ; ok; ok = iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if iter.Type() == storage.DeleteEntry || expired(iter, now) || e.coveredBy(rangeDels, key, iter.Seq()) {
+			continue
+		}
+		if !fn(key, iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// PrefixScan returns an iterator over the live keys starting with prefix,
+// in key order. An empty prefix iterates over every key. Unlike ScanPrefix
+// it does not hold the engine lock while the caller iterates; it reads a
+// snapshot like any other Iterator. Like ScanPrefix, it fails with
+// ErrInvalidArgument if a custom Comparator is configured.
+func (e *Engine) PrefixScan(prefix []byte) (*Iterator, error) {
+	if e.config.Comparator != nil {
+		return nil, gerrors.InvalidArgument("PrefixScan requires the default byte order, not a custom Comparator", nil)
+	}
+	start := bytes.Clone(prefix)
+	if start == nil {
+		start = []byte{}
+	}
+	return e.NewIterator(start, prefixUpperBound(prefix))
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix, or nil if there is none because prefix is empty or all 0xFF.
+func prefixUpperBound(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := bytes.Clone(prefix[:i+1])
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// prefixTablesLocked returns the tables, oldest first, that may hold keys
+// starting with prefix according to their prefix filters.
+// Must be called with the engine mutex held.
+func (e *Engine) prefixTablesLocked(prefix []byte) []*sstable.Reader {
+	tables := e.tablesLocked()
+	if e.config.PrefixExtractor == nil {
+		return tables
+	}
+	extracted := e.config.PrefixExtractor(prefix)
+	if extracted == nil {
+		return tables
+	}
+
+	matching := tables[:0]
+	for _, reader := range tables {
+		if reader.MayContainPrefix(extracted) {
+			matching = append(matching, reader)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// compactionScheduler queues compaction jobs, one per source tier, and runs
+// them on a fixed number of workers. A job for tier t rewrites tables of
+// tiers t and t+1, so two jobs only run at the same time when they share
+// neither tier.
+type compactionScheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []int        // tiers waiting to be compacted, oldest request first
+	busy    map[int]bool // tiers held by a running job
+	running int
+	peak    int // the most jobs ever running at once
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// startWorkers starts n workers that run queued compaction jobs until
+// stopWorkers is called.
+func (cm *CompactionManager) startWorkers(n int) {
+	s := &cm.sched
+	for range max(n, 1) {
+		s.workers.Add(1)
+		go cm.worker()
+	}
+}
+
+// stopWorkers stops the workers once they are idle. Jobs must no longer be
+// enqueued, which holds once the engine's wait group has drained.
+func (cm *CompactionManager) stopWorkers() {
+	s := &cm.sched
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.workers.Wait()
+}
+
+// enqueue schedules a compaction of tier unless one is already waiting.
+// The engine's wait group counts the job until it has finished, so
+// WaitForFlush and Close also wait for queued compactions.
+func (cm *CompactionManager) enqueue(tier int) {
+	s := &cm.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.Contains(s.queue, tier) {
+		return
+	}
+	cm.engine.wg.Add(1)
+	s.queue = append(s.queue, tier)
+	s.cond.Broadcast()
+}
+
+// nextJobLocked removes and returns the queued tier to compact next: of
+// those whose job can run alongside the running ones, the one the
+// CompactionPicker prefers. Must be called with s.mu held, which is
+// released while the picker runs.
+func (cm *CompactionManager) nextJobLocked() (int, bool) {
+	s := &cm.sched
+	for {
+		var runnable []int
+		for _, tier := range s.queue {
+			if !s.busy[tier] && !s.busy[tier+1] {
+				runnable = append(runnable, tier)
+			}
+		}
+		if len(runnable) == 0 {
+			return 0, false
+		}
+
+		tier := runnable[0]
+		if len(runnable) > 1 {
+			s.mu.Unlock()
+			tier = cm.pick(runnable)
+			s.mu.Lock()
+		}
+		// Another worker may have taken the tier or a neighbour meanwhile
+		i := slices.Index(s.queue, tier)
+		if i >= 0 && !s.busy[tier] && !s.busy[tier+1] {
+			s.queue = slices.Delete(s.queue, i, i+1)
+			return tier, true
+		}
+	}
+}
+
+// claim waits until no running job uses tier or tier+1, then holds both
+// for a compaction run outside the queue until release is called.
+func (s *compactionScheduler) claim(tier int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.busy[tier] || s.busy[tier+1] {
+		s.cond.Wait()
+	}
+	s.busy[tier], s.busy[tier+1] = true, true
+}
+
+// release gives back the tiers taken by claim.
+func (s *compactionScheduler) release(tier int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, tier)
+	delete(s.busy, tier+1)
+	s.cond.Broadcast()
+}
+
+func (cm *CompactionManager) worker() {
+	s := &cm.sched
+	defer s.workers.Done()
+
+	s.mu.Lock()
+	for {
+		tier, ok := cm.nextJobLocked()
+		if !ok {
+			if s.closed {
+				s.mu.Unlock()
+				return
+			}
+			s.cond.Wait()
+			continue
+		}
+		s.busy[tier], s.busy[tier+1] = true, true
+		s.running++
+		s.peak = max(s.peak, s.running)
+		s.mu.Unlock()
+
+		if err := cm.runJob(tier); err != nil {
+			log.Printf("compaction error: %v", err)
+		}
+
+		s.mu.Lock()
+		delete(s.busy, tier)
+		delete(s.busy, tier+1)
+		s.running--
+		s.cond.Broadcast()
+		cm.engine.wg.Done()
+	}
+}
+
+// runJob compacts tier if it is over its limit, then queues the tiers the
+// job may have left over theirs: the next tier, which received its output,
+// and tier itself, which may have gained tables while the merge ran.
+func (cm *CompactionManager) runJob(tier int) error {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if err := cm.compactTier(tier); err != nil {
+		return err
+	}
+
+	cm.engine.mu.RLock()
+	defer cm.engine.mu.RUnlock()
+	for _, t := range []int{tier, tier + 1} {
+		if cm.shouldCompactTier(t) {
+			cm.enqueue(t)
+		}
+	}
+	return nil
+}
+
+// rateLimiter paces the bytes written by compactions to a fixed rate,
+// shared by every compaction running at the same time.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64     // bytes per second
+	next time.Time // when the bytes reserved so far have been paid for
+}
+
+// newRateLimiter returns a limiter for bytesPerSecond, or nil, which never
+// waits, if bytesPerSecond is not positive.
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: int64(bytesPerSecond)}
+}
+
+// wait accounts for n bytes just written and sleeps until the writes so far
+// fit within the rate. Time spent idle is not saved up for later bursts.
+func (l *rateLimiter) wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n * int64(time.Second) / l.rate))
+	until := l.next
+	l.mu.Unlock()
+
+	if d := time.Until(until); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/MikhailWahib/graveldb/internal/memtable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// Stats is a snapshot of the engine's state and cumulative activity.
+type Stats struct {
+	// TablesPerTier is the number of SSTables in each tier, T0 first
+	TablesPerTier []int `json:"tables_per_tier"`
+	// BytesPerTier is the total size of the SSTables in each tier, T0
+	// first
+	BytesPerTier []int64 `json:"bytes_per_tier"`
+	// DiskBytes is the total size of the SSTables and WAL files
+	DiskBytes int64 `json:"disk_bytes"`
+	// MemtableBytes is the size of the active memtable
+	MemtableBytes int `json:"memtable_bytes"`
+	// ImmutableMemtables is the number of sealed memtables waiting to be
+	// flushed
+	ImmutableMemtables int `json:"immutable_memtables"`
+	// Puts, Deletes and Gets count the operations applied since the engine
+	// was opened. Each put or delete in a PutMany or Write counts once.
+	Puts    uint64 `json:"puts"`
+	Deletes uint64 `json:"deletes"`
+	Gets    uint64 `json:"gets"`
+	// BlockCacheHits and BlockCacheMisses count the point lookups that
+	// found their SSTable block in the block cache and those that read it
+	// from disk
+	BlockCacheHits   uint64 `json:"block_cache_hits"`
+	BlockCacheMisses uint64 `json:"block_cache_misses"`
+	// BytesFlushed and BytesCompacted are the total size of the SSTables
+	// written by flushes and by compactions since the engine was opened
+	BytesFlushed   uint64 `json:"bytes_flushed"`
+	BytesCompacted uint64 `json:"bytes_compacted"`
+}
+
+// opCounters holds the cumulative operation counts reported by Stats.
+type opCounters struct {
+	puts           atomic.Uint64
+	deletes        atomic.Uint64
+	gets           atomic.Uint64
+	bytesFlushed   atomic.Uint64
+	bytesCompacted atomic.Uint64
+}
+
+// Stats returns a consistent snapshot of the engine's statistics.
+func (e *Engine) Stats() Stats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	stats := Stats{
+		TablesPerTier:      make([]int, len(e.tiers)),
+		BytesPerTier:       make([]int64, len(e.tiers)),
+		MemtableBytes:      e.memtable.Size(),
+		ImmutableMemtables: len(e.immutableMemtables),
+		Puts:               e.counters.puts.Load(),
+		Deletes:            e.counters.deletes.Load(),
+		Gets:               e.counters.gets.Load(),
+		BytesFlushed:       e.counters.bytesFlushed.Load(),
+		BytesCompacted:     e.counters.bytesCompacted.Load(),
+	}
+	stats.BlockCacheHits, stats.BlockCacheMisses = e.blockCache.Stats()
+	for i, tier := range e.tiers {
+		stats.TablesPerTier[i] = len(tier)
+		for _, reader := range tier {
+			stats.BytesPerTier[i] += reader.Size()
+		}
+		stats.DiskBytes += stats.BytesPerTier[i]
+	}
+
+	// The WAL segments of memtables not yet flushed
+	if e.wal != nil {
+		stats.DiskBytes += e.wal.Size()
+	}
+
+	return stats
+}
+
+// TableInfo describes one live SSTable.
+type TableInfo struct {
+	// Tier is the tier holding the table, 0 for T0
+	Tier int `json:"tier"`
+	// Path is the table's file path
+	Path string `json:"path"`
+	// Size is the size of the file in bytes
+	Size int64 `json:"size"`
+	// MinKey and MaxKey are the smallest and largest keys in the table,
+	// nil if it holds no keys
+	MinKey []byte `json:"min_key"`
+	MaxKey []byte `json:"max_key"`
+	// Entries is the number of entries in the table, tombstones included
+	Entries uint64 `json:"entries"`
+}
+
+// SSTableInfo describes every live SSTable, tier by tier from T0 and oldest
+// first within a tier. It reads only what the readers loaded when the tables
+// were opened, not the tables themselves.
+func (e *Engine) SSTableInfo() []TableInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var infos []TableInfo
+	for tier, readers := range e.tiers {
+		for _, reader := range readers {
+			infos = append(infos, TableInfo{
+				Tier:    tier,
+				Path:    reader.Path(),
+				Size:    reader.Size(),
+				MinKey:  bytes.Clone(reader.MinKey()),
+				MaxKey:  bytes.Clone(reader.MaxKey()),
+				Entries: reader.Count(),
+			})
+		}
+	}
+	return infos
+}
+
+// ApproximateSize estimates the number of keys and bytes with
+// start <= key < end without reading any data: each SSTable contributes an
+// estimate from its sparse index, and the memtables are counted directly,
+// with each entry sized as it would be encoded in an uncompressed SSTable.
+// Overwritten and deleted keys are counted in every table that still holds
+// them, so the estimate runs high until compaction removes them. A nil start
+// or end leaves that side unbounded.
+func (e *Engine) ApproximateSize(start, end []byte) (keys, size uint64) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, tier := range e.tiers {
+		for _, reader := range tier {
+			k, b := reader.ApproximateRange(start, end)
+			keys += k
+			size += b
+		}
+	}
+
+	memtables := []memtable.Memtable{e.memtable}
+	for _, immutable := range e.immutableMemtables {
+		memtables = append(memtables, immutable.mt)
+	}
+	for _, mt := range memtables {
+		it := mt.NewRangeIterator(start, end)
+		for it.Next() {
+			keys++
+			size += uint64(storage.PrefixSize + len(it.Key()) + len(it.Value()) + storage.ChecksumSize)
+			if it.Seq() != 0 {
+				size += storage.SeqSize
+			}
+			if it.ExpiresAt() != 0 {
+				size += storage.ExpirySize
+			}
+		}
+	}
+	return keys, size
+}
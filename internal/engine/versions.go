@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"context"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// VersionedValue is one version of a key returned by GetVersions.
+type VersionedValue struct {
+	Value []byte
+	// Seq is the sequence number the version was written with
+	Seq uint64
+	// Deleted is set for a tombstone or an expired version, which has no
+	// Value
+	Deleted bool
+}
+
+// GetVersions returns up to n versions of key, newest first, or every
+// version still held if n <= 0. Flushes and compactions keep up to
+// config.MaxVersionsPerKey versions of each key; without it, only versions
+// not yet compacted together are returned. Versions deleted by a range
+// tombstone are left out, and merge entries are returned as the values they
+// resolve to.
+func (e *Engine) GetVersions(key []byte, n int) ([]VersionedValue, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed.Load() {
+		return nil, gerrors.Closed("engine is closed", nil)
+	}
+
+	e.counters.gets.Add(1)
+	var entries []storage.Entry
+	err := e.versionsLocked(context.Background(), key, func(entry storage.Entry) bool {
+		if !e.rangeDeletedLocked(key, entry.Seq) {
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge entries apply to the versions beneath them, so values are
+	// settled oldest first
+	now := e.now()
+	versions := make([]VersionedValue, len(entries))
+	var base []byte
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		version := VersionedValue{Value: entry.Value, Seq: entry.Seq}
+		switch {
+		case entry.Type == storage.DeleteEntry || entry.Expired(now):
+			version.Value, version.Deleted = nil, true
+		case entry.Type == storage.MergeEntry && e.config.MergeFunc != nil:
+			version.Value = e.config.MergeFunc(base, entry.Value)
+		}
+		base = version.Value
+		versions[i] = version
+	}
+
+	if n > 0 && len(versions) > n {
+		versions = versions[:n]
+	}
+	return versions, nil
+}
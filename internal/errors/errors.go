@@ -20,11 +20,58 @@ const (
 	ErrCodeClosed Code = "CLOSED"
 	// ErrCodeInternal indicates an internal error.
 	ErrCodeInternal Code = "INTERNAL"
+	// ErrCodeInvariant indicates a violated internal invariant.
+	ErrCodeInvariant Code = "INVARIANT"
+	// ErrCodeChecksumMismatch indicates data that failed checksum verification.
+	ErrCodeChecksumMismatch Code = "CHECKSUM_MISMATCH"
+	// ErrCodeBadMagic indicates a file that does not end in the expected magic number.
+	ErrCodeBadMagic Code = "BAD_MAGIC"
+	// ErrCodeUnsupportedVersion indicates a file written in an unknown format version.
+	ErrCodeUnsupportedVersion Code = "UNSUPPORTED_VERSION"
+	// ErrCodeEntryTooLarge indicates a key or value over a size limit.
+	ErrCodeEntryTooLarge Code = "ENTRY_TOO_LARGE"
+	// ErrCodeEmptyKey indicates a write of an empty key.
+	ErrCodeEmptyKey Code = "EMPTY_KEY"
+	// ErrCodeInvalidArgument indicates an argument outside what a call accepts.
+	ErrCodeInvalidArgument Code = "INVALID_ARGUMENT"
 )
 
 // ErrNotFound represents a Not Found error
 var ErrNotFound = &Error{Code: ErrCodeNotFound}
 
+// ErrCorrupt matches any corruption error
+var ErrCorrupt = &Error{Code: ErrCodeCorruption}
+
+// ErrChecksumMismatch is reported, wrapped in a corruption error, when stored
+// data does not match its checksum
+var ErrChecksumMismatch = &Error{Code: ErrCodeChecksumMismatch}
+
+// ErrBadMagic is reported, wrapped in a corruption error, when a file opened
+// as an SSTable does not end in the SSTable magic number
+var ErrBadMagic = &Error{Code: ErrCodeBadMagic}
+
+// ErrUnsupportedVersion is reported, wrapped in a corruption error, when an
+// SSTable was written in a format version this build cannot read
+var ErrUnsupportedVersion = &Error{Code: ErrCodeUnsupportedVersion}
+
+// ErrEntryTooLarge is reported when a write exceeds the configured key or
+// value size limit, and, wrapped in a corruption error, when stored data
+// claims a length over the hard limit on entry sizes
+var ErrEntryTooLarge = &Error{Code: ErrCodeEntryTooLarge}
+
+// ErrEmptyKey is reported when a write has an empty key
+var ErrEmptyKey = &Error{Code: ErrCodeEmptyKey}
+
+// ErrInvalidArgument is reported when a call is given an argument it does
+// not accept, such as a tier the database does not have
+var ErrInvalidArgument = &Error{Code: ErrCodeInvalidArgument}
+
+// ErrInvariant matches any invariant violation reported in strict mode
+var ErrInvariant = &Error{Code: ErrCodeInvariant}
+
+// ErrClosed matches any error from using a resource after it was closed
+var ErrClosed = &Error{Code: ErrCodeClosed}
+
 // Error represents a custom error with code, message, and underlying error.
 type Error struct {
 	Code    Code
@@ -75,3 +122,28 @@ func Closed(msg string, err error) error {
 func Internal(msg string, err error) error {
 	return &Error{Code: ErrCodeInternal, Message: msg, Err: err}
 }
+
+// TooLarge creates an entry too large error.
+func TooLarge(msg string, err error) error {
+	return &Error{Code: ErrCodeEntryTooLarge, Message: msg, Err: err}
+}
+
+// EmptyKey creates an empty key error.
+func EmptyKey(msg string, err error) error {
+	return &Error{Code: ErrCodeEmptyKey, Message: msg, Err: err}
+}
+
+// InvalidArgument creates an invalid argument error.
+func InvalidArgument(msg string, err error) error {
+	return &Error{Code: ErrCodeInvalidArgument, Message: msg, Err: err}
+}
+
+// NotFound creates a not found error.
+func NotFound(msg string, err error) error {
+	return &Error{Code: ErrCodeNotFound, Message: msg, Err: err}
+}
+
+// Invariant creates an invariant violation error.
+func Invariant(msg string, err error) error {
+	return &Error{Code: ErrCodeInvariant, Message: msg, Err: err}
+}
@@ -3,6 +3,8 @@
 package memtable
 
 import (
+	"bytes"
+
 	"github.com/MikhailWahib/graveldb/internal/storage"
 )
 
@@ -10,31 +12,67 @@ import (
 type Memtable interface {
 	// Entries() []storage.Entry
 	NewIterator() Iterator
+	NewRangeIterator(start, end []byte) Iterator
+	// NewVersionsIterator returns an iterator over every version kept of
+	// each key, newest first within a key
+	NewVersionsIterator() Iterator
 	Put(key, value []byte) error
+	Apply(entry storage.Entry) error
 	Get(key []byte) (storage.Entry, bool)
+	// Versions returns every version kept of key, newest first
+	Versions(key []byte) []storage.Entry
 	Delete(key []byte) error
+	// RangeTombstones returns the range tombstones applied to the memtable,
+	// oldest first. They are kept apart from the keys they cover.
+	RangeTombstones() []storage.Entry
 	Size() int
+	// Len returns the number of entries in the memtable: one per key,
+	// tombstones included, plus one per range tombstone.
+	Len() int
 	Clear()
 }
 
 // Iterator provides sequential access to entries in the memtable.
 type Iterator interface {
+	// Seek positions the iterator at the first entry with key >= key and
+	// reports whether there is one.
+	Seek(key []byte) bool
 	Next() bool
 	Key() []byte
 	Value() []byte
 	Type() storage.EntryType
+	IsDeleted() bool
+	// ExpiresAt returns the current entry's expiry in Unix nanoseconds, or 0
+	// if it never expires.
+	ExpiresAt() int64
+	// Seq returns the current entry's sequence number.
+	Seq() uint64
 }
 
 // SkiplistMemtable implements the Memtable interface using a skiplist
 // data structure for efficient operations
 type SkiplistMemtable struct {
-	sl *SkipList
+	sl        *SkipList
+	rangeDels []storage.Entry
+	rangeSize int
 }
 
-// NewMemtable creates a new Memtable instance.
+// NewMemtable creates a new Memtable instance ordered by bytes.Compare.
 func NewMemtable() Memtable {
+	return NewMemtableWithComparator(nil)
+}
+
+// NewMemtableWithComparator creates a new Memtable whose keys are ordered
+// by cmp. A nil cmp orders keys with bytes.Compare.
+func NewMemtableWithComparator(cmp func(a, b []byte) int) Memtable {
+	return NewMemtableWithOptions(Options{Comparator: cmp})
+}
+
+// NewMemtableWithOptions creates a new Memtable whose skiplist is
+// configured by opts.
+func NewMemtableWithOptions(opts Options) Memtable {
 	return &SkiplistMemtable{
-		sl: NewSkipList(),
+		sl: NewSkipListWithOptions(opts),
 	}
 }
 
@@ -48,10 +86,44 @@ func (m *SkiplistMemtable) NewIterator() Iterator {
 	return m.sl.NewIterator()
 }
 
-// Put inserts or updates an entry in the memtable
+// NewVersionsIterator creates an iterator over every version kept of each
+// key, newest first within a key. Only memtables created with MaxVersions
+// above 1 keep more than the newest.
+func (m *SkiplistMemtable) NewVersionsIterator() Iterator {
+	return m.sl.NewVersionsIterator()
+}
+
+// NewRangeIterator creates an iterator over the entries, tombstones
+// included, with start <= key < end. A nil start or end leaves that side
+// unbounded.
+func (m *SkiplistMemtable) NewRangeIterator(start, end []byte) Iterator {
+	return m.sl.NewRangeIterator(start, end)
+}
+
+// Put inserts or updates an entry in the memtable.
+// The key and value are copied, so the caller may reuse its buffers.
 func (m *SkiplistMemtable) Put(key, value []byte) error {
+	m.sl.Put(storage.Entry{Type: storage.PutEntry, Key: bytes.Clone(key), Value: bytes.Clone(value)})
+	return nil
+}
 
-	m.sl.Put(storage.Entry{Type: storage.PutEntry, Key: key, Value: value})
+// Apply inserts entry, a put, a tombstone or a range tombstone, keeping its
+// expiry and sequence number. The key and value are copied, so the caller
+// may reuse its buffers.
+func (m *SkiplistMemtable) Apply(entry storage.Entry) error {
+	entry.Key = bytes.Clone(entry.Key)
+	if entry.Type == storage.RangeDeleteEntry {
+		entry.Value = bytes.Clone(entry.Value)
+		m.rangeDels = append(m.rangeDels, entry)
+		m.rangeSize += len(entry.Key) + len(entry.Value)
+		return nil
+	}
+	if entry.Type == storage.DeleteEntry {
+		entry.Value = nil
+	} else {
+		entry.Value = bytes.Clone(entry.Value)
+	}
+	m.sl.Put(entry)
 	return nil
 }
 
@@ -60,21 +132,42 @@ func (m *SkiplistMemtable) Get(key []byte) (storage.Entry, bool) {
 	return m.sl.Get(key)
 }
 
-// Delete marks the given key as deleted
+// Versions returns every version kept of key, newest first.
+func (m *SkiplistMemtable) Versions(key []byte) []storage.Entry {
+	return m.sl.Versions(key)
+}
+
+// Delete marks the given key as deleted.
+// The key is copied, so the caller may reuse its buffer.
 func (m *SkiplistMemtable) Delete(key []byte) error {
-	err := m.sl.Delete(key)
+	err := m.sl.Delete(bytes.Clone(key))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Size returns the size of entries in the memtable in bytes
+// RangeTombstones returns the range tombstones applied to the memtable,
+// oldest first.
+func (m *SkiplistMemtable) RangeTombstones() []storage.Entry {
+	return m.rangeDels
+}
+
+// Size returns the size of entries in the memtable in bytes, range
+// tombstones included
 func (m *SkiplistMemtable) Size() int {
-	return m.sl.Size()
+	return m.sl.Size() + m.rangeSize
+}
+
+// Len returns the number of entries in the memtable, counting each key once
+// and each range tombstone
+func (m *SkiplistMemtable) Len() int {
+	return m.sl.Len() + len(m.rangeDels)
 }
 
 // Clear clears the memtable
 func (m *SkiplistMemtable) Clear() {
 	m.sl.Clear()
+	m.rangeDels = nil
+	m.rangeSize = 0
 }
@@ -1,6 +1,8 @@
 package memtable_test
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/MikhailWahib/graveldb/internal/memtable"
@@ -48,3 +50,213 @@ func TestMemtable_Size(t *testing.T) {
 
 	assert.Equal(t, 5, mt.Size(), "expected size 5 after logical delete")
 }
+
+func TestMemtable_SizeStableUnderOverwrites(t *testing.T) {
+	mt := memtable.NewMemtable()
+
+	require.NoError(t, mt.Put([]byte("key"), []byte("value")))
+	for range 1000 {
+		require.NoError(t, mt.Put([]byte("key"), []byte("value")))
+	}
+	assert.Equal(t, len("key")+len("value"), mt.Size())
+
+	// Only the value's length difference is applied
+	require.NoError(t, mt.Put([]byte("key"), []byte("v")))
+	assert.Equal(t, len("key")+len("v"), mt.Size())
+	require.NoError(t, mt.Put([]byte("key"), []byte("a longer value")))
+	assert.Equal(t, len("key")+len("a longer value"), mt.Size())
+}
+
+func TestMemtable_MaxVersions(t *testing.T) {
+	mt := memtable.NewMemtableWithOptions(memtable.Options{MaxVersions: 3})
+
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, mt.Apply(storage.Entry{Type: storage.PutEntry, Key: []byte("a"), Value: []byte(fmt.Sprint(i)), Seq: uint64(i)}))
+	}
+	require.NoError(t, mt.Apply(storage.Entry{Type: storage.DeleteEntry, Key: []byte("a"), Seq: 5}))
+	require.NoError(t, mt.Apply(storage.Entry{Type: storage.PutEntry, Key: []byte("b"), Value: []byte("1"), Seq: 6}))
+
+	// Only the three newest versions of a are kept, and all of them count
+	var seqs []uint64
+	for _, entry := range mt.Versions([]byte("a")) {
+		seqs = append(seqs, entry.Seq)
+	}
+	assert.Equal(t, []uint64{5, 4, 3}, seqs)
+	assert.Equal(t, len("a")+len("a4")+len("a3")+len("b1"), mt.Size())
+	assert.Equal(t, 2, mt.Len())
+	entry, ok := mt.Get([]byte("a"))
+	require.True(t, ok)
+	assert.Equal(t, storage.DeleteEntry, entry.Type)
+	assert.Nil(t, mt.Versions([]byte("c")))
+
+	var got []string
+	iter := mt.NewVersionsIterator()
+	for iter.Next() {
+		got = append(got, fmt.Sprintf("%s@%d", iter.Key(), iter.Seq()))
+	}
+	assert.Equal(t, []string{"a@5", "a@4", "a@3", "b@6"}, got)
+
+	// The plain iterator still sees one entry per key
+	got = got[:0]
+	iter = mt.NewIterator()
+	for iter.Next() {
+		got = append(got, fmt.Sprintf("%s@%d", iter.Key(), iter.Seq()))
+	}
+	assert.Equal(t, []string{"a@5", "b@6"}, got)
+}
+
+func TestMemtable_SizeAfterDeleteAndReinsert(t *testing.T) {
+	mt := memtable.NewMemtable()
+
+	require.NoError(t, mt.Put([]byte("key"), []byte("value")))
+	require.NoError(t, mt.Delete([]byte("key")))
+	assert.Equal(t, len("key"), mt.Size(), "a tombstone counts its key")
+
+	// Deleting again, or deleting a key never written, counts each key once
+	require.NoError(t, mt.Delete([]byte("key")))
+	require.NoError(t, mt.Delete([]byte("other")))
+	assert.Equal(t, len("key")+len("other"), mt.Size())
+
+	require.NoError(t, mt.Put([]byte("key"), []byte("new")))
+	assert.Equal(t, len("key")+len("new")+len("other"), mt.Size())
+}
+
+func TestMemtable_Len(t *testing.T) {
+	mt := memtable.NewMemtable()
+	assert.Equal(t, 0, mt.Len())
+
+	for i := range 100 {
+		require.NoError(t, mt.Put(fmt.Appendf(nil, "key%03d", i), []byte("v")))
+	}
+	assert.Equal(t, 100, mt.Len())
+
+	// Overwrites and deletes of existing keys count nothing new, while a
+	// tombstone for an unseen key and a range tombstone count once each
+	require.NoError(t, mt.Put([]byte("key000"), []byte("new")))
+	require.NoError(t, mt.Delete([]byte("key001")))
+	require.NoError(t, mt.Delete([]byte("other")))
+	require.NoError(t, mt.Apply(storage.Entry{Type: storage.RangeDeleteEntry, Key: []byte("a"), Value: []byte("b")}))
+	assert.Equal(t, 102, mt.Len())
+
+	mt.Clear()
+	assert.Equal(t, 0, mt.Len())
+}
+
+func TestMemtable_PutCopiesCallerBuffers(t *testing.T) {
+	mt := memtable.NewMemtable()
+
+	key := []byte("key1")
+	value := []byte("value1")
+	require.NoError(t, mt.Put(key, value))
+
+	// Reuse the caller's buffers
+	copy(key, "key2")
+	copy(value, "XXXXXX")
+
+	entry, ok := mt.Get([]byte("key1"))
+	require.True(t, ok)
+	assert.Equal(t, []byte("value1"), entry.Value)
+
+	_, ok = mt.Get([]byte("key2"))
+	assert.False(t, ok)
+}
+
+func TestMemtable_RangeIterator(t *testing.T) {
+	mt := memtable.NewMemtable()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, mt.Put([]byte(key), []byte("v"+key)))
+	}
+	require.NoError(t, mt.Delete([]byte("c")))
+
+	collect := func(it memtable.Iterator) []string {
+		var got []string
+		for it.Next() {
+			if it.IsDeleted() {
+				got = append(got, string(it.Key())+"=-")
+			} else {
+				got = append(got, string(it.Key())+"="+string(it.Value()))
+			}
+		}
+		return got
+	}
+
+	// Unbounded ranges match the plain iterator, tombstones included
+	all := collect(mt.NewIterator())
+	assert.Equal(t, []string{"a=va", "b=vb", "c=-", "d=vd", "e=ve"}, all)
+	assert.Equal(t, all, collect(mt.NewRangeIterator(nil, nil)))
+
+	// Start is inclusive and end exclusive
+	assert.Equal(t, []string{"b=vb", "c=-"}, collect(mt.NewRangeIterator([]byte("b"), []byte("d"))))
+	assert.Equal(t, []string{"c=-", "d=vd", "e=ve"}, collect(mt.NewRangeIterator([]byte("bb"), nil)))
+	assert.Equal(t, []string{"a=va"}, collect(mt.NewRangeIterator(nil, []byte("b"))))
+	assert.Empty(t, collect(mt.NewRangeIterator([]byte("x"), nil)))
+	assert.Empty(t, collect(mt.NewRangeIterator([]byte("c"), []byte("c"))))
+
+	// Seeks stay within the range
+	it := mt.NewRangeIterator([]byte("b"), []byte("d"))
+	require.True(t, it.Seek([]byte("a")))
+	assert.Equal(t, "b", string(it.Key()))
+	assert.False(t, it.Seek([]byte("d")))
+
+	// Entries written after creation ahead of the iterator are seen
+	it = mt.NewRangeIterator([]byte("a"), []byte("c"))
+	require.True(t, it.Next())
+	require.NoError(t, mt.Put([]byte("bb"), []byte("new")))
+	assert.Equal(t, []string{"b=vb", "bb=new"}, collect(it))
+}
+
+func TestMemtable_SkipListOptions(t *testing.T) {
+	for _, opts := range []memtable.Options{
+		{MaxLevel: 1},
+		{MaxLevel: 100, Probability: 0.9},
+		{MaxLevel: 24, Probability: 0.25},
+		{MaxLevel: -1, Probability: 2},
+	} {
+		mt := memtable.NewMemtableWithOptions(opts)
+		keys := rand.Perm(1000)
+		for _, i := range keys {
+			require.NoError(t, mt.Put(fmt.Appendf(nil, "key-%04d", i), []byte("v")))
+		}
+
+		it := mt.NewIterator()
+		for i := range 1000 {
+			require.True(t, it.Next(), "%+v", opts)
+			assert.Equal(t, fmt.Sprintf("key-%04d", i), string(it.Key()), "%+v", opts)
+		}
+		assert.False(t, it.Next())
+		_, ok := mt.Get([]byte("key-0500"))
+		assert.True(t, ok, "%+v", opts)
+	}
+}
+
+// BenchmarkSkipListGet looks up random keys in a memtable of two million
+// entries. With the default 16 levels, about 30 nodes share the top level
+// and every search walks part of that run; 24 levels leave room for the
+// list to keep growing logarithmically. Building each list takes a while.
+func BenchmarkSkipListGet(b *testing.B) {
+	const n = 2_000_000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = fmt.Appendf(nil, "key-%08d", i)
+	}
+	order := rand.Perm(n)
+
+	for _, maxLevel := range []int{16, 24} {
+		b.Run(fmt.Sprintf("maxLevel=%d", maxLevel), func(b *testing.B) {
+			mt := memtable.NewMemtableWithOptions(memtable.Options{MaxLevel: maxLevel})
+			for _, i := range order {
+				if err := mt.Put(keys[i], keys[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			rng := rand.New(rand.NewSource(1))
+
+			b.ResetTimer()
+			for range b.N {
+				if _, ok := mt.Get(keys[rng.Intn(n)]); !ok {
+					b.Fatal("key not found")
+				}
+			}
+		})
+	}
+}
@@ -9,14 +9,35 @@ import (
 )
 
 const (
-	maxLevel    = 16
-	probability = 0.5
+	defaultMaxLevel    = 16
+	defaultProbability = 0.5
+	// maxMaxLevel caps MaxLevel; with p = 0.5, 64 levels suit 2^64 entries
+	maxMaxLevel = 64
 )
 
+// Options configures a SkipList or Memtable.
+type Options struct {
+	// Comparator orders keys; nil means bytes.Compare
+	Comparator func(a, b []byte) int
+	// MaxLevel is the most levels a node may have; values below 1 mean 16
+	// and values above 64 mean 64. A list stays efficient up to about
+	// (1/Probability)^MaxLevel entries
+	MaxLevel int
+	// Probability is the chance that a node reaching one level also
+	// reaches the next; values outside (0, 1) mean 0.5
+	Probability float64
+	// MaxVersions is the most versions of a key kept, the newest included;
+	// values below 2 keep only the newest
+	MaxVersions int
+}
+
 // SkipListNode represents a node in the skip list data structure
 type SkipListNode struct {
 	key   []byte
 	entry storage.Entry
+	// older holds the versions entry replaced, newest first, when the
+	// list keeps more than one
+	older []storage.Entry
 	next  []*SkipListNode
 }
 
@@ -26,8 +47,12 @@ type SkipList struct {
 	head     *SkipListNode
 	level    int
 	maxLevel int
+	prob     float64
 	size     int
+	count    int
 	rng      *rand.Rand
+	cmp      func(a, b []byte) int
+	versions int
 }
 
 // NewSkipListNode creates a new SkipListNode with the given key, value, and level.
@@ -40,15 +65,45 @@ func NewSkipListNode(key []byte, entry storage.Entry, level int) *SkipListNode {
 	}
 }
 
-// NewSkipList initializes and returns a new empty SkipList.
-// The list is seeded with a pseudo-random generator and a head node with maxLevel pointers.
+// NewSkipList initializes and returns a new empty SkipList ordered by
+// bytes.Compare.
+// The list is seeded with a pseudo-random generator and a head node with
+// pointers for the default 16 levels.
 func NewSkipList() *SkipList {
+	return NewSkipListWithComparator(nil)
+}
+
+// NewSkipListWithComparator returns a new empty SkipList whose keys are
+// ordered by cmp. A nil cmp orders keys with bytes.Compare.
+func NewSkipListWithComparator(cmp func(a, b []byte) int) *SkipList {
+	return NewSkipListWithOptions(Options{Comparator: cmp})
+}
+
+// NewSkipListWithOptions returns a new empty SkipList configured by opts.
+// The head node gets one pointer per level up to opts.MaxLevel.
+func NewSkipListWithOptions(opts Options) *SkipList {
+	cmp := opts.Comparator
+	if cmp == nil {
+		cmp = bytes.Compare
+	}
+	maxLevel := opts.MaxLevel
+	if maxLevel < 1 {
+		maxLevel = defaultMaxLevel
+	}
+	maxLevel = min(maxLevel, maxMaxLevel)
+	prob := opts.Probability
+	if prob <= 0 || prob >= 1 {
+		prob = defaultProbability
+	}
 	return &SkipList{
 		head:     NewSkipListNode([]byte{}, storage.Entry{}, maxLevel),
 		level:    1,
 		maxLevel: maxLevel,
+		prob:     prob,
 		size:     0,
 		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		cmp:      cmp,
+		versions: max(opts.MaxVersions, 1),
 	}
 }
 
@@ -70,21 +125,83 @@ func NewSkipList() *SkipList {
 // }
 
 // SkiplistIterator provides sequential access to entries in the skiplist.
+// It walks the level-0 list lazily, so it sees writes made after it was
+// created that land ahead of its position.
 type SkiplistIterator struct {
+	list    *SkipList
 	current *SkipListNode
+	start   []byte // nil means from the first key
+	end     []byte // exclusive; nil means to the last key
+	// versions makes the iterator visit the older versions of each key
+	// after its newest; version is the current one, 0 for the newest
+	versions bool
+	version  int
 }
 
 // NewIterator creates a new SkiplistIterator for the skiplist
 func (sl *SkipList) NewIterator() *SkiplistIterator {
 	return &SkiplistIterator{
+		list:    sl,
 		current: sl.head,
 	}
 }
 
+// NewVersionsIterator creates a SkiplistIterator over every version kept
+// of each key, newest first within a key.
+func (sl *SkipList) NewVersionsIterator() *SkiplistIterator {
+	it := sl.NewIterator()
+	it.versions = true
+	return it
+}
+
+// NewRangeIterator creates a SkiplistIterator over the entries with
+// start <= key < end. A nil start or end leaves that side unbounded.
+func (sl *SkipList) NewRangeIterator(start, end []byte) *SkiplistIterator {
+	it := &SkiplistIterator{
+		list:  sl,
+		start: start,
+		end:   end,
+	}
+	it.current = it.before(start)
+	return it
+}
+
+// Seek positions the iterator at the first entry with key >= key and
+// reports whether there is one. Keys outside the iterator's range are
+// never returned.
+func (it *SkiplistIterator) Seek(key []byte) bool {
+	if it.start != nil && it.list.cmp(key, it.start) < 0 {
+		key = it.start
+	}
+	it.current = it.before(key)
+	it.version = 0
+	return it.Next()
+}
+
+// before returns the last node with a key < key, or the head if there is
+// none.
+func (it *SkiplistIterator) before(key []byte) *SkipListNode {
+	x := it.list.head
+	for i := it.list.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && it.list.cmp(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+	}
+	return x
+}
+
 // Next advances the iterator to the next entry
 func (it *SkiplistIterator) Next() bool {
+	if it.versions && it.current != nil && len(it.current.key) > 0 && it.version < len(it.current.older) {
+		it.version++
+		return true
+	}
+	it.version = 0
 	for it.current != nil && len(it.current.next) > 0 && it.current.next[0] != nil {
 		it.current = it.current.next[0]
+		if it.end != nil && it.list.cmp(it.current.key, it.end) >= 0 {
+			break
+		}
 		if len(it.current.key) > 0 {
 			return true
 		}
@@ -106,7 +223,7 @@ func (it *SkiplistIterator) Value() []byte {
 	if it.current == nil {
 		return nil
 	}
-	return it.current.entry.Value
+	return it.entry().Value
 }
 
 // Type returns the current entry's type
@@ -114,13 +231,42 @@ func (it *SkiplistIterator) Type() storage.EntryType {
 	if it.current == nil {
 		return 0
 	}
-	return it.current.entry.Type
+	return it.entry().Type
+}
+
+// IsDeleted reports whether the current entry is a tombstone
+func (it *SkiplistIterator) IsDeleted() bool {
+	return it.current != nil && it.entry().Type == storage.DeleteEntry
+}
+
+// entry returns the version of the current key the iterator is on.
+func (it *SkiplistIterator) entry() storage.Entry {
+	if it.version > 0 {
+		return it.current.older[it.version-1]
+	}
+	return it.current.entry
+}
+
+// ExpiresAt returns the current entry's expiry, or 0 if it never expires
+func (it *SkiplistIterator) ExpiresAt() int64 {
+	if it.current == nil {
+		return 0
+	}
+	return it.entry().ExpiresAt
+}
+
+// Seq returns the current entry's sequence number
+func (it *SkiplistIterator) Seq() uint64 {
+	if it.current == nil {
+		return 0
+	}
+	return it.entry().Seq
 }
 
 // randomLevel determines the level for a new node using a probabilistic model.
 func (sl *SkipList) randomLevel() int {
 	level := 1
-	for sl.rng.Float64() < probability && level < sl.maxLevel {
+	for sl.rng.Float64() < sl.prob && level < sl.maxLevel {
 		level++
 	}
 	return level
@@ -133,15 +279,29 @@ func (sl *SkipList) Put(entry storage.Entry) {
 	current := sl.head
 
 	for i := sl.level - 1; i >= 0; i-- {
-		for current.next[i] != nil && bytes.Compare(current.next[i].key, key) < 0 {
+		for current.next[i] != nil && sl.cmp(current.next[i].key, key) < 0 {
 			current = current.next[i]
 		}
 		update[i] = current
 	}
 
 	current = current.next[0]
-	if current != nil && bytes.Equal(current.key, key) {
+	if current != nil && sl.cmp(current.key, key) == 0 {
+		if sl.versions == 1 {
+			// The key is already counted; only the value changes
+			sl.size += len(entry.Value) - len(current.entry.Value)
+			current.entry = entry
+			return
+		}
+		// Every version kept counts its key and value
+		current.older = append([]storage.Entry{current.entry}, current.older...)
 		current.entry = entry
+		sl.size += len(entry.Key) + len(entry.Value)
+		if len(current.older) >= sl.versions {
+			dropped := current.older[len(current.older)-1]
+			current.older = current.older[:len(current.older)-1]
+			sl.size -= len(dropped.Key) + len(dropped.Value)
+		}
 		return
 	}
 
@@ -164,6 +324,7 @@ func (sl *SkipList) Put(entry storage.Entry) {
 	}
 
 	sl.size += len(entry.Key) + len(entry.Value)
+	sl.count++
 }
 
 // Get retrieves the value associated with a given key.
@@ -173,19 +334,35 @@ func (sl *SkipList) Get(key []byte) (storage.Entry, bool) {
 
 	// Start from the highest level and work down
 	for i := sl.level - 1; i >= 0; i-- {
-		for current.next[i] != nil && bytes.Compare(current.next[i].key, key) < 0 {
+		for current.next[i] != nil && sl.cmp(current.next[i].key, key) < 0 {
 			current = current.next[i]
 		}
 	}
 
 	// Check the node at level 0
 	current = current.next[0]
-	if current != nil && bytes.Equal(current.key, key) {
+	if current != nil && sl.cmp(current.key, key) == 0 {
 		return current.entry, true
 	}
 	return storage.Entry{}, false
 }
 
+// Versions returns every version kept of key, newest first, or nil if the
+// list does not hold it.
+func (sl *SkipList) Versions(key []byte) []storage.Entry {
+	current := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for current.next[i] != nil && sl.cmp(current.next[i].key, key) < 0 {
+			current = current.next[i]
+		}
+	}
+	current = current.next[0]
+	if current == nil || sl.cmp(current.key, key) != 0 {
+		return nil
+	}
+	return append([]storage.Entry{current.entry}, current.older...)
+}
+
 // Delete marks a key as deleted in the skiplist.
 func (sl *SkipList) Delete(key []byte) error {
 	entry, _ := sl.Get(key)
@@ -195,9 +372,8 @@ func (sl *SkipList) Delete(key []byte) error {
 		return nil
 	}
 
+	// The tombstone replaces the value, so Put leaves only the key counted
 	sl.Put(storage.Entry{Type: storage.DeleteEntry, Key: key, Value: nil})
-
-	sl.size -= len(entry.Value)
 	return nil
 }
 
@@ -209,7 +385,7 @@ func (sl *SkipList) Range(start, end []byte) [][]byte {
 
 	// Find the first node >= start
 	for i := sl.level - 1; i >= 0; i-- {
-		for current.next[i] != nil && bytes.Compare(current.next[i].key, start) < 0 {
+		for current.next[i] != nil && sl.cmp(current.next[i].key, start) < 0 {
 			current = current.next[i]
 		}
 	}
@@ -218,7 +394,7 @@ func (sl *SkipList) Range(start, end []byte) [][]byte {
 	current = current.next[0]
 
 	// Collect all nodes in range
-	for current != nil && bytes.Compare(current.key, end) <= 0 {
+	for current != nil && sl.cmp(current.key, end) <= 0 {
 		result = append(result, current.key)
 		current = current.next[0]
 	}
@@ -227,10 +403,19 @@ func (sl *SkipList) Range(start, end []byte) [][]byte {
 }
 
 // Size returns the size of key-value pairs currently stored in the SkipList in bytes.
+// Every key counts once, along with its current value; a tombstone counts
+// only its key. Older versions kept under MaxVersions count their keys and
+// values too.
 func (sl *SkipList) Size() int {
 	return sl.size
 }
 
+// Len returns the number of keys in the SkipList, tombstones included.
+// Updating a key does not change it.
+func (sl *SkipList) Len() int {
+	return sl.count
+}
+
 // Clear resets the SkipList to an empty state, retaining only the head node.
 func (sl *SkipList) Clear() {
 	for i := range sl.head.next {
@@ -238,6 +423,7 @@ func (sl *SkipList) Clear() {
 	}
 	sl.level = 1
 	sl.size = 0
+	sl.count = 0
 }
 
 // IsEmpty returns true if the SkipList contains no elements.
@@ -0,0 +1,112 @@
+package sstable
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// blockCacheKey identifies a data block by the table it belongs to and its
+// offset in the file.
+type blockCacheKey struct {
+	path   string
+	offset int64
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	block *block
+}
+
+// BlockCache is an LRU cache of decompressed data blocks that can be shared
+// by many readers. Its capacity is the total size of the cached blocks in
+// bytes, counting the entry offsets and keys kept with each block for
+// binary search. A nil *BlockCache caches nothing.
+//
+// Cached blocks are shared with every lookup that hits them and must not be
+// modified.
+type BlockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // of *blockCacheEntry, most recently used first
+	entries  map[blockCacheKey]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// NewBlockCache returns a cache holding up to capacity bytes of blocks, or
+// nil if capacity is not positive.
+func NewBlockCache(capacity int64) *BlockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &BlockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[blockCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached block for key and marks it as recently used.
+func (c *BlockCache) get(key blockCacheKey) (*block, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*blockCacheEntry).block, true
+}
+
+// add caches block under key, evicting the least recently used blocks to
+// make room. Blocks larger than the whole cache are not cached.
+func (c *BlockCache) add(key blockCacheKey, block *block) {
+	if c == nil || block.size() > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&blockCacheEntry{key: key, block: block})
+	c.size += block.size()
+
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*blockCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= entry.block.size()
+	}
+}
+
+// Size returns the total size in bytes of the cached blocks.
+func (c *BlockCache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Stats returns the number of lookups that found their block in the cache
+// and the number that had to read it from disk.
+func (c *BlockCache) Stats() (hits, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.hits.Load(), c.misses.Load()
+}
@@ -0,0 +1,22 @@
+package sstable
+
+// NewReaderFromFile exposes newReader so tests can wrap the underlying file.
+var NewReaderFromFile = newReader
+
+// WriteVersion4 makes w write the version 4 format, whose data blocks hold
+// full keys, so tests can check that older tables stay readable.
+func (w *Writer) WriteVersion4() {
+	w.version = 4
+}
+
+// SetLinearBlockSearch makes point lookups on r scan each block entry by
+// entry instead of binary searching it, so benchmarks can compare the two.
+func (r *Reader) SetLinearBlockSearch(linear bool) {
+	r.linearSearch = linear
+}
+
+// RecordedIndexEntries returns the number of index entries recorded in r's
+// meta section, or -1 if it records none.
+func (r *Reader) RecordedIndexEntries() int {
+	return r.indexEntries
+}
@@ -0,0 +1,119 @@
+package sstable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// legacyFooterSize is the size of the footer of the unversioned format
+// written before tables had a magic number: the offset and size of the
+// sparse index, 8 bytes each. The entries before the index are laid out as
+// [type][key length][value length][key][value], with no checksum.
+const legacyFooterSize = IndexOffsetSize + IndexSizeSize
+
+// legacyIndexOffset returns the offset of the index of f, a file of size
+// bytes, if it is a table in the unversioned format, or -1 if it is not:
+// it does not end with Magic, and its footer accounts for the whole file.
+func legacyIndexOffset(f io.ReaderAt, size int64) (int64, error) {
+	if size < legacyFooterSize {
+		return -1, nil
+	}
+	footer := make([]byte, legacyFooterSize)
+	if _, err := f.ReadAt(footer, size-legacyFooterSize); err != nil {
+		return -1, gerrors.IO("failed to read footer", err)
+	}
+	if binary.BigEndian.Uint32(footer[legacyFooterSize-MagicSize:]) == Magic {
+		return -1, nil
+	}
+	indexOffset := binary.BigEndian.Uint64(footer[:IndexOffsetSize])
+	indexSize := binary.BigEndian.Uint64(footer[IndexOffsetSize:])
+	if indexOffset > uint64(size) || indexSize > uint64(size) || indexOffset+indexSize+legacyFooterSize != uint64(size) {
+		return -1, nil
+	}
+	return int64(indexOffset), nil
+}
+
+// IsLegacy reports whether the file at path is a table in the unversioned
+// format written before tables had a magic number, which Reader does not
+// read; ConvertLegacy rewrites it in the current format.
+func IsLegacy(fs storage.FS, path string) (bool, error) {
+	f, err := storage.Open(storage.OrOS(fs), path)
+	if err != nil {
+		return false, gerrors.IO("failed to open SSTable", err)
+	}
+	defer func() { _ = f.Close() }()
+	stat, err := f.Stat()
+	if err != nil {
+		return false, gerrors.IO("failed to stat SST file", err)
+	}
+	indexOffset, err := legacyIndexOffset(f, stat.Size())
+	return indexOffset >= 0, err
+}
+
+// ConvertLegacy rewrites the table at path, in the unversioned format
+// reported by IsLegacy, in the current format with opts, replacing it only
+// once the new table is complete. Its entries keep their order and have no
+// sequence numbers. It fails with ErrCorrupt if the data section does not
+// parse, leaving the file as it was.
+func ConvertLegacy(path string, opts Options) error {
+	f, err := storage.Open(storage.OrOS(opts.FS), path)
+	if err != nil {
+		return gerrors.IO("failed to open SSTable", err)
+	}
+	defer func() { _ = f.Close() }()
+	stat, err := f.Stat()
+	if err != nil {
+		return gerrors.IO("failed to stat SST file", err)
+	}
+	indexOffset, err := legacyIndexOffset(f, stat.Size())
+	if err != nil {
+		return err
+	}
+	if indexOffset < 0 {
+		return gerrors.Corruption(fmt.Sprintf("SSTable %s is not in the legacy format", path), nil)
+	}
+
+	w, err := NewWriterWithOptions(path, opts)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(f, 0, indexOffset))
+	prefix := make([]byte, storage.PrefixSize)
+	for {
+		if _, err := io.ReadFull(reader, prefix); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			_ = w.Abort()
+			return gerrors.Corruption(fmt.Sprintf("legacy SSTable %s has a truncated entry", path), err)
+		}
+		entryType := storage.EntryType(prefix[0])
+		keyLen := int(binary.BigEndian.Uint32(prefix[storage.EntryTypeSize:]))
+		valLen := int(binary.BigEndian.Uint32(prefix[storage.EntryTypeSize+storage.LengthSize:]))
+		if entryType != storage.PutEntry && entryType != storage.DeleteEntry || int64(keyLen)+int64(valLen) > indexOffset {
+			_ = w.Abort()
+			return gerrors.Corruption(fmt.Sprintf("legacy SSTable %s has an invalid entry", path), nil)
+		}
+		body := make([]byte, keyLen+valLen)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			_ = w.Abort()
+			return gerrors.Corruption(fmt.Sprintf("legacy SSTable %s has a truncated entry", path), err)
+		}
+		if entryType == storage.DeleteEntry {
+			err = w.DeleteEntry(body[:keyLen])
+		} else {
+			err = w.PutEntry(body[:keyLen], body[keyLen:])
+		}
+		if err != nil {
+			_ = w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
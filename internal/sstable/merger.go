@@ -2,15 +2,27 @@ package sstable
 
 import (
 	"bytes"
-	"container/heap"
 
 	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"github.com/MikhailWahib/graveldb/internal/storage"
 )
 
-// Merger combines multiple SSTables into a single SSTable
+// Merger combines multiple SSTables into a single SSTable, or into several
+// consecutive ones when the output is split
 type Merger struct {
 	sources []*Reader
 	output  *Writer
+	outputs []*Writer
+	filter  func(key, value []byte) bool
+	merge   MergeFunc
+	now     int64
+
+	splitSize int64
+	next      func() (*Writer, error)
+
+	throttle       func(n int64)
+	dropTombstones bool
+	maxVersions    int
 }
 
 // NewMerger creates a new SSTable merger
@@ -31,114 +43,204 @@ func (m *Merger) SetOutput(sst *Writer) {
 	m.output = sst
 }
 
-type iteratorItem struct {
-	key      []byte
-	value    []byte
-	iter     *Iterator
-	deleted  bool
-	priority int // higher = newer
+// SetFilter sets a predicate consulted for every live entry written to the
+// output. Entries for which it returns false are written as tombstones, so
+// their values are purged while older versions in other tables stay shadowed.
+func (m *Merger) SetFilter(filter func(key, value []byte) bool) {
+	m.filter = filter
+}
+
+// SetMerge sets the function that folds merge entries into the older
+// versions of their keys. Chains that reach no older value are written as a
+// single merge entry, unless tombstones are dropped, in which case nothing
+// older can exist and they are applied to nil.
+func (m *Merger) SetMerge(merge MergeFunc) {
+	m.merge = merge
 }
 
-type iteratorHeap []*iteratorItem
+// SetNow sets the current time in Unix nanoseconds. Entries that expired at
+// or before it are written as tombstones. A zero time keeps every entry.
+func (m *Merger) SetNow(now int64) {
+	m.now = now
+}
 
-func (h iteratorHeap) Len() int { return len(h) }
+// SetSplit makes Merge finish the current output once it holds at least
+// targetSize bytes and continue in a new one returned by next, so the
+// outputs cover consecutive, non-overlapping key ranges.
+func (m *Merger) SetSplit(targetSize int64, next func() (*Writer, error)) {
+	m.splitSize = targetSize
+	m.next = next
+}
 
-func (h iteratorHeap) Less(i, j int) bool {
-	keyCmp := bytes.Compare(h[i].key, h[j].key)
-	if keyCmp != 0 {
-		return keyCmp < 0
-	}
-	// When keys match, pick item from newer SSTable (higher priority value wins)
-	return h[i].priority > h[j].priority
+// SetDropTombstones makes the merge leave deletes, expired entries and
+// filtered entries out of the output instead of writing tombstones, and
+// range tombstones out once they have been applied. It is
+// only safe when no table outside the merge holds older data for the
+// merged keys.
+func (m *Merger) SetDropTombstones(drop bool) {
+	m.dropTombstones = drop
 }
 
-func (h iteratorHeap) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
+// SetMaxVersions makes the merge keep up to n versions of each key, newest
+// first, instead of only the newest. Tombstones count as versions. When
+// tombstones are dropped, a key whose newest version is deleted is left out
+// with all its versions, while older tombstones are kept as versions.
+// Values of n below 2 keep only the newest.
+func (m *Merger) SetMaxVersions(n int) {
+	m.maxVersions = n
 }
 
-func (h *iteratorHeap) Push(x any) {
-	*h = append(*h, x.(*iteratorItem))
+// SetThrottle sets a function called after each entry is written with the
+// number of bytes it added to the output, which may block to slow the merge
+// down.
+func (m *Merger) SetThrottle(throttle func(n int64)) {
+	m.throttle = throttle
 }
 
-func (h *iteratorHeap) Pop() any {
-	old := *h
-	n := len(old)
-	item := old[n-1]
-	*h = old[:n-1]
-	return item
+// Outputs returns every output written by Merge, in key order. After a
+// failed Merge it holds the outputs that must be deleted.
+func (m *Merger) Outputs() []*Writer {
+	return m.outputs
 }
 
-// Merge performs the actual merge operation and writes the output SST to disk
+// Merge performs the actual merge operation and writes the output SST to disk.
+// Entries covered by a newer range tombstone of any source are left out, and
+// the range tombstones themselves are written to the first output so they
+// keep hiding older versions outside the merge. A merge that carries range
+// tombstones is not split, as each output would need the tombstones cut to
+// its own key range.
 func (m *Merger) Merge() error {
 	if m.output == nil {
 		return gerrors.Internal("merger: output SSTable not set", nil)
 	}
 
-	ih := &iteratorHeap{}
-	heap.Init(ih)
-
-	for i := range len(m.sources) {
-		source := m.sources[i]
-		iter := source.NewIterator()
-		if iter.Next() {
-			heap.Push(ih, &iteratorItem{
-				key:      iter.Key(),
-				value:    iter.Value(),
-				iter:     iter,
-				deleted:  iter.IsDeleted(),
-				priority: i,
-			})
+	m.outputs = []*Writer{m.output}
+	output := m.output
+
+	cmp := bytes.Compare
+	if len(m.sources) > 0 {
+		cmp = m.sources[0].cmp
+	}
+	var rangeDels []storage.Entry
+	for _, src := range m.sources {
+		rangeDels = append(rangeDels, src.RangeTombstones()...)
+	}
+	if !m.dropTombstones {
+		for _, entry := range rangeDels {
+			if err := output.AddRangeTombstone(entry); err != nil {
+				return err
+			}
 		}
 	}
-
+	split := m.next != nil && len(rangeDels) == 0
+	maxVersions := max(m.maxVersions, 1)
+
+	iter := NewMergedIterator(m.sources)
+	iter.SetAllVersions(maxVersions > 1)
+	if m.merge != nil {
+		iter.SetMerge(MergeOptions{
+			Func:     m.merge,
+			Complete: m.dropTombstones,
+			Deleted: func(key []byte, seq uint64) bool {
+				return coveredBy(cmp, rangeDels, key, seq)
+			},
+			Now: m.now,
+		})
+	}
+	// kept counts the versions written of lastKey; an output is only
+	// finished once it is full and the key changes, so the versions of a
+	// key never span outputs
 	var lastKey []byte
-
-	for ih.Len() > 0 {
-		item := heap.Pop(ih).(*iteratorItem)
-
-		if lastKey != nil && bytes.Equal(item.key, lastKey) {
-			if item.iter.Next() {
-				heap.Push(ih, &iteratorItem{
-					key:      item.iter.Key(),
-					value:    item.iter.Value(),
-					iter:     item.iter,
-					deleted:  item.iter.IsDeleted(),
-					priority: item.priority,
-				})
-			}
-			// Skip duplicates
+	kept, full := 0, false
+	for iter.Next() {
+		sameKey := lastKey != nil && cmp(iter.Key(), lastKey) == 0
+		if !sameKey {
+			lastKey, kept = append(lastKey[:0], iter.Key()...), 0
+		}
+		if kept >= maxVersions || coveredBy(cmp, rangeDels, iter.Key(), iter.Seq()) {
 			continue
 		}
-
-		// Write current key to output
-		if item.deleted {
-			if err := m.output.DeleteEntry(item.key); err != nil {
+		if full && !sameKey {
+			if err := output.Finish(); err != nil {
 				return err
 			}
-		} else {
-			if err := m.output.PutEntry(item.key, item.value); err != nil {
+			output, full = nil, false
+		}
+		if output == nil {
+			next, err := m.next()
+			if err != nil {
 				return err
 			}
+			m.outputs = append(m.outputs, next)
+			output = next
 		}
 
-		lastKey = item.key
-
-		if item.iter.Next() {
-			heap.Push(ih, &iteratorItem{
-				key:      item.iter.Key(),
-				value:    item.iter.Value(),
-				iter:     item.iter,
-				deleted:  item.iter.IsDeleted(),
-				priority: item.priority,
-			})
+		entry := storage.Entry{
+			Type:      storage.PutEntry,
+			Key:       iter.Key(),
+			ExpiresAt: iter.ExpiresAt(),
+			Seq:       iter.Seq(),
+		}
+		expired := m.now != 0 && entry.Expired(m.now)
+		if iter.Type() == storage.MergeEntry {
+			// Unresolved operands are kept for the value beneath them
+			entry.Type, entry.Value = storage.MergeEntry, iter.Value()
+		} else if iter.IsDeleted() || expired || (m.filter != nil && !m.filter(iter.Key(), iter.Value())) {
+			if m.dropTombstones && kept == 0 {
+				// Older versions are shadowed by the dropped one
+				kept = maxVersions
+				continue
+			}
+			entry = storage.Entry{Type: storage.DeleteEntry, Key: iter.Key(), Seq: iter.Seq()}
+		} else if ptr, _ := iter.blobPointer(); ptr != nil {
+			// Values in blob files stay where they are; only the pointer
+			// is copied
+			entry.Type, entry.Value = storage.BlobEntry, ptr
+		} else {
+			entry.Value = iter.Value()
 		}
+		before := output.Size()
+		if err := output.Add(entry); err != nil {
+			return err
+		}
+		kept++
+		if m.throttle != nil {
+			m.throttle(output.Size() - before)
+		}
+		full = split && output.Size() >= m.splitSize
+	}
+	if err := iter.Error(); err != nil {
+		return gerrors.IO("failed to read merge source", err)
 	}
 
-	return m.output.Finish()
+	if output == nil {
+		return nil
+	}
+	return output.Finish()
 }
 
 // Reset clears the merger
 func (m *Merger) Reset() {
 	m.sources = make([]*Reader, 0)
 	m.output = nil
+	m.outputs = nil
+	m.filter = nil
+	m.merge = nil
+	m.splitSize = 0
+	m.next = nil
+	m.now = 0
+	m.throttle = nil
+	m.dropTombstones = false
+	m.maxVersions = 0
+}
+
+// coveredBy reports whether any of rangeDels deletes the version of key
+// written with sequence number seq, with keys ordered by cmp.
+func coveredBy(cmp func(a, b []byte) int, rangeDels []storage.Entry, key []byte, seq uint64) bool {
+	for _, rangeDel := range rangeDels {
+		if rangeDel.Covers(cmp, key, seq) {
+			return true
+		}
+	}
+	return false
 }
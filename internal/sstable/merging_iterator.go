@@ -0,0 +1,343 @@
+package sstable
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/MikhailWahib/graveldb/internal/blob"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
+// Source is a sorted stream of entries that can be merged, such as an
+// SSTable or memtable iterator. Seek positions the source at the first entry
+// with key >= the target, as if Next had been called, and reports whether
+// there is one. Sources that can fail mid-iteration also implement
+// Error() error.
+type Source interface {
+	Seek(key []byte) bool
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Type() storage.EntryType
+	IsDeleted() bool
+	// ExpiresAt returns the current entry's expiry in Unix nanoseconds,
+	// or 0 if it never expires.
+	ExpiresAt() int64
+	// Seq returns the current entry's sequence number, or 0 if it was
+	// written before sequence numbers existed.
+	Seq() uint64
+}
+
+// errorSource is implemented by sources that can fail mid-iteration.
+type errorSource interface {
+	Error() error
+}
+
+// blobSource is implemented by sources whose values may be kept in blob
+// files. blobPointer returns the pointer to the current value and the
+// store holding it, or nil if the value is not in a blob file.
+type blobSource interface {
+	blobPointer() ([]byte, *blob.Store)
+}
+
+type mergeItem struct {
+	src      Source
+	priority int // higher = newer
+}
+
+// mergeHeap orders the sources by their current key according to cmp.
+type mergeHeap struct {
+	items []*mergeItem
+	cmp   func(a, b []byte) int
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	keyCmp := h.cmp(a.src.Key(), b.src.Key())
+	if keyCmp != 0 {
+		return keyCmp < 0
+	}
+	// When keys match, the higher sequence number wins. Entries without
+	// one, or with equal ones, fall back to the newer source.
+	if si, sj := a.src.Seq(), b.src.Seq(); si != sj {
+		return si > sj
+	}
+	return a.priority > b.priority
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.items = append(h.items, x.(*mergeItem))
+}
+
+func (h *mergeHeap) Pop() any {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+	return item
+}
+
+// MergeFunc returns the value that results from applying a merge operand
+// to existing, the older value of its key, or nil if there is none. It must
+// be associative.
+type MergeFunc func(existing, operand []byte) []byte
+
+// MergeOptions configure how a MergingIterator folds merge entries into the
+// versions beneath them.
+type MergeOptions struct {
+	Func MergeFunc
+	// Complete means the sources hold every version of their keys, so a
+	// chain of merge entries with no value beneath it is applied to nil.
+	// Otherwise such a chain is combined into a single merge entry.
+	Complete bool
+	// Deleted, if set, reports whether a range tombstone deletes the
+	// version of key written with sequence number seq.
+	Deleted func(key []byte, seq uint64) bool
+	// Now is the current time in Unix nanoseconds. Versions that expired at
+	// or before it count as deleted. Zero means no version has expired.
+	Now int64
+}
+
+// MergingIterator merges sorted sources into a single sorted stream holding
+// the newest version of every key, including tombstones. The version with
+// the highest sequence number wins, even one a source holds after an older
+// version of the same key. Sources are given oldest first: among versions
+// with equal sequence numbers, the one given last wins.
+// With SetMerge, a newest version that is a merge entry is instead folded
+// into the older versions it applies to.
+//
+// A MergingIterator is itself a Source, so merges can be nested.
+type MergingIterator struct {
+	sources  []Source
+	h        mergeHeap
+	merge    MergeOptions
+	all      bool
+	operands [][]byte
+	started  bool
+	key      []byte
+	value    []byte
+	// blobPtr points to the current value while it is only in a blob file
+	// of blobs; Value reads it on first use
+	blobPtr []byte
+	blobs   *blob.Store
+	typ     storage.EntryType
+	expires int64
+	seq     uint64
+	err     error
+}
+
+// NewMergingIterator returns an iterator over sources, which must be
+// given oldest first and ordered by bytes.Compare.
+func NewMergingIterator(sources []Source) *MergingIterator {
+	return NewMergingIteratorWithComparator(sources, nil)
+}
+
+// NewMergingIteratorWithComparator returns an iterator over sources, which
+// must be given oldest first and ordered by cmp. A nil cmp means
+// bytes.Compare.
+func NewMergingIteratorWithComparator(sources []Source, cmp func(a, b []byte) int) *MergingIterator {
+	if cmp == nil {
+		cmp = bytes.Compare
+	}
+	return &MergingIterator{sources: sources, h: mergeHeap{cmp: cmp}}
+}
+
+// NewMergedIterator returns an iterator over the entries of readers, which
+// must be given oldest first and opened with the same comparator.
+func NewMergedIterator(readers []*Reader) *MergingIterator {
+	sources := make([]Source, len(readers))
+	for i, reader := range readers {
+		sources[i] = reader.NewIterator()
+	}
+	var cmp func(a, b []byte) int
+	if len(readers) > 0 {
+		cmp = readers[0].cmp
+	}
+	return NewMergingIteratorWithComparator(sources, cmp)
+}
+
+// SetMerge makes the iterator resolve merge entries as opts describe. A
+// merge entry whose chain reaches a put, a tombstone or a deleted or
+// expired version, or the oldest version of a complete merge, becomes a
+// put holding the folded value and, if it was folded into a put, that
+// put's expiry. It must be called before iteration starts.
+func (m *MergingIterator) SetMerge(opts MergeOptions) {
+	m.merge = opts
+}
+
+// SetAllVersions makes the iterator visit every version of each key,
+// newest first, instead of only the newest. A merge entry resolved by
+// SetMerge still consumes the versions beneath it. It must be called before
+// iteration starts.
+func (m *MergingIterator) SetAllVersions(all bool) {
+	m.all = all
+}
+
+// Next advances to the next distinct key, or to the next version of the
+// current one if SetAllVersions is set.
+func (m *MergingIterator) Next() bool {
+	if !m.started {
+		m.started = true
+		for i, src := range m.sources {
+			m.push(&mergeItem{src: src, priority: i}, src.Next())
+		}
+	}
+	return m.pop()
+}
+
+// Seek positions the iterator at the first key >= key and reports whether
+// there is one.
+func (m *MergingIterator) Seek(key []byte) bool {
+	m.started = true
+	m.h.items = m.h.items[:0]
+	for i, src := range m.sources {
+		m.push(&mergeItem{src: src, priority: i}, src.Seek(key))
+	}
+	return m.pop()
+}
+
+// pop moves to the smallest key in the heap and advances every source
+// holding it.
+func (m *MergingIterator) pop() bool {
+	if m.err != nil || m.h.Len() == 0 {
+		m.key, m.value, m.blobPtr, m.typ, m.expires, m.seq = nil, nil, nil, 0, 0, 0
+		return false
+	}
+
+	top := heap.Pop(&m.h).(*mergeItem)
+	m.take(top.src)
+	m.push(top, top.src.Next())
+
+	if m.typ == storage.MergeEntry && m.merge.Func != nil {
+		m.fold()
+		return m.err == nil
+	}
+
+	// Skip older versions of the same key. A source should hold a key's
+	// versions newest first, but if a malformed one holds a newer version
+	// after an older one, the newer version still wins.
+	for !m.all && m.h.Len() > 0 && m.h.cmp(m.h.items[0].src.Key(), m.key) == 0 {
+		item := heap.Pop(&m.h).(*mergeItem)
+		if item.src.Seq() > m.seq {
+			m.take(item.src)
+		}
+		m.push(item, item.src.Next())
+	}
+
+	return m.err == nil
+}
+
+// take makes the entry src is on the current one.
+func (m *MergingIterator) take(src Source) {
+	m.key = src.Key()
+	m.value, m.blobPtr = nil, nil
+	if bs, ok := src.(blobSource); ok {
+		m.blobPtr, m.blobs = bs.blobPointer()
+	}
+	if m.blobPtr == nil {
+		m.value = src.Value()
+	}
+	m.typ = src.Type()
+	m.expires = src.ExpiresAt()
+	m.seq = src.Seq()
+}
+
+// fold consumes the older versions of the current key, applying the merge
+// operands down to the first version that is not a merge entry.
+func (m *MergingIterator) fold() {
+	operands := append(m.operands[:0], m.value)
+	var base []byte
+	settled := false
+	for m.h.Len() > 0 && m.h.cmp(m.h.items[0].src.Key(), m.key) == 0 {
+		item := heap.Pop(&m.h).(*mergeItem)
+		src := item.src
+		if !settled {
+			expired := m.merge.Now != 0 && src.ExpiresAt() != 0 && src.ExpiresAt() <= m.merge.Now
+			switch {
+			case src.IsDeleted() || expired || (m.merge.Deleted != nil && m.merge.Deleted(m.key, src.Seq())):
+				settled = true
+			case src.Type() == storage.MergeEntry:
+				operands = append(operands, src.Value())
+			default:
+				base, m.expires, settled = src.Value(), src.ExpiresAt(), true
+			}
+		}
+		m.push(item, src.Next())
+	}
+
+	// Operands were collected newest first
+	if settled || m.merge.Complete {
+		m.value, m.typ = base, storage.PutEntry
+		for i := len(operands) - 1; i >= 0; i-- {
+			m.value = m.merge.Func(m.value, operands[i])
+		}
+	} else {
+		m.value = operands[len(operands)-1]
+		for i := len(operands) - 2; i >= 0; i-- {
+			m.value = m.merge.Func(m.value, operands[i])
+		}
+	}
+	clear(operands)
+	m.operands = operands[:0]
+}
+
+// push returns item to the heap if its source is positioned on an entry,
+// and otherwise records the source's error, if any.
+func (m *MergingIterator) push(item *mergeItem, ok bool) {
+	if ok {
+		heap.Push(&m.h, item)
+		return
+	}
+	if es, isErr := item.src.(errorSource); isErr && es.Error() != nil && m.err == nil {
+		m.err = es.Error()
+	}
+}
+
+// Key returns the current key.
+func (m *MergingIterator) Key() []byte { return m.key }
+
+// Value returns the current value, reading it from its blob file if it is
+// kept in one. If that read fails, Value returns nil and the iteration ends
+// with the error.
+func (m *MergingIterator) Value() []byte {
+	if m.blobPtr != nil && m.value == nil {
+		value, err := m.blobs.Get(m.blobPtr)
+		if err != nil {
+			if m.err == nil {
+				m.err = err
+			}
+			return nil
+		}
+		m.value = value
+	}
+	return m.value
+}
+
+// blobPointer returns the pointer to the current value if it is kept in a
+// blob file.
+func (m *MergingIterator) blobPointer() ([]byte, *blob.Store) {
+	if m.blobPtr == nil {
+		return nil, nil
+	}
+	return m.blobPtr, m.blobs
+}
+
+// Type returns the current entry type.
+func (m *MergingIterator) Type() storage.EntryType { return m.typ }
+
+// IsDeleted reports whether the current entry is a tombstone.
+func (m *MergingIterator) IsDeleted() bool { return m.typ == storage.DeleteEntry }
+
+// ExpiresAt returns the current entry's expiry, or 0 if it never expires.
+func (m *MergingIterator) ExpiresAt() int64 { return m.expires }
+
+// Seq returns the current entry's sequence number.
+func (m *MergingIterator) Seq() uint64 { return m.seq }
+
+// Error returns the first error encountered by any source.
+func (m *MergingIterator) Error() error { return m.err }
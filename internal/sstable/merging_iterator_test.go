@@ -0,0 +1,166 @@
+package sstable_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/MikhailWahib/graveldb/internal/memtable"
+	"github.com/MikhailWahib/graveldb/internal/sstable"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sourceBackends build a merge source holding the given sorted entries.
+var sourceBackends = map[string]func(t *testing.T, entries []entry) sstable.Source{
+	"reader": func(t *testing.T, entries []entry) sstable.Source {
+		path := filepath.Join(t.TempDir(), "source.sst")
+		reader := createSST(t, path, entries)
+		t.Cleanup(func() { _ = reader.Close() })
+		return reader.NewIterator()
+	},
+	"memtable": func(t *testing.T, entries []entry) sstable.Source {
+		mt := memtable.NewMemtable()
+		for _, e := range entries {
+			if e.typ == storage.DeleteEntry {
+				require.NoError(t, mt.Delete([]byte(e.key)))
+			} else {
+				require.NoError(t, mt.Put([]byte(e.key), []byte(e.value)))
+			}
+		}
+		return mt.NewIterator()
+	},
+}
+
+func put(key, value string) entry { return entry{key, value, storage.PutEntry} }
+func del(key string) entry        { return entry{key, "", storage.DeleteEntry} }
+
+// drain returns every remaining entry of iter, rendering tombstones as "-".
+func drain(t *testing.T, iter *sstable.MergingIterator, ok bool) []string {
+	var got []string
+	for ; ok; ok = iter.Next() {
+		if iter.IsDeleted() {
+			got = append(got, string(iter.Key())+"=-")
+		} else {
+			got = append(got, fmt.Sprintf("%s=%s", iter.Key(), iter.Value()))
+		}
+	}
+	require.NoError(t, iter.Error())
+	return got
+}
+
+func TestMergingIterator(t *testing.T) {
+	cases := []struct {
+		name    string
+		sources [][]entry // oldest first
+		seek    string    // empty means iterate from the start
+		want    []string
+	}{
+		{
+			name:    "interleaved keys are sorted",
+			sources: [][]entry{{put("a", "1"), put("d", "1")}, {put("b", "2"), put("c", "2")}},
+			want:    []string{"a=1", "b=2", "c=2", "d=1"},
+		},
+		{
+			name:    "newer source wins",
+			sources: [][]entry{{put("a", "old"), put("b", "old")}, {put("b", "new")}},
+			want:    []string{"a=old", "b=new"},
+		},
+		{
+			name:    "older source wins over nothing",
+			sources: [][]entry{{put("a", "old")}, {put("b", "new")}, {}},
+			want:    []string{"a=old", "b=new"},
+		},
+		{
+			name:    "equal keys in every source",
+			sources: [][]entry{{put("k", "1")}, {put("k", "2")}, {put("k", "3")}},
+			want:    []string{"k=3"},
+		},
+		{
+			name:    "tombstone shadows older value",
+			sources: [][]entry{{put("a", "1"), put("b", "1")}, {del("a")}},
+			want:    []string{"a=-", "b=1"},
+		},
+		{
+			name:    "newer value replaces tombstone",
+			sources: [][]entry{{del("a")}, {put("a", "2")}},
+			want:    []string{"a=2"},
+		},
+		{
+			name:    "seek lands between keys",
+			sources: [][]entry{{put("a", "1"), put("c", "1")}, {put("b", "2"), put("d", "2")}},
+			seek:    "bb",
+			want:    []string{"c=1", "d=2"},
+		},
+		{
+			name:    "seek resolves equal keys",
+			sources: [][]entry{{put("a", "1"), put("b", "1")}, {del("b")}},
+			seek:    "b",
+			want:    []string{"b=-"},
+		},
+		{
+			name:    "seek past the end",
+			sources: [][]entry{{put("a", "1")}, {put("b", "2")}},
+			seek:    "z",
+			want:    nil,
+		},
+	}
+
+	for backend, build := range sourceBackends {
+		for _, tc := range cases {
+			t.Run(backend+"/"+tc.name, func(t *testing.T) {
+				sources := make([]sstable.Source, len(tc.sources))
+				for i, entries := range tc.sources {
+					sources[i] = build(t, entries)
+				}
+
+				iter := sstable.NewMergingIterator(sources)
+				var ok bool
+				if tc.seek == "" {
+					ok = iter.Next()
+				} else {
+					ok = iter.Seek([]byte(tc.seek))
+				}
+				assert.Equal(t, tc.want, drain(t, iter, ok))
+			})
+		}
+	}
+}
+
+func TestMergingIterator_SeekAcrossBlocks(t *testing.T) {
+	var entries []entry
+	for i := range 5 * indexInterval {
+		entries = append(entries, put(fmt.Sprintf("key-%03d", i), "v"))
+	}
+
+	for backend, build := range sourceBackends {
+		t.Run(backend, func(t *testing.T) {
+			iter := sstable.NewMergingIterator([]sstable.Source{build(t, entries)})
+			require.True(t, iter.Seek([]byte("key-037")))
+			assert.Equal(t, "key-037", string(iter.Key()))
+
+			// Seeking backwards restarts from the earlier key
+			require.True(t, iter.Seek([]byte("key-002")))
+			assert.Equal(t, "key-002", string(iter.Key()))
+			require.True(t, iter.Next())
+			assert.Equal(t, "key-003", string(iter.Key()))
+		})
+	}
+}
+
+func TestNewMergedIterator(t *testing.T) {
+	tables := [][]entry{
+		{put("a", "1"), put("b", "1"), put("c", "1"), put("k", "1")},
+		{del("a"), put("b", "2"), put("k", "2")},
+		{put("d", "3"), put("k", "3")},
+	}
+	readers := make([]*sstable.Reader, len(tables))
+	for i, entries := range tables {
+		readers[i] = createSST(t, filepath.Join(t.TempDir(), fmt.Sprintf("%d.sst", i)), entries)
+		t.Cleanup(func() { _ = readers[i].Close() })
+	}
+
+	iter := sstable.NewMergedIterator(readers)
+	assert.Equal(t, []string{"a=-", "b=2", "c=1", "d=3", "k=3"}, drain(t, iter, iter.Next()))
+}
@@ -5,63 +5,206 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"sort"
+	"sync/atomic"
+	"unsafe"
 
+	"github.com/MikhailWahib/graveldb/internal/blob"
+	"github.com/MikhailWahib/graveldb/internal/bloom"
 	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
 
 	"github.com/MikhailWahib/graveldb/internal/storage"
+	"github.com/golang/snappy"
 )
 
-// Reader provides functionality to read from an SSTable
+// file is the subset of *os.File used by the reader.
+type file interface {
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// Reader provides functionality to read from an SSTable.
+//
+// A Reader is safe for concurrent use: the index and filters are loaded
+// once when it is opened, and each lookup reads its data block with a
+// single ReadAt into a buffer of its own, so no lock is needed. Point
+// lookups take blocks from the block cache, if one is set, before reading
+// them from disk.
 type Reader struct {
-	file      *os.File
+	file      file
 	path      string
 	index     []IndexEntry
 	indexBase int64
+	size      int64
+
+	compression Compression
+	version     uint32
+
+	prefixFilter *bloom.Filter
+	keyFilter    *bloom.Filter
+	strict       bool
+	cache        *BlockCache
+	cmp          func(a, b []byte) int
+	blobs        *blob.Store
+
+	// linearSearch makes point lookups scan cached blocks entry by entry
+	// instead of binary searching them, for benchmarks
+	linearSearch bool
+
+	maxSeq    uint64
+	count     uint64
+	rangeDels []storage.Entry
+
+	// minKey and maxKey are the smallest and largest keys in the table,
+	// nil if it is empty
+	minKey []byte
+	maxKey []byte
+
+	// indexInterval and indexEntries are read from the meta section;
+	// indexEntries is -1 for tables that do not record it
+	indexInterval int
+	indexEntries  int
+
+	refs atomic.Int32
+	// remove makes the release of the last reference delete the file
+	// through fs as well as close it
+	remove atomic.Bool
+	fs     storage.FS
 }
 
 // NewReader creates a new SSTable reader
 func NewReader(path string) (*Reader, error) {
-	file, err := os.Open(path)
+	return NewReaderWithOptions(path, Options{})
+}
+
+// NewReaderWithOptions creates a new SSTable reader configured by opts
+func NewReaderWithOptions(path string, opts Options) (*Reader, error) {
+	f, err := storage.Open(storage.OrOS(opts.FS), path)
 	if err != nil {
 		return nil, gerrors.IO("failed to open SSTable", err)
 	}
+	return newReader(opts.wrapFile(f), path, opts)
+}
 
+// newReader creates a reader on top of an already opened file.
+func newReader(f file, path string, opts Options) (*Reader, error) {
 	reader := &Reader{
-		file: file,
-		path: path,
+		file:   f,
+		path:   path,
+		strict: opts.StrictInvariants,
+		cache:  opts.BlockCache,
+		cmp:    opts.comparator(),
+		blobs:  opts.Blobs,
+		fs:     storage.OrOS(opts.FS),
 	}
+	reader.refs.Store(1)
 
 	if err := reader.loadIndex(); err != nil {
-		_ = file.Close()
+		_ = f.Close()
 		return nil, gerrors.IO("failed to load index", err)
 	}
+	if opts.VerifyOnOpen {
+		if err := reader.Verify(); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
 
 	return reader, nil
 }
 
+// checkLegacy fails with ErrUnsupportedVersion if the file, of size bytes,
+// is a table in the unversioned format, which must be converted with
+// ConvertLegacy before it can be read.
+func (r *Reader) checkLegacy(size int64) error {
+	indexOffset, err := legacyIndexOffset(r.file, size)
+	if err != nil {
+		return err
+	}
+	if indexOffset >= 0 {
+		return gerrors.Corruption("SST file is in the unversioned format from before format versions and must be converted", gerrors.ErrUnsupportedVersion)
+	}
+	return nil
+}
+
 // loadIndex reads the footer and load the index to memory
 func (r *Reader) loadIndex() error {
 	stat, err := r.file.Stat()
 	if err != nil {
 		return gerrors.IO("failed to stat SST file", err)
 	}
-	if stat.Size() < FooterSize {
+	size := stat.Size()
+	r.size = size
+	if size == 0 {
+		// A zero-length file is a legitimately empty table
 		return nil
 	}
+	if size < FooterSize {
+		if err := r.checkLegacy(size); err != nil {
+			return err
+		}
+		return gerrors.Corruption("SST file too small for footer", nil)
+	}
 
 	// Read footer
-	footerOffset := stat.Size() - FooterSize
+	footerOffset := size - FooterSize
 	footer := make([]byte, FooterSize)
 	if _, err := io.ReadFull(io.NewSectionReader(r.file, footerOffset, FooterSize), footer); err != nil {
 		return gerrors.IO("failed to read footer", err)
 	}
 
-	indexOffset := int64(binary.BigEndian.Uint64(footer[:IndexOffsetSize]))
-	indexSize := int64(binary.BigEndian.Uint64(footer[IndexOffsetSize:]))
+	pos := 0
+	indexOffset := int64(binary.BigEndian.Uint64(footer[pos : pos+IndexOffsetSize]))
+	pos += IndexOffsetSize
+	indexSize := int64(binary.BigEndian.Uint64(footer[pos : pos+IndexSizeSize]))
+	pos += IndexSizeSize
+	metaSize := int64(binary.BigEndian.Uint64(footer[pos : pos+MetaSizeSize]))
+	pos += MetaSizeSize
+	entryCount := binary.BigEndian.Uint64(footer[pos : pos+EntryCountSize])
+	pos += EntryCountSize
+	compression := Compression(binary.BigEndian.Uint32(footer[pos : pos+CompressionSize]))
+	pos += CompressionSize
+	version := binary.BigEndian.Uint32(footer[pos : pos+VersionSize])
+	pos += VersionSize
+	magic := binary.BigEndian.Uint32(footer[pos : pos+MagicSize])
+
+	if magic != Magic {
+		if err := r.checkLegacy(size); err != nil {
+			return err
+		}
+		return gerrors.Corruption("bad SST magic number", gerrors.ErrBadMagic)
+	}
+	if version < oldestVersion {
+		return gerrors.Corruption(fmt.Sprintf("SST format version %d is older than the oldest readable version %d", version, oldestVersion), gerrors.ErrUnsupportedVersion)
+	}
+	if version > Version {
+		return gerrors.Corruption(fmt.Sprintf("unsupported SST version %d", version), gerrors.ErrUnsupportedVersion)
+	}
+	if !knownCompression(compression) {
+		return gerrors.Corruption(fmt.Sprintf("unsupported SST compression %d", compression), nil)
+	}
+	if indexOffset < 0 || indexSize < 0 || metaSize < 0 || indexOffset+indexSize+metaSize != footerOffset {
+		return gerrors.Corruption("SST footer does not match file size", nil)
+	}
+	if (entryCount == 0) != (indexSize == 0) {
+		return gerrors.Corruption("SST entry count does not match index", nil)
+	}
 	r.indexBase = indexOffset
+	r.compression = compression
+	r.version = version
+	r.count = entryCount
+
+	// The meta section records the number of index entries, if the table
+	// was written recently enough to have it
+	r.indexEntries = -1
+	if err := r.loadMeta(indexOffset+indexSize, metaSize); err != nil {
+		return err
+	}
 
 	// Read index section into memory buffer
 	indexBuf := make([]byte, indexSize)
@@ -70,7 +213,11 @@ func (r *Reader) loadIndex() error {
 	}
 
 	// Parse index from buffer
-	r.index = make([]IndexEntry, 0, indexSize/40) // rough guess; 40 bytes per entry
+	capacity := r.indexEntries
+	if capacity < 0 {
+		capacity = int(indexSize / 40) // rough guess; 40 bytes per entry
+	}
+	r.index = make([]IndexEntry, 0, capacity)
 	var offset int64
 	for offset < indexSize {
 		entry, bytesRead, err := storage.DecodeEntry(indexBuf[offset:])
@@ -78,89 +225,670 @@ func (r *Reader) loadIndex() error {
 			return gerrors.Corruption("failed to decode index entry", err)
 		}
 
-		if offset+int64(bytesRead)+8 > indexSize {
-			return gerrors.Corruption("corrupt index: missing data offset", nil)
+		if offset+int64(bytesRead)+blockHandleSize > indexSize {
+			return gerrors.Corruption("corrupt index: missing block handle", nil)
 		}
 
-		// Decode data offset
-		dataOffset := int64(binary.BigEndian.Uint64(indexBuf[offset+int64(bytesRead) : offset+int64(bytesRead)+8]))
+		// Decode the block's offset and sizes
+		handle := indexBuf[offset+int64(bytesRead) : offset+int64(bytesRead)+blockHandleSize]
+		dataOffset := int64(binary.BigEndian.Uint64(handle[0:8]))
+		blockSize := int64(binary.BigEndian.Uint64(handle[8:16]))
+		rawSize := int64(binary.BigEndian.Uint64(handle[16:24]))
+		if dataOffset < 0 || blockSize < 0 || rawSize < 0 || dataOffset > indexOffset-blockSize {
+			return gerrors.Corruption("corrupt index: block outside data section", nil)
+		}
+		if r.strict {
+			if err := checkIndexOrder(r.cmp, r.index, entry.Key, dataOffset, indexOffset); err != nil {
+				return err
+			}
+		}
 		r.index = append(r.index, IndexEntry{
-			Key:    entry.Key,
-			Offset: dataOffset,
+			Key:     entry.Key,
+			Offset:  dataOffset,
+			Size:    blockSize,
+			RawSize: rawSize,
 		})
-		offset += int64(bytesRead) + 8
+		offset += int64(bytesRead) + blockHandleSize
+	}
+	if r.indexEntries >= 0 && len(r.index) != r.indexEntries {
+		return gerrors.Corruption(fmt.Sprintf("SST index holds %d entries, expected %d", len(r.index), r.indexEntries), nil)
 	}
 
+	return r.loadKeyRange()
+}
+
+// loadKeyRange records the smallest and largest keys in the table. The
+// smallest is the first index key; the largest comes from the meta section,
+// or from the last block for tables written before it was recorded there.
+func (r *Reader) loadKeyRange() error {
+	if len(r.index) == 0 {
+		return nil
+	}
+	r.minKey = r.index[0].Key
+	if r.maxKey != nil {
+		return nil
+	}
+	block, err := r.readBlock(len(r.index) - 1)
+	if err != nil {
+		return gerrors.IO("failed to read last block", err)
+	}
+	for offset := 0; offset < len(block); {
+		entry, n, err := r.decodeEntry(block[offset:], r.maxKey)
+		if err != nil {
+			return gerrors.IO("failed to read entry", err)
+		}
+		r.maxKey = entry.Key
+		offset += n
+	}
 	return nil
 }
 
-// Get performs a lookup and returns the entry if found
+// decodeEntry decodes the data block entry at the start of buf, given the
+// key of the entry before it in the block, nil for the first.
+func (r *Reader) decodeEntry(buf, prev []byte) (storage.Entry, int, error) {
+	if r.version < 5 {
+		return storage.DecodeEntry(buf)
+	}
+	return storage.DecodeBlockEntry(buf, prev)
+}
+
+// decodeEntryHeader is like decodeEntry but decodes no value and skips the
+// checksum, as storage.DecodeEntryHeader does.
+func (r *Reader) decodeEntryHeader(buf, prev []byte) (storage.Entry, int, error) {
+	if r.version < 5 {
+		return storage.DecodeEntryHeader(buf)
+	}
+	return storage.DecodeBlockEntryHeader(buf, prev)
+}
+
+// checkIndexOrder reports an invariant violation unless an index entry for
+// key at dataOffset may follow the entries already in index: keys strictly
+// increasing by cmp and offsets monotonic within the data section.
+func checkIndexOrder(cmp func(a, b []byte) int, index []IndexEntry, key []byte, dataOffset, dataEnd int64) error {
+	if dataOffset < 0 || dataOffset >= dataEnd {
+		return gerrors.Invariant(fmt.Sprintf("index offset %d outside data section", dataOffset), nil)
+	}
+	if len(index) == 0 {
+		return nil
+	}
+	prev := index[len(index)-1]
+	if dataOffset <= prev.Offset {
+		return gerrors.Invariant(fmt.Sprintf("index offset %d not after %d", dataOffset, prev.Offset), nil)
+	}
+	if cmp(key, prev.Key) <= 0 {
+		return gerrors.Invariant(fmt.Sprintf("index key %q not after %q", key, prev.Key), nil)
+	}
+	return nil
+}
+
+// loadMeta reads the named metadata records between the index and the footer
+func (r *Reader) loadMeta(metaOffset, metaSize int64) error {
+	metaBuf := make([]byte, metaSize)
+	if _, err := io.ReadFull(io.NewSectionReader(r.file, metaOffset, metaSize), metaBuf); err != nil {
+		return gerrors.IO("failed to read meta section", err)
+	}
+
+	var offset int
+	for offset < len(metaBuf) {
+		record, n, err := storage.DecodeEntry(metaBuf[offset:])
+		if err != nil {
+			return gerrors.Corruption("failed to decode meta record", err)
+		}
+		offset += n
+
+		switch string(record.Key) {
+		case metaPrefixFilter:
+			filter, err := bloom.Decode(record.Value)
+			if err != nil {
+				return err
+			}
+			r.prefixFilter = filter
+		case metaKeyFilter:
+			filter, err := bloom.Decode(record.Value)
+			if err != nil {
+				return err
+			}
+			r.keyFilter = filter
+		case metaMaxKey:
+			r.maxKey = bytes.Clone(record.Value)
+		case metaMaxSeq:
+			if len(record.Value) != 8 {
+				return gerrors.Corruption("bad max sequence number record", nil)
+			}
+			r.maxSeq = binary.BigEndian.Uint64(record.Value)
+		case metaIndexInterval, metaIndexEntries:
+			if len(record.Value) != 8 {
+				return gerrors.Corruption("bad index properties record", nil)
+			}
+			n := binary.BigEndian.Uint64(record.Value)
+			if n > math.MaxInt32 {
+				return gerrors.Corruption("bad index properties record", nil)
+			}
+			if string(record.Key) == metaIndexInterval {
+				r.indexInterval = int(n)
+			} else {
+				r.indexEntries = int(n)
+			}
+		case metaRangeDels:
+			for buf := record.Value; len(buf) > 0; {
+				entry, n, err := storage.DecodeEntry(buf)
+				if err != nil || entry.Type != storage.RangeDeleteEntry {
+					return gerrors.Corruption("bad range tombstone record", err)
+				}
+				r.rangeDels = append(r.rangeDels, entry)
+				buf = buf[n:]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Get performs a lookup and returns the entry if found. The block that may
+// hold key is read in one call and decoded from memory. A tombstone is
+// reported as errors.ErrNotFound, like a missing key; use GetEntry to tell
+// them apart.
 func (r *Reader) Get(key []byte) (storage.Entry, error) {
-	// Find index entry with key <= target
-	pos := sort.Search(len(r.index), func(i int) bool {
-		return bytes.Compare(r.index[i].Key, key) > 0
-	}) - 1
+	entry, found, err := r.GetEntry(key)
+	if err != nil {
+		return storage.Entry{}, err
+	}
+	if !found || entry.Type == storage.DeleteEntry {
+		return storage.Entry{}, gerrors.ErrNotFound
+	}
+	return entry, nil
+}
+
+// GetEntry returns the table's entry for key as stored, reporting false if
+// there is none. Unlike Get, a tombstone is returned as found, with Type set
+// to storage.DeleteEntry and no Value.
+func (r *Reader) GetEntry(key []byte) (storage.Entry, bool, error) {
+	if !r.mayContain(key) {
+		return storage.Entry{}, false, nil
+	}
 
+	pos := r.blockFor(key)
 	if pos < 0 {
-		return storage.Entry{}, gerrors.ErrNotFound
+		return storage.Entry{}, false, nil
+	}
+
+	block, err := r.cachedBlock(pos)
+	if err != nil {
+		return storage.Entry{}, false, gerrors.IO("failed to read block for key", err)
+	}
+
+	offset, prev, found, err := r.seek(block, key)
+	if err != nil {
+		return storage.Entry{}, false, gerrors.IO("failed to read entry", err)
+	}
+	if !found {
+		return storage.Entry{}, false, nil
+	}
+	entry, _, err := r.decodeEntry(block.data[offset:], prev)
+	if err != nil {
+		return storage.Entry{}, false, gerrors.IO("failed to read entry", err)
+	}
+	if entry, err = r.resolveBlob(entry); err != nil {
+		return storage.Entry{}, false, err
+	}
+	if entry.Type == storage.DeleteEntry {
+		entry.Value = nil
+	}
+	return storage.Entry{Type: entry.Type, Key: key, Value: entry.Value, ExpiresAt: entry.ExpiresAt, Seq: entry.Seq}, true, nil
+}
+
+// GetVersions returns every entry the table holds for key, newest first,
+// or none if it holds no version of it. Tables only hold more than one
+// when written with several versions of a key; tombstones are returned
+// like in GetEntry.
+func (r *Reader) GetVersions(key []byte) ([]storage.Entry, error) {
+	if !r.mayContain(key) {
+		return nil, nil
 	}
 
-	// Calculate the block boundary
-	blockEnd := r.indexBase
-	if pos+1 < len(r.index) {
-		blockEnd = r.index[pos+1].Offset
+	pos := r.blockFor(key)
+	if pos < 0 {
+		return nil, nil
+	}
+
+	block, err := r.cachedBlock(pos)
+	if err != nil {
+		return nil, gerrors.IO("failed to read block for key", err)
 	}
 
-	// load block to memory
-	offset := r.index[pos].Offset
-	blockSize := blockEnd - offset
-	indexBlockBuf := make([]byte, blockSize)
-	_, err := r.file.ReadAt(indexBlockBuf, offset)
+	offset, prev, found, err := r.seek(block, key)
 	if err != nil {
-		return storage.Entry{}, gerrors.IO("failed to read block for key", err)
+		return nil, gerrors.IO("failed to read entry", err)
+	}
+	if !found {
+		return nil, nil
 	}
 
-	// resets index to read from the beginning of the in-mem block
-	offset = 0
-	for offset < blockSize {
-		entry, n, err := storage.DecodeEntry(indexBlockBuf[offset:])
+	// The versions of a key are adjacent and never span blocks
+	var versions []storage.Entry
+	for offset < len(block.data) {
+		entry, n, err := r.decodeEntry(block.data[offset:], prev)
 		if err != nil {
-			if err == io.EOF {
-				break
+			return nil, gerrors.IO("failed to read entry", err)
+		}
+		if r.cmp(entry.Key, key) != 0 {
+			break
+		}
+		if entry, err = r.resolveBlob(entry); err != nil {
+			return nil, err
+		}
+		if entry.Type == storage.DeleteEntry {
+			entry.Value = nil
+		}
+		versions = append(versions, storage.Entry{Type: entry.Type, Key: key, Value: entry.Value, ExpiresAt: entry.ExpiresAt, Seq: entry.Seq})
+		prev = entry.Key
+		offset += n
+	}
+	return versions, nil
+}
+
+// Probe reports whether the table holds key, like GetMulti for one key, but
+// returns the entry without its Value and does not fetch a value stored in
+// a blob file. The entry's checksum is still verified. A tombstone is
+// reported as found with Type set to storage.DeleteEntry.
+func (r *Reader) Probe(key []byte) (storage.Entry, bool, error) {
+	if !r.mayContain(key) {
+		return storage.Entry{}, false, nil
+	}
+
+	pos := r.blockFor(key)
+	if pos < 0 {
+		return storage.Entry{}, false, nil
+	}
+
+	block, err := r.cachedBlock(pos)
+	if err != nil {
+		return storage.Entry{}, false, gerrors.IO("failed to read block for key", err)
+	}
+
+	offset, prev, found, err := r.seek(block, key)
+	if err != nil {
+		return storage.Entry{}, false, gerrors.IO("failed to read entry", err)
+	}
+	if !found {
+		return storage.Entry{}, false, nil
+	}
+	entry, _, err := r.decodeEntry(block.data[offset:], prev)
+	if err != nil {
+		return storage.Entry{}, false, gerrors.IO("failed to read entry", err)
+	}
+	if entry.Type == storage.BlobEntry {
+		entry.Type = storage.PutEntry
+	}
+	entry.Value = nil
+	return entry, true, nil
+}
+
+// GetMulti looks up several keys, reading each data block at most once.
+// The returned slices are parallel to keys. Unlike Get, a tombstone is
+// reported as found with Type set to storage.DeleteEntry so callers can
+// stop searching older tables. Keys whose block cannot be read are
+// reported as not found; use GetMultiE to tell them apart.
+func (r *Reader) GetMulti(keys [][]byte) ([]storage.Entry, []bool) {
+	entries, found, _ := r.getMulti(keys)
+	return entries, found
+}
+
+// GetMultiE is GetMulti for callers that must not mistake a block that
+// could not be read for a missing key, such as the engine, which would
+// otherwise go on to serve an older version from a lower table.
+func (r *Reader) GetMultiE(keys [][]byte) ([]storage.Entry, []bool, error) {
+	entries, found, err := r.getMulti(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, found, nil
+}
+
+// getMulti fills in the keys of every block it can read and returns the
+// first error it met, if any.
+func (r *Reader) getMulti(keys [][]byte) ([]storage.Entry, []bool, error) {
+	entries := make([]storage.Entry, len(keys))
+	found := make([]bool, len(keys))
+
+	// Visit the keys in sorted order so that each block is scanned once,
+	// skipping keys the filter rules out
+	order := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if r.mayContain(key) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return r.cmp(keys[order[a]], keys[order[b]]) < 0
+	})
+	blocks := make([]int, len(order))
+	for n, i := range order {
+		blocks[n] = r.blockFor(keys[i])
+	}
+
+	var firstErr error
+	for i := 0; i < len(order); {
+		pos := blocks[i]
+
+		// Group all keys that fall in the same block
+		j := i + 1
+		for j < len(order) && blocks[j] == pos {
+			j++
+		}
+		if pos >= 0 {
+			if err := r.getInBlock(pos, keys, order[i:j], entries, found); err != nil && firstErr == nil {
+				firstErr = err
 			}
-			return storage.Entry{}, gerrors.IO("failed to read entry", err)
 		}
+		i = j
+	}
 
-		cmp := bytes.Compare(entry.Key, key)
-		if cmp == 0 {
-			if storage.EntryType(entry.Type) == storage.DeleteEntry {
-				return storage.Entry{}, gerrors.ErrNotFound
+	return entries, found, firstErr
+}
+
+// getInBlock looks up the keys at the sorted indexes order, all of which
+// fall in the block at index position pos.
+func (r *Reader) getInBlock(pos int, keys [][]byte, order []int, entries []storage.Entry, found []bool) error {
+	block, err := r.cachedBlock(pos)
+	if err != nil {
+		return gerrors.IO("failed to read block for keys", err)
+	}
+
+	var offset, i int
+	var prev []byte
+	for offset < len(block.data) && i < len(order) {
+		entry, n, err := r.decodeEntry(block.data[offset:], prev)
+		if err != nil {
+			return gerrors.IO("failed to read entry", err)
+		}
+		prev = entry.Key
+
+		// Skip requested keys that sort before the current entry; they
+		// are not in this block.
+		for i < len(order) && r.cmp(keys[order[i]], entry.Key) < 0 {
+			i++
+		}
+		if i < len(order) && r.cmp(keys[order[i]], entry.Key) == 0 {
+			if entry, err = r.resolveBlob(entry); err != nil {
+				return err
 			}
-			return storage.Entry{Type: storage.PutEntry, Key: key, Value: entry.Value}, nil
 		}
+		for i < len(order) && r.cmp(keys[order[i]], entry.Key) == 0 {
+			entries[order[i]] = entry
+			found[order[i]] = true
+			i++
+		}
+
+		offset += n
+	}
+	return nil
+}
 
+// resolveBlob returns entry with the pointer held by a blob entry replaced
+// by the value it points to, as the put it was written as. Other entries
+// are returned unchanged.
+func (r *Reader) resolveBlob(entry storage.Entry) (storage.Entry, error) {
+	if entry.Type != storage.BlobEntry {
+		return entry, nil
+	}
+	if r.blobs == nil {
+		return storage.Entry{}, gerrors.Internal(fmt.Sprintf("SSTable %s points to blob values but has no blob store", r.path), nil)
+	}
+	value, err := r.blobs.Get(entry.Value)
+	if err != nil {
+		return storage.Entry{}, err
+	}
+	entry.Type, entry.Value = storage.PutEntry, value
+	return entry, nil
+}
+
+// blockFor returns the index position of the block that may contain key,
+// or -1 if key sorts before the first block.
+func (r *Reader) blockFor(key []byte) int {
+	// Find index entry with key <= target
+	return sort.Search(len(r.index), func(i int) bool {
+		return r.cmp(r.index[i].Key, key) > 0
+	}) - 1
+}
+
+// cachedBlock returns the data block at index position pos from the block
+// cache, reading it from disk and caching it on a miss. Blocks that are
+// cached carry the offsets and keys of their entries so they can be binary
+// searched; without a cache, building them would cost more than the one
+// scan of the block they save. The block may be shared and must not be
+// modified.
+func (r *Reader) cachedBlock(pos int) (*block, error) {
+	key := blockCacheKey{path: r.path, offset: r.index[pos].Offset}
+	if block, ok := r.cache.get(key); ok {
+		return block, nil
+	}
+	data, err := r.readBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache == nil {
+		return &block{data: data}, nil
+	}
+	block, err := r.indexBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.add(key, block)
+	return block, nil
+}
+
+// block is a decompressed data block. An indexed block also holds the
+// offset and full key of each of its entries, decoded once when the block
+// is loaded, so that point lookups binary search it instead of scanning it.
+type block struct {
+	data    []byte
+	indexed bool
+	offsets []int
+	keys    [][]byte
+}
+
+// indexBlock decodes the entry headers of data into an indexed block.
+func (r *Reader) indexBlock(data []byte) (*block, error) {
+	b := &block{data: data, indexed: true}
+	var prev []byte
+	for offset := 0; offset < len(data); {
+		entry, n, err := r.decodeEntryHeader(data[offset:], prev)
+		if err != nil {
+			return nil, gerrors.IO("failed to read entry", err)
+		}
+		b.offsets = append(b.offsets, offset)
+		b.keys = append(b.keys, entry.Key)
+		prev = entry.Key
+		offset += n
+	}
+	return b, nil
+}
+
+// size returns the memory held by the block in bytes, as charged to the
+// block cache.
+func (b *block) size() int64 {
+	size := int64(len(b.data)) + int64(len(b.offsets))*int64(unsafe.Sizeof(0))
+	for _, key := range b.keys {
+		size += int64(unsafe.Sizeof(key)) + int64(len(key))
+	}
+	return size
+}
+
+// seek finds the entry for key in b and returns its offset along with the
+// key of the entry before it, which decoding the entry needs, or reports
+// that b does not hold key.
+func (r *Reader) seek(b *block, key []byte) (offset int, prev []byte, found bool, err error) {
+	if b.indexed && !r.linearSearch {
+		i := sort.Search(len(b.keys), func(i int) bool {
+			return r.cmp(b.keys[i], key) >= 0
+		})
+		if i == len(b.keys) || r.cmp(b.keys[i], key) != 0 {
+			return 0, nil, false, nil
+		}
+		if i > 0 {
+			prev = b.keys[i-1]
+		}
+		return b.offsets[i], prev, true, nil
+	}
+
+	// The loop stops at the end of the block itself, so any decode error
+	// is damage: the decoders never return io.EOF, and report an entry cut
+	// short by the end of the block as io.ErrUnexpectedEOF
+	for offset < len(b.data) {
+		entry, n, err := r.decodeEntryHeader(b.data[offset:], prev)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		cmp := r.cmp(entry.Key, key)
+		if cmp == 0 {
+			return offset, prev, true, nil
+		}
 		if cmp > 0 {
 			break
 		}
+		prev = entry.Key
+		offset += n
+	}
+	return 0, nil, false, nil
+}
 
-		offset += int64(n)
+// readBlock loads the data block at index position pos into memory,
+// decompressing it if needed.
+func (r *Reader) readBlock(pos int) ([]byte, error) {
+	handle := r.index[pos]
+	block := make([]byte, handle.Size)
+	if _, err := r.file.ReadAt(block, handle.Offset); err != nil {
+		return nil, err
 	}
 
-	return storage.Entry{}, gerrors.ErrNotFound
+	if r.compression != SnappyCompression {
+		return block, nil
+	}
+	n, err := snappy.DecodedLen(block)
+	if err != nil || int64(n) != handle.RawSize {
+		return nil, gerrors.Corruption("compressed block size mismatch", err)
+	}
+	raw, err := snappy.Decode(make([]byte, n), block)
+	if err != nil {
+		return nil, gerrors.Corruption("failed to decompress block", err)
+	}
+	return raw, nil
+}
+
+// mayContain reports whether the table may hold key, according to its key
+// range and key filter. Tables written without a filter may hold any key in
+// their range.
+func (r *Reader) mayContain(key []byte) bool {
+	if r.minKey == nil || r.cmp(key, r.minKey) < 0 || r.cmp(key, r.maxKey) > 0 {
+		return false
+	}
+	return r.keyFilter == nil || r.keyFilter.MayContain(key)
+}
+
+// MayContainPrefix reports whether the table may hold keys whose extracted
+// prefix is prefix, as recorded by the writer's PrefixExtractor. It returns
+// true when the table has no prefix filter. Callers must extract prefix with
+// the same function the table was written with.
+func (r *Reader) MayContainPrefix(prefix []byte) bool {
+	if r.prefixFilter == nil {
+		return true
+	}
+	return r.prefixFilter.MayContain(prefix)
+}
+
+// IndexEntries returns a copy of the sparse index.
+// Each key is the first key of a data block, not every key in the table,
+// and offsets are positions in the file format that callers should only
+// compare with each other, e.g. to estimate how many blocks a range spans.
+func (r *Reader) IndexEntries() []IndexEntry {
+	entries := make([]IndexEntry, len(r.index))
+	for i, e := range r.index {
+		entries[i] = e
+		entries[i].Key = bytes.Clone(e.Key)
+	}
+	return entries
+}
+
+// ApproximateRange estimates the number of entries, tombstones included,
+// and the bytes of data blocks with start <= key < end, from the index
+// alone. Block i holds the keys from its index key up to the next one, so
+// blocks entirely in range count fully and the blocks at either edge count
+// half. A nil start or end leaves that side unbounded.
+func (r *Reader) ApproximateRange(start, end []byte) (keys, size uint64) {
+	if len(r.index) == 0 {
+		return 0, 0
+	}
+	perBlock := float64(r.count) / float64(len(r.index))
+
+	var blocks, blockBytes float64
+	for i, block := range r.index {
+		// Keys in the block are >= first and < next, or <= maxKey for the
+		// last block
+		first := block.Key
+		beforeStart := false
+		if start != nil {
+			if i+1 < len(r.index) {
+				beforeStart = r.cmp(r.index[i+1].Key, start) <= 0
+			} else {
+				beforeStart = r.cmp(r.maxKey, start) < 0
+			}
+		}
+		if beforeStart || (end != nil && r.cmp(first, end) >= 0) {
+			continue
+		}
+
+		within := start == nil || r.cmp(first, start) >= 0
+		if end != nil {
+			if i+1 < len(r.index) {
+				within = within && r.cmp(r.index[i+1].Key, end) <= 0
+			} else {
+				within = within && r.cmp(r.maxKey, end) < 0
+			}
+		}
+		share := 1.0
+		if !within {
+			share = 0.5
+		}
+		blocks += share
+		blockBytes += share * float64(block.Size)
+	}
+	return uint64(blocks*perBlock + 0.5), uint64(blockBytes + 0.5)
 }
 
 // NewIterator creates a new iterator
 func (r *Reader) NewIterator() *Iterator {
-	return &Iterator{
-		reader:  r,
-		offset:  0,
-		dataEnd: r.indexBase,
-	}
+	return &Iterator{reader: r, blockPos: -1}
 }
 
-// Close closes the underlying file
+// Ref adds a reference to the reader that must be released with Close.
+// It keeps the file open for a user of the reader, such as an iterator,
+// after its owner has closed it.
+func (r *Reader) Ref() {
+	r.refs.Add(1)
+}
+
+// RemoveOnClose marks the table's file for deletion once the last
+// reference to the reader is released, so that users holding a reference,
+// such as an iterator, can keep reading a table that has been replaced.
+func (r *Reader) RemoveOnClose() {
+	r.remove.Store(true)
+}
+
+// Close releases a reference to the reader and closes the underlying file
+// once the last reference is released, deleting it if RemoveOnClose was
+// called
 func (r *Reader) Close() error {
-	return r.file.Close()
+	if r.refs.Add(-1) > 0 {
+		return nil
+	}
+	err := r.file.Close()
+	if r.remove.Load() {
+		if rmErr := r.fs.Remove(r.path); rmErr != nil && err == nil {
+			err = gerrors.IO("failed to remove SSTable", rmErr)
+		}
+	}
+	return err
 }
 
 // Path returns the SSTable file path
@@ -168,36 +896,246 @@ func (r *Reader) Path() string {
 	return r.path
 }
 
-// Iterator provides sequential access to entries in an SSTable
+// Size returns the size of the SSTable file in bytes
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// MinKey returns the smallest key in the table, or nil if it is empty.
+func (r *Reader) MinKey() []byte {
+	return r.minKey
+}
+
+// MaxKey returns the largest key in the table, or nil if it is empty.
+func (r *Reader) MaxKey() []byte {
+	return r.maxKey
+}
+
+// Properties returns how the table was written.
+func (r *Reader) Properties() Properties {
+	return Properties{
+		IndexInterval: r.indexInterval,
+		IndexEntries:  len(r.index),
+		Entries:       r.count,
+		Compression:   r.compression,
+		Version:       r.version,
+	}
+}
+
+// Count returns the number of entries in the table, tombstones included.
+func (r *Reader) Count() uint64 {
+	return r.count
+}
+
+// RangeTombstones returns the range tombstones held by the table. They are
+// not part of its key range or entry count.
+func (r *Reader) RangeTombstones() []storage.Entry {
+	return r.rangeDels
+}
+
+// Empty reports whether the table holds neither entries nor range
+// tombstones.
+func (r *Reader) Empty() bool {
+	return r.count == 0 && len(r.rangeDels) == 0
+}
+
+// MaxSeq returns the highest sequence number of any entry in the table, or
+// 0 if its entries have none.
+func (r *Reader) MaxSeq() uint64 {
+	return r.maxSeq
+}
+
+// Iterator provides sequential access to entries in an SSTable, in either
+// direction. It reads one data block at a time. Besides checking the result
+// of each move, it can be driven with Valid:
+//
+//	for it.SeekToFirst(); it.Valid(); it.Next() {
+//		...
+//	}
+//	if err := it.Error(); err != nil {
+//		...
+//	}
 type Iterator struct {
-	reader  *Reader
-	offset  int64
-	entry   *storage.Entry
-	dataEnd int64
-	err     error
+	reader   *Reader
+	block    []byte // current decompressed data block
+	blockPos int    // index position of block, -1 before the first
+	offset   int    // position of the next entry in block
+	entry    *storage.Entry
+	err      error
+
+	// decoded holds every entry of the block at decodedPos, and ends the
+	// offset just past each one, for moving backwards. Keys in a block
+	// are stored relative to the key before them, so an entry can only be
+	// found by decoding the block from its start.
+	decoded    []storage.Entry
+	ends       []int
+	decodedPos int
 }
 
 // Next advances the iterator to the next entry
 func (it *Iterator) Next() bool {
-	if it.err != nil || it.offset >= it.dataEnd {
+	if it.err != nil {
 		return false
 	}
 
-	entry, newOffset, err := storage.ReadEntryAt(it.reader.file, it.offset)
-	if err != nil {
-		if err == io.EOF {
+	for it.offset >= len(it.block) {
+		if it.blockPos+1 >= len(it.reader.index) {
 			it.entry = nil
 			return false
 		}
+		block, err := it.reader.readBlock(it.blockPos + 1)
+		if err != nil {
+			it.err = gerrors.IO("failed to read block", err)
+			return false
+		}
+		it.blockPos++
+		it.block = block
+		it.offset = 0
+		it.entry = nil
+	}
+
+	// Keys are rebuilt from the previous key in the same block
+	var prev []byte
+	if it.entry != nil {
+		prev = it.entry.Key
+	}
+	entry, n, err := it.reader.decodeEntry(it.block[it.offset:], prev)
+	if err != nil {
 		it.err = err
 		return false
 	}
 
 	it.entry = &entry
-	it.offset = newOffset
+	it.offset += n
+	return true
+}
+
+// Seek positions the iterator at the first entry with key >= key and
+// reports whether there is one. It uses the index to skip the blocks before
+// the one that may hold key. If every key is smaller, the iterator is left
+// exhausted.
+func (it *Iterator) Seek(key []byte) bool {
+	it.Reset()
+	if pos := it.reader.blockFor(key); pos >= 0 {
+		it.blockPos = pos - 1
+	}
+	for it.Next() {
+		if it.reader.cmp(it.entry.Key, key) >= 0 {
+			return true
+		}
+	}
+	it.entry = nil
+	return false
+}
+
+// SeekToFirst positions the iterator at the first entry and reports whether
+// the table has one.
+func (it *Iterator) SeekToFirst() bool {
+	it.Reset()
+	return it.Next()
+}
+
+// SeekToLast positions the iterator at the last entry and reports whether
+// the table has one.
+func (it *Iterator) SeekToLast() bool {
+	it.Reset()
+	if len(it.reader.index) == 0 {
+		return false
+	}
+	return it.lastInBlock(len(it.reader.index) - 1)
+}
+
+// SeekForPrev positions the iterator at the last entry with key <= key and
+// reports whether there is one. If every key is larger, the iterator is left
+// before the first entry.
+func (it *Iterator) SeekForPrev(key []byte) bool {
+	if !it.Seek(key) {
+		if it.err != nil {
+			return false
+		}
+		return it.SeekToLast()
+	}
+	if it.reader.cmp(it.entry.Key, key) == 0 {
+		return true
+	}
+	return it.Prev()
+}
+
+// Prev moves the iterator to the entry before the current one and reports
+// whether there is one. From the first entry it leaves the iterator before
+// the first entry, so a following Next returns the first entry again. Prev
+// returns false if the iterator is not at an entry.
+func (it *Iterator) Prev() bool {
+	if it.err != nil || it.entry == nil {
+		return false
+	}
+
+	if err := it.decodeBlock(); err != nil {
+		it.err = err
+		return false
+	}
+	if i := sort.SearchInts(it.ends, it.offset); i > 0 {
+		it.entry = &it.decoded[i-1]
+		it.offset = it.ends[i-1]
+		return true
+	}
+
+	if it.blockPos == 0 {
+		it.Reset()
+		return false
+	}
+	return it.lastInBlock(it.blockPos - 1)
+}
+
+// lastInBlock positions the iterator at the last entry of the block at pos.
+func (it *Iterator) lastInBlock(pos int) bool {
+	block, err := it.reader.readBlock(pos)
+	if err != nil {
+		it.err = gerrors.IO("failed to read block", err)
+		return false
+	}
+	it.block = block
+	it.blockPos = pos
+	if err := it.decodeBlock(); err != nil {
+		it.err = err
+		return false
+	}
+	if len(it.decoded) == 0 {
+		it.entry = nil
+		it.offset = 0
+		return false
+	}
+	it.entry = &it.decoded[len(it.decoded)-1]
+	it.offset = len(it.block)
 	return true
 }
 
+// decodeBlock fills decoded and ends for the current block unless they
+// already hold it.
+func (it *Iterator) decodeBlock() error {
+	if it.decoded != nil && it.decodedPos == it.blockPos {
+		return nil
+	}
+	it.decoded, it.ends = it.decoded[:0], it.ends[:0]
+	var prev []byte
+	for offset := 0; offset < len(it.block); {
+		entry, n, err := it.reader.decodeEntry(it.block[offset:], prev)
+		if err != nil {
+			it.decoded = nil
+			return err
+		}
+		offset += n
+		it.decoded = append(it.decoded, entry)
+		it.ends = append(it.ends, offset)
+		prev = entry.Key
+	}
+	if it.decoded == nil {
+		it.decoded = []storage.Entry{}
+	}
+	it.decodedPos = it.blockPos
+	return nil
+}
+
 // Key returns the current entry's key
 func (it *Iterator) Key() []byte {
 	if it.entry == nil {
@@ -206,7 +1144,9 @@ func (it *Iterator) Key() []byte {
 	return it.entry.Key
 }
 
-// Value returns the current entry's value
+// Value returns the current entry's value, reading it from its blob file if
+// it is kept in one. If that read fails, Value returns nil and the
+// iteration ends with the error.
 func (it *Iterator) Value() []byte {
 	if it.entry == nil {
 		return nil
@@ -215,14 +1155,36 @@ func (it *Iterator) Value() []byte {
 	if it.entry.Type == storage.DeleteEntry {
 		return nil
 	}
+	if it.entry.Type == storage.BlobEntry {
+		entry, err := it.reader.resolveBlob(*it.entry)
+		if err != nil {
+			it.err = err
+			return nil
+		}
+		return entry.Value
+	}
 	return it.entry.Value
 }
 
-// Type returns the current entry's type
+// blobPointer returns the pointer held by the current entry if it is a
+// put whose value is in a blob file, along with the store holding it, so
+// that merges can copy the pointer instead of the value.
+func (it *Iterator) blobPointer() ([]byte, *blob.Store) {
+	if it.entry == nil || it.entry.Type != storage.BlobEntry || it.reader.blobs == nil {
+		return nil, nil
+	}
+	return it.entry.Value, it.reader.blobs
+}
+
+// Type returns the current entry's type. Puts whose value is in a blob
+// file are reported as puts.
 func (it *Iterator) Type() storage.EntryType {
 	if it.entry == nil {
 		return 0
 	}
+	if it.entry.Type == storage.BlobEntry {
+		return storage.PutEntry
+	}
 	return it.entry.Type
 }
 
@@ -231,13 +1193,38 @@ func (it *Iterator) IsDeleted() bool {
 	return it.entry != nil && it.entry.Type == storage.DeleteEntry
 }
 
+// ExpiresAt returns the current entry's expiry, or 0 if it never expires
+func (it *Iterator) ExpiresAt() int64 {
+	if it.entry == nil {
+		return 0
+	}
+	return it.entry.ExpiresAt
+}
+
+// Seq returns the current entry's sequence number
+func (it *Iterator) Seq() uint64 {
+	if it.entry == nil {
+		return 0
+	}
+	return it.entry.Seq
+}
+
 // Reset resets the iterator
 func (it *Iterator) Reset() {
+	it.block = nil
+	it.blockPos = -1
 	it.offset = 0
 	it.entry = nil
 	it.err = nil
 }
 
+// Valid reports whether the iterator is positioned on an entry. It is false
+// before the first move, once the iterator has moved past either end of the
+// table and after an error.
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.entry != nil
+}
+
 // Error returns any error encountered during iteration
 func (it *Iterator) Error() error {
 	return it.err
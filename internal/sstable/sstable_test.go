@@ -2,10 +2,18 @@ package sstable_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/MikhailWahib/graveldb/internal/blob"
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
 	"github.com/MikhailWahib/graveldb/internal/sstable"
 	"github.com/MikhailWahib/graveldb/internal/storage"
 	"github.com/stretchr/testify/assert"
@@ -381,15 +389,195 @@ func TestSSTableEmptyIterator(t *testing.T) {
 	require.NoError(t, sstReader.Close())
 }
 
+func TestSSTableIterator_Seek(t *testing.T) {
+	// Even keys only, spread over several index blocks
+	var entries []entry
+	for i := 0; i < 4*indexInterval; i += 2 {
+		entries = append(entries, put(fmt.Sprintf("key-%03d", i), "v"))
+	}
+	reader := createSST(t, filepath.Join(t.TempDir(), "seek.sst"), entries)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	cases := []struct {
+		name string
+		seek string
+		want string // empty means exhausted
+		next string
+	}{
+		{name: "existing key", seek: "key-034", want: "key-034", next: "key-036"},
+		{name: "first key", seek: "key-000", want: "key-000", next: "key-002"},
+		{name: "missing key in range", seek: "key-035", want: "key-036", next: "key-038"},
+		{name: "before first key", seek: "a", want: "key-000", next: "key-002"},
+		{name: "last key", seek: "key-062", want: "key-062"},
+		{name: "after last key", seek: "z"},
+	}
+
+	iter := reader.NewIterator()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.want == "" {
+				require.False(t, iter.Seek([]byte(tc.seek)))
+				assert.Nil(t, iter.Key())
+				assert.False(t, iter.Next())
+				assert.NoError(t, iter.Error())
+				return
+			}
+
+			require.True(t, iter.Seek([]byte(tc.seek)))
+			assert.Equal(t, tc.want, string(iter.Key()))
+			if tc.next == "" {
+				assert.False(t, iter.Next())
+			} else {
+				require.True(t, iter.Next())
+				assert.Equal(t, tc.next, string(iter.Key()))
+			}
+			assert.NoError(t, iter.Error())
+		})
+	}
+}
+
+func TestSSTableIterator_Valid(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "valid.sst")
+	var entries []entry
+	for i := range 2*indexInterval + 3 {
+		entries = append(entries, put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%03d", i)))
+	}
+	reader := createSST(t, sstPath, entries)
+
+	iter := reader.NewIterator()
+	assert.False(t, iter.Valid(), "before the first move")
+	var keys []string
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	require.NoError(t, iter.Error())
+	require.Len(t, keys, len(entries))
+	assert.Equal(t, entries[0].key, keys[0])
+	assert.Equal(t, entries[len(entries)-1].key, keys[len(keys)-1])
+
+	// The idiom restarts from the first entry
+	iter.SeekToFirst()
+	require.True(t, iter.Valid())
+	assert.Equal(t, entries[0].key, string(iter.Key()))
+
+	assert.False(t, iter.Seek([]byte("zzz")))
+	assert.False(t, iter.Valid(), "after seeking past the last key")
+	assert.True(t, iter.Seek([]byte("key-005")))
+	assert.True(t, iter.Valid())
+	require.NoError(t, reader.Close())
+
+	// A damaged entry ends the iteration with an error
+	data, err := os.ReadFile(sstPath)
+	require.NoError(t, err)
+	pos := bytes.Index(data, []byte("value-001"))
+	require.Positive(t, pos)
+	data[pos+len("value-")] ^= 0xff
+	require.NoError(t, os.WriteFile(sstPath, data, 0644))
+	reader, err = sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	iter = reader.NewIterator()
+	require.True(t, iter.SeekToFirst())
+	iter.Next()
+	assert.False(t, iter.Valid())
+	assert.ErrorIs(t, iter.Error(), gerrors.ErrChecksumMismatch)
+
+	empty := createSST(t, filepath.Join(t.TempDir(), "empty.sst"), nil)
+	defer func() { require.NoError(t, empty.Close()) }()
+	iter = empty.NewIterator()
+	assert.False(t, iter.SeekToFirst())
+	assert.False(t, iter.Valid())
+}
+
+func TestSSTableIterator_Reverse(t *testing.T) {
+	// Shared prefixes and a tombstone, spread over several index blocks
+	var entries []entry
+	for i := 0; i < 3*indexInterval+5; i++ {
+		entries = append(entries, put(fmt.Sprintf("user:%04d", i*2), fmt.Sprintf("v%d", i)))
+	}
+	entries[7] = entry{key: entries[7].key, typ: storage.DeleteEntry}
+	reader := createSST(t, filepath.Join(t.TempDir(), "reverse.sst"), entries)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	type kv struct{ key, value string }
+	var forward []kv
+	iter := reader.NewIterator()
+	for iter.Next() {
+		forward = append(forward, kv{string(iter.Key()), string(iter.Value())})
+	}
+	require.NoError(t, iter.Error())
+	require.Len(t, forward, len(entries))
+
+	var reverse []kv
+	for ok := iter.SeekToLast(); ok; ok = iter.Prev() {
+		reverse = append(reverse, kv{string(iter.Key()), string(iter.Value())})
+	}
+	require.NoError(t, iter.Error())
+	slices.Reverse(reverse)
+	assert.Equal(t, forward, reverse)
+
+	// Past the first entry the iterator starts over
+	assert.Nil(t, iter.Key())
+	assert.False(t, iter.Prev())
+	require.True(t, iter.Next())
+	assert.Equal(t, forward[0].key, string(iter.Key()))
+
+	// Next and Prev can be mixed across a block boundary
+	require.True(t, iter.Seek([]byte(forward[indexInterval].key)))
+	require.True(t, iter.Prev())
+	assert.Equal(t, forward[indexInterval-1].key, string(iter.Key()))
+	require.True(t, iter.Next())
+	assert.Equal(t, forward[indexInterval].key, string(iter.Key()))
+	require.True(t, iter.Next())
+	assert.Equal(t, forward[indexInterval+1].key, string(iter.Key()))
+	require.True(t, iter.Prev())
+	require.True(t, iter.Prev())
+	assert.Equal(t, forward[indexInterval-1].key, string(iter.Key()))
+
+	cases := []struct {
+		name string
+		seek string
+		want string // empty means no key is <= seek
+	}{
+		{name: "existing key", seek: "user:0034", want: "user:0034"},
+		{name: "missing key in range", seek: "user:0035", want: "user:0034"},
+		{name: "first key of a block", seek: forward[indexInterval].key, want: forward[indexInterval].key},
+		{name: "between blocks", seek: forward[indexInterval-1].key + "x", want: forward[indexInterval-1].key},
+		{name: "after last key", seek: "z", want: forward[len(forward)-1].key},
+		{name: "before first key", seek: "a"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok := iter.SeekForPrev([]byte(tc.seek))
+			assert.NoError(t, iter.Error())
+			if tc.want == "" {
+				assert.False(t, ok)
+				assert.Nil(t, iter.Key())
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, tc.want, string(iter.Key()))
+		})
+	}
+
+	empty := createSST(t, filepath.Join(t.TempDir(), "empty.sst"), nil)
+	defer func() { require.NoError(t, empty.Close()) }()
+	assert.False(t, empty.NewIterator().SeekToLast())
+}
+
 func createSST(t *testing.T, path string, entries []entry) *sstable.Reader {
 	sst, err := sstable.NewWriter(path, indexInterval)
 	require.NoError(t, err)
 
 	for _, e := range entries {
-		if e.typ == storage.PutEntry {
+		switch e.typ {
+		case storage.PutEntry:
 			require.NoError(t, sst.PutEntry([]byte(e.key), []byte(e.value)))
-		} else {
+		case storage.DeleteEntry:
 			require.NoError(t, sst.DeleteEntry([]byte(e.key)))
+		default:
+			require.NoError(t, sst.Add(storage.Entry{Type: e.typ, Key: []byte(e.key), Value: []byte(e.value)}))
 		}
 	}
 	require.NoError(t, sst.Finish())
@@ -558,3 +746,1833 @@ func TestMerger_MultipleSSTablesMerge(t *testing.T) {
 	assert.NoError(t, iter.Error())
 	require.NoError(t, outputReader.Close())
 }
+
+func TestMerger_HigherSeqWins(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Two tables of one tier hold the same keys; the one given first, which
+	// position alone would treat as older, has the newer writes of "a" and "c"
+	write := func(name string, entries []storage.Entry) *sstable.Reader {
+		path := filepath.Join(tempDir, name)
+		w, err := sstable.NewWriter(path, indexInterval)
+		require.NoError(t, err)
+		for _, e := range entries {
+			require.NoError(t, w.Add(e))
+		}
+		require.NoError(t, w.Close())
+		r, err := sstable.NewReader(path)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	first := write("first.sst", []storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("first"), Seq: 9},
+		{Type: storage.PutEntry, Key: []byte("b"), Value: []byte("first"), Seq: 2},
+		{Type: storage.DeleteEntry, Key: []byte("c"), Seq: 7},
+	})
+	second := write("second.sst", []storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("second"), Seq: 4},
+		{Type: storage.PutEntry, Key: []byte("b"), Value: []byte("second"), Seq: 5},
+		{Type: storage.PutEntry, Key: []byte("c"), Value: []byte("second"), Seq: 6},
+	})
+	assert.Equal(t, uint64(9), first.MaxSeq())
+	assert.Equal(t, uint64(6), second.MaxSeq())
+
+	mergedPath := filepath.Join(tempDir, "merged.sst")
+	output, err := sstable.NewWriter(mergedPath, indexInterval)
+	require.NoError(t, err)
+	merger := sstable.NewMerger()
+	require.NoError(t, merger.AddSource(first))
+	require.NoError(t, merger.AddSource(second))
+	merger.SetOutput(output)
+	require.NoError(t, merger.Merge())
+	require.NoError(t, output.Close())
+
+	merged, err := sstable.NewReader(mergedPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, merged.Close()) }()
+	assert.Equal(t, uint64(9), merged.MaxSeq())
+
+	var got []string
+	iter := merged.NewIterator()
+	for iter.Next() {
+		got = append(got, fmt.Sprintf("%s=%s@%d", iter.Key(), iter.Value(), iter.Seq()))
+	}
+	require.NoError(t, iter.Error())
+	assert.Equal(t, []string{"a=first@9", "b=second@5", "c=@7"}, got)
+}
+
+func TestMerger_KeepsMaxVersions(t *testing.T) {
+	tempDir := t.TempDir()
+	write := func(name string, entries ...storage.Entry) *sstable.Reader {
+		path := filepath.Join(tempDir, name)
+		w, err := sstable.NewWriterWithOptions(path, sstable.Options{IndexInterval: 1, StrictInvariants: true})
+		require.NoError(t, err)
+		for _, e := range entries {
+			require.NoError(t, w.Add(e))
+		}
+		require.NoError(t, w.Close())
+		r, err := sstable.NewReader(path)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	putSeq := func(key, value string, seq uint64) storage.Entry {
+		return storage.Entry{Type: storage.PutEntry, Key: []byte(key), Value: []byte(value), Seq: seq}
+	}
+	older := write("older.sst", putSeq("a", "1", 1), putSeq("b", "1", 2), putSeq("c", "1", 3))
+	newer := write("newer.sst",
+		putSeq("a", "3", 6), putSeq("a", "2", 4),
+		storage.Entry{Type: storage.DeleteEntry, Key: []byte("b"), Seq: 5},
+		putSeq("c", "2", 7))
+
+	versions := func(r *sstable.Reader, key string) []string {
+		entries, err := r.GetVersions([]byte(key))
+		require.NoError(t, err)
+		var got []string
+		for _, e := range entries {
+			if e.Type == storage.DeleteEntry {
+				got = append(got, fmt.Sprintf("-@%d", e.Seq))
+			} else {
+				got = append(got, fmt.Sprintf("%s@%d", e.Value, e.Seq))
+			}
+		}
+		return got
+	}
+	assert.Equal(t, []string{"3@6", "2@4"}, versions(newer, "a"))
+
+	for _, drop := range []bool{false, true} {
+		n := 0
+		next := func() (*sstable.Writer, error) {
+			n++
+			return sstable.NewWriterWithOptions(filepath.Join(tempDir, fmt.Sprintf("out-%t-%d.sst", drop, n)), sstable.Options{IndexInterval: 1, StrictInvariants: true})
+		}
+		first, err := next()
+		require.NoError(t, err)
+		merger := sstable.NewMerger()
+		require.NoError(t, merger.AddSource(older))
+		require.NoError(t, merger.AddSource(newer))
+		merger.SetOutput(first)
+		merger.SetMaxVersions(2)
+		merger.SetDropTombstones(drop)
+		// Every entry fills an output, but a key's versions stay together
+		merger.SetSplit(1, next)
+		require.NoError(t, merger.Merge())
+
+		got := map[string][]string{}
+		for _, w := range merger.Outputs() {
+			require.NoError(t, w.Close())
+			reader, err := sstable.NewReader(w.Path())
+			require.NoError(t, err)
+			assert.Equal(t, reader.MinKey(), reader.MaxKey(), "drop %t", drop)
+			got[string(reader.MinKey())] = versions(reader, string(reader.MinKey()))
+			require.NoError(t, reader.Close())
+		}
+
+		want := map[string][]string{"a": {"3@6", "2@4"}, "b": {"-@5", "1@2"}, "c": {"2@7", "1@3"}}
+		if drop {
+			// A key whose newest version is deleted goes with its versions
+			delete(want, "b")
+		}
+		assert.Equal(t, want, got, "drop %t", drop)
+	}
+}
+
+func TestMerger_ResolvesDuplicateKeysWithinATable(t *testing.T) {
+	tempDir := t.TempDir()
+	write := func(name string, entries ...storage.Entry) *sstable.Reader {
+		path := filepath.Join(tempDir, name)
+		w, err := sstable.NewWriter(path, indexInterval)
+		require.NoError(t, err)
+		for _, e := range entries {
+			require.NoError(t, w.Add(e))
+		}
+		require.NoError(t, w.Close())
+		r, err := sstable.NewReader(path)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	putSeq := func(key, value string, seq uint64) storage.Entry {
+		return storage.Entry{Type: storage.PutEntry, Key: []byte(key), Value: []byte(value), Seq: seq}
+	}
+
+	// A malformed table holds several versions of a and c, some of them
+	// oldest first, around versions of the same keys in another table
+	malformed := write("malformed.sst",
+		putSeq("a", "stale", 1), putSeq("a", "newest", 5), putSeq("a", "older", 2),
+		putSeq("b", "b", 3),
+		putSeq("c", "stale", 4), storage.Entry{Type: storage.DeleteEntry, Key: []byte("c"), Seq: 8})
+	other := write("other.sst", putSeq("a", "other", 4), putSeq("c", "other", 6))
+
+	mergedPath := filepath.Join(tempDir, "merged.sst")
+	output, err := sstable.NewWriter(mergedPath, indexInterval)
+	require.NoError(t, err)
+	merger := sstable.NewMerger()
+	require.NoError(t, merger.AddSource(malformed))
+	require.NoError(t, merger.AddSource(other))
+	merger.SetOutput(output)
+	require.NoError(t, merger.Merge())
+	require.NoError(t, output.Close())
+
+	merged, err := sstable.NewReader(mergedPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, merged.Close()) }()
+	var got []string
+	iter := merged.NewIterator()
+	for iter.Next() {
+		got = append(got, fmt.Sprintf("%s=%s@%d", iter.Key(), iter.Value(), iter.Seq()))
+	}
+	require.NoError(t, iter.Error())
+	assert.Equal(t, []string{"a=newest@5", "b=b@3", "c=@8"}, got)
+}
+
+func TestMerger_DropTombstones(t *testing.T) {
+	tempDir := t.TempDir()
+	older := createSST(t, filepath.Join(tempDir, "older.sst"), []entry{put("a", "1"), put("b", "1"), put("c", "1")})
+	newer := createSST(t, filepath.Join(tempDir, "newer.sst"), []entry{del("a"), put("c", "2"), del("d")})
+	defer func() {
+		require.NoError(t, older.Close())
+		require.NoError(t, newer.Close())
+	}()
+
+	for _, drop := range []bool{false, true} {
+		output, err := sstable.NewWriter(filepath.Join(tempDir, fmt.Sprintf("out-%t.sst", drop)), indexInterval)
+		require.NoError(t, err)
+		merger := sstable.NewMerger()
+		require.NoError(t, merger.AddSource(older))
+		require.NoError(t, merger.AddSource(newer))
+		merger.SetOutput(output)
+		merger.SetDropTombstones(drop)
+		require.NoError(t, merger.Merge())
+		require.NoError(t, output.Close())
+
+		reader, err := sstable.NewReader(output.Path())
+		require.NoError(t, err)
+		iter := sstable.NewMergedIterator([]*sstable.Reader{reader})
+		got := drain(t, iter, iter.Next())
+		require.NoError(t, reader.Close())
+
+		want := []string{"a=-", "b=1", "c=2", "d=-"}
+		if drop {
+			want = []string{"b=1", "c=2"}
+		}
+		assert.Equal(t, want, got, "drop %t", drop)
+	}
+}
+
+func TestMerger_DropsExpiredEntries(t *testing.T) {
+	tempDir := t.TempDir()
+	older := createSST(t, filepath.Join(tempDir, "older.sst"), []entry{put("a", "1"), put("b", "1")})
+	w, err := sstable.NewWriter(filepath.Join(tempDir, "newer.sst"), indexInterval)
+	require.NoError(t, err)
+	require.NoError(t, w.Add(storage.Entry{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("2"), ExpiresAt: 100, Seq: 2}))
+	require.NoError(t, w.Add(storage.Entry{Type: storage.PutEntry, Key: []byte("b"), Value: []byte("2"), ExpiresAt: 300, Seq: 2}))
+	require.NoError(t, w.Close())
+	newer, err := sstable.NewReader(w.Path())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, older.Close())
+		require.NoError(t, newer.Close())
+	}()
+
+	for _, drop := range []bool{false, true} {
+		output, err := sstable.NewWriter(filepath.Join(tempDir, fmt.Sprintf("out-%t.sst", drop)), indexInterval)
+		require.NoError(t, err)
+		merger := sstable.NewMerger()
+		require.NoError(t, merger.AddSource(older))
+		require.NoError(t, merger.AddSource(newer))
+		merger.SetOutput(output)
+		merger.SetNow(200)
+		merger.SetDropTombstones(drop)
+		require.NoError(t, merger.Merge())
+		require.NoError(t, output.Close())
+
+		reader, err := sstable.NewReader(output.Path())
+		require.NoError(t, err)
+		iter := sstable.NewMergedIterator([]*sstable.Reader{reader})
+		got := drain(t, iter, iter.Next())
+		require.NoError(t, reader.Close())
+
+		// An expired entry still hides older values while some may lie
+		// beneath the merge, and is gone with them once none can
+		want := []string{"a=-", "b=2"}
+		if drop {
+			want = []string{"b=2"}
+		}
+		assert.Equal(t, want, got, "drop %t", drop)
+	}
+}
+
+func TestMerger_FoldsMergeEntries(t *testing.T) {
+	tempDir := t.TempDir()
+	merge := func(key, value string) entry { return entry{key, value, storage.MergeEntry} }
+	older := createSST(t, filepath.Join(tempDir, "older.sst"), []entry{put("a", "1"), merge("b", "2"), del("c")})
+	newer := createSST(t, filepath.Join(tempDir, "newer.sst"), []entry{merge("a", "x"), merge("b", "y"), merge("c", "z"), merge("d", "w")})
+	defer func() {
+		require.NoError(t, older.Close())
+		require.NoError(t, newer.Close())
+	}()
+
+	// Concatenation is associative, and shows the order operands applied in
+	concat := func(existing, operand []byte) []byte {
+		return append(append([]byte(nil), existing...), operand...)
+	}
+	for _, drop := range []bool{false, true} {
+		output, err := sstable.NewWriter(filepath.Join(tempDir, fmt.Sprintf("out-%t.sst", drop)), indexInterval)
+		require.NoError(t, err)
+		merger := sstable.NewMerger()
+		require.NoError(t, merger.AddSource(older))
+		require.NoError(t, merger.AddSource(newer))
+		merger.SetOutput(output)
+		merger.SetMerge(concat)
+		merger.SetDropTombstones(drop)
+		require.NoError(t, merger.Merge())
+		require.NoError(t, output.Close())
+
+		reader, err := sstable.NewReader(output.Path())
+		require.NoError(t, err)
+		var got []string
+		iter := reader.NewIterator()
+		for iter.Next() {
+			got = append(got, fmt.Sprintf("%s=%s/%d", iter.Key(), iter.Value(), iter.Type()))
+		}
+		require.NoError(t, iter.Error())
+		require.NoError(t, reader.Close())
+
+		// Chains that reach no value stay merges unless nothing older
+		// can exist
+		putType, mergeType := storage.PutEntry, storage.MergeEntry
+		if drop {
+			mergeType = putType
+		}
+		want := []string{
+			fmt.Sprintf("a=1x/%d", putType),
+			fmt.Sprintf("b=2y/%d", mergeType),
+			fmt.Sprintf("c=z/%d", putType),
+			fmt.Sprintf("d=w/%d", mergeType),
+		}
+		assert.Equal(t, want, got, "drop %t", drop)
+	}
+}
+
+func TestMerger_AppliesRangeTombstones(t *testing.T) {
+	tempDir := t.TempDir()
+	rangeDel := storage.Entry{Type: storage.RangeDeleteEntry, Key: []byte("b"), Value: []byte("d"), Seq: 5}
+
+	older := filepath.Join(tempDir, "older.sst")
+	w, err := sstable.NewWriter(older, indexInterval)
+	require.NoError(t, err)
+	for i, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, w.Add(storage.Entry{Type: storage.PutEntry, Key: []byte(key), Value: []byte("old"), Seq: uint64(i + 1)}))
+	}
+	require.NoError(t, w.Close())
+
+	// The newer table holds the range tombstone and a write made after it
+	newer := filepath.Join(tempDir, "newer.sst")
+	w, err = sstable.NewWriter(newer, indexInterval)
+	require.NoError(t, err)
+	require.NoError(t, w.Add(storage.Entry{Type: storage.PutEntry, Key: []byte("c"), Value: []byte("new"), Seq: 6}))
+	require.NoError(t, w.AddRangeTombstone(rangeDel))
+	require.NoError(t, w.Close())
+
+	sources := make([]*sstable.Reader, 0, 2)
+	for _, path := range []string{older, newer} {
+		reader, err := sstable.NewReader(path)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, reader.Close()) }()
+		sources = append(sources, reader)
+	}
+	require.Len(t, sources[1].RangeTombstones(), 1)
+	assert.Equal(t, rangeDel, sources[1].RangeTombstones()[0])
+	assert.Equal(t, uint64(6), sources[1].MaxSeq())
+
+	for _, drop := range []bool{false, true} {
+		output, err := sstable.NewWriter(filepath.Join(tempDir, fmt.Sprintf("out-%t.sst", drop)), indexInterval)
+		require.NoError(t, err)
+		merger := sstable.NewMerger()
+		for _, src := range sources {
+			require.NoError(t, merger.AddSource(src))
+		}
+		merger.SetOutput(output)
+		merger.SetDropTombstones(drop)
+		require.NoError(t, merger.Merge())
+		require.NoError(t, output.Close())
+
+		reader, err := sstable.NewReader(output.Path())
+		require.NoError(t, err)
+		iter := sstable.NewMergedIterator([]*sstable.Reader{reader})
+		got := drain(t, iter, iter.Next())
+		assert.Equal(t, []string{"a=old", "c=new", "d=old"}, got, "drop %t", drop)
+
+		// The tombstone is kept for older data outside the merge, unless
+		// there is none
+		if drop {
+			assert.Empty(t, reader.RangeTombstones())
+		} else {
+			assert.Equal(t, []storage.Entry{rangeDel}, reader.RangeTombstones())
+		}
+		require.NoError(t, reader.Close())
+	}
+}
+
+func TestMerger_SplitOutputs(t *testing.T) {
+	tempDir := t.TempDir()
+	var entries []entry
+	for i := range 100 {
+		entries = append(entries, put(fmt.Sprintf("key-%03d", i), "value"))
+	}
+	source := createSST(t, filepath.Join(tempDir, "source.sst"), entries)
+	defer func() { require.NoError(t, source.Close()) }()
+	assert.Equal(t, "key-000", string(source.MinKey()))
+	assert.Equal(t, "key-099", string(source.MaxKey()))
+
+	n := 0
+	next := func() (*sstable.Writer, error) {
+		n++
+		return sstable.NewWriter(filepath.Join(tempDir, fmt.Sprintf("out-%d.sst", n)), indexInterval)
+	}
+	first, err := next()
+	require.NoError(t, err)
+
+	merger := sstable.NewMerger()
+	require.NoError(t, merger.AddSource(source))
+	merger.SetOutput(first)
+	merger.SetSplit(512, next)
+	require.NoError(t, merger.Merge())
+
+	// The outputs hold consecutive key ranges covering every entry
+	outputs := merger.Outputs()
+	require.Greater(t, len(outputs), 1)
+	var keys []string
+	var lastMax []byte
+	for _, w := range outputs {
+		require.NoError(t, w.Close())
+		reader, err := sstable.NewReader(w.Path())
+		require.NoError(t, err)
+		if lastMax != nil {
+			assert.Negative(t, bytes.Compare(lastMax, reader.MinKey()))
+		}
+		lastMax = reader.MaxKey()
+		iter := reader.NewIterator()
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		require.NoError(t, iter.Error())
+		assert.Equal(t, keys[len(keys)-1], string(reader.MaxKey()))
+		require.NoError(t, reader.Close())
+	}
+	assert.Len(t, keys, len(entries))
+}
+
+func TestMerger_CopiesBlobPointers(t *testing.T) {
+	tempDir := t.TempDir()
+	blobs, err := blob.Open(filepath.Join(tempDir, "blobs"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, blobs.Close()) }()
+	opts := sstable.Options{IndexInterval: indexInterval, Blobs: blobs, ValueThreshold: 100}
+	large := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i)}, 1000) }
+
+	// Large values go to the blob file, small ones stay in the table
+	var sources []*sstable.Reader
+	for n := range 2 {
+		path := filepath.Join(tempDir, fmt.Sprintf("source-%d.sst", n))
+		w, err := sstable.NewWriterWithOptions(path, opts)
+		require.NoError(t, err)
+		for i := range 10 {
+			value := large(i)
+			if i%2 == 0 {
+				value = []byte("small")
+			}
+			require.NoError(t, w.PutEntry(fmt.Appendf(nil, "key-%d-%02d", n, i), value))
+		}
+		require.NoError(t, w.Close())
+		reader, err := sstable.NewReaderWithOptions(path, opts)
+		require.NoError(t, err)
+		assert.Less(t, reader.Size(), int64(1000))
+		sources = append(sources, reader)
+	}
+	blobPath := blob.FilePath(blobs.Dir(), 1)
+	before, err := os.Stat(blobPath)
+	require.NoError(t, err)
+
+	outputPath := filepath.Join(tempDir, "output.sst")
+	output, err := sstable.NewWriterWithOptions(outputPath, opts)
+	require.NoError(t, err)
+	merger := sstable.NewMerger()
+	for _, source := range sources {
+		require.NoError(t, merger.AddSource(source))
+	}
+	merger.SetOutput(output)
+	require.NoError(t, merger.Merge())
+	require.NoError(t, output.Close())
+	for _, source := range sources {
+		require.NoError(t, source.Close())
+	}
+
+	// The merge copied pointers, so the blob file did not grow
+	after, err := os.Stat(blobPath)
+	require.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+
+	reader, err := sstable.NewReaderWithOptions(outputPath, opts)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+	assert.Less(t, reader.Size(), int64(2000))
+	iter := reader.NewIterator()
+	var n int
+	for iter.Next() {
+		var want []byte
+		var src, i int
+		_, err := fmt.Sscanf(string(iter.Key()), "key-%d-%02d", &src, &i)
+		require.NoError(t, err)
+		if want = large(i); i%2 == 0 {
+			want = []byte("small")
+		}
+		assert.Equal(t, storage.PutEntry, iter.Type())
+		assert.Equal(t, want, iter.Value(), "%s", iter.Key())
+		got, err := reader.Get(iter.Key())
+		require.NoError(t, err)
+		assert.Equal(t, want, got.Value)
+		n++
+	}
+	require.NoError(t, iter.Error())
+	assert.Equal(t, 20, n)
+
+	// Without the blob store the pointers cannot be followed
+	bare, err := sstable.NewReader(outputPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, bare.Close()) }()
+	_, err = bare.Get([]byte("key-0-01"))
+	assert.Error(t, err)
+}
+
+// countingFile wraps an *os.File and counts ReadAt calls.
+type countingFile struct {
+	*os.File
+	reads int
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+	return f.File.ReadAt(p, off)
+}
+
+func TestReader_BlockCache(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "cache.sst")
+	var entries []entry
+	for i := range 4 * indexInterval {
+		entries = append(entries, put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%03d", i)))
+	}
+	entries = append(entries, del("key-999"))
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	uncached, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, uncached.Close()) }()
+
+	cache := sstable.NewBlockCache(1 << 20)
+	f, err := os.Open(sstPath)
+	require.NoError(t, err)
+	cf := &countingFile{File: f}
+	cached, err := sstable.NewReaderFromFile(cf, sstPath, sstable.Options{BlockCache: cache})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, cached.Close()) }()
+
+	// The first pass fills the cache, the second is served from it
+	for pass := range 2 {
+		cf.reads = 0
+		for _, e := range entries {
+			want, wantErr := uncached.Get([]byte(e.key))
+			got, err := cached.Get([]byte(e.key))
+			assert.Equal(t, wantErr, err, e.key)
+			assert.Equal(t, want, got, e.key)
+		}
+		if pass == 1 {
+			assert.Zero(t, cf.reads)
+		}
+	}
+	assert.Positive(t, cache.Size())
+
+	// Other readers sharing the cache hit the same blocks
+	f2, err := os.Open(sstPath)
+	require.NoError(t, err)
+	cf2 := &countingFile{File: f2}
+	shared, err := sstable.NewReaderFromFile(cf2, sstPath, sstable.Options{BlockCache: cache})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, shared.Close()) }()
+	cf2.reads = 0
+	_, found := shared.GetMulti([][]byte{[]byte("key-000"), []byte("key-063")})
+	assert.Equal(t, []bool{true, true}, found)
+	assert.Zero(t, cf2.reads)
+}
+
+func TestBlockCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "evict.sst")
+	var entries []entry
+	for i := range 4 * indexInterval {
+		entries = append(entries, put(fmt.Sprintf("key-%03d", i), "value"))
+	}
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	// Cached blocks are charged for the keys kept with them, so measure
+	// each through a cache of its own
+	var blockSize int64
+	for i := range 4 {
+		probeCache := sstable.NewBlockCache(1 << 20)
+		probe, err := sstable.NewReaderWithOptions(sstPath, sstable.Options{BlockCache: probeCache})
+		require.NoError(t, err)
+		_, err = probe.Get([]byte(fmt.Sprintf("key-%03d", i*indexInterval)))
+		require.NoError(t, err)
+		blockSize = max(blockSize, probeCache.Size())
+		require.NoError(t, probe.Close())
+	}
+
+	// Room for two blocks
+	cache := sstable.NewBlockCache(2 * blockSize)
+	f, err := os.Open(sstPath)
+	require.NoError(t, err)
+	cf := &countingFile{File: f}
+	reader, err := sstable.NewReaderFromFile(cf, sstPath, sstable.Options{BlockCache: cache})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	get := func(i int) int {
+		cf.reads = 0
+		_, err := reader.Get([]byte(fmt.Sprintf("key-%03d", i*indexInterval)))
+		require.NoError(t, err)
+		return cf.reads
+	}
+	assert.Equal(t, 1, get(0))
+	assert.Equal(t, 1, get(1))
+	assert.Equal(t, 0, get(0))
+	assert.Equal(t, 1, get(2)) // evicts block 1, the least recently used
+	assert.Equal(t, 0, get(0))
+	assert.Equal(t, 1, get(1))
+	assert.LessOrEqual(t, cache.Size(), 2*blockSize)
+
+	assert.Nil(t, sstable.NewBlockCache(0))
+}
+
+func TestReader_GetMultiScansBlockOnce(t *testing.T) {
+	tempDir := t.TempDir()
+	sstPath := filepath.Join(tempDir, "multi.sst")
+
+	var entries []entry
+	for i := range 2 * indexInterval {
+		entries = append(entries, entry{fmt.Sprintf("key-%02d", i), fmt.Sprintf("val-%02d", i), storage.PutEntry})
+	}
+	entries[3].typ = storage.DeleteEntry
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	f, err := os.Open(sstPath)
+	require.NoError(t, err)
+	cf := &countingFile{File: f}
+	reader, err := sstable.NewReaderFromFile(cf, sstPath, sstable.Options{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	// All requested keys live in the first block, requested out of order
+	keys := [][]byte{[]byte("key-07"), []byte("key-01"), []byte("key-03"), []byte("key-05a"), []byte("key-12")}
+	cf.reads = 0
+	got, found := reader.GetMulti(keys)
+	assert.Equal(t, 1, cf.reads, "expected a single block read")
+
+	assert.Equal(t, []bool{true, true, true, false, true}, found)
+	assert.Equal(t, "val-07", string(got[0].Value))
+	assert.Equal(t, "val-01", string(got[1].Value))
+	assert.Equal(t, storage.DeleteEntry, got[2].Type)
+	assert.Equal(t, "val-12", string(got[4].Value))
+
+	// Keys spanning both blocks read each block once
+	cf.reads = 0
+	_, found = reader.GetMulti([][]byte{[]byte("key-20"), []byte("key-00"), []byte("key-31"), []byte("a")})
+	assert.Equal(t, 2, cf.reads)
+	assert.Equal(t, []bool{true, true, true, false}, found)
+}
+
+func TestReader_GetReadsOneBlock(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "get.sst")
+	var entries []entry
+	for i := range 4 * indexInterval {
+		entries = append(entries, entry{fmt.Sprintf("key-%02d", i), fmt.Sprintf("val-%02d", i), storage.PutEntry})
+	}
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	f, err := os.Open(sstPath)
+	require.NoError(t, err)
+	cf := &countingFile{File: f}
+	reader, err := sstable.NewReaderFromFile(cf, sstPath, sstable.Options{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	// The last key of a block is decoded from the same single read
+	for _, key := range []string{"key-00", "key-15", "key-16", "key-63"} {
+		cf.reads = 0
+		got, err := reader.Get([]byte(key))
+		require.NoError(t, err)
+		assert.Equal(t, "val-"+key[4:], string(got.Value))
+		assert.Equal(t, 1, cf.reads, key)
+	}
+}
+
+func TestReader_GetEntry(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "entry.sst")
+	reader := createSST(t, sstPath, []entry{put("a", "1"), del("b"), put("c", "3")})
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	got, found, err := reader.GetEntry([]byte("a"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, storage.PutEntry, got.Type)
+	assert.Equal(t, "1", string(got.Value))
+
+	// A tombstone is returned with its type, while Get reports it missing
+	got, found, err = reader.GetEntry([]byte("b"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, storage.DeleteEntry, got.Type)
+	assert.Equal(t, "b", string(got.Key))
+	assert.Nil(t, got.Value)
+	_, err = reader.Get([]byte("b"))
+	assert.ErrorIs(t, err, gerrors.ErrNotFound)
+
+	for _, key := range []string{"0", "bb", "d"} {
+		_, found, err = reader.GetEntry([]byte(key))
+		require.NoError(t, err)
+		assert.False(t, found, key)
+	}
+}
+
+func TestReader_Probe(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "probe.sst")
+	big := strings.Repeat("v", 4096)
+	reader := createSST(t, sstPath, []entry{put("a", big), del("b"), put("c", "1")})
+	require.NoError(t, reader.Close())
+
+	// Corrupt a byte of a's value; Probe leaves the value out but still
+	// checks it against the entry's checksum
+	data, err := os.ReadFile(sstPath)
+	require.NoError(t, err)
+	at := bytes.Index(data, []byte(big))
+	require.GreaterOrEqual(t, at, 0)
+	data[at+100] = 'x'
+	require.NoError(t, os.WriteFile(sstPath, data, 0644))
+
+	reader, err = sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	_, err = reader.Get([]byte("a"))
+	require.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+
+	_, _, err = reader.Probe([]byte("a"))
+	require.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+
+	got, found, err := reader.Probe([]byte("c"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, storage.PutEntry, got.Type)
+	assert.Nil(t, got.Value)
+
+	// A tombstone is found, with its type
+	got, found, err = reader.Probe([]byte("b"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, storage.DeleteEntry, got.Type)
+
+	for _, key := range []string{"0", "bb", "d"} {
+		_, found, err = reader.Probe([]byte(key))
+		require.NoError(t, err)
+		assert.False(t, found, key)
+	}
+}
+
+func TestReader_KeyRangeAndCount(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "range.sst")
+	var entries []entry
+	for i := range 3*indexInterval + 5 {
+		entries = append(entries, put(fmt.Sprintf("key-%03d", i+10), "v"))
+	}
+	entries = append(entries, del("key-999"))
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	f, err := os.Open(sstPath)
+	require.NoError(t, err)
+	cf := &countingFile{File: f}
+	reader, err := sstable.NewReaderFromFile(cf, sstPath, sstable.Options{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	assert.Equal(t, "key-010", string(reader.MinKey()))
+	assert.Equal(t, "key-999", string(reader.MaxKey()))
+	assert.Equal(t, uint64(len(entries)), reader.Count())
+
+	// Keys outside the range are rejected without reading a block, even
+	// though the table has no Bloom filter
+	cf.reads = 0
+	for _, key := range []string{"a", "key-009", "key-9999", "z"} {
+		_, err := reader.Get([]byte(key))
+		assert.ErrorIs(t, err, gerrors.ErrNotFound, key)
+	}
+	_, found := reader.GetMulti([][]byte{[]byte("a"), []byte("z")})
+	assert.Equal(t, []bool{false, false}, found)
+	assert.Zero(t, cf.reads)
+
+	// The bounds themselves are in range
+	got, err := reader.Get([]byte("key-010"))
+	require.NoError(t, err)
+	assert.Equal(t, "v", string(got.Value))
+	_, found = reader.GetMulti([][]byte{[]byte("key-999")})
+	assert.Equal(t, []bool{true}, found)
+}
+
+func TestReader_ApproximateRange(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "approx.sst")
+	w, err := sstable.NewWriter(sstPath, 10)
+	require.NoError(t, err)
+	for i := range 1000 {
+		require.NoError(t, w.PutEntry([]byte(fmt.Sprintf("k%04d", i)), []byte("value")))
+	}
+	require.NoError(t, w.Close())
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	keys, size := reader.ApproximateRange(nil, nil)
+	assert.Equal(t, uint64(1000), keys)
+	assert.Positive(t, size)
+
+	// Ranges cut blocks in the middle; the estimate is off by at most a
+	// block at either edge
+	for _, r := range []struct{ start, end, want int }{{0, 1000, 1000}, {250, 750, 500}, {333, 337, 4}, {995, 1000, 5}} {
+		keys, _ := reader.ApproximateRange([]byte(fmt.Sprintf("k%04d", r.start)), []byte(fmt.Sprintf("k%04d", r.end)))
+		assert.InDelta(t, r.want, keys, 10, "[%d, %d)", r.start, r.end)
+	}
+
+	keys, size = reader.ApproximateRange([]byte("x"), nil)
+	assert.Zero(t, keys)
+	assert.Zero(t, size)
+	keys, _ = reader.ApproximateRange(nil, []byte("k"))
+	assert.Zero(t, keys)
+}
+
+func TestReader_ConcurrentLookups(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "concurrent.sst")
+	var entries []entry
+	for i := range 500 {
+		entries = append(entries, entry{fmt.Sprintf("key-%03d", i), fmt.Sprintf("val-%03d", i), storage.PutEntry})
+	}
+	reader := createSST(t, sstPath, entries)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range entries {
+				e := entries[(i+g*61)%len(entries)]
+				got, err := reader.Get([]byte(e.key))
+				if !assert.NoError(t, err) || !assert.Equal(t, e.value, string(got.Value)) {
+					return
+				}
+			}
+			iter := reader.NewIterator()
+			n := 0
+			for iter.Next() {
+				n++
+			}
+			assert.NoError(t, iter.Error())
+			assert.Equal(t, len(entries), n)
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkReaderGet compares decoding a lookup's block from one buffered
+// read with reading every entry before the key with its own ReadAt.
+func BenchmarkReaderGet(b *testing.B) {
+	sstPath := filepath.Join(b.TempDir(), "bench_get.sst")
+	sst, err := sstable.NewWriter(sstPath, indexInterval)
+	require.NoError(b, err)
+	const n = 10000
+	for i := range n {
+		require.NoError(b, sst.PutEntry(fmt.Appendf(nil, "key-%05d", i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	require.NoError(b, sst.Close())
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(b, err)
+	defer func() { require.NoError(b, reader.Close()) }()
+	index := reader.IndexEntries()
+
+	f, err := os.Open(sstPath)
+	require.NoError(b, err)
+	defer func() { require.NoError(b, f.Close()) }()
+
+	b.Run("PerEntryReads", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			key := fmt.Appendf(nil, "key-%05d", i%n)
+			pos := sort.Search(len(index), func(j int) bool {
+				return bytes.Compare(index[j].Key, key) > 0
+			}) - 1
+			offset := index[pos].Offset
+			for {
+				e, next, err := storage.ReadEntryAt(f, offset)
+				if err != nil {
+					b.Fatalf("failed to read entry: %v", err)
+				}
+				if bytes.Equal(e.Key, key) {
+					break
+				}
+				offset = next
+			}
+		}
+	})
+
+	b.Run("BlockReads", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			if _, err := reader.Get(fmt.Appendf(nil, "key-%05d", i%n)); err != nil {
+				b.Fatalf("failed to get key: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkBlockSearch looks up keys in cached blocks of 1024 entries,
+// scanning each block entry by entry or binary searching the keys kept
+// with it.
+func BenchmarkBlockSearch(b *testing.B) {
+	sstPath := filepath.Join(b.TempDir(), "bench_search.sst")
+	sst, err := sstable.NewWriter(sstPath, 1024)
+	require.NoError(b, err)
+	const n = 10000
+	for i := range n {
+		require.NoError(b, sst.PutEntry(fmt.Appendf(nil, "key-%05d", i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	require.NoError(b, sst.Close())
+
+	for _, linear := range []bool{true, false} {
+		name := "Binary"
+		if linear {
+			name = "Linear"
+		}
+		b.Run(name, func(b *testing.B) {
+			reader, err := sstable.NewReaderWithOptions(sstPath, sstable.Options{BlockCache: sstable.NewBlockCache(1 << 20)})
+			require.NoError(b, err)
+			defer func() { require.NoError(b, reader.Close()) }()
+			reader.SetLinearBlockSearch(linear)
+
+			for i := 0; b.Loop(); i++ {
+				if _, err := reader.Get(fmt.Appendf(nil, "key-%05d", i*7919%n)); err != nil {
+					b.Fatalf("failed to get key: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestReader_SearchesCachedBlocks(t *testing.T) {
+	for _, version4 := range []bool{false, true} {
+		sstPath := filepath.Join(t.TempDir(), "search.sst")
+		w, err := sstable.NewWriter(sstPath, 16)
+		require.NoError(t, err)
+		if version4 {
+			w.WriteVersion4()
+		}
+		// Only even keys, every third one deleted
+		for i := 0; i < 200; i += 2 {
+			key := fmt.Appendf(nil, "key-%03d", i)
+			if i%3 == 0 {
+				require.NoError(t, w.DeleteEntry(key))
+			} else {
+				require.NoError(t, w.PutEntry(key, fmt.Appendf(nil, "value-%03d", i)))
+			}
+		}
+		require.NoError(t, w.Close())
+
+		reader, err := sstable.NewReaderWithOptions(sstPath, sstable.Options{BlockCache: sstable.NewBlockCache(1 << 20)})
+		require.NoError(t, err)
+		// Twice, so that the second pass searches the cached blocks
+		for range 2 {
+			for i := range 201 {
+				key := fmt.Appendf(nil, "key-%03d", i)
+				entry, found, err := reader.GetEntry(key)
+				require.NoError(t, err)
+				probed, probeFound, err := reader.Probe(key)
+				require.NoError(t, err)
+				assert.Equal(t, found, probeFound, "version4 %v: %s", version4, key)
+				switch {
+				case i%2 == 1 || i == 200:
+					assert.False(t, found, "version4 %v: %s", version4, key)
+				case i%3 == 0:
+					assert.True(t, found, "version4 %v: %s", version4, key)
+					assert.Equal(t, storage.DeleteEntry, entry.Type)
+					assert.Equal(t, storage.DeleteEntry, probed.Type)
+				default:
+					assert.True(t, found, "version4 %v: %s", version4, key)
+					assert.Equal(t, fmt.Sprintf("value-%03d", i), string(entry.Value))
+					assert.Equal(t, string(key), string(probed.Key))
+				}
+			}
+		}
+		require.NoError(t, reader.Close())
+	}
+}
+
+func TestReader_ZeroLengthFileIsEmpty(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "zero.sst")
+	require.NoError(t, os.WriteFile(sstPath, nil, 0644))
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+
+	_, err = reader.Get([]byte("a"))
+	assert.ErrorIs(t, err, gerrors.ErrNotFound)
+	assert.False(t, reader.NewIterator().Next())
+
+	require.NoError(t, reader.Close())
+}
+
+func TestReader_TruncatedFileIsCorrupt(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "truncated.sst")
+	var entries []entry
+	for i := range 100 {
+		entries = append(entries, entry{fmt.Sprintf("key-%03d", i), "value", storage.PutEntry})
+	}
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	info, err := os.Stat(sstPath)
+	require.NoError(t, err)
+
+	// Cut the file in the middle of the data section, and just before the footer ends
+	for _, size := range []int64{info.Size() / 2, info.Size() - 1, sstable.FooterSize - 1} {
+		require.NoError(t, os.Truncate(sstPath, size))
+		_, err = sstable.NewReader(sstPath)
+		assert.ErrorIs(t, err, gerrors.ErrCorrupt, "size %d", size)
+	}
+}
+
+func TestReader_Verify(t *testing.T) {
+	var entries []entry
+	for i := range 3 * indexInterval {
+		entries = append(entries, entry{fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%03d", i), storage.PutEntry})
+	}
+	// build writes entries to a fresh table and returns its path and bytes
+	build := func(t *testing.T, entries []entry) (string, []byte) {
+		sstPath := filepath.Join(t.TempDir(), "verify.sst")
+		require.NoError(t, createSST(t, sstPath, entries).Close())
+		data, err := os.ReadFile(sstPath)
+		require.NoError(t, err)
+		return sstPath, data
+	}
+	// verify opens the table at sstPath and runs Verify on it
+	verify := func(t *testing.T, sstPath string) error {
+		reader, err := sstable.NewReader(sstPath)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, reader.Close()) }()
+		return reader.Verify()
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		sstPath, _ := build(t, entries)
+		assert.NoError(t, verify(t, sstPath))
+
+		empty := filepath.Join(t.TempDir(), "empty.sst")
+		require.NoError(t, os.WriteFile(empty, nil, 0644))
+		assert.NoError(t, verify(t, empty))
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		sstPath, data := build(t, entries)
+		pos := bytes.Index(data, []byte("value-020"))
+		require.Positive(t, pos)
+		data[pos+len("value-")] ^= 0xff
+		require.NoError(t, os.WriteFile(sstPath, data, 0644))
+
+		err := verify(t, sstPath)
+		assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+		assert.ErrorContains(t, err, "bad entry in block 1")
+	})
+
+	t.Run("key order", func(t *testing.T) {
+		unsorted := slices.Clone(entries)
+		unsorted[4], unsorted[5] = unsorted[5], unsorted[4]
+		sstPath, _ := build(t, unsorted)
+
+		err := verify(t, sstPath)
+		assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+		assert.ErrorContains(t, err, `key "key-004" in block 0 sorts before "key-005"`)
+	})
+
+	t.Run("index offset", func(t *testing.T) {
+		sstPath, data := build(t, entries)
+		// Move the second block's offset one byte into its first entry
+		indexOffset := int(binary.BigEndian.Uint64(data[len(data)-sstable.FooterSize:]))
+		_, n, err := storage.DecodeEntry(data[indexOffset:])
+		require.NoError(t, err)
+		second := indexOffset + n + 24
+		_, n, err = storage.DecodeEntry(data[second:])
+		require.NoError(t, err)
+		handle := data[second+n:]
+		binary.BigEndian.PutUint64(handle, binary.BigEndian.Uint64(handle)+1)
+		require.NoError(t, os.WriteFile(sstPath, data, 0644))
+
+		err = verify(t, sstPath)
+		assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+		assert.ErrorContains(t, err, "block 1 starts at offset")
+	})
+
+	t.Run("file size", func(t *testing.T) {
+		sstPath, _ := build(t, entries)
+		reader, err := sstable.NewReader(sstPath)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, reader.Close()) }()
+
+		// Grow the file after it was opened
+		f, err := os.OpenFile(sstPath, os.O_APPEND|os.O_WRONLY, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("trailing"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		err = reader.Verify()
+		assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+		assert.ErrorContains(t, err, "when opened")
+	})
+}
+
+func TestReader_VerifyOnOpen(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "paranoid.sst")
+	var entries []entry
+	for i := range 3 * indexInterval {
+		entries = append(entries, entry{fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%03d", i), storage.PutEntry})
+	}
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	paranoid := sstable.Options{VerifyOnOpen: true}
+	reader, err := sstable.NewReaderWithOptions(sstPath, paranoid)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	data, err := os.ReadFile(sstPath)
+	require.NoError(t, err)
+	pos := bytes.Index(data, []byte("value-020"))
+	require.Positive(t, pos)
+	data[pos+len("value-")] ^= 0xff
+	require.NoError(t, os.WriteFile(sstPath, data, 0644))
+
+	// By default the damage only shows up when the entry is read
+	reader, err = sstable.NewReaderWithOptions(sstPath, sstable.Options{})
+	require.NoError(t, err)
+	_, err = reader.Get([]byte("key-000"))
+	assert.NoError(t, err)
+	_, err = reader.Get([]byte("key-020"))
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+	require.NoError(t, reader.Close())
+
+	_, err = sstable.NewReaderWithOptions(sstPath, paranoid)
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+}
+
+func TestWriter_PrefixCompressesKeys(t *testing.T) {
+	const n = 1000
+	var entries []entry
+	var fullSize int64
+	for i := range n {
+		e := put(fmt.Sprintf("tenant/acme-corp/user:%07d", 1000000+i), fmt.Sprintf("v%d", i))
+		entries = append(entries, e)
+		fullSize += int64(len(storage.SerializeEntry(storage.Entry{Type: e.typ, Key: []byte(e.key), Value: []byte(e.value)})))
+	}
+
+	sstPath := filepath.Join(t.TempDir(), "prefix.sst")
+	reader := createSST(t, sstPath, entries)
+	defer func() { require.NoError(t, reader.Close()) }()
+	require.NoError(t, reader.Verify())
+
+	// Keys are stored after the prefix they share with the previous key, so
+	// the data section is well under the size of full entries
+	var dataSize int64
+	for _, block := range reader.IndexEntries() {
+		dataSize += block.Size
+		// Index keys stay whole
+		assert.True(t, strings.HasPrefix(string(block.Key), "tenant/acme-corp/user:"), string(block.Key))
+	}
+	assert.Less(t, dataSize, fullSize/2, "data %d bytes, %d uncompressed", dataSize, fullSize)
+
+	for _, e := range entries {
+		got, err := reader.Get([]byte(e.key))
+		require.NoError(t, err, e.key)
+		assert.Equal(t, e.value, string(got.Value))
+
+		header, found, err := reader.Probe([]byte(e.key))
+		require.NoError(t, err)
+		require.True(t, found, e.key)
+		assert.Equal(t, e.key, string(header.Key))
+	}
+
+	keys := [][]byte{[]byte(entries[n-1].key), []byte(entries[17].key), []byte("tenant/acme-corp/user:0999999")}
+	got, found := reader.GetMulti(keys)
+	assert.Equal(t, []bool{true, true, false}, found)
+	assert.Equal(t, entries[n-1].key, string(got[0].Key))
+	assert.Equal(t, entries[17].key, string(got[1].Key))
+
+	it := reader.NewIterator()
+	var i int
+	for it.Next() {
+		require.Less(t, i, n)
+		assert.Equal(t, entries[i].key, string(it.Key()))
+		assert.Equal(t, entries[i].value, string(it.Value()))
+		i++
+	}
+	require.NoError(t, it.Error())
+	assert.Equal(t, n, i)
+	require.True(t, it.Seek([]byte(entries[500].key)))
+	assert.Equal(t, entries[500].key, string(it.Key()))
+	require.True(t, it.Next())
+	assert.Equal(t, entries[501].key, string(it.Key()))
+	assert.Equal(t, entries[n-1].key, string(reader.MaxKey()))
+}
+
+func TestReader_ReadsVersion4(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "v4.sst")
+	w, err := sstable.NewWriter(sstPath, 4)
+	require.NoError(t, err)
+	w.WriteVersion4()
+	for i := range 10 {
+		require.NoError(t, w.PutEntry(fmt.Appendf(nil, "key-%02d", i), fmt.Appendf(nil, "value-%02d", i)))
+	}
+	require.NoError(t, w.Close())
+
+	// Keys in version 4 blocks are stored whole
+	data, err := os.ReadFile(sstPath)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), binary.BigEndian.Uint32(data[len(data)-sstable.MagicSize-sstable.VersionSize:]))
+	assert.Contains(t, string(data), "key-05")
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+	require.NoError(t, reader.Verify())
+	got, err := reader.Get([]byte("key-05"))
+	require.NoError(t, err)
+	assert.Equal(t, "value-05", string(got.Value))
+	it := reader.NewIterator()
+	var n int
+	for it.Next() {
+		assert.Equal(t, fmt.Sprintf("key-%02d", n), string(it.Key()))
+		n++
+	}
+	assert.Equal(t, 10, n)
+}
+
+// legacyTable encodes a table in the unversioned format written before
+// tables had a magic number: entries as [type][key length][value length]
+// [key][value], a sparse index of every entry and a footer holding the
+// index offset and size.
+func legacyTable(entries []storage.Entry) []byte {
+	appendRecord := func(buf []byte, entryType storage.EntryType, key, value []byte) []byte {
+		buf = append(buf, byte(entryType))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+		return append(append(buf, key...), value...)
+	}
+	var data []byte
+	offsets := make([]int, len(entries))
+	for i, entry := range entries {
+		offsets[i] = len(data)
+		data = appendRecord(data, entry.Type, entry.Key, entry.Value)
+	}
+	indexOffset := len(data)
+	for i, entry := range entries {
+		data = appendRecord(data, storage.IndexEntry, entry.Key, nil)
+		data = binary.BigEndian.AppendUint64(data, uint64(offsets[i]))
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(indexOffset))
+	return binary.BigEndian.AppendUint64(data, uint64(len(data)-indexOffset-8))
+}
+
+func TestReader_LegacyFormat(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "000001.sst")
+	require.NoError(t, os.WriteFile(path, legacyTable([]storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")},
+		{Type: storage.DeleteEntry, Key: []byte("b")},
+		{Type: storage.PutEntry, Key: []byte("c"), Value: []byte("3")},
+	}), 0644))
+
+	// Reading it fails with an explicit error rather than as damage
+	_, err := sstable.NewReader(path)
+	assert.ErrorIs(t, err, gerrors.ErrUnsupportedVersion)
+	legacy, err := sstable.IsLegacy(nil, path)
+	require.NoError(t, err)
+	assert.True(t, legacy)
+
+	require.NoError(t, sstable.ConvertLegacy(path, sstable.Options{IndexInterval: indexInterval}))
+	legacy, err = sstable.IsLegacy(nil, path)
+	require.NoError(t, err)
+	assert.False(t, legacy)
+	assert.NoFileExists(t, path+sstable.TempSuffix)
+
+	reader, err := sstable.NewReader(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+	require.NoError(t, reader.Verify())
+	got, err := reader.Get([]byte("c"))
+	require.NoError(t, err)
+	assert.Equal(t, "3", string(got.Value))
+	entry, found, err := reader.GetEntry([]byte("b"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, storage.DeleteEntry, entry.Type)
+	assert.Equal(t, uint64(3), reader.Count())
+}
+
+func TestConvertLegacy_RejectsDamagedTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	data := legacyTable([]storage.Entry{{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")}})
+	data[0] = 9
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	assert.ErrorIs(t, sstable.ConvertLegacy(path, sstable.Options{}), gerrors.ErrCorrupt)
+	kept, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, kept)
+	assert.NoFileExists(t, path+sstable.TempSuffix)
+}
+
+func TestReader_IndexEntries(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "index.sst")
+	var entries []entry
+	for i := range 3*indexInterval + 1 {
+		entries = append(entries, entry{fmt.Sprintf("key-%03d", i), "value", storage.PutEntry})
+	}
+	reader := createSST(t, sstPath, entries)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	index := reader.IndexEntries()
+	require.Len(t, index, 4)
+	for i, ie := range index {
+		assert.Equal(t, fmt.Sprintf("key-%03d", i*indexInterval), string(ie.Key))
+		if i > 0 {
+			assert.Greater(t, ie.Offset, index[i-1].Offset)
+		}
+	}
+
+	// Modifying the copy must not affect the reader
+	index[0].Key[0] = 'X'
+	_, err := reader.Get([]byte("key-000"))
+	assert.NoError(t, err)
+}
+
+func TestWriter_BlockSize(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "blocksize.sst")
+	w, err := sstable.NewWriterWithOptions(sstPath, sstable.Options{IndexInterval: 1000, BlockSize: 4096})
+	require.NoError(t, err)
+	value := bytes.Repeat([]byte("v"), 1000)
+	for i := range 100 {
+		require.NoError(t, w.PutEntry(fmt.Appendf(nil, "key-%03d", i), value))
+	}
+	require.NoError(t, w.Close())
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	// Each block stops at the first entry that takes it past BlockSize
+	index := reader.IndexEntries()
+	require.Len(t, index, 20)
+	for _, ie := range index[:len(index)-1] {
+		assert.GreaterOrEqual(t, ie.RawSize, int64(4096))
+		assert.Less(t, ie.RawSize, int64(4096+1100))
+	}
+	got, err := reader.Get([]byte("key-042"))
+	require.NoError(t, err)
+	assert.Equal(t, value, got.Value)
+}
+
+func TestReader_PrefixFilter(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "prefix.sst")
+	w, err := sstable.NewWriterWithOptions(sstPath, sstable.Options{
+		IndexInterval:   indexInterval,
+		PrefixExtractor: func(key []byte) []byte { return key[:min(len(key), 5)] },
+	})
+	require.NoError(t, err)
+	for i := range 50 {
+		require.NoError(t, w.PutEntry(fmt.Appendf(nil, "user:%02d", i), []byte("v")))
+	}
+	require.NoError(t, w.Close())
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	assert.True(t, reader.MayContainPrefix([]byte("user:")))
+	assert.False(t, reader.MayContainPrefix([]byte("item:")))
+
+	// The filter does not change point lookups
+	entry, err := reader.Get([]byte("user:07"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), entry.Value)
+}
+
+func TestReader_Properties(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "props.sst")
+	w, err := sstable.NewWriterWithOptions(sstPath, sstable.Options{IndexInterval: 16, Compression: sstable.SnappyCompression})
+	require.NoError(t, err)
+	for i := range 100 {
+		require.NoError(t, w.PutEntry(fmt.Appendf(nil, "key-%03d", i), []byte("value")))
+	}
+	require.NoError(t, w.Close())
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	// The parsed index matches the recorded count, one entry per block
+	assert.Equal(t, 7, reader.RecordedIndexEntries())
+	assert.Len(t, reader.IndexEntries(), reader.RecordedIndexEntries())
+	assert.Equal(t, sstable.Properties{
+		IndexInterval: 16,
+		IndexEntries:  7,
+		Entries:       100,
+		Compression:   sstable.SnappyCompression,
+		Version:       sstable.Version,
+	}, reader.Properties())
+}
+
+func TestReader_RefKeepsFileOpen(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "ref.sst")
+	reader := createSST(t, sstPath, []entry{{"a", "1", storage.PutEntry}})
+
+	reader.Ref()
+	require.NoError(t, reader.Close())
+
+	// The extra reference keeps the reader usable
+	entry, err := reader.Get([]byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), entry.Value)
+
+	require.NoError(t, reader.Close())
+	_, err = reader.Get([]byte("a"))
+	assert.Error(t, err)
+}
+
+func TestReader_RemoveOnCloseWaitsForLastReference(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "remove.sst")
+	reader := createSST(t, sstPath, []entry{{"a", "1", storage.PutEntry}})
+
+	reader.Ref()
+	reader.RemoveOnClose()
+	require.NoError(t, reader.Close())
+
+	// The file stays while a reference is held
+	_, err := os.Stat(sstPath)
+	require.NoError(t, err)
+	entry, err := reader.Get([]byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), entry.Value)
+
+	require.NoError(t, reader.Close())
+	_, err = os.Stat(sstPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriter_StrictInvariantsRejectsUnsortedKeys(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "strict.sst")
+	w, err := sstable.NewWriterWithOptions(sstPath, sstable.Options{IndexInterval: indexInterval, StrictInvariants: true})
+	require.NoError(t, err)
+	defer func() { _ = w.Close() }()
+
+	require.NoError(t, w.PutEntry([]byte("b"), []byte("1")))
+	assert.ErrorIs(t, w.PutEntry([]byte("a"), []byte("2")), gerrors.ErrInvariant)
+	assert.ErrorIs(t, w.DeleteEntry([]byte("b")), gerrors.ErrInvariant)
+	assert.NoError(t, w.PutEntry([]byte("c"), []byte("3")))
+}
+
+func TestWriter_RejectsOversizedEntries(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "limits.sst")
+	w, err := sstable.NewWriterWithOptions(sstPath, sstable.Options{IndexInterval: indexInterval, MaxKeySize: 4, MaxValueSize: 8})
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, w.PutEntry([]byte("key-1"), []byte("v")), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, w.PutEntry([]byte("k1"), make([]byte, 9)), gerrors.ErrEntryTooLarge)
+	require.NoError(t, w.PutEntry([]byte("k2"), make([]byte, 8)))
+	require.NoError(t, w.Close())
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+	assert.Equal(t, uint64(1), reader.Count())
+}
+
+// lengthFirst orders keys by length and then bytes, so that "k2" sorts
+// before "k10"
+func lengthFirst(a, b []byte) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(a, b)
+}
+
+func TestReader_Comparator(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "comparator.sst")
+	opts := sstable.Options{IndexInterval: 2, StrictInvariants: true, Comparator: lengthFirst}
+	keys := []string{"k1", "k2", "k9", "k10", "k11", "k100"}
+
+	// In byte order k10 sorts before k2, so the writer would reject it
+	w, err := sstable.NewWriterWithOptions(sstPath, opts)
+	require.NoError(t, err)
+	for _, key := range keys {
+		require.NoError(t, w.PutEntry([]byte(key), []byte("v"+key)))
+	}
+	require.NoError(t, w.Close())
+
+	reader, err := sstable.NewReaderWithOptions(sstPath, opts)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	assert.Equal(t, "k1", string(reader.MinKey()))
+	assert.Equal(t, "k100", string(reader.MaxKey()))
+	for _, key := range keys {
+		entry, err := reader.Get([]byte(key))
+		require.NoError(t, err, key)
+		assert.Equal(t, "v"+key, string(entry.Value))
+	}
+	_, err = reader.Get([]byte("k3"))
+	assert.ErrorIs(t, err, gerrors.ErrNotFound)
+
+	entries, found := reader.GetMulti([][]byte{[]byte("k100"), []byte("k3"), []byte("k2")})
+	assert.Equal(t, []bool{true, false, true}, found)
+	assert.Equal(t, "vk2", string(entries[2].Value))
+
+	iter := sstable.NewMergedIterator([]*sstable.Reader{reader})
+	var got []string
+	for ok := iter.Seek([]byte("k3")); ok; ok = iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	require.NoError(t, iter.Error())
+	assert.Equal(t, []string{"k9", "k10", "k11", "k100"}, got)
+}
+
+func TestReader_StrictInvariantsRejectsUnsortedIndex(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "unsorted.sst")
+
+	// Without strict mode the writer accepts keys out of order
+	w, err := sstable.NewWriter(sstPath, 1)
+	require.NoError(t, err)
+	require.NoError(t, w.PutEntry([]byte("b"), []byte("1")))
+	require.NoError(t, w.PutEntry([]byte("a"), []byte("2")))
+	require.NoError(t, w.Close())
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	_, err = sstable.NewReaderWithOptions(sstPath, sstable.Options{StrictInvariants: true})
+	assert.ErrorIs(t, err, gerrors.ErrInvariant)
+}
+
+func TestWriter_NonPositiveIndexInterval(t *testing.T) {
+	for _, interval := range []int{0, -3} {
+		sstPath := filepath.Join(t.TempDir(), "interval.sst")
+		w, err := sstable.NewWriter(sstPath, interval)
+		require.NoError(t, err)
+		for _, key := range []string{"a", "b", "c"} {
+			require.NoError(t, w.PutEntry([]byte(key), []byte("v"+key)))
+		}
+		require.NoError(t, w.Close())
+
+		reader, err := sstable.NewReader(sstPath)
+		require.NoError(t, err)
+		// Treated as an interval of 1: a block and index entry per key
+		assert.Len(t, reader.IndexEntries(), 3, "interval %d", interval)
+		entry, err := reader.Get([]byte("b"))
+		require.NoError(t, err)
+		assert.Equal(t, "vb", string(entry.Value))
+		require.NoError(t, reader.Close())
+	}
+}
+
+func TestWriter_PublishesOnlyOnClose(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "atomic.sst")
+	w, err := sstable.NewWriter(sstPath, indexInterval)
+	require.NoError(t, err)
+	require.NoError(t, w.PutEntry([]byte("a"), []byte("1")))
+	require.NoError(t, w.Finish())
+
+	// A finished but unclosed table only exists under its temporary name
+	assert.NoFileExists(t, sstPath)
+	assert.FileExists(t, sstPath+sstable.TempSuffix)
+
+	require.NoError(t, w.Close())
+	assert.FileExists(t, sstPath)
+	assert.NoFileExists(t, sstPath+sstable.TempSuffix)
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+}
+
+func TestWriter_UnfinishedTableIsNotPublished(t *testing.T) {
+	dir := t.TempDir()
+	sstPath := filepath.Join(dir, "crashed.sst")
+	w, err := sstable.NewWriter(sstPath, indexInterval)
+	require.NoError(t, err)
+	for i := range 3 * indexInterval {
+		require.NoError(t, w.PutEntry(fmt.Appendf(nil, "key-%03d", i), []byte("value")))
+	}
+
+	// A writer abandoned before Finish, as by a crash, has written blocks
+	// only to the temporary file
+	info, err := os.Stat(sstPath + sstable.TempSuffix)
+	require.NoError(t, err)
+	assert.Positive(t, info.Size())
+	matches, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	require.NoError(t, w.Delete())
+}
+
+func TestWriter_Abort(t *testing.T) {
+	dir := t.TempDir()
+	sstPath := filepath.Join(dir, "aborted.sst")
+	w, err := sstable.NewWriter(sstPath, indexInterval)
+	require.NoError(t, err)
+	for i := range 3 * indexInterval {
+		require.NoError(t, w.PutEntry(fmt.Appendf(nil, "key-%03d", i), []byte("value")))
+	}
+
+	require.NoError(t, w.Abort())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// An aborted table cannot be written, closed into place or aborted again
+	assert.Error(t, w.PutEntry([]byte("late"), []byte("value")))
+	require.NoError(t, w.Close())
+	_, err = os.Stat(sstPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Error(t, w.Abort())
+}
+
+// recordingFS records the renames and directory syncs made through it.
+type recordingFS struct {
+	*storage.MemFS
+	ops []string
+}
+
+func (fs *recordingFS) Rename(oldpath, newpath string) error {
+	fs.ops = append(fs.ops, "rename "+filepath.Base(newpath))
+	return fs.MemFS.Rename(oldpath, newpath)
+}
+
+func (fs *recordingFS) SyncDir(dir string) error {
+	fs.ops = append(fs.ops, "sync "+dir)
+	return fs.MemFS.SyncDir(dir)
+}
+
+func TestWriter_SyncsDirectoryAfterRename(t *testing.T) {
+	fs := &recordingFS{MemFS: storage.NewMemFS()}
+	require.NoError(t, fs.MkdirAll("/db/T0", 0755))
+	w, err := sstable.NewWriterWithOptions("/db/T0/000001.sst", sstable.Options{FS: fs})
+	require.NoError(t, err)
+	require.NoError(t, w.PutEntry([]byte("a"), []byte("1")))
+	require.NoError(t, w.Close())
+
+	// The rename only survives a crash once the directory is synced
+	assert.Equal(t, []string{"rename 000001.sst", "sync /db/T0"}, fs.ops)
+}
+
+func TestWriter_DeleteDiscardsUnclosedTable(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "discard.sst")
+	w, err := sstable.NewWriter(sstPath, indexInterval)
+	require.NoError(t, err)
+	require.NoError(t, w.PutEntry([]byte("a"), []byte("1")))
+
+	require.NoError(t, w.Delete())
+	assert.NoFileExists(t, sstPath)
+	assert.NoFileExists(t, sstPath+sstable.TempSuffix)
+}
+
+func TestReader_ChecksumMismatch(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "checksum.sst")
+	var entries []entry
+	for i := range 3 * indexInterval {
+		entries = append(entries, entry{fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%03d", i), storage.PutEntry})
+	}
+	require.NoError(t, createSST(t, sstPath, entries).Close())
+
+	// Flip a byte inside one value in the data section
+	data, err := os.ReadFile(sstPath)
+	require.NoError(t, err)
+	pos := bytes.Index(data, []byte("value-020"))
+	require.Positive(t, pos)
+	data[pos+len("value-")] ^= 0xff
+	require.NoError(t, os.WriteFile(sstPath, data, 0644))
+
+	reader, err := sstable.NewReader(sstPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	_, err = reader.Get([]byte("key-020"))
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+
+	// Keys in other blocks are unaffected
+	e, err := reader.Get([]byte("key-001"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value-001"), e.Value)
+
+	keys := [][]byte{[]byte("key-020"), []byte("key-001")}
+	_, _, err = reader.GetMultiE(keys)
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+	got, found := reader.GetMulti(keys)
+	assert.Equal(t, []bool{false, true}, found)
+	assert.Equal(t, []byte("value-001"), got[1].Value)
+
+	it := reader.NewIterator()
+	for it.Next() {
+		assert.NotEqual(t, "key-020", string(it.Key()))
+	}
+	assert.ErrorIs(t, it.Error(), gerrors.ErrChecksumMismatch)
+}
+
+func TestReader_KeyFilterSkipsMissingKeys(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "bloom.sst")
+	w, err := sstable.NewWriterWithOptions(sstPath, sstable.Options{IndexInterval: indexInterval, BloomBitsPerKey: 10})
+	require.NoError(t, err)
+	for i := range 1000 {
+		require.NoError(t, w.PutEntry(fmt.Appendf(nil, "key-%04d", 2*i), []byte("v")))
+	}
+	require.NoError(t, w.Close())
+
+	f, err := os.Open(sstPath)
+	require.NoError(t, err)
+	cf := &countingFile{File: f}
+	reader, err := sstable.NewReaderFromFile(cf, sstPath, sstable.Options{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	// Every stored key is still found
+	cf.reads = 0
+	for i := range 1000 {
+		_, err := reader.Get(fmt.Appendf(nil, "key-%04d", 2*i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1000, cf.reads)
+
+	// Odd keys fall inside the table's range but are absent; the filter
+	// should rule out nearly all of them without a block read
+	cf.reads = 0
+	for i := range 1000 {
+		_, err := reader.Get(fmt.Appendf(nil, "key-%04d", 2*i+1))
+		require.ErrorIs(t, err, gerrors.ErrNotFound)
+	}
+	assert.Less(t, cf.reads, 50)
+
+	keys := [][]byte{[]byte("key-0001"), []byte("key-0002"), []byte("key-0003")}
+	_, found := reader.GetMulti(keys)
+	assert.Equal(t, []bool{false, true, false}, found)
+}
+
+func TestSSTable_SnappyCompression(t *testing.T) {
+	dir := t.TempDir()
+	value := bytes.Repeat([]byte("gravel"), 100)
+
+	write := func(name string, compression sstable.Compression) string {
+		path := filepath.Join(dir, name)
+		w, err := sstable.NewWriterWithOptions(path, sstable.Options{IndexInterval: indexInterval, Compression: compression})
+		require.NoError(t, err)
+		for i := range 5 * indexInterval {
+			key := fmt.Appendf(nil, "key-%03d", i)
+			if i%7 == 0 {
+				require.NoError(t, w.DeleteEntry(key))
+			} else {
+				require.NoError(t, w.PutEntry(key, value))
+			}
+		}
+		require.NoError(t, w.Close())
+		return path
+	}
+	plainPath := write("plain.sst", sstable.NoCompression)
+	snappyPath := write("snappy.sst", sstable.SnappyCompression)
+
+	plainInfo, err := os.Stat(plainPath)
+	require.NoError(t, err)
+	snappyInfo, err := os.Stat(snappyPath)
+	require.NoError(t, err)
+	assert.Less(t, snappyInfo.Size(), plainInfo.Size()/4)
+
+	reader, err := sstable.NewReader(snappyPath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+
+	e, err := reader.Get([]byte("key-041"))
+	require.NoError(t, err)
+	assert.Equal(t, value, e.Value)
+	_, err = reader.Get([]byte("key-042"))
+	assert.ErrorIs(t, err, gerrors.ErrNotFound)
+
+	_, found := reader.GetMulti([][]byte{[]byte("key-003"), []byte("key-070"), []byte("key-100")})
+	assert.Equal(t, []bool{true, true, false}, found)
+
+	var n int
+	it := reader.NewIterator()
+	for ok := it.Seek([]byte("key-030")); ok; ok = it.Next() {
+		n++
+	}
+	require.NoError(t, it.Error())
+	assert.Equal(t, 5*indexInterval-30, n)
+}
+
+func TestReader_RejectsNonSSTable(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "placeholder.sst")
+	require.NoError(t, os.WriteFile(sstPath, bytes.Repeat([]byte("placeholder"), 10), 0644))
+
+	_, err := sstable.NewReader(sstPath)
+	assert.ErrorIs(t, err, gerrors.ErrBadMagic)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+}
+
+func TestReader_RejectsUnsupportedVersion(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "version.sst")
+	require.NoError(t, createSST(t, sstPath, []entry{put("a", "1")}).Close())
+
+	// The version is the last byte of its big-endian footer field
+	data, err := os.ReadFile(sstPath)
+	require.NoError(t, err)
+	data[len(data)-sstable.MagicSize-1] = 99
+	require.NoError(t, os.WriteFile(sstPath, data, 0644))
+
+	_, err = sstable.NewReader(sstPath)
+	assert.ErrorIs(t, err, gerrors.ErrUnsupportedVersion)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+	assert.NotErrorIs(t, err, gerrors.ErrBadMagic)
+
+	// Tables older than the oldest readable format are refused by name
+	data[len(data)-sstable.MagicSize-1] = 3
+	require.NoError(t, os.WriteFile(sstPath, data, 0644))
+	_, err = sstable.NewReader(sstPath)
+	assert.ErrorIs(t, err, gerrors.ErrUnsupportedVersion)
+	assert.ErrorContains(t, err, "version 3 is older than the oldest readable version")
+}
+
+func TestReader_RejectsUnknownCompression(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "codec.sst")
+	require.NoError(t, createSST(t, sstPath, []entry{put("a", "1")}).Close())
+
+	// The codec is the last byte of its big-endian footer field
+	data, err := os.ReadFile(sstPath)
+	require.NoError(t, err)
+	data[len(data)-sstable.MagicSize-sstable.VersionSize-1] = 0x7f
+	require.NoError(t, os.WriteFile(sstPath, data, 0644))
+
+	_, err = sstable.NewReader(sstPath)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+
+	_, err = sstable.NewWriterWithOptions(filepath.Join(t.TempDir(), "bad.sst"), sstable.Options{IndexInterval: indexInterval, Compression: 0x7f})
+	assert.Error(t, err)
+}
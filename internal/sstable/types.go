@@ -1,17 +1,177 @@
 package sstable
 
+import (
+	"bytes"
+
+	"github.com/MikhailWahib/graveldb/internal/blob"
+	"github.com/MikhailWahib/graveldb/internal/storage"
+)
+
 // File format constants for SSTable
 const (
 	// IndexOffsetSize is the size in bytes of the index offset field
 	IndexOffsetSize = 8
 	// IndexSizeSize is the size in bytes of the index size field
 	IndexSizeSize = 8
+	// MetaSizeSize is the size in bytes of the meta section size field
+	MetaSizeSize = 8
+	// EntryCountSize is the size in bytes of the entry count field
+	EntryCountSize = 8
+	// CompressionSize is the size in bytes of the block codec field
+	CompressionSize = 4
+	// VersionSize is the size in bytes of the format version field
+	VersionSize = 4
+	// MagicSize is the size in bytes of the magic number field
+	MagicSize = 4
 	// FooterSize is the total size of the SSTable footer
-	FooterSize = IndexOffsetSize + IndexSizeSize
+	FooterSize = IndexOffsetSize + IndexSizeSize + MetaSizeSize + EntryCountSize + CompressionSize + VersionSize + MagicSize
+)
+
+const (
+	// Magic marks the end of a completely written SSTable
+	Magic uint32 = 0x47525654 // "GRVT"
+	// Version is the SSTable format version written by this package.
+	// Version 2 added the meta section, with its size in the footer;
+	// version 3 added a CRC32 checksum to every entry; version 4 added
+	// block compression, with block sizes in the index and the codec in
+	// the footer; version 5 stores each key in a data block as the length
+	// of the prefix it shares with the previous key and the rest of the key;
+	// version 6 added blob entries, whose value points into a blob file.
+	Version uint32 = 6
+
+	// oldestVersion is the oldest format version readers still accept
+	oldestVersion uint32 = 4
 )
 
-// IndexEntry represents an entry in the sparse index
+// Compression selects the codec applied to data blocks.
+type Compression uint8
+
+const (
+	// NoCompression stores data blocks as is.
+	NoCompression Compression = iota
+	// SnappyCompression compresses each data block with Snappy.
+	SnappyCompression
+)
+
+// TempSuffix is appended to an SSTable's path while it is being written. The
+// file is renamed to its final path only once it is complete and synced, so
+// files with this suffix are leftovers of an interrupted write.
+const TempSuffix = ".tmp"
+
+// Names of records in the meta section, which sits between the index and the
+// footer. Readers ignore records they do not recognize.
+const (
+	metaPrefixFilter = "filter.prefix"
+	metaKeyFilter    = "filter.key"
+	metaMaxSeq       = "seq.max"
+	metaMaxKey       = "key.max"
+	metaRangeDels    = "rangedel"
+	// metaIndexInterval and metaIndexEntries describe how the table was
+	// written: its entries per data block and its number of index entries
+	metaIndexInterval = "index.interval"
+	metaIndexEntries  = "index.entries"
+)
+
+// prefixBloomBitsPerKey is the size of the prefix filter per distinct prefix
+const prefixBloomBitsPerKey = 10
+
+// blockHandleSize is the size of the offset and sizes stored after each key
+// in the index
+const blockHandleSize = 24
+
+// Properties describe how a table was written, as recorded in its footer
+// and meta section.
+type Properties struct {
+	// IndexInterval is the number of entries per data block the table was
+	// written with, or 0 for tables written before it was recorded
+	IndexInterval int
+	// IndexEntries is the number of index entries, one per data block
+	IndexEntries int
+	// Entries is the number of entries in the table, tombstones included
+	Entries uint64
+	// Compression is the codec applied to the data blocks
+	Compression Compression
+	// Version is the format version the table was written in
+	Version uint32
+}
+
+// IndexEntry represents an entry in the sparse index. Each entry describes
+// one data block: the first key in it, where it starts, its size on disk and
+// its size once decompressed.
 type IndexEntry struct {
-	Key    []byte
-	Offset int64
+	Key     []byte
+	Offset  int64
+	Size    int64
+	RawSize int64
+}
+
+// Options configures SSTable readers and writers.
+type Options struct {
+	// IndexInterval is the most entries per data block and sparse index
+	// entry; values below 1 mean 1. Large values mean a smaller index
+	// but longer block reads and scans per lookup (writers only)
+	IndexInterval int
+	// BlockSize, if positive, also ends a data block once its entries take
+	// up BlockSize bytes before compression, so blocks of large entries
+	// stay small and blocks of small ones can be made large enough to
+	// compress well by raising IndexInterval (writers only)
+	BlockSize int
+	// IORetry is the retry policy for transient disk errors
+	IORetry storage.RetryPolicy
+	// PrefixExtractor, if set, selects the key prefix recorded in the
+	// prefix filter (writers only)
+	PrefixExtractor func(key []byte) []byte
+	// StrictInvariants makes writers reject keys that are not strictly
+	// increasing and readers reject indexes that are out of order
+	StrictInvariants bool
+	// BloomBitsPerKey sizes the Bloom filter of keys consulted by Get and
+	// GetMulti; 0 writes no filter (writers only)
+	BloomBitsPerKey int
+	// Compression is the codec applied to data blocks (writers only;
+	// readers use the codec recorded in the footer)
+	Compression Compression
+	// BlockCache, if set, caches the data blocks read by point lookups.
+	// It may be shared by any number of readers (readers only)
+	BlockCache *BlockCache
+	// Comparator orders keys; nil means bytes.Compare. A table must be
+	// read with the comparator it was written with
+	Comparator func(a, b []byte) int
+	// MaxKeySize and MaxValueSize reject entries with longer keys or values
+	// with errors.ErrEntryTooLarge; 0 means no limit (writers only)
+	MaxKeySize   int
+	MaxValueSize int
+	// Blobs, if set, holds the values of puts longer than ValueThreshold
+	// bytes, which writers append to it and store a pointer to instead.
+	// Readers of tables holding such pointers need it to resolve them
+	Blobs *blob.Store
+	// ValueThreshold is the longest value kept in the table itself when
+	// Blobs is set; 0 keeps every value in the table (writers only)
+	ValueThreshold int
+	// VerifyOnOpen makes opening a table run Verify and fail if it finds
+	// damage, instead of checking only the entries later read (readers
+	// only)
+	VerifyOnOpen bool
+	// FS holds the table files; nil means the operating system's
+	FS storage.FS
+}
+
+// comparator returns the key order set in o.
+func (o Options) comparator() func(a, b []byte) int {
+	if o.Comparator == nil {
+		return bytes.Compare
+	}
+	return o.Comparator
+}
+
+// knownCompression reports whether c is a codec this package can read and write.
+func knownCompression(c Compression) bool {
+	return c == NoCompression || c == SnappyCompression
+}
+
+// wrapFile applies the retry policy in opts to f.
+func (o Options) wrapFile(f storage.File) storage.File {
+	if o.IORetry.MaxAttempts <= 1 {
+		return f
+	}
+	return storage.NewRetryFile(f, o.IORetry)
 }
@@ -0,0 +1,113 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+)
+
+// Verify checks the whole table for damage. It rereads the footer and
+// checks it still matches the file, then reads every data block and checks
+// that the blocks tile the data section in index order, that each index key
+// is the first key of its block, that every entry decodes with a valid
+// checksum, and that keys never decrease. The first problem found is
+// returned as a corruption error; a healthy table returns nil.
+//
+// Verify bypasses the block cache and reads the entire data section, so it
+// is meant for offline checks rather than the read path.
+func (r *Reader) Verify() error {
+	if err := r.verifyFooter(); err != nil {
+		return err
+	}
+
+	var (
+		next    int64
+		count   uint64
+		lastKey []byte
+	)
+	for pos, handle := range r.index {
+		if handle.Offset != next {
+			return gerrors.Corruption(fmt.Sprintf("block %d starts at offset %d, want %d", pos, handle.Offset, next), nil)
+		}
+		next = handle.Offset + handle.Size
+
+		block, err := r.readBlock(pos)
+		if err != nil {
+			return gerrors.Corruption(fmt.Sprintf("failed to read block %d", pos), err)
+		}
+		if r.compression == NoCompression && int64(len(block)) != handle.RawSize {
+			return gerrors.Corruption(fmt.Sprintf("block %d is %d bytes, index says %d", pos, len(block), handle.RawSize), nil)
+		}
+		if len(block) == 0 {
+			return gerrors.Corruption(fmt.Sprintf("block %d is empty", pos), nil)
+		}
+
+		var prev []byte
+		for offset := 0; offset < len(block); {
+			entry, n, err := r.decodeEntry(block[offset:], prev)
+			if err != nil {
+				return gerrors.Corruption(fmt.Sprintf("bad entry in block %d at offset %d", pos, offset), err)
+			}
+			if offset == 0 && !bytes.Equal(entry.Key, handle.Key) {
+				return gerrors.Corruption(fmt.Sprintf("block %d starts with key %q, index says %q", pos, entry.Key, handle.Key), nil)
+			}
+			if lastKey != nil && r.cmp(entry.Key, lastKey) < 0 {
+				return gerrors.Corruption(fmt.Sprintf("key %q in block %d sorts before %q", entry.Key, pos, lastKey), nil)
+			}
+			lastKey, prev = entry.Key, entry.Key
+			count++
+			offset += n
+		}
+	}
+
+	if next != r.indexBase {
+		return gerrors.Corruption(fmt.Sprintf("data blocks end at offset %d, index starts at %d", next, r.indexBase), nil)
+	}
+	if count != r.count {
+		return gerrors.Corruption(fmt.Sprintf("table has %d entries, footer says %d", count, r.count), nil)
+	}
+	if lastKey != nil && !bytes.Equal(lastKey, r.maxKey) {
+		return gerrors.Corruption(fmt.Sprintf("last key %q does not match recorded max key %q", lastKey, r.maxKey), nil)
+	}
+	return nil
+}
+
+// verifyFooter rereads the footer and checks that it still describes the
+// file as it was when the reader was opened.
+func (r *Reader) verifyFooter() error {
+	stat, err := r.file.Stat()
+	if err != nil {
+		return gerrors.IO("failed to stat SST file", err)
+	}
+	size := stat.Size()
+	if size != r.size {
+		return gerrors.Corruption(fmt.Sprintf("SST file is %d bytes, was %d when opened", size, r.size), nil)
+	}
+	if size == 0 {
+		return nil
+	}
+
+	footerOffset := size - FooterSize
+	footer := make([]byte, FooterSize)
+	if _, err := io.ReadFull(io.NewSectionReader(r.file, footerOffset, FooterSize), footer); err != nil {
+		return gerrors.IO("failed to read footer", err)
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer[0:IndexOffsetSize]))
+	pos := IndexOffsetSize
+	indexSize := int64(binary.BigEndian.Uint64(footer[pos : pos+IndexSizeSize]))
+	pos += IndexSizeSize
+	metaSize := int64(binary.BigEndian.Uint64(footer[pos : pos+MetaSizeSize]))
+	pos += MetaSizeSize
+	entryCount := binary.BigEndian.Uint64(footer[pos : pos+EntryCountSize])
+
+	if indexOffset != r.indexBase || entryCount != r.count {
+		return gerrors.Corruption("SST footer changed since the table was opened", nil)
+	}
+	if indexOffset < 0 || indexSize < 0 || metaSize < 0 || indexOffset+indexSize+metaSize != footerOffset {
+		return gerrors.Corruption("SST footer does not match file size", nil)
+	}
+	return nil
+}
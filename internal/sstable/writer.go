@@ -3,39 +3,116 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/MikhailWahib/graveldb/internal/blob"
+	"github.com/MikhailWahib/graveldb/internal/bloom"
 	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
 
 	"github.com/MikhailWahib/graveldb/internal/storage"
+	"github.com/golang/snappy"
 )
 
 // Writer provides functionality to write to an SSTable
 type Writer struct {
-	file          *os.File
+	file          storage.File
 	path          string
 	index         []IndexEntry
 	offset        int64
 	indexSize     int64
-	count         int // tracks number of entries for sparse indexing
+	count         int    // tracks number of entries for sparse indexing
+	blockEntries  int    // entries in the data block being built
+	maxSeq        uint64 // highest sequence number written
 	finished      bool
+	closed        bool
 	indexInterval int
+	blockSize     int
+
+	// block buffers the entries of the data block being built; blockKey is
+	// its first key
+	block       []byte
+	blockKey    []byte
+	compression Compression
+
+	prefixExtractor func(key []byte) []byte
+	prefixFilter    *bloom.Builder
+	lastPrefix      []byte
+
+	keyFilter       *bloom.Builder
+	bloomBitsPerKey int
+
+	strict  bool
+	lastKey []byte
+	lastSeq uint64
+	cmp     func(a, b []byte) int
+
+	maxKeySize   int
+	maxValueSize int
+
+	// version is the format written; before version 5, keys in data
+	// blocks are stored in full
+	version uint32
+
+	rangeDels []storage.Entry
+
+	// blobs receives values longer than valueThreshold; wroteBlobs is set
+	// once one has been appended, so Finish syncs it before the table
+	blobs          *blob.Store
+	valueThreshold int
+	wroteBlobs     bool
+
+	fs storage.FS
 }
 
-// NewWriter creates a new SSTable writer
+// NewWriter creates a new SSTable writer with indexInterval entries per
+// data block. A non-positive indexInterval is treated as 1.
 func NewWriter(path string, indexInterval int) (*Writer, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	return NewWriterWithOptions(path, Options{IndexInterval: indexInterval})
+}
+
+// NewWriterWithOptions creates a new SSTable writer configured by opts.
+// The table is written to path+TempSuffix and only appears at path once
+// Close succeeds. An IndexInterval below 1 is treated as 1.
+func NewWriterWithOptions(path string, opts Options) (*Writer, error) {
+	if !knownCompression(opts.Compression) {
+		return nil, gerrors.Internal(fmt.Sprintf("unknown SSTable compression %d", opts.Compression), nil)
+	}
+
+	fs := storage.OrOS(opts.FS)
+	file, err := fs.OpenFile(path+TempSuffix, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, gerrors.IO("failed to create SSTable", err)
 	}
 
-	return &Writer{
-		file:          file,
-		path:          path,
-		index:         make([]IndexEntry, 0),
-		indexInterval: indexInterval,
-	}, nil
+	w := &Writer{
+		file:            opts.wrapFile(file),
+		path:            path,
+		fs:              fs,
+		index:           make([]IndexEntry, 0),
+		indexInterval:   max(opts.IndexInterval, 1),
+		blockSize:       opts.BlockSize,
+		compression:     opts.Compression,
+		prefixExtractor: opts.PrefixExtractor,
+		strict:          opts.StrictInvariants,
+		bloomBitsPerKey: opts.BloomBitsPerKey,
+		cmp:             opts.comparator(),
+		maxKeySize:      opts.MaxKeySize,
+		maxValueSize:    opts.MaxValueSize,
+		version:         Version,
+		blobs:           opts.Blobs,
+		valueThreshold:  opts.ValueThreshold,
+	}
+	if w.prefixExtractor != nil {
+		w.prefixFilter = bloom.NewBuilder()
+	}
+	if w.bloomBitsPerKey > 0 {
+		w.keyFilter = bloom.NewBuilder()
+	}
+	return w, nil
 }
 
 // PutEntry writes a key-value pair to the SSTable
@@ -50,6 +127,39 @@ func (w *Writer) PutEntry(key, value []byte) error {
 	})
 }
 
+// Add writes entry, a put or a tombstone, keeping its expiry and sequence
+// number. A blob entry, a pointer read from another table, is written as it
+// is, without copying the value it points to.
+func (w *Writer) Add(entry storage.Entry) error {
+	if w.finished {
+		return gerrors.Internal("cannot write to finished SSTable", nil)
+	}
+	if entry.Type == storage.DeleteEntry {
+		entry.Value = nil
+	}
+	return w.writeEntry(entry)
+}
+
+// AddRangeTombstone records entry, a range tombstone, in the table. Range
+// tombstones are kept in the meta section rather than among the keys, and
+// may be added in any order before the table is finished.
+func (w *Writer) AddRangeTombstone(entry storage.Entry) error {
+	if w.finished {
+		return gerrors.Internal("cannot write to finished SSTable", nil)
+	}
+	if entry.Type != storage.RangeDeleteEntry {
+		return gerrors.Internal(fmt.Sprintf("entry type %d is not a range tombstone", entry.Type), nil)
+	}
+	w.rangeDels = append(w.rangeDels, storage.Entry{
+		Type:  storage.RangeDeleteEntry,
+		Key:   bytes.Clone(entry.Key),
+		Value: bytes.Clone(entry.Value),
+		Seq:   entry.Seq,
+	})
+	w.maxSeq = max(w.maxSeq, entry.Seq)
+	return nil
+}
+
 // DeleteEntry writes a deletion marker for a key to the SSTable
 func (w *Writer) DeleteEntry(key []byte) error {
 	if w.finished {
@@ -64,19 +174,87 @@ func (w *Writer) DeleteEntry(key []byte) error {
 
 // writeEntry writes a key-value pair to the data section
 func (w *Writer) writeEntry(entry storage.Entry) error {
-	entryOffset := w.offset
-
-	// Write the entry prefixed with type byte and k,v
-	n, err := storage.WriteEntryAt(entry, w.file, w.offset)
-	if err != nil {
+	if err := storage.CheckEntrySize(entry, w.maxKeySize, w.maxValueSize); err != nil {
 		return err
 	}
-	w.offset = n
+	// A key may repeat, for tables keeping several versions of it, as long
+	// as each version is older than the one before
+	sameKey := w.count > 0 && w.cmp(entry.Key, w.lastKey) == 0
+	if w.strict && w.count > 0 && (w.cmp(entry.Key, w.lastKey) < 0 || sameKey && entry.Seq >= w.lastSeq) {
+		return gerrors.Invariant(fmt.Sprintf("SSTable key %q (seq %d) written after %q (seq %d)", entry.Key, entry.Seq, w.lastKey, w.lastSeq), nil)
+	}
+	if entry.Type == storage.PutEntry && w.blobs != nil && w.valueThreshold > 0 && len(entry.Value) > w.valueThreshold {
+		ptr, err := w.blobs.Append(entry.Value)
+		if err != nil {
+			return err
+		}
+		entry.Type, entry.Value = storage.BlobEntry, ptr
+		w.wroteBlobs = true
+	}
 
-	if w.count%w.indexInterval == 0 {
-		w.index = append(w.index, IndexEntry{Key: entry.Key, Offset: entryOffset})
+	// A data block ends after indexInterval entries or blockSize bytes,
+	// but the versions of a key stay in one block so a lookup finds them
+	// all
+	shared := 0
+	full := w.blockEntries >= w.indexInterval || w.blockSize > 0 && len(w.block) >= w.blockSize
+	if w.count == 0 || full && !sameKey {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+		w.blockKey = bytes.Clone(entry.Key)
+		w.blockEntries = 0
+	} else {
+		// Keys share prefixes only with earlier keys in the same block, so
+		// each block decodes on its own
+		shared = storage.SharedPrefixLen(w.lastKey, entry.Key)
 	}
+	if w.version < 5 {
+		w.block = append(w.block, storage.SerializeEntry(entry)...)
+	} else {
+		w.block = storage.AppendBlockEntry(w.block, entry, shared)
+	}
+	w.lastKey = append(w.lastKey[:0], entry.Key...)
+	w.lastSeq = entry.Seq
 	w.count++
+	w.blockEntries++
+	w.maxSeq = max(w.maxSeq, entry.Seq)
+
+	if w.keyFilter != nil {
+		w.keyFilter.Add(entry.Key)
+	}
+	if w.prefixFilter != nil {
+		// Keys arrive sorted, so equal prefixes are adjacent
+		if prefix := w.prefixExtractor(entry.Key); prefix != nil && (w.lastPrefix == nil || !bytes.Equal(prefix, w.lastPrefix)) {
+			w.prefixFilter.Add(prefix)
+			w.lastPrefix = bytes.Clone(prefix)
+		}
+	}
+	return nil
+}
+
+// flushBlock compresses the buffered data block, writes it to the data
+// section and records it in the index
+func (w *Writer) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	data := w.block
+	if w.compression == SnappyCompression {
+		data = snappy.Encode(nil, w.block)
+	}
+	if _, err := w.file.WriteAt(data, w.offset); err != nil {
+		return gerrors.IO("failed to write data block", err)
+	}
+
+	w.index = append(w.index, IndexEntry{
+		Key:     w.blockKey,
+		Offset:  w.offset,
+		Size:    int64(len(data)),
+		RawSize: int64(len(w.block)),
+	})
+	w.offset += int64(len(data))
+	w.block = w.block[:0]
 	return nil
 }
 
@@ -97,14 +275,16 @@ func (w *Writer) writeIndex() error {
 		}
 		w.offset = newOffset
 
-		// Write offset
-		offsetBytes := make([]byte, 8)
-		binary.BigEndian.PutUint64(offsetBytes, uint64(entry.Offset))
-		_, err = w.file.WriteAt(offsetBytes, w.offset)
+		// Write the block's offset, size on disk and decompressed size
+		handle := make([]byte, blockHandleSize)
+		binary.BigEndian.PutUint64(handle[0:8], uint64(entry.Offset))
+		binary.BigEndian.PutUint64(handle[8:16], uint64(entry.Size))
+		binary.BigEndian.PutUint64(handle[16:24], uint64(entry.RawSize))
+		_, err = w.file.WriteAt(handle, w.offset)
 		if err != nil {
 			return err
 		}
-		w.offset += 8
+		w.offset += blockHandleSize
 	}
 
 	// Calculate actual index size
@@ -112,33 +292,134 @@ func (w *Writer) writeIndex() error {
 	return nil
 }
 
-// Finish finalizes the SSTable and closes the file
+// writeMeta writes the named metadata records that follow the index
+func (w *Writer) writeMeta() (int64, error) {
+	metaStartOffset := w.offset
+
+	var records []storage.Entry
+	if w.prefixFilter != nil {
+		records = append(records, storage.Entry{
+			Type:  storage.MetaEntry,
+			Key:   []byte(metaPrefixFilter),
+			Value: w.prefixFilter.Build(prefixBloomBitsPerKey),
+		})
+	}
+	if w.keyFilter != nil {
+		records = append(records, storage.Entry{
+			Type:  storage.MetaEntry,
+			Key:   []byte(metaKeyFilter),
+			Value: w.keyFilter.Build(w.bloomBitsPerKey),
+		})
+	}
+
+	if w.count > 0 {
+		records = append(records, storage.Entry{
+			Type:  storage.MetaEntry,
+			Key:   []byte(metaMaxKey),
+			Value: w.lastKey,
+		})
+	}
+	if len(w.rangeDels) > 0 {
+		var value []byte
+		for _, entry := range w.rangeDels {
+			value = append(value, storage.SerializeEntry(entry)...)
+		}
+		records = append(records, storage.Entry{
+			Type:  storage.MetaEntry,
+			Key:   []byte(metaRangeDels),
+			Value: value,
+		})
+	}
+	if w.maxSeq > 0 {
+		records = append(records, storage.Entry{
+			Type:  storage.MetaEntry,
+			Key:   []byte(metaMaxSeq),
+			Value: binary.BigEndian.AppendUint64(nil, w.maxSeq),
+		})
+	}
+	records = append(records,
+		storage.Entry{
+			Type:  storage.MetaEntry,
+			Key:   []byte(metaIndexInterval),
+			Value: binary.BigEndian.AppendUint64(nil, uint64(w.indexInterval)),
+		},
+		storage.Entry{
+			Type:  storage.MetaEntry,
+			Key:   []byte(metaIndexEntries),
+			Value: binary.BigEndian.AppendUint64(nil, uint64(len(w.index))),
+		},
+	)
+
+	for _, record := range records {
+		newOffset, err := storage.WriteEntryAt(record, w.file, w.offset)
+		if err != nil {
+			return 0, err
+		}
+		w.offset = newOffset
+	}
+
+	return w.offset - metaStartOffset, nil
+}
+
+// Finish writes the index, meta section and footer and syncs the file.
+// The table is not visible at its final path until Close.
 func (w *Writer) Finish() error {
 	if w.finished {
 		return nil // already finished
 	}
 
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+
 	// Write the index section to the file
 	indexOffset := w.offset // The current offset will be the start of the index section
 	if err := w.writeIndex(); err != nil {
 		return gerrors.IO("failed to write index", err)
 	}
 
+	metaSize, err := w.writeMeta()
+	if err != nil {
+		return gerrors.IO("failed to write meta section", err)
+	}
+
 	// Write the footer section at the end of the file
 	// The footer contains:
 	// - The offset of the index section
 	// - The size of the index section
+	// - The size of the meta section, which follows the index
+	// - The number of entries in the data section
+	// - The codec used for data blocks
+	// - The format version
+	// - The magic number
 	footer := make([]byte, FooterSize)
-	binary.BigEndian.PutUint64(footer[:IndexOffsetSize], uint64(indexOffset))
-	binary.BigEndian.PutUint64(footer[IndexOffsetSize:], uint64(w.indexSize))
+	pos := 0
+	binary.BigEndian.PutUint64(footer[pos:pos+IndexOffsetSize], uint64(indexOffset))
+	pos += IndexOffsetSize
+	binary.BigEndian.PutUint64(footer[pos:pos+IndexSizeSize], uint64(w.indexSize))
+	pos += IndexSizeSize
+	binary.BigEndian.PutUint64(footer[pos:pos+MetaSizeSize], uint64(metaSize))
+	pos += MetaSizeSize
+	binary.BigEndian.PutUint64(footer[pos:pos+EntryCountSize], uint64(w.count))
+	pos += EntryCountSize
+	binary.BigEndian.PutUint32(footer[pos:pos+CompressionSize], uint32(w.compression))
+	pos += CompressionSize
+	binary.BigEndian.PutUint32(footer[pos:pos+VersionSize], w.version)
+	pos += VersionSize
+	binary.BigEndian.PutUint32(footer[pos:pos+MagicSize], Magic)
 
-	_, err := w.file.WriteAt(footer, w.offset)
-	if err != nil {
+	if _, err := w.file.WriteAt(footer, w.offset); err != nil {
 		return gerrors.IO("failed to write footer", err)
 	}
 
 	w.offset += FooterSize
 
+	// The values the table points to must be durable before it is
+	if w.wroteBlobs {
+		if err := w.blobs.Sync(); err != nil {
+			return err
+		}
+	}
 	if err := w.file.Sync(); err != nil {
 		return gerrors.IO("failed to sync file", err)
 	}
@@ -147,23 +428,64 @@ func (w *Writer) Finish() error {
 	return nil
 }
 
-// Close closes the underlying file
+// Close finishes the SSTable if needed, closes the file and atomically
+// renames it to its final path. On error the temporary file is removed and
+// nothing is left at the final path.
 func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+
 	if !w.finished {
 		if err := w.Finish(); err != nil {
-			_ = w.file.Close()
+			_ = w.Abort()
 			return err
 		}
 	}
-	return w.file.Close()
+
+	w.closed = true
+	if err := w.file.Close(); err != nil {
+		_ = w.fs.Remove(w.path + TempSuffix)
+		return gerrors.IO("failed to close SSTable", err)
+	}
+	if err := w.fs.Rename(w.path+TempSuffix, w.path); err != nil {
+		_ = w.fs.Remove(w.path + TempSuffix)
+		return gerrors.IO("failed to rename SSTable into place", err)
+	}
+	if err := w.fs.SyncDir(filepath.Dir(w.path)); err != nil {
+		return gerrors.IO("failed to sync SSTable directory", err)
+	}
+	return nil
 }
 
-// Delete removes the SSTable file from disk
+// Abort discards an unfinished SSTable after a failed write: it closes the
+// file and removes it without renaming it into place, so nothing is left
+// at the final path. It fails for a table already closed.
+func (w *Writer) Abort() error {
+	if w.closed {
+		return gerrors.Internal("cannot abort a closed SSTable", nil)
+	}
+	w.finished, w.closed = true, true
+	_ = w.file.Close()
+	if err := w.fs.Remove(w.path + TempSuffix); err != nil {
+		return gerrors.IO("failed to remove unfinished SSTable", err)
+	}
+	return nil
+}
+
+// Delete discards the SSTable: an unclosed table is aborted, and a closed
+// table's file is removed.
 func (w *Writer) Delete() error {
-	if err := w.Close(); err != nil {
-		return err
+	if w.closed {
+		return w.fs.Remove(w.path)
 	}
-	return os.Remove(w.path)
+	return w.Abort()
+}
+
+// Size returns the number of bytes written so far, including the data block
+// still being built.
+func (w *Writer) Size() int64 {
+	return w.offset + int64(len(w.block))
 }
 
 // Path returns the SSTable file path
@@ -8,3 +8,32 @@ const LengthSize = 4
 
 // PrefixSize is the total size of entry metadata (type + key length + value length)
 const PrefixSize = EntryTypeSize + (2 * LengthSize) // 9 bytes
+
+// MaxEntryLength is the hard limit on the combined key and value length of
+// an entry read from a file. Longer lengths can only come from corruption
+// and are rejected before anything is allocated for them.
+const MaxEntryLength = 1 << 30
+
+// ChecksumSize is the size in bytes of the CRC32 checksum that ends every entry
+const ChecksumSize = 4
+
+// ExpirySize is the size in bytes of the expiry timestamp stored at the start
+// of the value of an entry whose type byte has ExpiryFlag set, after the
+// sequence number if there is one
+const ExpirySize = 8
+
+// ExpiryFlag is set in the type byte of an encoded entry that carries an
+// expiry timestamp. Entries without one are encoded without the field.
+const ExpiryFlag = 0x80
+
+// SeqSize is the size in bytes of the sequence number stored at the start of
+// the value of an entry whose type byte has SeqFlag set
+const SeqSize = 8
+
+// SeqFlag is set in the type byte of an encoded entry that carries a
+// sequence number. Entries written before sequence numbers existed have
+// none and decode with Seq 0.
+const SeqFlag = 0x40
+
+// typeFlags are the bits of the type byte that are not part of the EntryType
+const typeFlags = ExpiryFlag | SeqFlag
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// File is the subset of *os.File used for positional reads and writes of data files.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// RetryPolicy controls how transient disk errors are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// A value of 1 disables retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry; it doubles after each attempt.
+	Backoff time.Duration
+}
+
+// RetryFile wraps a File and retries ReadAt, WriteAt and Sync when they fail
+// with a transient error. Positional reads and writes are idempotent, so a
+// failed attempt can safely be repeated in full.
+type RetryFile struct {
+	File
+	policy RetryPolicy
+}
+
+// NewRetryFile wraps f with the given retry policy.
+func NewRetryFile(f File, policy RetryPolicy) *RetryFile {
+	return &RetryFile{File: f, policy: policy}
+}
+
+// ReadAt reads len(p) bytes at off, retrying transient errors.
+func (f *RetryFile) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	err := f.policy.Do(func() error {
+		var err error
+		n, err = f.File.ReadAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// WriteAt writes p at off, retrying transient errors.
+func (f *RetryFile) WriteAt(p []byte, off int64) (int, error) {
+	var n int
+	err := f.policy.Do(func() error {
+		var err error
+		n, err = f.File.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// Sync commits the file to stable storage, retrying transient errors.
+func (f *RetryFile) Sync() error {
+	return f.policy.Do(f.File.Sync)
+}
+
+// Do runs op, running it again after a backoff while it fails with a
+// transient error, up to MaxAttempts times in all.
+func (p RetryPolicy) Do(op func() error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !isTransient(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether err may clear up if the operation is retried.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ENOSPC)
+}
+
+// SyncDir fsyncs a directory so that entries created, renamed or removed in
+// it survive a crash.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
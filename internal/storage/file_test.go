@@ -0,0 +1,88 @@
+package storage_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/MikhailWahib/graveldb/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyFile fails WriteAt with err for the first failures calls.
+type flakyFile struct {
+	*os.File
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyFile) WriteAt(p []byte, off int64) (int, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return 0, f.err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func openFlaky(t *testing.T, failures int, err error) *flakyFile {
+	f, openErr := os.OpenFile(filepath.Join(t.TempDir(), "flaky.db"), os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(t, openErr)
+	t.Cleanup(func() { _ = f.Close() })
+	return &flakyFile{File: f, failures: failures, err: err}
+}
+
+func TestRetryFile_RetriesTransientErrors(t *testing.T) {
+	flaky := openFlaky(t, 2, &os.PathError{Op: "write", Err: syscall.EAGAIN})
+	f := storage.NewRetryFile(flaky, storage.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	e := storage.Entry{Type: storage.PutEntry, Key: []byte("k"), Value: []byte("v")}
+	_, err := storage.WriteEntryAt(e, f, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, flaky.calls)
+
+	got, _, err := storage.ReadEntryAt(f, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), got.Value)
+}
+
+func TestRetryFile_GivesUp(t *testing.T) {
+	flaky := openFlaky(t, 5, syscall.ENOSPC)
+	f := storage.NewRetryFile(flaky, storage.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	_, err := f.WriteAt([]byte("data"), 0)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, 3, flaky.calls)
+}
+
+func TestRetryFile_DoesNotRetryPermanentErrors(t *testing.T) {
+	permanent := errors.New("permanent")
+	flaky := openFlaky(t, 1, permanent)
+	f := storage.NewRetryFile(flaky, storage.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	_, err := f.WriteAt([]byte("data"), 0)
+	assert.ErrorIs(t, err, permanent)
+	assert.Equal(t, 1, flaky.calls)
+}
+
+func TestSyncDir(t *testing.T) {
+	dir := t.TempDir()
+	tmp, path := filepath.Join(dir, "table.tmp"), filepath.Join(dir, "table")
+	require.NoError(t, os.WriteFile(tmp, []byte("data"), 0644))
+	require.NoError(t, os.Rename(tmp, path))
+	require.NoError(t, storage.SyncDir(dir))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "table", entries[0].Name())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	assert.Error(t, storage.SyncDir(filepath.Join(dir, "missing")))
+}
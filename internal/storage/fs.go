@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// FS is the file system holding a database's files: OSFS for files on
+// disk, MemFS for a database that lives only in memory.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (FSFile, error)
+	ReadDir(dir string) ([]os.DirEntry, error)
+	MkdirAll(dir string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	// SyncDir makes the entries created, renamed or removed in dir durable
+	SyncDir(dir string) error
+}
+
+// FSFile is a file opened through an FS.
+type FSFile interface {
+	File
+	io.Reader
+	io.Writer
+	Name() string
+	Truncate(size int64) error
+}
+
+// Open opens name in fs for reading.
+func Open(fs FS, name string) (FSFile, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// ReadFile returns the contents of name in fs.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := Open(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return io.ReadAll(f)
+}
+
+// OrOS returns fs, or OSFS if fs is nil.
+func OrOS(fs FS) FS {
+	if fs == nil {
+		return OSFS{}
+	}
+	return fs
+}
+
+// OSFS is the FS of the operating system.
+type OSFS struct{}
+
+// OpenFile opens name with os.OpenFile.
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Avoid returning a non-nil interface holding a nil *os.File
+		return nil, err
+	}
+	return f, nil
+}
+
+// ReadDir lists dir with os.ReadDir.
+func (OSFS) ReadDir(dir string) ([]os.DirEntry, error) {
+	return os.ReadDir(dir)
+}
+
+// MkdirAll creates dir with os.MkdirAll.
+func (OSFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+// Stat describes name with os.Stat.
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Remove removes name with os.Remove.
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Rename renames oldpath with os.Rename.
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Link hard links newname to oldname with os.Link.
+func (OSFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// SyncDir fsyncs dir.
+func (OSFS) SyncDir(dir string) error {
+	return SyncDir(dir)
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemFS is an FS that keeps files in memory, for databases that never touch
+// the disk. Its contents are lost with it. Errors wrap the same fs.Err*
+// values as the os package, so os.IsNotExist and os.IsExist work. A MemFS is
+// safe for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+// memData is the contents of a file, shared by its hard links.
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFS returns an empty MemFS holding only the root directory.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{string(filepath.Separator): true, ".": true},
+	}
+}
+
+// OpenFile opens name, creating it if flag has os.O_CREATE. Its directory
+// must exist.
+func (m *MemFS) OpenFile(name string, flag int, _ os.FileMode) (FSFile, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, fs.ErrExist)
+	case !ok && m.dirs[name]:
+		return nil, pathError("open", name, fs.ErrInvalid)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, fs.ErrNotExist)
+	case !ok:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, pathError("open", name, fs.ErrNotExist)
+		}
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.data, d.modTime = nil, time.Now()
+		d.mu.Unlock()
+	}
+	return &memFile{name: name, d: d, flag: flag}, nil
+}
+
+// ReadDir lists the files and directories directly in dir, sorted by name.
+func (m *MemFS) ReadDir(dir string) ([]os.DirEntry, error) {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[dir] {
+		return nil, pathError("readdir", dir, fs.ErrNotExist)
+	}
+
+	var entries []os.DirEntry
+	for name, d := range m.files {
+		if filepath.Dir(name) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(d.info(name)))
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(name)))
+		}
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// MkdirAll creates dir and any missing parents.
+func (m *MemFS) MkdirAll(dir string, _ os.FileMode) error {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := dir; !m.dirs[p]; p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return pathError("mkdir", p, fs.ErrExist)
+		}
+		m.dirs[p] = true
+	}
+	return nil
+}
+
+// Stat describes the file or directory name.
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.files[name]; ok {
+		return d.info(name), nil
+	}
+	if m.dirs[name] {
+		return dirInfo(name), nil
+	}
+	return nil, pathError("stat", name, fs.ErrNotExist)
+}
+
+// Remove removes a file or an empty directory. Open handles to a removed
+// file keep working.
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+	for p := range m.files {
+		if filepath.Dir(p) == name {
+			return pathError("remove", name, fs.ErrExist)
+		}
+	}
+	for p := range m.dirs {
+		if p != name && filepath.Dir(p) == name {
+			return pathError("remove", name, fs.ErrExist)
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+// Rename moves the file oldpath to newpath, replacing any file there.
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !m.dirs[filepath.Dir(newpath)] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = d
+	return nil
+}
+
+// Link makes newname another name for the file oldname.
+func (m *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[oldname]
+	if !ok || !m.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.files[newname]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	m.files[newname] = d
+	return nil
+}
+
+// SyncDir does nothing: there is nothing to make durable.
+func (m *MemFS) SyncDir(string) error {
+	return nil
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (d *memData) info(name string) os.FileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memInfo{name: filepath.Base(name), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+func dirInfo(name string) os.FileInfo {
+	return memInfo{name: filepath.Base(name), dir: true}
+}
+
+// memInfo describes a MemFS file or directory.
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() any           { return nil }
+
+func (i memInfo) Mode() os.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// memFile is an open MemFS file. Read and Write use and advance its offset;
+// ReadAt and WriteAt do not, and may run concurrently.
+type memFile struct {
+	name   string
+	d      *memData
+	flag   int
+	closed atomic.Bool
+
+	mu     sync.Mutex // guards offset
+	offset int64
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		return 0, pathError("read", f.name, fs.ErrClosed)
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY {
+		return 0, pathError("read", f.name, fs.ErrPermission)
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	off := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		f.d.mu.RLock()
+		off = int64(len(f.d.data))
+		f.d.mu.RUnlock()
+	}
+	n, err := f.writeAt(p, off)
+	f.offset = off + int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		return 0, pathError("write", f.name, fs.ErrClosed)
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, pathError("write", f.name, fs.ErrPermission)
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.data = append(f.d.data, make([]byte, end-int64(len(f.d.data)))...)
+	}
+	copy(f.d.data[off:], p)
+	f.d.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed.Load() {
+		return pathError("truncate", f.name, fs.ErrClosed)
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return pathError("truncate", f.name, fs.ErrPermission)
+	}
+	if size < 0 {
+		return pathError("truncate", f.name, fs.ErrInvalid)
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	if size <= int64(len(f.d.data)) {
+		f.d.data = f.d.data[:size]
+	} else {
+		f.d.data = append(f.d.data, make([]byte, size-int64(len(f.d.data)))...)
+	}
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed.Load() {
+		return pathError("sync", f.name, fs.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed.Load() {
+		return nil, pathError("stat", f.name, fs.ErrClosed)
+	}
+	return f.d.info(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed.Swap(true) {
+		return pathError("close", f.name, fs.ErrClosed)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package storage_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/MikhailWahib/graveldb/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS_Files(t *testing.T) {
+	fs := storage.NewMemFS()
+
+	// Files can only be created in existing directories
+	_, err := fs.OpenFile("/db/a", os.O_CREATE|os.O_RDWR, 0644)
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, fs.MkdirAll("/db/sub", 0755))
+
+	f, err := fs.OpenFile("/db/a", os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("world"), 6)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(buf))
+	n, err := f.ReadAt(buf, 8)
+	assert.Equal(t, 3, n)
+	assert.ErrorIs(t, err, io.EOF)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size())
+	require.NoError(t, f.Close())
+
+	_, err = fs.OpenFile("/db/a", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	assert.True(t, os.IsExist(err))
+
+	// Appends go to the end; reads follow the offset
+	f, err = fs.OpenFile("/db/a", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	data, err := storage.ReadFile(fs, "/db/a")
+	require.NoError(t, err)
+	assert.Equal(t, "hello\x00world!", string(data))
+
+	// A link shares the contents and survives removing the original
+	require.NoError(t, fs.Link("/db/a", "/db/sub/b"))
+	require.NoError(t, fs.Rename("/db/a", "/db/c"))
+	require.NoError(t, fs.Remove("/db/c"))
+	data, err = storage.ReadFile(fs, "/db/sub/b")
+	require.NoError(t, err)
+	assert.Equal(t, "hello\x00world!", string(data))
+	_, err = fs.Stat("/db/a")
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := fs.ReadDir("/db")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "sub", entries[0].Name())
+	assert.True(t, entries[0].IsDir())
+
+	// Directories are only removed once empty
+	assert.Error(t, fs.Remove("/db/sub"))
+	require.NoError(t, fs.Remove("/db/sub/b"))
+	require.NoError(t, fs.Remove("/db/sub"))
+	_, err = fs.ReadDir("/db/sub")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Preallocate reserves size bytes of disk space for f, extending it with
+// zeros, so that later writes within that space neither fragment the file
+// nor update its size. It uses fallocate, falling back to Truncate where
+// the file system does not support it or f is not an operating system
+// file. A file already that large is left alone.
+func Preallocate(f FSFile, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	if osFile, ok := f.(*os.File); ok {
+		err := syscall.Fallocate(int(osFile.Fd()), 0, 0, size)
+		if err == nil || !errors.Is(err, syscall.EOPNOTSUPP) && !errors.Is(err, syscall.ENOSYS) {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+// fallocZeroRange is FALLOC_FL_ZERO_RANGE, which the syscall package does
+// not define.
+const fallocZeroRange = 0x10
+
+// ZeroRange makes f exactly size bytes of zeros, keeping the disk space it
+// already has where the file system allows, so a file can be reused without
+// its old contents showing through or its space being given up and
+// reserved again. It uses fallocate's zero range mode, falling back to
+// truncating f and preallocating it again.
+func ZeroRange(f FSFile, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if osFile, ok := f.(*os.File); ok {
+		if info.Size() > size {
+			if err := f.Truncate(size); err != nil {
+				return err
+			}
+		}
+		err := syscall.Fallocate(int(osFile.Fd()), fallocZeroRange, 0, size)
+		if err == nil || !errors.Is(err, syscall.EOPNOTSUPP) && !errors.Is(err, syscall.ENOSYS) {
+			return err
+		}
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	return Preallocate(f, size)
+}
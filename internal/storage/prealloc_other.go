@@ -0,0 +1,28 @@
+//go:build !linux
+
+package storage
+
+// Preallocate reserves size bytes for f by extending it with zeros, so that
+// later writes within that space do not update its size. Without fallocate,
+// the space may not be reserved on disk. A file already that large is left
+// alone.
+func Preallocate(f FSFile, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// ZeroRange makes f exactly size bytes of zeros, so a file can be reused
+// without its old contents showing through. Without fallocate it truncates
+// f and extends it again.
+func ZeroRange(f FSFile, size int64) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	return Preallocate(f, size)
+}
@@ -10,6 +10,24 @@ const (
 	DeleteEntry
 	// IndexEntry indicates an index record in the SSTable
 	IndexEntry
+	// MetaEntry indicates a named metadata record in the SSTable
+	MetaEntry
+	// BatchEntry indicates a WAL record whose value holds several
+	// serialized entries that must be replayed together or not at all
+	BatchEntry
+	// EditEntry indicates a manifest record whose value lists SSTables
+	// added to and removed from the tiers in one step
+	EditEntry
+	// RangeDeleteEntry indicates a range tombstone: it deletes every key
+	// with Key <= key < Value written before it, or every key from Key up
+	// if Value is empty
+	RangeDeleteEntry
+	// MergeEntry indicates a merge operand, combined with the older value
+	// of its key by the configured merge function when the key is read
+	MergeEntry
+	// BlobEntry indicates a put whose value is kept in a blob file; the
+	// SSTable stores a pointer to it as the entry's value
+	BlobEntry
 )
 
 // Entry represents a database entry to be written to storage
@@ -17,4 +35,23 @@ type Entry struct {
 	Type  EntryType
 	Key   []byte
 	Value []byte
+	// ExpiresAt is when the entry expires, in Unix nanoseconds. Zero means
+	// it never expires.
+	ExpiresAt int64
+	// Seq orders writes to the same key: a higher sequence number is newer.
+	// Zero means the entry predates sequence numbers.
+	Seq uint64
+}
+
+// Expired reports whether the entry has an expiry at or before now, given
+// in Unix nanoseconds.
+func (e Entry) Expired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
+
+// Covers reports whether e is a range tombstone that deletes the version of
+// key written with sequence number seq, with keys ordered by cmp.
+func (e Entry) Covers(cmp func(a, b []byte) int, key []byte, seq uint64) bool {
+	return e.Type == RangeDeleteEntry && seq < e.Seq &&
+		cmp(key, e.Key) >= 0 && (len(e.Value) == 0 || cmp(key, e.Value) < 0)
 }
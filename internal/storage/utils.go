@@ -5,26 +5,23 @@ package storage
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
+	"hash/crc32"
 	"io"
-	"os"
 )
 
+// castagnoli is the CRC32 table used for entry checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // WriteEntryAt writes an entry to the given file at the specified offset using a length-prefixed format.
-// Format: [1 byte EntryType][4 bytes KeyLen][4 bytes ValueLen][Key][Value]
+// Format: [1 byte EntryType][4 bytes KeyLen][4 bytes ValueLen][Key][Value][4 bytes CRC32]
 // If the value is nil or empty, only the key is written with ValueLen set to 0.
-func WriteEntryAt(e Entry, file *os.File, offset int64) (int64, error) {
-	keyLen := len(e.Key)
-	valueLen := len(e.Value)
-
-	buf := make([]byte, PrefixSize+keyLen+valueLen)
-	buf[0] = byte(e.Type)
-	binary.BigEndian.PutUint32(buf[EntryTypeSize:EntryTypeSize+LengthSize], uint32(keyLen))
-	binary.BigEndian.PutUint32(buf[EntryTypeSize+LengthSize:EntryTypeSize+(LengthSize*2)], uint32(valueLen))
-	copy(buf[9:], e.Key)
-	if valueLen > 0 {
-		copy(buf[PrefixSize+keyLen:], e.Value)
-	}
+// An entry with a sequence number or an expiry has SeqFlag or ExpiryFlag set
+// in its type byte and its value prefixed with the 8-byte sequence number
+// followed by the 8-byte expiry, each only if present. ValueLen includes them.
+func WriteEntryAt(e Entry, file io.WriterAt, offset int64) (int64, error) {
+	buf := SerializeEntry(e)
 
 	n, err := file.WriteAt(buf, offset)
 	if err != nil {
@@ -35,66 +32,58 @@ func WriteEntryAt(e Entry, file *os.File, offset int64) (int64, error) {
 }
 
 // ReadEntryAt reads an entry from a file at the given offset using a length-prefixed format.
-// Format: [1 byte EntryType][4 bytes KeyLen][4 bytes ValueLen][Key][Value]
-func ReadEntryAt(f *os.File, offset int64) (Entry, int64, error) {
+// Format: [1 byte EntryType][4 bytes KeyLen][4 bytes ValueLen][Key][Value][4 bytes CRC32]
+// A checksum mismatch is reported as a corruption error matching
+// errors.ErrChecksumMismatch.
+func ReadEntryAt(f io.ReaderAt, offset int64) (Entry, int64, error) {
 	lenBuf := make([]byte, PrefixSize)
 	_, err := f.ReadAt(lenBuf, offset)
 	if err != nil {
 		return Entry{}, 0, err
 	}
 
-	entryType := EntryType(lenBuf[0])
-	keyLen := binary.BigEndian.Uint32(lenBuf[EntryTypeSize : EntryTypeSize+LengthSize])
-	valLen := binary.BigEndian.Uint32(lenBuf[EntryTypeSize+LengthSize : EntryTypeSize+(LengthSize*2)])
-
-	key := make([]byte, keyLen)
-	value := make([]byte, valLen)
-
-	_, err = f.ReadAt(key, offset+PrefixSize)
+	keyLen, valLen := entryLengths(lenBuf)
+	if err := checkEntryLength(keyLen, valLen, MaxEntryLength); err != nil {
+		return Entry{}, 0, err
+	}
+	body := make([]byte, keyLen+valLen+ChecksumSize)
+	_, err = f.ReadAt(body, offset+PrefixSize)
 	if err != nil {
 		return Entry{}, 0, err
 	}
 
-	_, err = f.ReadAt(value, offset+PrefixSize+int64(keyLen))
+	entry, err := verifyEntry(nil, lenBuf, body, keyLen, valLen)
 	if err != nil {
 		return Entry{}, 0, err
 	}
 
-	newOffset := offset + PrefixSize + int64(keyLen) + int64(valLen)
-
-	return Entry{
-		Type:  entryType,
-		Key:   key,
-		Value: value,
-	}, newOffset, nil
+	newOffset := offset + PrefixSize + int64(len(body))
+	return entry, newOffset, nil
 }
 
 // ReadEntryFromReader reads a single entry from a buffered reader using a length-prefixed format.
-func ReadEntryFromReader(r *bufio.Reader) (Entry, error) {
+// An entry whose key and value lengths add up to more than maxLen is
+// reported as corrupt before anything is allocated for it; a maxLen <= 0
+// allows any length up to MaxEntryLength.
+func ReadEntryFromReader(r *bufio.Reader, maxLen int) (Entry, error) {
 	lenBuf := make([]byte, PrefixSize)
 	if _, err := io.ReadFull(r, lenBuf); err != nil {
 		return Entry{}, err
 	}
 
-	entryType := EntryType(lenBuf[0])
-	keyLen := binary.BigEndian.Uint32(lenBuf[EntryTypeSize : EntryTypeSize+LengthSize])
-	valLen := binary.BigEndian.Uint32(lenBuf[EntryTypeSize+LengthSize : EntryTypeSize+(LengthSize*2)])
-
-	key := make([]byte, keyLen)
-	if _, err := io.ReadFull(r, key); err != nil {
+	keyLen, valLen := entryLengths(lenBuf)
+	if maxLen <= 0 || maxLen > MaxEntryLength {
+		maxLen = MaxEntryLength
+	}
+	if err := checkEntryLength(keyLen, valLen, maxLen); err != nil {
 		return Entry{}, err
 	}
-
-	value := make([]byte, valLen)
-	if _, err := io.ReadFull(r, value); err != nil {
+	body := make([]byte, keyLen+valLen+ChecksumSize)
+	if _, err := io.ReadFull(r, body); err != nil {
 		return Entry{}, err
 	}
 
-	return Entry{
-		Type:  entryType,
-		Key:   key,
-		Value: value,
-	}, nil
+	return verifyEntry(nil, lenBuf, body, keyLen, valLen)
 }
 
 // DecodeEntry parses an entry from a byte slice.
@@ -105,30 +94,66 @@ func DecodeEntry(buf []byte) (Entry, int, error) {
 		return Entry{}, 0, io.ErrUnexpectedEOF
 	}
 
-	entryType := EntryType(buf[0])
-	keyLen := binary.BigEndian.Uint32(buf[EntryTypeSize : EntryTypeSize+LengthSize])
-	valLen := binary.BigEndian.Uint32(buf[EntryTypeSize+LengthSize : EntryTypeSize+(LengthSize*2)])
-	totalLen := PrefixSize + int(keyLen) + int(valLen)
+	keyLen, valLen := entryLengths(buf)
+	totalLen := PrefixSize + keyLen + valLen + ChecksumSize
 
 	if len(buf) < totalLen {
 		return Entry{}, 0, io.ErrUnexpectedEOF
 	}
 
-	key := buf[PrefixSize : PrefixSize+keyLen]
-	value := buf[PrefixSize+keyLen : totalLen]
+	entry, err := verifyEntry(nil, buf[:PrefixSize], buf[PrefixSize:totalLen], keyLen, valLen)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	return entry, totalLen, nil
+}
 
-	return Entry{
-		Type:  entryType,
-		Key:   key,
-		Value: value,
-	}, totalLen, nil
+// DecodeEntryHeader is like DecodeEntry but stops after the key, sequence
+// number and expiry: the returned entry has no Value and its checksum is
+// not verified. It is meant for membership checks that never use the value.
+func DecodeEntryHeader(buf []byte) (Entry, int, error) {
+	if len(buf) < PrefixSize {
+		return Entry{}, 0, io.ErrUnexpectedEOF
+	}
+
+	keyLen, valLen := entryLengths(buf)
+	totalLen := PrefixSize + keyLen + valLen + ChecksumSize
+	if len(buf) < totalLen {
+		return Entry{}, 0, io.ErrUnexpectedEOF
+	}
+
+	entry := Entry{
+		Type: EntryType(buf[0] &^ typeFlags),
+		Key:  buf[PrefixSize : PrefixSize+keyLen : PrefixSize+keyLen],
+	}
+	value := buf[PrefixSize+keyLen : PrefixSize+keyLen+valLen]
+	if buf[0]&SeqFlag != 0 {
+		if len(value) < SeqSize {
+			return Entry{}, 0, gerrors.Corruption("entry too short for its sequence number", nil)
+		}
+		entry.Seq = binary.BigEndian.Uint64(value)
+		value = value[SeqSize:]
+	}
+	if buf[0]&ExpiryFlag != 0 {
+		if len(value) < ExpirySize {
+			return Entry{}, 0, gerrors.Corruption("entry too short for its expiry", nil)
+		}
+		entry.ExpiresAt = int64(binary.BigEndian.Uint64(value))
+	}
+	return entry, totalLen, nil
 }
 
 // SerializeEntry converts an Entry to a byte slice
 func SerializeEntry(e Entry) []byte {
 	keyLen := len(e.Key)
 	valLen := len(e.Value)
-	totalSize := PrefixSize + keyLen + valLen
+	if e.Seq != 0 {
+		valLen += SeqSize
+	}
+	if e.ExpiresAt != 0 {
+		valLen += ExpirySize
+	}
+	totalSize := PrefixSize + keyLen + valLen + ChecksumSize
 
 	buf := make([]byte, totalSize)
 
@@ -139,9 +164,186 @@ func SerializeEntry(e Entry) []byte {
 
 	copy(buf[PrefixSize:], e.Key)
 
-	if valLen > 0 {
-		copy(buf[PrefixSize+keyLen:], e.Value)
+	valueOffset := PrefixSize + keyLen
+	if e.Seq != 0 {
+		buf[0] |= SeqFlag
+		binary.BigEndian.PutUint64(buf[valueOffset:], e.Seq)
+		valueOffset += SeqSize
 	}
+	if e.ExpiresAt != 0 {
+		buf[0] |= ExpiryFlag
+		binary.BigEndian.PutUint64(buf[valueOffset:], uint64(e.ExpiresAt))
+		valueOffset += ExpirySize
+	}
+	copy(buf[valueOffset:], e.Value)
+
+	checksumOffset := totalSize - ChecksumSize
+	binary.BigEndian.PutUint32(buf[checksumOffset:], crc32.Checksum(buf[:checksumOffset], castagnoli))
 
 	return buf
 }
+
+// AppendBlockEntry appends e to dst in the prefix-compressed form used in
+// SSTable data blocks: shared, the number of leading bytes e.Key has in
+// common with the previous key in the block, as a uvarint, then e encoded as
+// by SerializeEntry but with only the rest of its key. The checksum covers
+// the shared length too. The first entry of a block has shared 0.
+func AppendBlockEntry(dst []byte, e Entry, shared int) []byte {
+	start := len(dst)
+	dst = binary.AppendUvarint(dst, uint64(shared))
+	suffix := e
+	suffix.Key = e.Key[shared:]
+	dst = append(dst, SerializeEntry(suffix)...)
+
+	checksumOffset := len(dst) - ChecksumSize
+	binary.BigEndian.PutUint32(dst[checksumOffset:], crc32.Checksum(dst[start:checksumOffset], castagnoli))
+	return dst
+}
+
+// DecodeBlockEntry parses an entry written by AppendBlockEntry, rebuilding
+// its key from the first bytes of prev, the previous key in the block, and
+// returns the number of bytes consumed. The key is newly allocated unless
+// the entry shares nothing with prev, in which case it aliases buf like
+// DecodeEntry.
+func DecodeBlockEntry(buf, prev []byte) (Entry, int, error) {
+	shared, lead, keyLen, valLen, err := blockEntryLengths(buf, prev)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	prefix := buf[lead : lead+PrefixSize]
+	totalLen := lead + PrefixSize + keyLen + valLen + ChecksumSize
+	entry, err := verifyEntry(buf[:lead], prefix, buf[lead+PrefixSize:totalLen], keyLen, valLen)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	entry.Key = joinKey(prev[:shared], entry.Key)
+	return entry, totalLen, nil
+}
+
+// DecodeBlockEntryHeader is like DecodeBlockEntry but, like
+// DecodeEntryHeader, returns no Value and does not verify the checksum.
+func DecodeBlockEntryHeader(buf, prev []byte) (Entry, int, error) {
+	shared, lead, _, _, err := blockEntryLengths(buf, prev)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	entry, n, err := DecodeEntryHeader(buf[lead:])
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	entry.Key = joinKey(prev[:shared], entry.Key)
+	return entry, lead + n, nil
+}
+
+// blockEntryLengths reads the shared key length at the start of a block
+// entry and the lengths in the entry prefix after it, whose offset is lead,
+// and checks that the whole entry is in buf.
+func blockEntryLengths(buf, prev []byte) (shared, lead, keyLen, valLen int, err error) {
+	n, lead := binary.Uvarint(buf)
+	if lead == 0 {
+		return 0, 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	if lead < 0 {
+		return 0, 0, 0, 0, gerrors.Corruption("bad shared key length", nil)
+	}
+	if n > uint64(len(prev)) {
+		return 0, 0, 0, 0, gerrors.Corruption(fmt.Sprintf("entry shares %d key bytes with a %d-byte key", n, len(prev)), nil)
+	}
+	if len(buf) < lead+PrefixSize {
+		return 0, 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	keyLen, valLen = entryLengths(buf[lead:])
+	if len(buf) < lead+PrefixSize+keyLen+valLen+ChecksumSize {
+		return 0, 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	return int(n), lead, keyLen, valLen, nil
+}
+
+// joinKey returns shared followed by suffix, reusing suffix when shared is
+// empty.
+func joinKey(shared, suffix []byte) []byte {
+	if len(shared) == 0 {
+		return suffix
+	}
+	key := make([]byte, len(shared)+len(suffix))
+	copy(key, shared)
+	copy(key[len(shared):], suffix)
+	return key
+}
+
+// SharedPrefixLen returns the number of leading bytes a and b have in common.
+func SharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// checkEntryLength reports an entry whose key and value lengths, read from
+// a file, add up to more than maxLen as corrupt.
+func checkEntryLength(keyLen, valLen, maxLen int) error {
+	if keyLen+valLen > maxLen {
+		return gerrors.Corruption(fmt.Sprintf("entry length %d exceeds limit of %d", keyLen+valLen, maxLen), gerrors.ErrEntryTooLarge)
+	}
+	return nil
+}
+
+// CheckEntrySize rejects an entry about to be written whose key is longer
+// than maxKeySize or whose value is longer than maxValueSize, with an error
+// matching errors.ErrEntryTooLarge. A limit <= 0 is not checked.
+func CheckEntrySize(e Entry, maxKeySize, maxValueSize int) error {
+	if maxKeySize > 0 && len(e.Key) > maxKeySize {
+		return gerrors.TooLarge(fmt.Sprintf("key of %d bytes exceeds the limit of %d", len(e.Key), maxKeySize), nil)
+	}
+	if maxValueSize > 0 && len(e.Value) > maxValueSize {
+		return gerrors.TooLarge(fmt.Sprintf("value of %d bytes exceeds the limit of %d", len(e.Value), maxValueSize), nil)
+	}
+	return nil
+}
+
+// entryLengths returns the key and value lengths from an entry prefix.
+func entryLengths(prefix []byte) (int, int) {
+	keyLen := binary.BigEndian.Uint32(prefix[EntryTypeSize : EntryTypeSize+LengthSize])
+	valLen := binary.BigEndian.Uint32(prefix[EntryTypeSize+LengthSize : PrefixSize])
+	return int(keyLen), int(valLen)
+}
+
+// verifyEntry checks the checksum at the end of body, which holds the key,
+// value and checksum following prefix, and returns the entry. The checksum
+// also covers lead, any bytes stored before prefix. The entry's key and
+// value alias body.
+func verifyEntry(lead, prefix, body []byte, keyLen, valLen int) (Entry, error) {
+	checksumOffset := keyLen + valLen
+	want := binary.BigEndian.Uint32(body[checksumOffset:])
+
+	crc := crc32.Update(0, castagnoli, lead)
+	crc = crc32.Update(crc, castagnoli, prefix)
+	crc = crc32.Update(crc, castagnoli, body[:checksumOffset])
+	if crc != want {
+		return Entry{}, gerrors.Corruption("entry checksum mismatch", gerrors.ErrChecksumMismatch)
+	}
+
+	entry := Entry{
+		Type:  EntryType(prefix[0] &^ typeFlags),
+		Key:   body[:keyLen:keyLen],
+		Value: body[keyLen:checksumOffset],
+	}
+	if prefix[0]&SeqFlag != 0 {
+		if len(entry.Value) < SeqSize {
+			return Entry{}, gerrors.Corruption("entry too short for its sequence number", nil)
+		}
+		entry.Seq = binary.BigEndian.Uint64(entry.Value)
+		entry.Value = entry.Value[SeqSize:]
+	}
+	if prefix[0]&ExpiryFlag != 0 {
+		if len(entry.Value) < ExpirySize {
+			return Entry{}, gerrors.Corruption("entry too short for its expiry", nil)
+		}
+		entry.ExpiresAt = int64(binary.BigEndian.Uint64(entry.Value))
+		entry.Value = entry.Value[ExpirySize:]
+	}
+	return entry, nil
+}
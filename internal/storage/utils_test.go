@@ -1,11 +1,16 @@
 package storage_test
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
 
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
 	"github.com/MikhailWahib/graveldb/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -31,7 +36,7 @@ func TestWriteEntry(t *testing.T) {
 	newOffset, err := storage.WriteEntryAt(entry, f, offset)
 	require.NoError(t, err)
 
-	expectedLen := 1 + 4 + 4 + len(key) + len(value)
+	expectedLen := 1 + 4 + 4 + len(key) + len(value) + 4
 	expectedOffset := offset + int64(expectedLen)
 	assert.Equal(t, expectedOffset, newOffset, "unexpected new offset")
 
@@ -43,7 +48,7 @@ func TestWriteEntry(t *testing.T) {
 	entryType := buf[0]
 	keyLen := binary.BigEndian.Uint32(buf[1:5])
 	readKey := buf[9 : 9+keyLen]
-	readValue := buf[9+keyLen:]
+	readValue := buf[9+keyLen : expectedLen-4]
 
 	// Validate entryType, key and value
 	assert.Equal(t, storage.PutEntry, storage.EntryType(entryType), "entry type mismatch")
@@ -78,8 +83,150 @@ func TestReadEntry(t *testing.T) {
 	assert.Equal(t, key, entry.Key, "key mismatch")
 	assert.Equal(t, value, entry.Value, "value mismatch")
 
-	expectedLen := 1 + 4 + 4 + len(key) + len(value)
+	expectedLen := 1 + 4 + 4 + len(key) + len(value) + 4
 	expectedOffset := offset + int64(expectedLen)
 	assert.Equal(t, expectedOffset, newOffset, "unexpected new offset")
 	assert.Equal(t, storage.DeleteEntry, storage.EntryType(entry.Type), "entry type mismatch")
 }
+
+func TestDecodeEntry_ChecksumMismatch(t *testing.T) {
+	buf := storage.SerializeEntry(storage.Entry{Type: storage.PutEntry, Key: []byte("key"), Value: []byte("value")})
+
+	entry, n, err := storage.DecodeEntry(buf)
+	require.NoError(t, err)
+	assert.Equal(t, len(buf), n)
+	assert.Equal(t, []byte("value"), entry.Value)
+
+	// Flip one bit in every position in turn, including the length fields
+	// and the checksum itself
+	for i := range buf {
+		corrupt := bytes.Clone(buf)
+		corrupt[i] ^= 0x01
+		_, _, err := storage.DecodeEntry(corrupt)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A corrupted length can make the entry look truncated
+			continue
+		}
+		assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch, "byte %d", i)
+		assert.ErrorIs(t, err, gerrors.ErrCorrupt, "byte %d", i)
+	}
+
+	_, err = storage.ReadEntryFromReader(bufio.NewReader(bytes.NewReader(append(buf[:len(buf)-1:len(buf)-1], buf[len(buf)-1]^0xff))), 0)
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+}
+
+func TestDecodeEntry_Expiry(t *testing.T) {
+	e := storage.Entry{
+		Type:      storage.PutEntry,
+		Key:       []byte("key"),
+		Value:     []byte("value"),
+		ExpiresAt: 1700000000123456789,
+	}
+	buf := storage.SerializeEntry(e)
+	assert.Len(t, buf, storage.PrefixSize+len(e.Key)+storage.ExpirySize+len(e.Value)+storage.ChecksumSize)
+
+	entry, n, err := storage.DecodeEntry(buf)
+	require.NoError(t, err)
+	assert.Equal(t, len(buf), n)
+	assert.Equal(t, e, entry)
+	assert.True(t, entry.Expired(e.ExpiresAt))
+	assert.False(t, entry.Expired(e.ExpiresAt-1))
+
+	// Entries without an expiry keep the original encoding
+	plain := storage.SerializeEntry(storage.Entry{Type: storage.PutEntry, Key: e.Key, Value: e.Value})
+	assert.Equal(t, byte(storage.PutEntry), plain[0])
+	entry, _, err = storage.DecodeEntry(plain)
+	require.NoError(t, err)
+	assert.Zero(t, entry.ExpiresAt)
+	assert.False(t, entry.Expired(e.ExpiresAt))
+}
+
+func TestDecodeEntry_Seq(t *testing.T) {
+	for _, e := range []storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("key"), Value: []byte("value"), Seq: 42},
+		{Type: storage.PutEntry, Key: []byte("key"), Value: []byte("value"), Seq: 43, ExpiresAt: 1700000000123456789},
+		{Type: storage.DeleteEntry, Key: []byte("key"), Value: []byte{}, Seq: 44},
+	} {
+		buf := storage.SerializeEntry(e)
+		entry, n, err := storage.DecodeEntry(buf)
+		require.NoError(t, err)
+		assert.Equal(t, len(buf), n)
+		assert.Equal(t, e, entry)
+	}
+}
+
+func TestReadEntryFromReader_MaxLength(t *testing.T) {
+	buf := storage.SerializeEntry(storage.Entry{Type: storage.PutEntry, Key: []byte("key"), Value: []byte("value")})
+
+	entry, err := storage.ReadEntryFromReader(bufio.NewReader(bytes.NewReader(buf)), 8)
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(entry.Value))
+
+	_, err = storage.ReadEntryFromReader(bufio.NewReader(bytes.NewReader(buf)), 7)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+}
+
+func TestReadEntry_HugeLengthPrefix(t *testing.T) {
+	// A prefix claiming a 4GB key in front of a few bytes of data
+	buf := make([]byte, storage.PrefixSize+8)
+	binary.BigEndian.PutUint32(buf[storage.EntryTypeSize:], 0xfffffff0)
+	path := filepath.Join(t.TempDir(), "huge")
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, f.Close()) }()
+	_, _, err = storage.ReadEntryAt(f, 0)
+	assert.ErrorIs(t, err, gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+
+	// Without a limit of its own, the reader still applies the hard one
+	_, err = storage.ReadEntryFromReader(bufio.NewReader(bytes.NewReader(buf)), 0)
+	assert.ErrorIs(t, err, gerrors.ErrEntryTooLarge)
+	_, err = storage.ReadEntryFromReader(bufio.NewReader(bytes.NewReader(buf)), 16)
+	assert.ErrorIs(t, err, gerrors.ErrEntryTooLarge)
+}
+
+func TestCheckEntrySize(t *testing.T) {
+	e := storage.Entry{Type: storage.PutEntry, Key: []byte("key"), Value: []byte("value")}
+	assert.NoError(t, storage.CheckEntrySize(e, 3, 5))
+	assert.NoError(t, storage.CheckEntrySize(e, 0, 0))
+	assert.ErrorIs(t, storage.CheckEntrySize(e, 2, 0), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, storage.CheckEntrySize(e, 0, 4), gerrors.ErrEntryTooLarge)
+}
+
+func TestBlockEntry_RoundTrip(t *testing.T) {
+	first := storage.Entry{Type: storage.PutEntry, Key: []byte("user:1000"), Value: []byte("a"), Seq: 7}
+	second := storage.Entry{Type: storage.DeleteEntry, Key: []byte("user:1001"), Seq: 8, ExpiresAt: 99}
+
+	buf := storage.AppendBlockEntry(nil, first, 0)
+	firstLen := len(buf)
+	buf = storage.AppendBlockEntry(buf, second, storage.SharedPrefixLen(first.Key, second.Key))
+	assert.Less(t, len(buf)-firstLen, len(storage.SerializeEntry(second)))
+
+	got, n, err := storage.DecodeBlockEntry(buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, firstLen, n)
+	assert.Equal(t, first, got)
+
+	got, m, err := storage.DecodeBlockEntry(buf[n:], got.Key)
+	require.NoError(t, err)
+	assert.Equal(t, len(buf), n+m)
+	assert.Equal(t, "user:1001", string(got.Key))
+	assert.Equal(t, second.Seq, got.Seq)
+	assert.Equal(t, second.ExpiresAt, got.ExpiresAt)
+
+	header, _, err := storage.DecodeBlockEntryHeader(buf[n:], first.Key)
+	require.NoError(t, err)
+	assert.Equal(t, "user:1001", string(header.Key))
+
+	// The shared length is checksummed along with the entry
+	corrupt := bytes.Clone(buf[n:])
+	corrupt[0]--
+	_, _, err = storage.DecodeBlockEntry(corrupt, first.Key)
+	assert.ErrorIs(t, err, gerrors.ErrChecksumMismatch)
+
+	// A key cannot share more than the previous key holds
+	_, _, err = storage.DecodeBlockEntry(buf[n:], []byte("u"))
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+}
@@ -0,0 +1,11 @@
+package wal
+
+// File is the file interface the WAL writes through.
+type File = walFile
+
+// WrapFile replaces the WAL's file with wrap(file), for fault injection.
+func (w *WAL) WrapFile(wrap func(File) File) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.file = wrap(w.file)
+}
@@ -3,55 +3,440 @@ package wal
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/MikhailWahib/graveldb/internal/config"
 	"github.com/MikhailWahib/graveldb/internal/storage"
 )
 
-// WAL manages the write-ahead log file
+// walFile is the subset of *os.File used by the WAL.
+type walFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// WAL manages the write-ahead log. Entries are appended to the newest of a
+// series of numbered segment files in one directory (wal-000001.log,
+// wal-000002.log, ...). A segment is closed and a new one started when it
+// grows past the segment size or when Rotate is called, so segments whose
+// data has reached SSTables can be deleted with RemoveBefore.
 type WAL struct {
 	mu sync.Mutex
 
-	path string
-	file *os.File
-	buf  []byte
+	dir     string
+	segment uint64 // number of the active segment
+	file    walFile
+	written int64 // bytes written to the active segment
+	buf     []byte
 
 	flushTicker *time.Ticker
 	closeChan   chan struct{}
 	closed      bool
 	err         error
+	// unsynced is set when data was written to the file without a sync
+	unsynced bool
+	// recycled holds the paths of removed segments kept for reuse when
+	// segments are preallocated
+	recycled []string
 
-	flushThreshold int
-	flushInterval  time.Duration
+	opts Options
 }
 
-// NewWAL creates a new WAL
-func NewWAL(path string, flushThreshold int, flushInterval time.Duration) (*WAL, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+// Options configures a WAL.
+type Options struct {
+	// FlushThreshold is the number of buffered bytes that triggers a write
+	// to the active segment.
+	FlushThreshold int
+	// FlushInterval is how often buffered entries are written regardless
+	// of the threshold.
+	FlushInterval time.Duration
+	// SyncMode selects when written entries are synced.
+	SyncMode config.WALSyncMode
+	// SegmentSize is the size past which the active segment is closed and
+	// a new one started. 0 means segments only change on Rotate.
+	SegmentSize int64
+	// MaxRecordSize is the largest combined key and value size of a
+	// record. Larger appends are rejected, and replay treats a record
+	// claiming a larger size as corrupt. 0 means no bound.
+	MaxRecordSize int
+	// MaxKeySize and MaxValueSize are the longest key and value an append
+	// may hold; longer ones are rejected with errors.ErrEntryTooLarge. 0
+	// means no limit.
+	MaxKeySize   int
+	MaxValueSize int
+	// FS holds the segment files; nil means the operating system's.
+	FS storage.FS
+	// IORetry is the retry policy for transient errors writing and
+	// syncing segments. A MaxAttempts of 1 or less disables retries.
+	IORetry storage.RetryPolicy
+	// Preallocate is the size each new segment is extended to with zeros
+	// before it is written, so appends fill space already reserved instead
+	// of growing the file. Segments keep the space when the WAL moves past
+	// them, and removed ones are reused for new segments; only the active
+	// segment is truncated to its data, on Close. 0 means segments grow
+	// with each write.
+	Preallocate int64
+}
+
+// legacyName is the single WAL file used before segments were numbered.
+const legacyName = "wal.log"
+
+// legacyConverting and legacyConverted hold a legacy WAL rewritten in the
+// current record format: the first while it is written, the second once it
+// is synced and until it replaces the legacy files. Neither parses as a
+// segment.
+const (
+	legacyConverting = "converting-wal.tmp"
+	legacyConverted  = "converted-wal.log"
+)
+
+// maxRecycled is the number of removed segments kept for reuse.
+const maxRecycled = 2
+
+// Open opens the WAL in dir and starts a new segment after any existing
+// ones, which are left in place for Replay. A WAL written before segments
+// were numbered is first converted to the current format by
+// convertLegacy.
+func Open(dir string, opts Options) (*WAL, error) {
+	opts.FS = storage.OrOS(opts.FS)
+	fs := opts.FS
+	if err := convertLegacy(fs, dir); err != nil {
+		return nil, err
+	}
+	nums, err := segmentNumbers(fs, dir)
 	if err != nil {
 		return nil, err
 	}
+	var last uint64
+	if len(nums) > 0 {
+		last = nums[len(nums)-1]
+	}
 
 	wal := &WAL{
-		path:           path,
-		file:           file,
-		buf:            make([]byte, 0, flushThreshold),
-		closeChan:      make(chan struct{}),
-		flushThreshold: flushThreshold,
-		flushInterval:  flushInterval,
-	}
-	wal.flushTicker = time.NewTicker(flushInterval)
+		dir:       dir,
+		segment:   last + 1,
+		buf:       make([]byte, 0, opts.FlushThreshold),
+		closeChan: make(chan struct{}),
+		opts:      opts,
+	}
+	if wal.recycled, err = recycledSegments(fs, dir, opts.Preallocate > 0); err != nil {
+		return nil, err
+	}
+	if wal.file, err = wal.createSegmentLocked(last + 1); err != nil {
+		return nil, err
+	}
+	wal.flushTicker = time.NewTicker(opts.FlushInterval)
 	go wal.backgroundFlusher()
 	return wal, nil
 }
 
+// convertLegacy rewrites a WAL from before segments were numbered as
+// segment 1 in the current format. Such a WAL is marked by its wal.log
+// file, and the wal-NNNNNN.log files next to it were sealed from wal.log
+// in the same format, which has no checksum, sequence number or expiry.
+// Their records are copied, oldest file first as they were replayed, to a
+// new file that is synced before any legacy file is removed, so a crash at
+// any point leaves either the legacy files or the converted copy to start
+// over from. A legacy file that cannot be read fails the conversion with
+// ErrCorrupt and leaves every file in place.
+func convertLegacy(fs storage.FS, dir string) error {
+	converted := filepath.Join(dir, legacyConverted)
+	if _, err := fs.Stat(converted); os.IsNotExist(err) {
+		if _, err := fs.Stat(filepath.Join(dir, legacyName)); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return gerrors.IO("failed to stat legacy WAL", err)
+		}
+		if err := writeConverted(fs, dir); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return gerrors.IO("failed to stat converted WAL", err)
+	}
+
+	// The converted copy is complete, so the legacy files can go
+	nums, err := segmentNumbers(fs, dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if err := fs.Remove(segmentPath(dir, num)); err != nil && !os.IsNotExist(err) {
+			return gerrors.IO("failed to remove legacy WAL segment", err)
+		}
+	}
+	if err := fs.Remove(filepath.Join(dir, legacyName)); err != nil && !os.IsNotExist(err) {
+		return gerrors.IO("failed to remove legacy WAL", err)
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		return gerrors.IO("failed to sync WAL directory", err)
+	}
+	if err := fs.Rename(converted, segmentPath(dir, 1)); err != nil {
+		return gerrors.IO("failed to rename converted WAL", err)
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		return gerrors.IO("failed to sync WAL directory", err)
+	}
+	return nil
+}
+
+// writeConverted copies the records of the legacy segments in dir, then of
+// wal.log, to a synced file at legacyConverted in the current format.
+func writeConverted(fs storage.FS, dir string) error {
+	nums, err := segmentNumbers(fs, dir)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(nums)+1)
+	for _, num := range nums {
+		paths = append(paths, segmentPath(dir, num))
+	}
+	paths = append(paths, filepath.Join(dir, legacyName))
+
+	tmp := filepath.Join(dir, legacyConverting)
+	file, err := fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return gerrors.IO("failed to create converted WAL", err)
+	}
+	out := bufio.NewWriter(file)
+	for _, path := range paths {
+		err := readLegacy(fs, path, func(entry storage.Entry) error {
+			_, err := out.Write(storage.SerializeEntry(entry))
+			return err
+		})
+		if err != nil {
+			_ = file.Close()
+			_ = fs.Remove(tmp)
+			return err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		_ = file.Close()
+		_ = fs.Remove(tmp)
+		return gerrors.IO("failed to write converted WAL", err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		_ = fs.Remove(tmp)
+		return gerrors.IO("failed to sync converted WAL", err)
+	}
+	if err := file.Close(); err != nil {
+		_ = fs.Remove(tmp)
+		return gerrors.IO("failed to close converted WAL", err)
+	}
+	if err := fs.Rename(tmp, filepath.Join(dir, legacyConverted)); err != nil {
+		return gerrors.IO("failed to rename converted WAL", err)
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		return gerrors.IO("failed to sync WAL directory", err)
+	}
+	return nil
+}
+
+// readLegacy calls fn with each record of the legacy WAL file at path, laid
+// out as [type][key length][value length][key][value]. A record cut short
+// at the end of the file by a crash is dropped, as the legacy replay did.
+// Only puts and deletes were logged, so any other type, or a length past
+// storage.MaxEntryLength, fails with ErrCorrupt.
+func readLegacy(fs storage.FS, path string, fn func(entry storage.Entry) error) error {
+	file, err := storage.Open(fs, path)
+	if err != nil {
+		return gerrors.IO("failed to open legacy WAL", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	reader := bufio.NewReader(file)
+	prefix := make([]byte, storage.PrefixSize)
+	for {
+		if _, err := io.ReadFull(reader, prefix); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return gerrors.IO("failed to read legacy WAL", err)
+		}
+		entryType := storage.EntryType(prefix[0])
+		keyLen := int(binary.BigEndian.Uint32(prefix[storage.EntryTypeSize:]))
+		valLen := int(binary.BigEndian.Uint32(prefix[storage.EntryTypeSize+storage.LengthSize:]))
+		if entryType != storage.PutEntry && entryType != storage.DeleteEntry || keyLen+valLen > storage.MaxEntryLength {
+			return gerrors.Corruption(fmt.Sprintf("legacy WAL %s has an invalid record", path), nil)
+		}
+		body := make([]byte, keyLen+valLen)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return gerrors.IO("failed to read legacy WAL", err)
+		}
+		entry := storage.Entry{Type: entryType, Key: body[:keyLen:keyLen]}
+		if entryType == storage.PutEntry {
+			entry.Value = body[keyLen:]
+		}
+		if err := fn(entry); err != nil {
+			return gerrors.IO("failed to write converted WAL", err)
+		}
+	}
+}
+
+// segmentPath returns the path of segment num in dir.
+func segmentPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wal-%06d.log", num))
+}
+
+// recycledPath returns the path removed segment num is kept at for reuse.
+// The name does not parse as a segment, so it is never replayed.
+func recycledPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("recycled-%06d.log", num))
+}
+
+// recycledSegments returns the paths of the segments kept for reuse in dir.
+// Unless keep is set, as when segments are no longer preallocated, they are
+// removed instead.
+func recycledSegments(fs storage.FS, dir string, keep bool) ([]string, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "recycled-") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if keep && len(paths) < maxRecycled {
+			paths = append(paths, path)
+			continue
+		}
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, gerrors.IO("failed to remove recycled WAL segment", err)
+		}
+	}
+	return paths, nil
+}
+
+// segmentNumbers returns the numbers of the segments in dir in ascending
+// order.
+func segmentNumbers(fs storage.FS, dir string) ([]uint64, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var nums []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), "wal-")
+		if !ok {
+			continue
+		}
+		name, ok = strings.CutSuffix(name, ".log")
+		if !ok {
+			continue
+		}
+		num, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	slices.Sort(nums)
+	return nums, nil
+}
+
+// createSegmentLocked creates segment num, preallocated to opts.Preallocate
+// bytes if positive, reusing a recycled segment if there is one, and with
+// writes and syncs retried under opts.IORetry. A preallocated segment is
+// written from its start rather than appended to. Must be called with w.mu
+// held or before the WAL is shared.
+func (w *WAL) createSegmentLocked(num uint64) (walFile, error) {
+	var recycled string
+	if n := len(w.recycled); n > 0 {
+		recycled, w.recycled = w.recycled[n-1], w.recycled[:n-1]
+	}
+	file, err := openSegment(w.opts.FS, w.dir, num, w.opts.Preallocate, recycled)
+	if err != nil {
+		return nil, err
+	}
+	if w.opts.IORetry.MaxAttempts <= 1 {
+		return file, nil
+	}
+	return &retryFile{walFile: file, policy: w.opts.IORetry}, nil
+}
+
+// openSegment creates segment num in dir. A recycled segment at recycled,
+// if set, is renamed to it and zeroed, keeping its disk space; otherwise a
+// new file is preallocated. Failing to reserve the space, e.g. because the
+// disk is full, fails the segment rather than leaving appends to hit it
+// later.
+func openSegment(fs storage.FS, dir string, num uint64, preallocate int64, recycled string) (walFile, error) {
+	path := segmentPath(dir, num)
+	if preallocate <= 0 {
+		return fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+
+	flag, reserve := os.O_CREATE|os.O_WRONLY|os.O_TRUNC, storage.Preallocate
+	if recycled != "" {
+		if err := fs.Rename(recycled, path); err != nil {
+			return nil, err
+		}
+		flag, reserve = os.O_WRONLY, storage.ZeroRange
+	}
+	file, err := fs.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = reserve(file, preallocate)
+	if err == nil && recycled != "" {
+		// The old records must not reappear after a crash, and the new
+		// name must survive one
+		if err = file.Sync(); err == nil {
+			err = fs.SyncDir(dir)
+		}
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = fs.Remove(path)
+		return nil, err
+	}
+	return file, nil
+}
+
+// retryFile retries writes and syncs to a segment that fail with a
+// transient error. Segments are written sequentially, so a retried write
+// carries on after the bytes an earlier attempt already wrote.
+type retryFile struct {
+	walFile
+	policy storage.RetryPolicy
+}
+
+func (f *retryFile) Write(p []byte) (int, error) {
+	var n int
+	err := f.policy.Do(func() error {
+		m, err := f.walFile.Write(p[n:])
+		n += m
+		return err
+	})
+	return n, err
+}
+
+func (f *retryFile) Sync() error {
+	return f.policy.Do(f.walFile.Sync)
+}
+
 // writeEntry appends a serialized entry to the WAL buffer and triggers flush if needed
 func (w *WAL) writeEntry(e storage.Entry) error {
 	w.mu.Lock()
@@ -64,23 +449,44 @@ func (w *WAL) writeEntry(e storage.Entry) error {
 		return gerrors.Closed("WAL is closed", nil)
 	}
 
+	if err := storage.CheckEntrySize(e, w.opts.MaxKeySize, w.opts.MaxValueSize); err != nil {
+		w.mu.Unlock()
+		return err
+	}
 	data := storage.SerializeEntry(e)
+	if err := w.checkRecordSize(data); err != nil {
+		w.mu.Unlock()
+		return err
+	}
 	w.buf = append(w.buf, data...)
 
-	if len(w.buf) >= w.flushThreshold {
-		err := w.flushBuffer()
-		w.mu.Unlock()
+	if len(w.buf) >= w.opts.FlushThreshold {
+		err := w.flushBuffer(w.opts.SyncMode == config.WALSyncAlways)
 		if err != nil {
-			w.fail(err)
-			return err
+			w.failLocked(err)
 		}
-		return nil
+		w.mu.Unlock()
+		return err
 	}
 
 	w.mu.Unlock()
 	return nil
 }
 
+// checkRecordSize rejects a serialized record whose key and value are too
+// large for replay to accept.
+func (w *WAL) checkRecordSize(record []byte) error {
+	size := len(record) - storage.PrefixSize - storage.ChecksumSize
+	limit := storage.MaxEntryLength
+	if w.opts.MaxRecordSize > 0 {
+		limit = min(limit, w.opts.MaxRecordSize)
+	}
+	if size > limit {
+		return gerrors.TooLarge(fmt.Sprintf("WAL record of %d bytes exceeds the limit of %d", size, limit), nil)
+	}
+	return nil
+}
+
 // AppendPut appends a put operation to the WAL
 func (w *WAL) AppendPut(key, value []byte) error {
 	return w.writeEntry(storage.Entry{
@@ -90,6 +496,12 @@ func (w *WAL) AppendPut(key, value []byte) error {
 	})
 }
 
+// Append appends a put or delete entry to the WAL, including its expiry
+// and sequence number.
+func (w *WAL) Append(entry storage.Entry) error {
+	return w.writeEntry(entry)
+}
+
 // AppendDelete appends a delete operation to the WAL
 func (w *WAL) AppendDelete(key []byte) error {
 	return w.writeEntry(storage.Entry{
@@ -98,18 +510,154 @@ func (w *WAL) AppendDelete(key []byte) error {
 	})
 }
 
+// AppendBatch appends all entries to the WAL and writes them to disk with a
+// single sync, regardless of the flush threshold. The sync is skipped unless
+// the sync mode is WALSyncAlways.
+func (w *WAL) AppendBatch(entries []storage.Entry) error {
+	w.mu.Lock()
+	if w.closed {
+		err := w.err
+		w.mu.Unlock()
+		return gerrors.Closed("WAL is closed", err)
+	}
+
+	records := make([][]byte, len(entries))
+	for i, e := range entries {
+		// The entries of a batch record were checked by AppendAtomic
+		if e.Type != storage.BatchEntry {
+			if err := storage.CheckEntrySize(e, w.opts.MaxKeySize, w.opts.MaxValueSize); err != nil {
+				w.mu.Unlock()
+				return err
+			}
+		}
+		records[i] = storage.SerializeEntry(e)
+		if err := w.checkRecordSize(records[i]); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+	}
+	for _, record := range records {
+		w.buf = append(w.buf, record...)
+	}
+
+	err := w.flushBuffer(w.opts.SyncMode == config.WALSyncAlways)
+	if err != nil {
+		w.failLocked(err)
+	}
+	w.mu.Unlock()
+	return err
+}
+
+// AppendAtomic appends entries to the WAL as a single record and writes it
+// to disk with a single sync. Replay returns either all of the entries or,
+// if the record was cut short by a crash, none of them.
+func (w *WAL) AppendAtomic(entries []storage.Entry) error {
+	var value []byte
+	for _, e := range entries {
+		if err := storage.CheckEntrySize(e, w.opts.MaxKeySize, w.opts.MaxValueSize); err != nil {
+			return err
+		}
+		value = append(value, storage.SerializeEntry(e)...)
+	}
+	return w.AppendBatch([]storage.Entry{{Type: storage.BatchEntry, Value: value}})
+}
+
+// Write is one caller's entries in a group passed to AppendGroup.
+type Write struct {
+	Entries []storage.Entry
+	// Atomic logs Entries as a single record, as AppendAtomic does
+	Atomic bool
+	// Flush has the group written to the file before AppendGroup returns,
+	// as AppendBatch does, instead of waiting for the flush threshold. It
+	// is synced only if the sync mode says so.
+	Flush bool
+	// ForceSync has the group written and synced before AppendGroup
+	// returns, whatever the sync mode
+	ForceSync bool
+}
+
+// AppendGroup appends the writes of several callers under one lock, in
+// order, so a group committed together shares one write and, when a write
+// asks for it, one sync. A write with ForceSync is synced even if the sync
+// mode would skip it, along with everything written before it. A write
+// that fails its size checks is left out and its error returned at its
+// index in errs, which is nil when every write passed; the others are
+// still appended. err reports a failure to write the group to disk, which
+// applies to every write in it.
+func (w *WAL) AppendGroup(writes []Write) (errs []error, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, gerrors.Closed("WAL is closed", w.err)
+	}
+
+	flush, forceSync := false, false
+	for i, write := range writes {
+		if err := w.bufferWrite(write); err != nil {
+			if errs == nil {
+				errs = make([]error, len(writes))
+			}
+			errs[i] = err
+			continue
+		}
+		flush = flush || write.Flush || write.ForceSync
+		forceSync = forceSync || write.ForceSync
+	}
+
+	if !flush && len(w.buf) < w.opts.FlushThreshold {
+		return errs, nil
+	}
+	if err := w.flushBuffer(forceSync || w.opts.SyncMode == config.WALSyncAlways); err != nil {
+		w.failLocked(err)
+		return errs, err
+	}
+	return errs, nil
+}
+
+// bufferWrite serializes the records of write into the buffer, checking the
+// size of each entry and record. On error the buffer is left as it was.
+func (w *WAL) bufferWrite(write Write) error {
+	mark := len(w.buf)
+	if write.Atomic {
+		var value []byte
+		for _, e := range write.Entries {
+			if err := storage.CheckEntrySize(e, w.opts.MaxKeySize, w.opts.MaxValueSize); err != nil {
+				return err
+			}
+			value = append(value, storage.SerializeEntry(e)...)
+		}
+		write.Entries = []storage.Entry{{Type: storage.BatchEntry, Value: value}}
+	}
+
+	for _, e := range write.Entries {
+		if e.Type != storage.BatchEntry {
+			if err := storage.CheckEntrySize(e, w.opts.MaxKeySize, w.opts.MaxValueSize); err != nil {
+				w.buf = w.buf[:mark]
+				return err
+			}
+		}
+		record := storage.SerializeEntry(e)
+		if err := w.checkRecordSize(record); err != nil {
+			w.buf = w.buf[:mark]
+			return err
+		}
+		w.buf = append(w.buf, record...)
+	}
+	return nil
+}
+
 // backgroundFlusher handles periodic and threshold-based flushing
 func (w *WAL) backgroundFlusher() {
 	for {
 		select {
 		case <-w.flushTicker.C:
 			w.mu.Lock()
-			if err := w.flushBuffer(); err != nil {
+			if err := w.flushBuffer(w.opts.SyncMode != config.WALSyncNever); err != nil {
 				w.failLocked(err)
 				w.mu.Unlock()
 				return
 			}
-			w.flushTicker.Reset(w.flushInterval)
+			w.flushTicker.Reset(w.opts.FlushInterval)
 			w.mu.Unlock()
 		case <-w.closeChan:
 			return
@@ -117,101 +665,267 @@ func (w *WAL) backgroundFlusher() {
 	}
 }
 
-// flushBuffer writes buffered data to disk and syncs
-func (w *WAL) flushBuffer() error {
-	if w.closed || len(w.buf) == 0 {
+// flushBuffer writes buffered data to disk and, if sync is set, syncs it
+// along with any earlier writes that were not synced
+func (w *WAL) flushBuffer(sync bool) error {
+	if w.closed {
 		return nil
 	}
 
-	if _, err := w.file.Write(w.buf); err != nil {
-		return err
+	if len(w.buf) > 0 {
+		n, err := w.file.Write(w.buf)
+		w.written += int64(n)
+		if err != nil {
+			return gerrors.IO("failed to write WAL", err)
+		}
+		w.buf = w.buf[:0]
+		w.unsynced = true
 	}
 
-	if err := w.file.Sync(); err != nil {
-		return err
+	if sync && w.unsynced {
+		// A failed sync leaves the WAL unusable; callers close it and
+		// report the error from then on
+		if err := w.file.Sync(); err != nil {
+			return gerrors.IO("failed to sync WAL", err)
+		}
+		w.unsynced = false
+	}
+
+	// The buffer only holds whole records, so a segment never ends
+	// partway through one
+	if w.opts.SegmentSize > 0 && w.written >= w.opts.SegmentSize {
+		return w.nextSegmentLocked()
 	}
+	return nil
+}
 
-	w.buf = w.buf[:0]
+// nextSegmentLocked closes the active segment, synced unless the sync mode
+// is WALSyncNever, and starts the next one. Must be called with w.mu held
+// and the buffer already written.
+func (w *WAL) nextSegmentLocked() error {
+	if w.unsynced && w.opts.SyncMode != config.WALSyncNever {
+		if err := w.file.Sync(); err != nil {
+			return gerrors.IO("failed to sync WAL", err)
+		}
+	}
+	if err := w.file.Close(); err != nil {
+		return gerrors.IO("failed to close WAL segment", err)
+	}
+	// The segment keeps its reserved space, whose zeros end it on replay,
+	// unless there are too few of them to tell apart from a torn record
+	if gap := w.opts.Preallocate - w.written; gap > 0 && gap < storage.PrefixSize {
+		if err := truncateSegment(w.opts.FS, segmentPath(w.dir, w.segment), w.written, true); err != nil {
+			w.file = nopFile{}
+			return err
+		}
+	}
 
+	file, err := w.createSegmentLocked(w.segment + 1)
+	if err != nil {
+		// Keep a file to close; the caller fails the WAL
+		w.file = nopFile{}
+		return gerrors.IO("failed to create WAL segment", err)
+	}
+	w.segment++
+	w.file = file
+	w.written = 0
+	w.unsynced = false
 	return nil
 }
 
-// Seal flushes the active WAL, renames it to archivePath, and starts a fresh
-// active WAL file at the original path.
-func (w *WAL) Seal(archivePath string) (string, error) {
+// nopFile stands in for a segment that could not be created.
+type nopFile struct{}
+
+func (nopFile) Write(p []byte) (int, error) { return 0, os.ErrClosed }
+func (nopFile) Sync() error                 { return os.ErrClosed }
+func (nopFile) Close() error                { return nil }
+
+// Rotate writes out the buffer and starts a new segment, returning its
+// number. Entries appended before Rotate are all in lower-numbered segments.
+func (w *WAL) Rotate() (uint64, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.closed {
-		if w.err != nil {
-			return "", gerrors.Closed("WAL is closed", w.err)
-		}
-		return "", gerrors.Closed("WAL is closed", nil)
+		return 0, gerrors.Closed("WAL is closed", w.err)
 	}
 
-	if err := w.flushBuffer(); err != nil {
-		return "", err
+	if err := w.flushBuffer(false); err != nil {
+		w.failLocked(err)
+		return 0, err
+	}
+	if err := w.nextSegmentLocked(); err != nil {
+		w.failLocked(err)
+		return 0, err
 	}
+	return w.segment, nil
+}
 
-	if err := w.file.Close(); err != nil {
-		return "", err
+// RemoveBefore deletes every segment numbered below num, oldest first, so a
+// crash partway through leaves only newer segments behind. The active
+// segment is never removed. When segments are preallocated, up to
+// maxRecycled of them are kept under another name to be reused by the next
+// new segments instead.
+func (w *WAL) RemoveBefore(num uint64) error {
+	w.mu.Lock()
+	num = min(num, w.segment)
+	w.mu.Unlock()
+
+	nums, err := segmentNumbers(w.opts.FS, w.dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range nums {
+		if n >= num {
+			break
+		}
+		if err := w.retireSegment(n); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// retireSegment recycles or removes segment num.
+func (w *WAL) retireSegment(num uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	if err := os.Rename(w.path, archivePath); err != nil {
-		file, openErr := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if openErr != nil {
-			return "", gerrors.IO("failed to rotate WAL: rename failed", err)
+	path := segmentPath(w.dir, num)
+	if w.opts.Preallocate > 0 && len(w.recycled) < maxRecycled {
+		dest := recycledPath(w.dir, num)
+		if err := w.opts.FS.Rename(path, dest); err == nil {
+			w.recycled = append(w.recycled, dest)
+			return nil
 		}
-		w.file = file
-		return "", gerrors.IO("failed to rotate WAL", err)
 	}
+	if err := w.opts.FS.Remove(path); err != nil && !os.IsNotExist(err) {
+		return gerrors.IO("failed to remove WAL segment", err)
+	}
+	return nil
+}
 
-	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+// Size returns the total size of the WAL's segments on disk.
+func (w *WAL) Size() int64 {
+	nums, err := segmentNumbers(w.opts.FS, w.dir)
 	if err != nil {
-		return "", err
+		return 0
 	}
-	w.file = file
-	return archivePath, nil
+	var size int64
+	for _, n := range nums {
+		if info, err := w.opts.FS.Stat(segmentPath(w.dir, n)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
 }
 
-// Replay reads entries from the active WAL file.
-func (w *WAL) Replay() ([]storage.Entry, error) {
-	return replayFile(w.path)
+// Path returns the path of the active segment.
+func (w *WAL) Path() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return segmentPath(w.dir, w.segment)
 }
 
-// ReplayDir reads entries from all WAL files in a directory.
-func ReplayDir(dir string) ([]storage.Entry, error) {
-	patterns := []string{
-		filepath.Join(dir, "wal-*.log"),
-		filepath.Join(dir, "wal.log"),
+// Replay reads the entries of every segment in the WAL's directory, oldest
+// first. truncated reports whether the last segment written to ended with
+// a record cut short by a crash, which is dropped. That segment is cut back
+// to the end of its valid data, so it replays cleanly once newer records
+// follow it. A bad record followed by newer ones fails with ErrCorrupt.
+func (w *WAL) Replay() (entries []storage.Entry, truncated bool, err error) {
+	entries, tail, err := replayDir(w.opts.FS, w.dir, w.opts.MaxRecordSize)
+	if err != nil {
+		return nil, false, err
 	}
-
-	pathSet := make(map[string]struct{})
-	for _, pattern := range patterns {
-		matches, err := filepath.Glob(pattern)
-		if err != nil {
-			return nil, err
-		}
-		for _, match := range matches {
-			pathSet[match] = struct{}{}
+	if tail != nil && tail.num < w.segment {
+		if err := truncateSegment(w.opts.FS, segmentPath(w.dir, tail.num), tail.end, true); err != nil {
+			return nil, false, err
 		}
 	}
+	return entries, tail != nil, nil
+}
+
+// ReplayDir reads the entries of every WAL segment in dir, oldest first,
+// without changing any file. truncated reports whether the last segment
+// written to ended with a record cut short by a crash or failing its
+// checksum or size bound, which ends the valid data. Such a record followed
+// by newer ones in a later segment fails with ErrCorrupt instead. Records
+// larger than maxRecordSize, if positive, are treated as corrupt.
+func ReplayDir(dir string, maxRecordSize int) (entries []storage.Entry, truncated bool, err error) {
+	entries, tail, err := replayDir(storage.OSFS{}, dir, maxRecordSize)
+	return entries, tail != nil, err
+}
+
+// tornTail locates the torn record ending the valid data of a segment.
+type tornTail struct {
+	num uint64
+	end int64
+}
 
-	paths := make([]string, 0, len(pathSet))
-	for path := range pathSet {
-		paths = append(paths, path)
+// replayDir reads the segments in dir, oldest first. tail is set if the
+// last segment holding records ends with a torn record.
+func replayDir(fs storage.FS, dir string, maxRecordSize int) (entries []storage.Entry, tail *tornTail, err error) {
+	nums, err := segmentNumbers(fs, dir)
+	if err != nil {
+		return nil, nil, err
 	}
-	sort.Strings(paths)
 
-	var entries []storage.Entry
-	for _, path := range paths {
-		segmentEntries, err := replayFile(path)
+	for _, num := range nums {
+		segmentEntries, end, torn, err := replayFile(fs, segmentPath(dir, num), maxRecordSize)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		// Only the last segment written to can be torn by a crash. The WAL
+		// had moved past a torn segment followed by more records, so the
+		// bad record lost acknowledged writes.
+		if tail != nil && (torn || len(segmentEntries) > 0) {
+			return nil, nil, gerrors.Corruption(fmt.Sprintf("WAL segment %s has a torn or corrupt record before newer records", segmentPath(dir, tail.num)), nil)
 		}
 		entries = append(entries, segmentEntries...)
+		if torn {
+			tail = &tornTail{num: num, end: end}
+		}
 	}
-	return entries, nil
+	return entries, tail, nil
+}
+
+// truncateSegment cuts the segment at path to size bytes, syncing it if
+// sync is set.
+func truncateSegment(fs storage.FS, path string, size int64, sync bool) error {
+	f, err := fs.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return gerrors.IO("failed to open WAL segment", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return gerrors.IO("failed to truncate WAL segment", err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			_ = f.Close()
+			return gerrors.IO("failed to sync WAL segment", err)
+		}
+	}
+	return f.Close()
+}
+
+// Dump reads the entries logged at path, a WAL segment file or a directory
+// of segments read oldest first, without opening the WAL or changing any
+// file, for inspecting a database that is not running. The entries of
+// atomic batches are returned one by one. As in replay, a torn or corrupt
+// record ends a segment's valid data and is reported by truncated, except
+// that one followed by newer records in a directory fails with ErrCorrupt;
+// its segment can still be dumped on its own.
+func Dump(path string) (entries []storage.Entry, truncated bool, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if info.IsDir() {
+		return ReplayDir(path, 0)
+	}
+	entries, _, truncated, err = replayFile(storage.OSFS{}, path, 0)
+	return entries, truncated, err
 }
 
 // Close flushes all data and closes the WAL
@@ -228,7 +942,7 @@ func (w *WAL) Close() error {
 		w.flushTicker.Stop()
 	}
 
-	if err := w.flushBuffer(); err != nil {
+	if err := w.flushBuffer(w.opts.SyncMode != config.WALSyncNever); err != nil {
 		w.closed = true
 		_ = w.file.Close()
 		return err
@@ -236,15 +950,18 @@ func (w *WAL) Close() error {
 
 	w.closed = true
 	_ = w.file.Close()
+	if w.opts.Preallocate > 0 {
+		// Give back the space the active segment did not use. Zeros left
+		// by a crash before the truncation reaches disk end the segment
+		// cleanly on replay, so it is not synced.
+		_ = truncateSegment(w.opts.FS, segmentPath(w.dir, w.segment), w.written, false)
+	}
 	return nil
 }
 
-func (w *WAL) fail(err error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.failLocked(err)
-}
-
+// failLocked closes the WAL after a failed write or sync. It runs before the
+// mutex is released so no later append can succeed on top of data that never
+// reached disk. Must be called with w.mu held.
 func (w *WAL) failLocked(err error) {
 	if w.closed {
 		return
@@ -262,24 +979,96 @@ func (w *WAL) failLocked(err error) {
 	_ = w.file.Close()
 }
 
-func replayFile(path string) ([]storage.Entry, error) {
-	readFile, err := os.Open(path)
+// replayFile reads the entries of one segment. A record cut short at the
+// end of the file, by a crash partway through writing it, is dropped and
+// reported as torn, with end set to its offset. So is a record that fails
+// its checksum or claims to be larger than maxRecordSize, along with
+// everything after it: its lengths cannot be trusted to find the next
+// record. Zeros filling the rest of the file, the unused space of a
+// preallocated segment, end it cleanly; fewer zeros than a record prefix
+// could be the start of a torn record instead.
+func replayFile(fs storage.FS, path string, maxRecordSize int) (entries []storage.Entry, end int64, torn bool, err error) {
+	readFile, err := storage.Open(fs, path)
 	if err != nil {
-		return nil, err
+		return nil, 0, false, err
 	}
 	defer func() { _ = readFile.Close() }()
 
-	var entries []storage.Entry
-	reader := bufio.NewReader(readFile)
+	counter := &countingReader{r: readFile}
+	reader := bufio.NewReader(counter)
 	for {
-		entry, err := storage.ReadEntryFromReader(reader)
+		start := counter.n - int64(reader.Buffered())
+		if _, err := reader.Peek(1); errors.Is(err, io.EOF) {
+			// A clean end between records
+			return entries, start, false, nil
+		}
+		entry, err := storage.ReadEntryFromReader(reader, maxRecordSize)
 		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
-				break
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gerrors.ErrCorrupt) {
+				zeros, err := zeroTail(readFile, start)
+				if err != nil {
+					return nil, 0, false, err
+				}
+				return entries, start, !zeros, nil
 			}
-			return nil, err
+			return nil, 0, false, err
+		}
+		if entry.Type == storage.BatchEntry {
+			batch, err := decodeBatch(entry.Value)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			entries = append(entries, batch...)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// zeroTail reports whether f holds at least a record prefix of bytes from
+// off to its end and all of them are zero.
+func zeroTail(f io.ReaderAt, off int64) (bool, error) {
+	buf := make([]byte, 32*1024)
+	start := off
+	for {
+		n, err := f.ReadAt(buf, off)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += int64(n)
+		if errors.Is(err, io.EOF) {
+			return off-start >= storage.PrefixSize, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// decodeBatch returns the entries held in the value of a BatchEntry record.
+func decodeBatch(data []byte) ([]storage.Entry, error) {
+	var entries []storage.Entry
+	for len(data) > 0 {
+		entry, n, err := storage.DecodeEntry(data)
+		if err != nil {
+			return nil, gerrors.Corruption("failed to decode WAL batch", err)
 		}
 		entries = append(entries, entry)
+		data = data[n:]
 	}
 	return entries, nil
 }
@@ -2,27 +2,39 @@ package wal_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/MikhailWahib/graveldb/internal/config"
+	gerrors "github.com/MikhailWahib/graveldb/internal/errors"
 	"github.com/MikhailWahib/graveldb/internal/storage"
 	"github.com/MikhailWahib/graveldb/internal/wal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func setup(t *testing.T, path string) (string, int, time.Duration) {
-	testDir := t.TempDir()
-	walPath := filepath.Join(testDir, path)
-	return walPath, 64 * 1024, 10 * time.Millisecond
+func setup(t *testing.T) (string, int, time.Duration) {
+	return t.TempDir(), 64 * 1024, 10 * time.Millisecond
+}
+
+func open(t *testing.T, dir string, threshold int, interval time.Duration) *wal.WAL {
+	t.Helper()
+	w, err := wal.Open(dir, wal.Options{FlushThreshold: threshold, FlushInterval: interval})
+	require.NoError(t, err)
+	return w
 }
 
 func TestWAL_BasicOperations(t *testing.T) {
-	walPath, threshold, interval := setup(t, "basic.wal")
+	dir, threshold, interval := setup(t)
 
-	w, err := wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w := open(t, dir, threshold, interval)
 
 	require.NoError(t, w.AppendPut([]byte("key1"), []byte("value1")))
 	require.NoError(t, w.AppendPut([]byte("key2"), []byte("value2")))
@@ -31,14 +43,13 @@ func TestWAL_BasicOperations(t *testing.T) {
 
 	require.NoError(t, w.Close())
 
-	assert.FileExists(t, walPath)
+	assert.FileExists(t, filepath.Join(dir, "wal-000001.log"))
 }
 
 func TestWAL_Replay(t *testing.T) {
-	walPath, threshold, interval := setup(t, "replay.wal")
+	dir, threshold, interval := setup(t)
 
-	w, err := wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w := open(t, dir, threshold, interval)
 
 	expected := []struct {
 		op    string
@@ -62,11 +73,10 @@ func TestWAL_Replay(t *testing.T) {
 	require.NoError(t, w.Close())
 
 	// Reopen WAL for replay
-	w, err = wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w = open(t, dir, threshold, interval)
 
 	// Replay and verify entries
-	entries, err := w.Replay()
+	entries, _, err := w.Replay()
 	require.NoError(t, err)
 
 	assert.Len(t, entries, len(expected))
@@ -87,14 +97,13 @@ func TestWAL_Replay(t *testing.T) {
 }
 
 func TestWAL_EmptyReplay(t *testing.T) {
-	walPath, threshold, interval := setup(t, "empty.wal")
+	dir, threshold, interval := setup(t)
 
 	// Create empty WAL
-	w, err := wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w := open(t, dir, threshold, interval)
 
 	// Replay empty WAL
-	entries, err := w.Replay()
+	entries, _, err := w.Replay()
 	require.NoError(t, err)
 
 	assert.Len(t, entries, 0, "Expected empty replay, got entries")
@@ -102,10 +111,9 @@ func TestWAL_EmptyReplay(t *testing.T) {
 }
 
 func TestWAL_LargeEntries(t *testing.T) {
-	walPath, threshold, interval := setup(t, "large.wal")
+	dir, threshold, interval := setup(t)
 
-	w, err := wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w := open(t, dir, threshold, interval)
 
 	// Generate large key and value
 	largeKey := make([]byte, 1024)
@@ -119,10 +127,9 @@ func TestWAL_LargeEntries(t *testing.T) {
 	require.NoError(t, w.Close())
 
 	// Reopen and replay
-	w, err = wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w = open(t, dir, threshold, interval)
 
-	entries, err := w.Replay()
+	entries, _, err := w.Replay()
 	require.NoError(t, err)
 
 	assert.Len(t, entries, 2)
@@ -139,27 +146,24 @@ func TestWAL_LargeEntries(t *testing.T) {
 }
 
 func TestWAL_Reopening(t *testing.T) {
-	walPath, threshold, interval := setup(t, "reopen.wal")
+	dir, threshold, interval := setup(t)
 
 	// Create WAL and add entries
-	w, err := wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w := open(t, dir, threshold, interval)
 
 	require.NoError(t, w.AppendPut([]byte("key1"), []byte("value1")))
 	require.NoError(t, w.Close())
 
 	// Reopen and add more entries
-	w, err = wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w = open(t, dir, threshold, interval)
 
 	require.NoError(t, w.AppendPut([]byte("key2"), []byte("value2")))
 	require.NoError(t, w.Close())
 
 	// Open and replay
-	w, err = wal.NewWAL(walPath, threshold, interval)
-	require.NoError(t, err)
+	w = open(t, dir, threshold, interval)
 
-	entries, err := w.Replay()
+	entries, _, err := w.Replay()
 	require.NoError(t, err)
 
 	assert.Len(t, entries, 2)
@@ -173,6 +177,794 @@ func TestWAL_Reopening(t *testing.T) {
 
 func TestWAL_InvalidPath(t *testing.T) {
 	// Try to create WAL in non-existent directory
-	_, err := wal.NewWAL("/nonexistent/directory/test.wal", 1, 1)
+	_, err := wal.Open("/nonexistent/directory", wal.Options{FlushThreshold: 1, FlushInterval: 1})
 	assert.Error(t, err, "Expected error with invalid path, got nil")
 }
+
+func TestWAL_AppendBatchFlushesImmediately(t *testing.T) {
+	dir, threshold, _ := setup(t)
+
+	// Use an interval long enough that only AppendBatch can flush
+	w := open(t, dir, threshold, time.Hour)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	require.NoError(t, w.AppendBatch([]storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")},
+		{Type: storage.PutEntry, Key: []byte("b"), Value: []byte("2")},
+		{Type: storage.DeleteEntry, Key: []byte("a")},
+	}))
+
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, []byte("b"), entries[1].Key)
+	assert.Equal(t, storage.DeleteEntry, entries[2].Type)
+}
+
+func TestWAL_AppendAtomicReplaysAllOrNothing(t *testing.T) {
+	dir, threshold, _ := setup(t)
+
+	w := open(t, dir, threshold, time.Hour)
+	require.NoError(t, w.AppendBatch([]storage.Entry{{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")}}))
+	require.NoError(t, w.AppendAtomic([]storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("b"), Value: []byte("2")},
+		{Type: storage.DeleteEntry, Key: []byte("a")},
+	}))
+	require.NoError(t, w.Close())
+
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, []byte("b"), entries[1].Key)
+	assert.Equal(t, storage.DeleteEntry, entries[2].Type)
+
+	// A batch record cut short by a crash is dropped as a whole
+	info, err := os.Stat(w.Path())
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(w.Path(), info.Size()-3))
+
+	entries, truncated, err := w.Replay()
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	require.Len(t, entries, 1)
+	assert.Equal(t, []byte("a"), entries[0].Key)
+}
+
+func TestWAL_AppendGroup(t *testing.T) {
+	dir, threshold, _ := setup(t)
+
+	w, err := wal.Open(dir, wal.Options{FlushThreshold: threshold, FlushInterval: time.Hour, MaxValueSize: 8})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	// Without a write asking for a flush the group stays buffered
+	errs, err := w.AppendGroup([]wal.Write{
+		{Entries: []storage.Entry{{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")}}},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, errs)
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// A rejected write is left out without failing the rest of the group
+	errs, err = w.AppendGroup([]wal.Write{
+		{Entries: []storage.Entry{{Type: storage.PutEntry, Key: []byte("b"), Value: []byte("2")}}},
+		{Entries: []storage.Entry{{Type: storage.PutEntry, Key: []byte("big"), Value: make([]byte, 9)}}, Flush: true},
+		{Entries: []storage.Entry{
+			{Type: storage.PutEntry, Key: []byte("c"), Value: []byte("3")},
+			{Type: storage.DeleteEntry, Key: []byte("a")},
+		}, Atomic: true, Flush: true},
+	})
+	require.NoError(t, err)
+	require.Len(t, errs, 3)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], gerrors.ErrEntryTooLarge)
+	assert.NoError(t, errs[2])
+
+	entries, _, err = w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	for i, key := range []string{"a", "b", "c", "a"} {
+		assert.Equal(t, key, string(entries[i].Key))
+	}
+	assert.Equal(t, storage.DeleteEntry, entries[3].Type)
+}
+
+func TestWAL_AppendGroupForceSync(t *testing.T) {
+	dir, threshold, _ := setup(t)
+
+	w, err := wal.Open(dir, wal.Options{FlushThreshold: threshold, FlushInterval: time.Hour, SyncMode: config.WALSyncNever})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+	var syncs atomic.Int64
+	w.WrapFile(func(f wal.File) wal.File { return countingSyncFile{f, &syncs} })
+
+	put := func(key string) []storage.Entry {
+		return []storage.Entry{{Type: storage.PutEntry, Key: []byte(key), Value: []byte("v")}}
+	}
+	_, err = w.AppendGroup([]wal.Write{{Entries: put("a"), Flush: true}})
+	require.NoError(t, err)
+	assert.Zero(t, syncs.Load(), "Flush alone follows the sync mode")
+
+	_, err = w.AppendGroup([]wal.Write{{Entries: put("b")}})
+	require.NoError(t, err)
+	_, err = w.AppendGroup([]wal.Write{{Entries: put("c"), ForceSync: true}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), syncs.Load())
+
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+var errSync = errors.New("injected sync failure")
+
+// failingSyncFile passes writes through but fails every Sync.
+type failingSyncFile struct {
+	wal.File
+}
+
+func (failingSyncFile) Sync() error { return errSync }
+
+func TestWAL_SyncFailureClosesWAL(t *testing.T) {
+	dir, _, _ := setup(t)
+
+	// A threshold of one byte flushes on every append
+	w := open(t, dir, 1, time.Hour)
+	w.WrapFile(func(f wal.File) wal.File { return failingSyncFile{f} })
+
+	err := w.AppendPut([]byte("a"), []byte("1"))
+	require.ErrorIs(t, err, errSync)
+
+	// Later writes must not succeed on top of the failed one
+	require.ErrorIs(t, w.AppendDelete([]byte("a")), errSync)
+	require.ErrorIs(t, w.AppendBatch([]storage.Entry{{Type: storage.PutEntry, Key: []byte("b")}}), errSync)
+	require.NoError(t, w.Close())
+}
+
+// flakyFS hands out segments whose writes stop halfway with EAGAIN and
+// whose syncs fail with EINTR, once every other call.
+type flakyFS struct {
+	storage.FS
+	failures *atomic.Int64
+}
+
+func (fs flakyFS) OpenFile(name string, flag int, perm os.FileMode) (storage.FSFile, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyFile{FSFile: f, failures: fs.failures}, nil
+}
+
+type flakyFile struct {
+	storage.FSFile
+	failures *atomic.Int64
+	calls    int
+}
+
+func (f *flakyFile) Write(p []byte) (int, error) {
+	f.calls++
+	if f.calls%2 == 1 && len(p) > 1 {
+		f.failures.Add(1)
+		n, _ := f.FSFile.Write(p[:len(p)/2])
+		return n, syscall.EAGAIN
+	}
+	return f.FSFile.Write(p)
+}
+
+func (f *flakyFile) Sync() error {
+	f.calls++
+	if f.calls%2 == 1 {
+		f.failures.Add(1)
+		return syscall.EINTR
+	}
+	return f.FSFile.Sync()
+}
+
+func TestWAL_RetriesTransientErrors(t *testing.T) {
+	dir, _, _ := setup(t)
+	var failures atomic.Int64
+	opts := wal.Options{
+		FlushThreshold: 1,
+		FlushInterval:  time.Hour,
+		SyncMode:       config.WALSyncAlways,
+		FS:             flakyFS{FS: storage.OSFS{}, failures: &failures},
+		IORetry:        storage.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	}
+	w, err := wal.Open(dir, opts)
+	require.NoError(t, err)
+	for i := range 5 {
+		require.NoError(t, w.AppendPut(fmt.Appendf(nil, "key-%d", i), []byte("value")))
+	}
+	require.NoError(t, w.Close())
+	assert.Positive(t, failures.Load())
+
+	// The retried halves line up with the ones written first
+	w, err = wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: time.Hour})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	for i, e := range entries {
+		assert.Equal(t, fmt.Sprintf("key-%d", i), string(e.Key))
+	}
+
+	// Without retries the first failure is returned
+	opts.IORetry = storage.RetryPolicy{MaxAttempts: 1}
+	w2, err := wal.Open(t.TempDir(), opts)
+	require.NoError(t, err)
+	assert.ErrorIs(t, w2.AppendPut([]byte("k"), []byte("v")), syscall.EAGAIN)
+	require.NoError(t, w2.Close())
+}
+
+func TestWAL_BackgroundSyncFailureSurfaces(t *testing.T) {
+	dir, threshold, _ := setup(t)
+
+	w := open(t, dir, threshold, time.Millisecond)
+	defer func() { _ = w.Close() }()
+	w.WrapFile(func(f wal.File) wal.File { return failingSyncFile{f} })
+
+	// Buffered below the threshold, so only the background flusher syncs
+	require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+
+	require.Eventually(t, func() bool {
+		return errors.Is(w.AppendPut([]byte("b"), []byte("2")), errSync)
+	}, time.Second, time.Millisecond)
+}
+
+// countingSyncFile passes everything through and counts calls to Sync.
+type countingSyncFile struct {
+	wal.File
+	syncs *atomic.Int64
+}
+
+func (f countingSyncFile) Sync() error {
+	f.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func TestWAL_SyncMode(t *testing.T) {
+	tests := []struct {
+		mode          config.WALSyncMode
+		appendSyncs   int64
+		intervalSyncs bool
+		closeSyncs    int64
+	}{
+		{config.WALSyncAlways, 3, false, 3},
+		// The flusher may sync between appends, so this is an upper bound
+		{config.WALSyncInterval, 0, true, 3},
+		{config.WALSyncNever, 0, false, 0},
+	}
+
+	for _, tt := range tests {
+		dir, _, _ := setup(t)
+
+		// A threshold of one byte writes on every append; the interval
+		// controls whether the background flusher runs during the test
+		interval := time.Hour
+		if tt.intervalSyncs {
+			interval = time.Millisecond
+		}
+		w, err := wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: interval, SyncMode: tt.mode})
+		require.NoError(t, err)
+		var syncs atomic.Int64
+		w.WrapFile(func(f wal.File) wal.File { return countingSyncFile{f, &syncs} })
+
+		require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+		require.NoError(t, w.AppendDelete([]byte("b")))
+		require.NoError(t, w.AppendBatch([]storage.Entry{{Type: storage.PutEntry, Key: []byte("c")}}))
+
+		if tt.intervalSyncs {
+			require.Eventually(t, func() bool { return syncs.Load() >= 1 }, time.Second, time.Millisecond)
+		} else {
+			assert.Equal(t, tt.appendSyncs, syncs.Load(), "mode %d", tt.mode)
+		}
+
+		// Every mode writes entries to the file, synced or not
+		entries, _, err := w.Replay()
+		require.NoError(t, err)
+		assert.Len(t, entries, 3, "mode %d", tt.mode)
+
+		require.NoError(t, w.Close())
+		if tt.intervalSyncs {
+			assert.LessOrEqual(t, syncs.Load(), tt.closeSyncs, "mode %d", tt.mode)
+		} else {
+			assert.Equal(t, tt.closeSyncs, syncs.Load(), "mode %d", tt.mode)
+		}
+	}
+}
+
+func TestWAL_SegmentRollover(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every append is written at once and fills a segment
+	w, err := wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, SegmentSize: 1})
+	require.NoError(t, err)
+	for i := range 5 {
+		require.NoError(t, w.AppendPut(fmt.Appendf(nil, "key-%d", i), []byte("v")))
+	}
+	require.NoError(t, w.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	require.NoError(t, err)
+	assert.Len(t, segments, 6, "one per append plus the empty active segment")
+
+	// Reopening replays every segment in order
+	w = open(t, dir, 1, time.Hour)
+	defer func() { require.NoError(t, w.Close()) }()
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	for i, entry := range entries {
+		assert.Equal(t, fmt.Sprintf("key-%d", i), string(entry.Key))
+	}
+}
+
+func TestWAL_PartialLastSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	w := open(t, dir, 1, time.Hour)
+	require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+	_, err := w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.AppendPut([]byte("b"), []byte("2")))
+	require.NoError(t, w.AppendPut([]byte("c"), []byte("3")))
+	last := w.Path()
+	require.NoError(t, w.Close())
+
+	// A crash cut the last record of the newest segment short
+	info, err := os.Stat(last)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(last, info.Size()-3))
+
+	entries, truncated, err := wal.ReplayDir(dir, 0)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "a", string(entries[0].Key))
+	assert.Equal(t, "b", string(entries[1].Key))
+}
+
+func TestWAL_TornOlderSegmentIsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	w := open(t, dir, 1, time.Hour)
+	require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+	require.NoError(t, w.AppendPut([]byte("b"), []byte("2")))
+	older := w.Path()
+	_, err := w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.AppendPut([]byte("c"), []byte("3")))
+	require.NoError(t, w.Close())
+
+	// The segment was complete when the WAL moved past it, so a short
+	// record there cannot be a crash and must not hide the newer segment
+	info, err := os.Stat(older)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(older, info.Size()-3))
+
+	_, _, err = wal.ReplayDir(dir, 0)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+	_, _, err = wal.Dump(dir)
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+
+	// The damaged segment can still be inspected on its own
+	entries, truncated, err := wal.Dump(older)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a", string(entries[0].Key))
+}
+
+func TestWAL_RemoveBefore(t *testing.T) {
+	dir := t.TempDir()
+
+	w := open(t, dir, 1, time.Hour)
+	defer func() { require.NoError(t, w.Close()) }()
+	require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+	second, err := w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.AppendPut([]byte("b"), []byte("2")))
+	_, err = w.Rotate()
+	require.NoError(t, err)
+
+	require.NoError(t, w.RemoveBefore(second))
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "b", string(entries[0].Key))
+
+	// The active segment is kept even if num is past it
+	require.NoError(t, w.RemoveBefore(100))
+	assert.FileExists(t, w.Path())
+	require.NoError(t, w.AppendPut([]byte("c"), []byte("3")))
+	entries, _, err = w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "c", string(entries[0].Key))
+}
+
+// legacyRecord encodes a record in the WAL format used before segments were
+// numbered: [type][key length][value length][key][value], with no checksum.
+func legacyRecord(entryType storage.EntryType, key, value string) []byte {
+	buf := []byte{byte(entryType)}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(append(buf, key...), value...)
+}
+
+func TestWAL_OpenConvertsLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	// A sealed segment and the active wal.log, the last ending with a record
+	// torn by a crash
+	sealed := append(legacyRecord(storage.PutEntry, "a", "1"), legacyRecord(storage.PutEntry, "b", "2")...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "wal-000001.log"), sealed, 0644))
+	active := append(legacyRecord(storage.DeleteEntry, "a", ""), legacyRecord(storage.PutEntry, "c", "3")...)
+	active = append(active, legacyRecord(storage.PutEntry, "torn", "value")[:storage.PrefixSize+2]...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "wal.log"), active, 0644))
+
+	w := open(t, dir, 1, time.Hour)
+	assert.NoFileExists(t, filepath.Join(dir, "wal.log"))
+	entries, truncated, err := w.Replay()
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	var got []string
+	for _, entry := range entries {
+		got = append(got, fmt.Sprintf("%d:%s=%s", entry.Type, entry.Key, entry.Value))
+	}
+	assert.Equal(t, []string{"0:a=1", "0:b=2", "1:a=", "0:c=3"}, got)
+
+	// The converted segment is in the current format, so it replays the
+	// same after another restart
+	require.NoError(t, w.AppendPut([]byte("d"), []byte("4")))
+	require.NoError(t, w.Close())
+	w = open(t, dir, 1, time.Hour)
+	defer func() { require.NoError(t, w.Close()) }()
+	entries, truncated, err = w.Replay()
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	require.Len(t, entries, 5)
+	assert.Equal(t, "d", string(entries[4].Key))
+}
+
+func TestWAL_OpenFinishesInterruptedLegacyConversion(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "wal.log"), legacyRecord(storage.PutEntry, "old", "1"), 0644))
+
+	// A crash left a complete converted copy next to the legacy files
+	converted := storage.SerializeEntry(storage.Entry{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "converted-wal.log"), converted, 0644))
+
+	w := open(t, dir, 1, time.Hour)
+	defer func() { require.NoError(t, w.Close()) }()
+	assert.NoFileExists(t, filepath.Join(dir, "wal.log"))
+	assert.NoFileExists(t, filepath.Join(dir, "converted-wal.log"))
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a", string(entries[0].Key))
+}
+
+func TestWAL_OpenRejectsUnreadableLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+	data := append(legacyRecord(storage.PutEntry, "a", "1"), legacyRecord(storage.EntryType(9), "b", "2")...)
+	path := filepath.Join(dir, "wal.log")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	_, err := wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: time.Hour})
+	assert.ErrorIs(t, err, gerrors.ErrCorrupt)
+
+	// Nothing is lost or truncated
+	kept, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, kept)
+	assert.NoFileExists(t, filepath.Join(dir, "converted-wal.log"))
+	assert.NoFileExists(t, filepath.Join(dir, "wal-000001.log"))
+}
+
+func TestWAL_ReplayStopsAtTornRecord(t *testing.T) {
+	record := storage.SerializeEntry(storage.Entry{Type: storage.PutEntry, Key: []byte("torn"), Value: []byte("value")})
+
+	// A crash can cut a record off inside its header, key, value or checksum
+	for _, cut := range []int{1, storage.PrefixSize, storage.PrefixSize + 2, len(record) - 1} {
+		dir := t.TempDir()
+		w := open(t, dir, 1, time.Hour)
+		require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+		require.NoError(t, w.AppendDelete([]byte("b")))
+		path := w.Path()
+		require.NoError(t, w.Close())
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = f.Write(record[:cut])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		w = open(t, dir, 1, time.Hour)
+		entries, truncated, err := w.Replay()
+		require.NoError(t, err, "cut at %d", cut)
+		assert.True(t, truncated, "cut at %d", cut)
+		require.Len(t, entries, 2, "cut at %d", cut)
+		assert.Equal(t, "a", string(entries[0].Key))
+		assert.Equal(t, storage.DeleteEntry, entries[1].Type)
+
+		// Appends after recovery go to a new segment and replay cleanly
+		require.NoError(t, w.AppendPut([]byte("c"), []byte("3")))
+		entries, _, err = w.Replay()
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+		assert.Equal(t, "c", string(entries[2].Key))
+		require.NoError(t, w.Close())
+
+		// The torn record was cut off, so the segment is not mistaken for
+		// a damaged older one once a newer segment follows it
+		entries, truncated, err = wal.ReplayDir(dir, 0)
+		require.NoError(t, err, "cut at %d", cut)
+		assert.False(t, truncated, "cut at %d", cut)
+		require.Len(t, entries, 3, "cut at %d", cut)
+	}
+}
+
+func TestWAL_Dump(t *testing.T) {
+	dir := t.TempDir()
+	w := open(t, dir, 1, time.Hour)
+	require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+	require.NoError(t, w.AppendDelete([]byte("b")))
+	require.NoError(t, w.AppendAtomic([]storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("c"), Value: []byte("3")},
+		{Type: storage.DeleteEntry, Key: []byte("a")},
+	}))
+	_, err := w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.AppendPut([]byte("d"), []byte("4")))
+	path := w.Path()
+	require.NoError(t, w.Close())
+
+	// Cut the last segment's record short, as a crash would
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:len(data)-3], 0644))
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	type dumped struct {
+		typ        storage.EntryType
+		key, value string
+	}
+	collect := func(entries []storage.Entry) []dumped {
+		var got []dumped
+		for _, entry := range entries {
+			got = append(got, dumped{entry.Type, string(entry.Key), string(entry.Value)})
+		}
+		return got
+	}
+	first := []dumped{{storage.PutEntry, "a", "1"}, {storage.DeleteEntry, "b", ""}, {storage.PutEntry, "c", "3"}, {storage.DeleteEntry, "a", ""}}
+
+	entries, truncated, err := wal.Dump(dir)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, first, collect(entries))
+
+	// A single segment can be dumped on its own
+	segments, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+	entries, truncated, err = wal.Dump(segments[0])
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, first, collect(entries))
+
+	// The torn segment is left as it was
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	_, _, err = wal.Dump(filepath.Join(dir, "missing.log"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWAL_ReplayStopsAtCorruptRecord(t *testing.T) {
+	first := storage.SerializeEntry(storage.Entry{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")})
+	valueLen := storage.EntryTypeSize + storage.LengthSize
+
+	corruptions := map[string]func(record []byte){
+		// A huge length must be rejected before anything is allocated
+		"value length": func(record []byte) { binary.BigEndian.PutUint32(record[valueLen:], 0xfffffff0) },
+		"key length":   func(record []byte) { binary.BigEndian.PutUint32(record[storage.EntryTypeSize:], 0x7fffffff) },
+		// A plausible length that runs into the next record fails the checksum
+		"short length": func(record []byte) { binary.BigEndian.PutUint32(record[valueLen:], 5) },
+		"payload":      func(record []byte) { record[storage.PrefixSize] ^= 0xff },
+	}
+	for name, corrupt := range corruptions {
+		dir := t.TempDir()
+		w, err := wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, MaxRecordSize: 1024})
+		require.NoError(t, err)
+		require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+		require.NoError(t, w.AppendPut([]byte("b"), []byte("2")))
+		require.NoError(t, w.AppendPut([]byte("c"), []byte("3")))
+		path := w.Path()
+		require.NoError(t, w.Close())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		corrupt(data[len(first):])
+		require.NoError(t, os.WriteFile(path, data, 0644))
+
+		// Nothing after the bad record can be trusted, even if it is intact
+		entries, truncated, err := wal.ReplayDir(dir, 1024)
+		require.NoError(t, err, name)
+		assert.True(t, truncated, name)
+		require.Len(t, entries, 1, name)
+		assert.Equal(t, "a", string(entries[0].Key), name)
+
+		// Once a newer segment holds records, the bad one lost writes that
+		// were acknowledged after it
+		w, err = wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, MaxRecordSize: 1024})
+		require.NoError(t, err)
+		require.NoError(t, w.AppendPut([]byte("d"), []byte("4")))
+		require.NoError(t, w.Close())
+		_, _, err = wal.ReplayDir(dir, 1024)
+		assert.ErrorIs(t, err, gerrors.ErrCorrupt, name)
+	}
+}
+
+func TestWAL_RejectsOversizedRecord(t *testing.T) {
+	w, err := wal.Open(t.TempDir(), wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, MaxRecordSize: 16})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	assert.ErrorIs(t, w.AppendPut([]byte("key"), make([]byte, 14)), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, w.AppendBatch([]storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")},
+		{Type: storage.PutEntry, Key: []byte("key"), Value: make([]byte, 14)},
+	}), gerrors.ErrEntryTooLarge)
+
+	// A rejected append leaves the WAL usable and writes nothing
+	require.NoError(t, w.AppendPut([]byte("key"), make([]byte, 13)))
+	entries, truncated, err := w.Replay()
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	require.Len(t, entries, 1)
+}
+
+func TestWAL_ReplayCleanEndIsNotTruncated(t *testing.T) {
+	dir := t.TempDir()
+	w := open(t, dir, 1, time.Hour)
+	defer func() { require.NoError(t, w.Close()) }()
+	require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+
+	entries, truncated, err := w.Replay()
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Len(t, entries, 1)
+}
+
+func TestWAL_Preallocate(t *testing.T) {
+	dir := t.TempDir()
+	const size = 64 * 1024
+	w, err := wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, Preallocate: size})
+	require.NoError(t, err)
+	require.NoError(t, w.AppendPut([]byte("a"), []byte("1")))
+	require.NoError(t, w.AppendDelete([]byte("b")))
+
+	info, err := os.Stat(w.Path())
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), info.Size())
+
+	// Replaying while the zeros are still there, as after a crash, ends
+	// cleanly after the written entries
+	entries, truncated, err := wal.ReplayDir(dir, 0)
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "a", string(entries[0].Key))
+	assert.Equal(t, storage.DeleteEntry, entries[1].Type)
+
+	path := w.Path()
+	require.NoError(t, w.Close())
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(storage.SerializeEntry(entries[0]))+len(storage.SerializeEntry(entries[1]))), info.Size())
+
+	entries, truncated, err = wal.ReplayDir(dir, 0)
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Len(t, entries, 2)
+}
+
+func TestWAL_PreallocateRecyclesSegments(t *testing.T) {
+	dir := t.TempDir()
+	const size = 64 * 1024
+	w, err := wal.Open(dir, wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, Preallocate: size})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	for i := range 10 {
+		require.NoError(t, w.AppendPut(fmt.Appendf(nil, "old-%d", i), []byte("v")))
+	}
+	first := w.Path()
+	_, err = w.Rotate()
+	require.NoError(t, err)
+
+	// A segment the WAL moved past keeps its reserved space
+	info, err := os.Stat(first)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), info.Size())
+
+	// Removing it keeps the file for the next segment
+	require.NoError(t, w.RemoveBefore(2))
+	assert.NoFileExists(t, first)
+	recycled, err := filepath.Glob(filepath.Join(dir, "recycled-*.log"))
+	require.NoError(t, err)
+	require.Len(t, recycled, 1)
+
+	require.NoError(t, w.AppendPut([]byte("new"), []byte("v")))
+	_, err = w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.AppendPut([]byte("newer"), []byte("v")))
+	assert.NoFileExists(t, recycled[0])
+	info, err = os.Stat(w.Path())
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), info.Size())
+
+	// The reused file's old records never come back, even after a crash
+	entries, truncated, err := wal.ReplayDir(dir, 0)
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "new", string(entries[0].Key))
+	assert.Equal(t, "newer", string(entries[1].Key))
+}
+
+// fullFS hands out files that cannot grow, as on a full disk.
+type fullFS struct {
+	storage.FS
+}
+
+func (fs fullFS) OpenFile(name string, flag int, perm os.FileMode) (storage.FSFile, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fullFile{f}, nil
+}
+
+type fullFile struct {
+	storage.FSFile
+}
+
+func (fullFile) Truncate(int64) error { return syscall.ENOSPC }
+
+func TestWAL_PreallocateFailureFailsSegment(t *testing.T) {
+	fs := storage.NewMemFS()
+	require.NoError(t, fs.MkdirAll("wal", 0755))
+	_, err := wal.Open("wal", wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, Preallocate: 4096, FS: fullFS{fs}})
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+}
+
+func TestWAL_RejectsOversizedKeysAndValues(t *testing.T) {
+	w, err := wal.Open(t.TempDir(), wal.Options{FlushThreshold: 1, FlushInterval: time.Hour, MaxKeySize: 4, MaxValueSize: 8})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	assert.ErrorIs(t, w.AppendPut([]byte("key-1"), []byte("v")), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, w.AppendDelete([]byte("key-1")), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, w.AppendPut([]byte("k"), make([]byte, 9)), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, w.AppendBatch([]storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")},
+		{Type: storage.PutEntry, Key: []byte("key-2"), Value: []byte("2")},
+	}), gerrors.ErrEntryTooLarge)
+	assert.ErrorIs(t, w.AppendAtomic([]storage.Entry{
+		{Type: storage.PutEntry, Key: []byte("a"), Value: []byte("1")},
+		{Type: storage.PutEntry, Key: []byte("b"), Value: make([]byte, 9)},
+	}), gerrors.ErrEntryTooLarge)
+
+	require.NoError(t, w.AppendPut([]byte("key"), make([]byte, 8)))
+	entries, _, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}